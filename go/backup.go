@@ -0,0 +1,144 @@
+package chidb
+
+import (
+	"context"
+	"encoding/binary"
+	"fmt"
+	"os"
+)
+
+// BackupTo writes a copy of the database to filename
+//
+// The dirty pages are flushed and then the header and every page are copied
+// to the new file, page by page. Writes to the database wait until the copy
+// is done, so it's a consistent snapshot even while other goroutines keep
+// writing. Like in Open, the copy is built on a temporary file which is
+// synced and renamed to filename, so a crash never leaves a torn backup.
+//
+// Unlike SaveAs, the header is copied as is. The contents of free pages are
+// not copied, only the headers of their runs on the free list, and the free
+// pages at the end of the file are left out of the copy.
+//
+// Uncommitted changes are never backed up, so BackupTo fails with
+// ErrTransactionActive during a transaction.
+func (b *BTree) BackupTo(filename string) error {
+	p := b.pager
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	if p.closed {
+		return ErrClosed
+	}
+	if p.inTransaction() {
+		return fmt.Errorf("%w: can't back up uncommitted changes", ErrTransactionActive)
+	}
+	if err := p.sameFile(filename); err != nil {
+		return err
+	}
+
+	if err := p.flush(context.Background()); err != nil {
+		return err
+	}
+
+	header, err := p.readHeader()
+	if err != nil {
+		return err
+	}
+	runs, err := p.freeRuns()
+	if err != nil {
+		return err
+	}
+
+	// The contents of the free pages: the header of the run on the first
+	// page of each run, and zeros on the others
+	free := make(map[uint32][]byte)
+	for i, run := range runs {
+		next := uint32(0)
+		if i+1 < len(runs) {
+			next = runs[i+1].start
+		}
+		header := make([]byte, freeRunHeaderSize)
+		binary.LittleEndian.PutUint32(header, next)
+		binary.LittleEndian.PutUint32(header[4:], run.count)
+
+		free[run.start] = header
+		for nPage := run.start + 1; nPage < run.start+run.count; nPage++ {
+			free[nPage] = nil
+		}
+	}
+
+	backup, err := create(context.Background(), filename, p.pageSize, func(dst *BTree) error {
+		if p.checksums {
+			if err := dst.pager.EnableChecksums(); err != nil {
+				return err
+			}
+		}
+
+		// Pages are allocated before the header is written, so the free
+		// list copied with it isn't used to allocate them.
+		for nPage := uint32(1); nPage <= p.totalPages; nPage++ {
+			dstPage, err := dst.allocatePage()
+			if err != nil {
+				return err
+			}
+
+			data := make([]byte, dstPage.Len())
+			if header, ok := free[nPage]; ok {
+				copy(data, header)
+			} else {
+				page, err := p.readPage(nPage)
+				if err != nil {
+					return err
+				}
+				copy(data, page.Read())
+			}
+
+			if err := dstPage.Write(data); err != nil {
+				return err
+			}
+			if err := dst.pager.WritePage(dstPage); err != nil {
+				return err
+			}
+		}
+
+		if err := dst.pager.WriteHeader(header); err != nil {
+			return err
+		}
+
+		nPages := p.totalPages
+		for nPages > 1 {
+			if _, ok := free[nPages]; !ok {
+				break
+			}
+			nPages--
+		}
+		return dst.pager.Truncate(nPages)
+	})
+	if err != nil {
+		return err
+	}
+	return backup.Close()
+}
+
+// sameFile returns an error if filename is the file of the pager
+func (p *Pager) sameFile(filename string) error {
+	info, err := os.Stat(filename)
+	if err != nil {
+		// A missing file can't be the file of the pager
+		return nil
+	}
+
+	// Only a storage on a file can be the same file
+	f, ok := p.buffer.(interface{ Stat() (os.FileInfo, error) })
+	if !ok {
+		return nil
+	}
+	current, err := f.Stat()
+	if err != nil {
+		return err
+	}
+	if os.SameFile(info, current) {
+		return fmt.Errorf("%s is the file of the database", filename)
+	}
+	return nil
+}
@@ -0,0 +1,93 @@
+package chidb
+
+import (
+	"errors"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestBackupTo(t *testing.T) {
+	btree := openBtree(t)
+	keys := insertSequentialKeys(t, btree, 1, 500, 100)
+
+	filename := filepath.Join(t.TempDir(), "backup.db")
+	require.Nil(t, btree.BackupTo(filename))
+
+	// Changes after the backup don't reach the copy
+	require.Nil(t, btree.Insert(1, NewLeafTableCell(1000, []byte("after backup"))))
+
+	backup, err := Open(filename)
+	require.Nil(t, err)
+	defer backup.Close()
+
+	assert.Nil(t, backup.CheckIntegrity(1))
+	for _, key := range keys {
+		_, err := backup.Find(1, key)
+		require.Nil(t, err, "Expected to find key %d on backup", key)
+	}
+	_, err = backup.Find(1, 1000)
+	assert.True(t, errors.Is(err, ErrKeyNotFound), "Expected key inserted after backup to be missing, got %v", err)
+
+	header, err := btree.ReadHeader()
+	require.Nil(t, err)
+	backupHeader, err := backup.ReadHeader()
+	require.Nil(t, err)
+	header.fileChangeCounter = backupHeader.fileChangeCounter
+	header.lastModified = backupHeader.lastModified
+	assert.Equal(t, header, backupHeader, "Expected header copied as is")
+}
+
+func TestBackupToFreePages(t *testing.T) {
+	btree := openSmallPageBtree(t)
+	keys := insertSequentialKeys(t, btree, 1, 200, 200)
+
+	// Deleting the last keys releases pages at the end of the file
+	for _, key := range keys[100:] {
+		require.Nil(t, btree.Delete(1, key))
+	}
+	free, err := btree.pager.freePages()
+	require.Nil(t, err)
+	require.NotEmpty(t, free)
+
+	filename := filepath.Join(t.TempDir(), "backup.db")
+	require.Nil(t, btree.BackupTo(filename))
+
+	backup, err := Open(filename)
+	require.Nil(t, err)
+	defer backup.Close()
+
+	assert.Equal(t, keys[:100], cursorKeys(t, backup, 1))
+	assert.Nil(t, backup.CheckIntegrity(1))
+	assert.LessOrEqual(t, backup.pager.totalPages, btree.pager.totalPages)
+
+	// Free pages on the copy are still reusable
+	backupFree, err := backup.pager.freePages()
+	require.Nil(t, err)
+	for _, nPage := range backupFree {
+		assert.Contains(t, free, nPage)
+	}
+	totalPages := backup.pager.totalPages
+	insertSequentialKeys(t, backup, 1000, len(backupFree), 200)
+	assert.Equal(t, totalPages, backup.pager.totalPages)
+}
+
+func TestBackupToErrors(t *testing.T) {
+	btree := openBtree(t)
+	insertSequentialKeys(t, btree, 1, 10, 10)
+
+	err := btree.BackupTo(btree.pager.filename)
+	assert.NotNil(t, err, "Expected error to back up database to itself")
+
+	require.Nil(t, btree.BeginTransaction())
+	filename := filepath.Join(t.TempDir(), "backup.db")
+	err = btree.BackupTo(filename)
+	assert.True(t, errors.Is(err, ErrTransactionActive), "Expected transaction error, got %v", err)
+	require.Nil(t, btree.Rollback())
+
+	_, err = os.Stat(filename)
+	assert.True(t, errors.Is(err, os.ErrNotExist), "Expected no backup file")
+}
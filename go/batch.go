@@ -0,0 +1,120 @@
+package chidb
+
+import "sort"
+
+// nodeBatch keeps in memory the nodes changed by InsertMany, so each node is
+// read and written once no matter how many cells are inserted on it
+type nodeBatch struct {
+	// Nodes read or created by the batch, by page number
+	nodes map[uint32]*BTreeNode
+
+	// Pages of the nodes changed by the batch
+	dirty map[uint32]bool
+}
+
+// InsertMany inserts leaf table cells on a table B-Tree like Insert, but
+// writes each changed node once after all cells are inserted
+//
+// Cells are inserted on in-memory copies of the nodes, so inserting many
+// cells on the same leaf reads and writes its page once instead of once per
+// cell. Nodes are split as in Insert. Sorted cells are inserted faster,
+// since consecutive cells go to the same leaf.
+//
+// If a cell can't be inserted (e.g. its key is a duplicate), the cells
+// before it are kept and written, and the error is returned.
+//
+// The batch is kept on a copy of b used only by this call, so other
+// operations on b read and write nodes directly meanwhile.
+func (b *BTree) InsertMany(rootPage uint32, cells []*BTreeCell) error {
+	batched := *b
+	batched.batch = &nodeBatch{
+		nodes: make(map[uint32]*BTreeNode),
+		dirty: make(map[uint32]bool),
+	}
+
+	var insertErr error
+	for _, cell := range cells {
+		if insertErr = batched.insert(rootPage, cell); insertErr != nil {
+			break
+		}
+	}
+
+	if err := b.writeBatch(batched.batch); err != nil {
+		return err
+	}
+	if len(batched.batch.dirty) > 0 {
+		if err := b.touch(); err != nil {
+			return err
+		}
+	}
+	return insertErr
+}
+
+// writeBatch writes the nodes changed by the batch ordered by page number,
+// without updating the header
+func (b *BTree) writeBatch(batch *nodeBatch) error {
+	pages := make([]uint32, 0, len(batch.dirty))
+	for nPage := range batch.dirty {
+		pages = append(pages, nPage)
+	}
+	sort.Slice(pages, func(i, j int) bool {
+		return pages[i] < pages[j]
+	})
+
+	for _, nPage := range pages {
+		if err := b.writeNode(batch.nodes[nPage]); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// getNode returns the node on nPage, which is shared by the following
+// calls during InsertMany
+func (b *BTree) getNode(nPage uint32) (*BTreeNode, error) {
+	if b.batch == nil {
+		return b.GetNodeByPage(nPage)
+	}
+
+	if node, ok := b.batch.nodes[nPage]; ok {
+		return node, nil
+	}
+
+	node, err := b.GetNodeByPage(nPage)
+	if err != nil {
+		return nil, err
+	}
+	b.batch.nodes[nPage] = node
+	return node, nil
+}
+
+// putNode writes the node without updating the header, or during
+// InsertMany marks it to be written when the batch ends
+func (b *BTree) putNode(node *BTreeNode) error {
+	if b.batch == nil {
+		return b.writeNode(node)
+	}
+
+	b.batch.nodes[node.page.number] = node
+	b.batch.dirty[node.page.number] = true
+	return nil
+}
+
+// newNode creates a new node like NewNode, but during InsertMany the empty
+// node is only written when the batch ends
+func (b *BTree) newNode(typ BTreeNodeType) (*BTreeNode, error) {
+	if b.batch == nil {
+		return b.NewNode(typ)
+	}
+
+	nPage, err := b.pager.AllocatePage()
+	if err != nil {
+		return nil, err
+	}
+
+	node, err := b.formatNode(nPage, typ)
+	if err != nil {
+		return nil, err
+	}
+	return node, b.putNode(node)
+}
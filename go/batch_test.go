@@ -0,0 +1,116 @@
+package chidb
+
+import (
+	"errors"
+	"math/rand"
+	"path/filepath"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestInsertMany(t *testing.T) {
+	filename := filepath.Join(t.TempDir(), "many.db")
+
+	btree, err := Open(filename)
+	require.Nil(t, err)
+
+	keys := sequentialKeys(1, 2000)
+	shuffled := append([]ChidbKey(nil), keys...)
+	rand.Shuffle(len(shuffled), func(i, j int) {
+		shuffled[i], shuffled[j] = shuffled[j], shuffled[i]
+	})
+
+	require.Nil(t, btree.InsertMany(1, leafTableCells(shuffled, 200)), "Expected nil error to insert many cells")
+	require.Nil(t, btree.Close())
+
+	btree, err = Open(filename)
+	require.Nil(t, err)
+	defer btree.Close()
+
+	for _, key := range keys {
+		_, err := btree.Find(1, key)
+		assert.Nil(t, err, "Expected to find key %d", key)
+	}
+	assert.Equal(t, keys, cursorKeys(t, btree, 1))
+	assert.Nil(t, btree.CheckIntegrity(1))
+}
+
+func TestInsertManyDuplicateKey(t *testing.T) {
+	btree := openBtree(t)
+
+	err := btree.InsertMany(1, leafTableCells([]ChidbKey{1, 2, 3, 2, 4}, 200))
+	assert.True(t, errors.Is(err, ErrDuplicateKey), "Expected duplicate key error, got %v", err)
+
+	assert.Equal(t, []ChidbKey{1, 2, 3}, cursorKeys(t, btree, 1), "Expected cells before the duplicate to be inserted")
+
+	// The batch ended, so nodes are written directly again
+	require.Nil(t, btree.Insert(1, NewLeafTableCell(4, []byte("data"))))
+	assert.Equal(t, []ChidbKey{1, 2, 3, 4}, cursorKeys(t, btree, 1))
+}
+
+func TestInsertManyConcurrentInsert(t *testing.T) {
+	btree := openBtree(t)
+	other, err := btree.NewNode(LeafTable)
+	require.Nil(t, err)
+	require.Nil(t, btree.WriteNode(other))
+
+	done := make(chan error)
+	go func() {
+		done <- btree.InsertMany(1, leafTableCells(shuffledKeys(sequentialKeys(1, 2000)), 200))
+	}()
+
+	// Inserts on another table during the batch are written right away
+	for _, key := range sequentialKeys(1, 200) {
+		require.Nil(t, btree.Insert(other.page.number, NewLeafTableCell(key, []byte("data"))))
+		_, err := btree.Find(other.page.number, key)
+		require.Nil(t, err, "Expected to find key %d inserted during the batch", key)
+	}
+	require.Nil(t, <-done)
+
+	assert.Equal(t, sequentialKeys(1, 2000), cursorKeys(t, btree, 1))
+	assert.Equal(t, sequentialKeys(1, 200), cursorKeys(t, btree, other.page.number))
+	assert.Nil(t, btree.CheckIntegrity(1))
+	assert.Nil(t, btree.CheckIntegrity(other.page.number))
+}
+
+func BenchmarkInsert(b *testing.B) {
+	cells := leafTableCells(sequentialKeys(1, 1000), 200)
+
+	for i := 0; i < b.N; i++ {
+		b.StopTimer()
+		btree := openBtree(b)
+		b.StartTimer()
+
+		for _, cell := range cells {
+			if err := btree.Insert(1, cell); err != nil {
+				b.Fatal(err)
+			}
+		}
+	}
+}
+
+func BenchmarkInsertMany(b *testing.B) {
+	cells := leafTableCells(sequentialKeys(1, 1000), 200)
+
+	for i := 0; i < b.N; i++ {
+		b.StopTimer()
+		btree := openBtree(b)
+		b.StartTimer()
+
+		if err := btree.InsertMany(1, cells); err != nil {
+			b.Fatal(err)
+		}
+	}
+}
+
+// leafTableCells returns a leaf table cell with dataSize bytes of data for
+// each key
+func leafTableCells(keys []ChidbKey, dataSize int) []*BTreeCell {
+	cells := make([]*BTreeCell, 0, len(keys))
+	for _, key := range keys {
+		cells = append(cells, NewLeafTableCell(key, make([]byte, dataSize)))
+	}
+	return cells
+}
@@ -2,29 +2,105 @@ package chidb
 
 import (
 	"bytes"
+	"context"
 	"encoding/binary"
 	"errors"
 	"fmt"
 	"io"
+	"os"
+	"path/filepath"
+	"time"
 	"unsafe"
 )
 
 type (
 	// ChidbKey represents the key of BTreeCell
-	ChidbKey uint32
+	ChidbKey uint64
 )
 
 const PageCacheSizeInitial = 20000
 
 var MagicBytes = []byte("SQLite format 3")
 
+// ChidbMagicBytes identifies a file written by chidb. It's stored on the
+// reserved bytes of the header, since chidb files are not fully compatible
+// with SQLite despite sharing its magic bytes.
+var ChidbMagicBytes = []byte("chidb")
+
 var ErrCorruptHeader = errors.New("corrupt header")
 
+var ErrNotChidbFile = errors.New("missing chidb magic bytes on header")
+
+var ErrUnsupportedFormat = errors.New("unsupported file format version")
+
+// HeaderFlagChecksums is set on the flags of the header of files whose pages
+// end with a checksum, see Pager.EnableChecksums.
+const HeaderFlagChecksums = 1 << 0
+
+// FormatVersion is the version of the file format written on the header of
+// new files. Version 2 stores keys with 64 bits, files without a version
+// were written with 32 bit keys and can't be read. Version 3 stores the right
+// page of nodes with 32 bits, like the other page numbers. Version 4 stores
+// the free list as runs of contiguous pages, see Pager.DeallocatePage.
+const FormatVersion = 4
+
+var ErrCorruptCell = errors.New("corrupt cell")
+
+var ErrNodeTypeDrift = errors.New("node type differs from page type")
+
+var ErrNodeFull = errors.New("node is full")
+
+var ErrInvalidNodeType = errors.New("invalid node type")
+
+var ErrCellNotFound = errors.New("cell not found")
+
+var ErrCellExists = errors.New("cell already exists")
+
+var ErrKeyNotFound = errors.New("key not found")
+
+var ErrDuplicateKey = errors.New("duplicate key")
+
 // BTree represent a "B-Tree file". It contains a pointer to the
 // chidb database it is a part of, and a pointer to a Pager, which it will
 // use to access pages on the file
 type BTree struct {
 	pager *Pager
+
+	// Whether the pager was opened by this BTree and must be closed with it
+	ownsPager bool
+
+	// Whether files without ChidbMagicBytes on header are rejected
+	strict bool
+
+	// Nodes changed by InsertMany, nil when nodes are read and written
+	// directly, see getNode
+	batch *nodeBatch
+
+	// SplitPolicy chooses how the cells of a full node are divided when
+	// it's split. The zero value is SplitHalf.
+	SplitPolicy SplitPolicy
+
+	// DefragmentRatio makes a node be defragmented when it's written if
+	// the dead space left on its cell area by removed and moved cells is
+	// more than this fraction of the page, see Defragment. The zero value
+	// disables it, leaving the dead space until a cell doesn't fit.
+	DefragmentRatio float64
+
+	// CellFormat is the encoding of the cells of the nodes created by the
+	// B-Tree. Existing nodes keep the format they were written with, so a
+	// file can have nodes with different formats. The zero value is
+	// CellFormatV1.
+	CellFormat CellFormat
+
+	// Comparator orders the keys of byte-keyed indexes, see NewByteIndex,
+	// returning a negative number if a goes before b, zero if they're the
+	// same key and a positive number if a goes after b. The nil value
+	// compares the keys byte-wise, see bytes.Compare.
+	//
+	// The comparator isn't stored on the file, so the same one must be set
+	// every time the file is opened, or searches may miss keys stored with
+	// another order.
+	Comparator func(a, b []byte) int
 }
 
 // Open a B-Tree file
@@ -35,83 +111,337 @@ type BTree struct {
 // then this function will (1) initialize the file header using
 // the default page size and (2) create an empty table leaf node
 // in page 1.
+//
+// A new database is first built on a temporary file which is synced and
+// then atomically renamed to filename, so a crash while creating the
+// database never leaves a half-formed file behind.
 func Open(filename string) (*BTree, error) {
+	return open(context.Background(), filename, false)
+}
+
+// OpenContext opens a B-Tree file like Open, but stops with the context
+// error if ctx is done before the file is opened
+//
+// The context is checked between the reads and writes done to open the
+// file, so a slow open can be cancelled. A new database is only renamed to
+// filename if it's created before ctx is done.
+func OpenContext(ctx context.Context, filename string) (*BTree, error) {
+	return open(ctx, filename, false)
+}
+
+// OpenStrict opens a B-Tree file like Open, but also rejects with
+// ErrNotChidbFile files that have the SQLite magic bytes but lack the
+// chidb magic bytes, as these may have been written by another tool.
+func OpenStrict(filename string) (*BTree, error) {
+	return open(context.Background(), filename, true)
+}
+
+// OpenReadOnly opens a B-Tree file without write permission
+//
+// Reads like Find and cursors work as usual, but every write returns
+// ErrReadOnly, so the file is never modified. Unlike Open, an empty file is
+// not initialized, so it has no pages to read.
+func OpenReadOnly(filename string) (*BTree, error) {
+	pager, err := OpenPagerReadOnly(filename)
+	if err != nil {
+		return nil, err
+	}
+	btree := &BTree{pager: pager, ownsPager: true}
+
+	isEmpty, err := pager.IsEmpty()
+	if err != nil {
+		pager.Close()
+		return nil, err
+	}
+
+	if isEmpty {
+		return btree, nil
+	}
+	if err := btree.validateHeader(); err != nil {
+		pager.Close()
+		return nil, err
+	}
+	return btree, nil
+}
+
+// OpenMemory opens a new empty database kept in memory
+//
+// It works like a database opened with Open, but no file is ever created,
+// not even for the rollback journal of transactions, and the database is
+// lost when it's closed. SaveAs and BackupTo write it to a file.
+func OpenMemory() (*BTree, error) {
+	pager, err := openPagerMemory()
+	if err != nil {
+		return nil, err
+	}
+	btree := &BTree{pager: pager, ownsPager: true}
+
+	if err := btree.initialize(); err != nil {
+		pager.Close()
+		return nil, err
+	}
+	return btree, nil
+}
+
+func open(ctx context.Context, filename string, strict bool) (*BTree, error) {
+	if err := ctx.Err(); err != nil {
+		return nil, err
+	}
+
 	pager, err := OpenPager(filename)
 	if err != nil {
 		return nil, err
 	}
-	btree := &BTree{pager: pager}
+	return openOnPager(ctx, pager, filename, strict)
+}
+
+// openOnPager opens the B-Tree of the database filename on pager like open,
+// creating the database if it's empty
+//
+// The BTree takes ownership of pager, which is closed on every error.
+func openOnPager(ctx context.Context, pager *Pager, filename string, strict bool) (*BTree, error) {
+	btree := &BTree{pager: pager, ownsPager: true, strict: strict}
 
 	isEmpty, err := pager.IsEmpty()
 	if err != nil {
+		pager.Close()
 		return nil, err
 	}
 
 	if isEmpty {
-		if err := btree.initializeHeader(); err != nil {
+		if err := pager.Close(); err != nil {
 			return nil, err
 		}
+		return create(ctx, filename, PageSize, (*BTree).initialize)
+	}
 
-		if err := btree.initializeEmptyTableLeaf(); err != nil {
+	if err := ctx.Err(); err != nil {
+		pager.Close()
+		return nil, err
+	}
+	if err := btree.validateHeader(); err != nil {
+		pager.Close()
+		return nil, err
+	}
+	return btree, nil
+}
+
+// NewBTree creates a BTree over an already opened pager
+//
+// Several BTrees can share the same pager, so all of them use the same
+// file header and page allocation. If the pager is empty the database is
+// initialized in place. Closing a BTree created by NewBTree does not close
+// the pager, which remains owned by the caller.
+func NewBTree(pager *Pager) (*BTree, error) {
+	btree := &BTree{pager: pager}
+
+	isEmpty, err := pager.IsEmpty()
+	if err != nil {
+		return nil, err
+	}
+
+	if isEmpty {
+		if err := btree.initialize(); err != nil {
 			return nil, err
 		}
 		return btree, nil
 	}
 
-	return btree, btree.validateHeader()
+	if err := btree.validateHeader(); err != nil {
+		return nil, err
+	}
+	return btree, nil
 }
 
-/// GetNodeByPage Loads a B-Tree node from disk
-///
-/// Reads a B-Tree node from a page in the disk. All the information regarding
-/// the node is stored in a BTreeNode struct (see header file for more details
-/// on this struct).
-/// Any changes made to a BTreeNode variable will not be effective in the database
-/// until write_node is called on that BTreeNode.
-func (b *BTree) GetNodeByPage(nPage uint32) (*BTreeNode, error) {
-	page, err := b.pager.ReadPage(nPage)
+// CreateSuffix is appended to the database filename to name the temporary
+// file used while a new database is being created.
+const CreateSuffix = "-create"
+
+// create initialize a new database with pages of pageSize bytes on a
+// temporary file using init and rename it to filename once the written pages
+// are synced to disk.
+//
+// The returned BTree keeps using the pager opened on the temporary file,
+// which after the rename refers to filename.
+//
+// The database is discarded if ctx is done before it's renamed.
+func create(ctx context.Context, filename string, pageSize uint32, init func(*BTree) error) (*BTree, error) {
+	tmp := filename + CreateSuffix
+
+	// A leftover file from a crash during a previous create is discarded.
+	if err := os.Remove(tmp); err != nil && !errors.Is(err, os.ErrNotExist) {
+		return nil, err
+	}
+
+	f, err := os.OpenFile(tmp, os.O_CREATE|os.O_RDWR, os.ModePerm)
 	if err != nil {
 		return nil, err
 	}
-	return BTreeNodeFromPage(page)
+	return createStorage(ctx, &fileStorage{f}, filename, pageSize, init)
 }
 
-// NewNode create a new B-Tree node
-//
-// Allocates a new page in the file and initializes it as an empty B-Tree node.
-func (b *BTree) NewNode(typ BTreeNodeType) (*BTreeNode, error) {
-	nPage := b.pager.AllocatePage()
-	page, err := b.pager.ReadPage(nPage)
+// createStorage initializes a new database like create on s, the storage
+// of the temporary file of filename, which is closed on every error
+func createStorage(ctx context.Context, s Storage, filename string, pageSize uint32, init func(*BTree) error) (*BTree, error) {
+	tmp := filename + CreateSuffix
+
+	pager, err := newPager(s, tmp, false)
 	if err != nil {
+		s.Close()
 		return nil, err
 	}
+	btree := &BTree{pager: pager, ownsPager: true}
 
-	node := NewBTreeNode(page, typ)
+	if err := pager.setPageSize(pageSize); err != nil {
+		pager.Close()
+		return nil, err
+	}
 
-	bytes, err := node.Bytes()
-	if err != nil {
+	if err := init(btree); err != nil {
+		pager.Close()
 		return nil, err
 	}
 
-	if err := page.Write(bytes); err != nil {
+	if err := pager.FlushContext(ctx); err != nil {
+		pager.Close()
+		os.Remove(tmp)
+		return nil, err
+	}
+
+	if err := pager.Sync(); err != nil {
+		pager.Close()
+		return nil, err
+	}
+
+	if err := ctx.Err(); err != nil {
+		pager.Close()
+		os.Remove(tmp)
 		return nil, err
 	}
 
-	if err := b.pager.WritePage(page); err != nil {
+	if err := os.Rename(tmp, filename); err != nil {
+		pager.Close()
 		return nil, err
 	}
+	pager.filename = filename
 
+	return btree, syncDir(filepath.Dir(filename))
+}
+
+// syncDir flushes the directory entry changes (such as a rename) to disk.
+func syncDir(dir string) error {
+	d, err := os.Open(dir)
+	if err != nil {
+		return err
+	}
+	defer d.Close()
+	return d.Sync()
+}
+
+// GetNodeByPage Loads a B-Tree node from disk
+//
+// Reads a B-Tree node from a page in the disk. All the information regarding
+// the node is stored in a BTreeNode struct (see header file for more details
+// on this struct).
+// Any changes made to a BTreeNode variable will not be effective in the database
+// until write_node is called on that BTreeNode.
+func (b *BTree) GetNodeByPage(nPage uint32) (*BTreeNode, error) {
+	page, err := b.pager.ReadPage(nPage)
+	if err != nil {
+		return nil, err
+	}
+
+	node, err := BTreeNodeFromPage(page)
+	if err != nil {
+		return nil, err
+	}
+	node.pager = b.pager
 	return node, nil
 }
 
+// ReadNodeHeader reads only the header of a B-Tree node from disk
+//
+// Unlike GetNodeByPage it doesn't read the whole page, which makes
+// traversals that only need the node type, the number of cells or the
+// right page cheaper.
+func (b *BTree) ReadNodeHeader(nPage uint32) (typ BTreeNodeType, nCells, rightPage uint32, err error) {
+	header := make([]byte, PageHeaderSize)
+	if err := b.pager.readPagePrefix(nPage, header); err != nil {
+		return 0, 0, 0, err
+	}
+
+	typ, err = BTreeNodeTypeFromByte(header[0])
+	if err != nil {
+		return 0, 0, 0, err
+	}
+
+	// The header layout is type, free offset, number of cells,
+	// cells offset and right page. See BTreeNode.Bytes.
+	nCells = uint32(binary.LittleEndian.Uint16(header[3:5]))
+	rightPage = binary.LittleEndian.Uint32(header[7:11])
+
+	return typ, nCells, rightPage, nil
+}
+
+// NewNode create a new B-Tree node
+//
+// Allocates a new page in the file and initializes it as an empty B-Tree node.
+func (b *BTree) NewNode(typ BTreeNodeType) (*BTreeNode, error) {
+	nPage, err := b.pager.AllocatePage()
+	if err != nil {
+		return nil, err
+	}
+	return b.initEmptyNode(nPage, typ)
+}
+
 // Initialize a B-Tree node
 //
 // Initializes a database page to contain an empty B-Tree node. The
 // database page is assumed to exist and to have been already allocated
 // by the pager.
+//
+// Unlike NewNode, no page is allocated, which is useful to format a page
+// that was allocated before (e.g. page 1 when creating a database).
 func (b *BTree) InitEmptyNode(nPage uint32, typ BTreeNodeType) error {
-	// FIXME: I don't know how to implement this since NewNode already creates a new empty node
-	return errors.New("not implemented")
+	_, err := b.initEmptyNode(nPage, typ)
+	return err
+}
+
+func (b *BTree) initEmptyNode(nPage uint32, typ BTreeNodeType) (*BTreeNode, error) {
+	node, err := b.formatNode(nPage, typ)
+	if err != nil {
+		return nil, err
+	}
+
+	if err := b.pager.WritePage(node.page); err != nil {
+		return nil, err
+	}
+
+	return node, nil
+}
+
+// formatNode formats the in-memory copy of a page as an empty node without
+// writing it
+func (b *BTree) formatNode(nPage uint32, typ BTreeNodeType) (*BTreeNode, error) {
+	page, err := b.pager.ReadPage(nPage)
+	if err != nil {
+		return nil, err
+	}
+
+	node := NewBTreeNode(page, typ)
+	node.pager = b.pager
+	node.cellFormat = b.CellFormat
+
+	bytes, err := node.Bytes()
+	if err != nil {
+		return nil, err
+	}
+
+	if err := page.Write(bytes); err != nil {
+		return nil, err
+	}
+
+	return node, nil
 }
 
 // WriteNode writes an in-memory B-Tree node to disk
@@ -122,25 +452,496 @@ func (b *BTree) InitEmptyNode(nPage uint32, typ BTreeNodeType) error {
 // page, the only thing to do is to store the values of "type",
 // "free_offset", "n_cells", "cells_offset" and "right_page" in the
 // in-memory page.
+//
+// The file change counter and the last modification time on the file
+// header are updated after the node is written. Operations that write
+// several nodes, like Insert and Delete, update them once instead.
 func (b *BTree) WriteNode(node *BTreeNode) error {
+	if err := b.writeNode(node); err != nil {
+		return err
+	}
+	return b.touch()
+}
+
+// writeNode writes the node like WriteNode without updating the header
+func (b *BTree) writeNode(node *BTreeNode) error {
+	if err := b.defragmentFragmented(node); err != nil {
+		return err
+	}
+
 	bytes, err := node.Bytes()
 	if err != nil {
 		return err
 	}
-	if err := node.page.Write(bytes); err != nil {
+
+	// Only the node header and the cell format are written, the rest of
+	// bytes is an empty page that would override the cell offset array
+	// and the cells.
+	if err := node.page.WriteAt(bytes[:PageHeaderSize+1], 0); err != nil {
 		return err
 	}
 
 	return b.pager.WritePage(node.page)
 }
 
+// defragmentFragmented defragments the node if its dead space is more than
+// DefragmentRatio of the page
+func (b *BTree) defragmentFragmented(node *BTreeNode) error {
+	if b.DefragmentRatio <= 0 {
+		return nil
+	}
+
+	fragmented, err := node.fragmentedBytes()
+	if err != nil {
+		return err
+	}
+	if float64(fragmented) <= b.DefragmentRatio*float64(node.page.Len()) {
+		return nil
+	}
+	return node.Defragment()
+}
+
+// Find searches a key on a table or index B-Tree
+//
+// Starting at the root page nPage, descends the internal nodes until the
+// leaf that may contain key is reached. On each internal node, the child
+// page of the first cell whose key is greater than or equal to key is
+// followed, or the right page if key is greater than all keys on the node.
+// On OrderDescending B-Trees the comparisons are reversed, see searchKey.
+// Returns the leaf cell with key, or ErrKeyNotFound if there is none.
+//
+// Index B-Trees also store entries on internal nodes, so the search stops
+// at an internal index cell with key.
+func (b *BTree) Find(nPage uint32, key ChidbKey) (*BTreeCell, error) {
+	return b.find(nPage, intKey(key))
+}
+
+// find searches key like Find
+func (b *BTree) find(nPage uint32, key treeKey) (*BTreeCell, error) {
+	for {
+		node, err := b.GetNodeByPage(nPage)
+		if err != nil {
+			return nil, err
+		}
+
+		nCell, found, err := b.search(node, key)
+		if err != nil {
+			return nil, err
+		}
+
+		switch node.typ {
+		case LeafTable, LeafIndex:
+			if !found {
+				return nil, fmt.Errorf("%w: %v", ErrKeyNotFound, key)
+			}
+			return node.GetCell(nCell)
+		case InternalIndex:
+			if found {
+				return node.GetCell(nCell)
+			}
+		}
+
+		if nPage, err = b.childPageForPosition(node, nCell); err != nil {
+			return nil, err
+		}
+	}
+}
+
+// Insert inserts a leaf cell on a table or index B-Tree
+//
+// Starting at rootPage, descends the tree to the leaf where cell.key
+// belongs, inserts the cell keeping the leaf cells sorted by key and writes
+// the leaf. Returns ErrDuplicateKey if the tree already contains the key.
+// Leaf table cells are inserted on table B-Trees and leaf index cells on
+// index B-Trees.
+//
+// Nodes are split on the way down: if the root doesn't have space for the
+// cell it's split first, and then every full node found while descending is
+// split before moving into it, so the parent of a split node always has
+// space for the promoted key. The root stays on rootPage.
+//
+// The file change counter and the last modification time on the file
+// header are updated once, after the nodes are written.
+func (b *BTree) Insert(rootPage uint32, cell *BTreeCell) error {
+	err := b.insert(rootPage, cell)
+	// Nodes may have been split before the duplicate key was found
+	if err != nil && !errors.Is(err, ErrDuplicateKey) {
+		return err
+	}
+	if touchErr := b.touch(); touchErr != nil {
+		return touchErr
+	}
+	return err
+}
+
+// insert inserts cell like Insert without updating the header
+func (b *BTree) insert(rootPage uint32, cell *BTreeCell) error {
+	if cell.typ != LeafTable && cell.typ != LeafIndex {
+		return fmt.Errorf("%w: can't insert %s cell on a B-Tree", ErrInvalidNodeType, cell.typ)
+	}
+
+	root, err := b.getNode(rootPage)
+	if err != nil {
+		return err
+	}
+	if isTable(root.typ) != isTable(cell.typ) {
+		return fmt.Errorf("%w: can't insert %s cell on %s node of page %d", ErrInvalidNodeType, cell.typ, root.typ, rootPage)
+	}
+	if root.byteKeys != (cell.keyBytes != nil) {
+		return fmt.Errorf("%w: can't insert cell with key %v on page %d", ErrKeyType, cellTreeKey(cell), rootPage)
+	}
+	if max := root.maxKeyBytes(); len(cell.keyBytes) > max {
+		return fmt.Errorf("%w: key of %d bytes, the maximum is %d", ErrKeyTooLarge, len(cell.keyBytes), max)
+	}
+
+	full, err := root.isFullFor(cell)
+	if err != nil {
+		return err
+	}
+	if full {
+		if err := b.splitRoot(root, cellTreeKey(cell)); err != nil {
+			return err
+		}
+	}
+
+	return b.insertNonFull(root, cell)
+}
+
+// insertNonFull inserts cell on the subtree of node, which must have space
+// for one more cell.
+func (b *BTree) insertNonFull(node *BTreeNode, cell *BTreeCell) error {
+	for {
+		nCell, found, err := b.search(node, cellTreeKey(cell))
+		if err != nil {
+			return err
+		}
+
+		switch node.typ {
+		case LeafTable, LeafIndex:
+			if found {
+				return fmt.Errorf("%w: %v", ErrDuplicateKey, cellTreeKey(cell))
+			}
+			if err := node.InsertCell(nCell, cell); err != nil {
+				return err
+			}
+			return b.putNode(node)
+		case InternalTable, InternalIndex:
+			// Internal index cells are entries of the index too
+			if found && node.typ == InternalIndex {
+				return fmt.Errorf("%w: %v", ErrDuplicateKey, cellTreeKey(cell))
+			}
+
+			childPage, err := b.childPageForPosition(node, nCell)
+			if err != nil {
+				return err
+			}
+
+			child, err := b.getNode(childPage)
+			if err != nil {
+				return err
+			}
+
+			full, err := child.isFullFor(cell)
+			if err != nil {
+				return err
+			}
+			if full {
+				if _, err := b.splitNode(node, child, nCell, cellTreeKey(cell)); err != nil {
+					return err
+				}
+				// The promoted key was inserted at nCell, so search
+				// node again to pick the half where cell belongs.
+				continue
+			}
+
+			node = child
+		default:
+			return fmt.Errorf("unexpected %s node on page %d", node.typ, node.page.number)
+		}
+	}
+}
+
+// splitRoot splits a full root node keeping it on the same page
+//
+// The cells of the root are moved to a new page, the root becomes an empty
+// internal node whose right page is the new page and then the new page is
+// split as its child. key is the key being inserted, see splitNode.
+func (b *BTree) splitRoot(root *BTreeNode, key treeKey) error {
+	cells, err := root.cells()
+	if err != nil {
+		return err
+	}
+
+	child, err := b.newNode(root.typ)
+	if err != nil {
+		return err
+	}
+	child.rightPage = root.rightPage
+	child.order, child.byteKeys = root.order, root.byteKeys
+	if err := child.appendCells(cells); err != nil {
+		return err
+	}
+	if err := b.putNode(child); err != nil {
+		return err
+	}
+
+	typ := InternalTable
+	if root.typ == InternalIndex || root.typ == LeafIndex {
+		typ = InternalIndex
+	}
+	if err := root.reset(typ); err != nil {
+		return err
+	}
+	root.rightPage = child.page.number
+
+	_, err = b.splitNode(root, child, 1, key)
+	return err
+}
+
+// splitNode splits a B-Tree node in two
+//
+// A new page is allocated for the cells of child with the lower keys, and
+// child keeps the cells with the higher keys. The median key is promoted to
+// parent as an internal cell at position parentNCell pointing to the new
+// page, so parentNCell must be the position of the cell pointing to child
+// (or nCells+1 if child is the right page of parent). Returns the number of
+// the new page.
+//
+// On table leaves the median cell stays on the new page, since only leaves
+// store the data. On internal nodes the median cell leaves the node and its
+// child page becomes the right page of the new node. Index nodes keep every
+// entry once, so the median cell is always moved to parent.
+//
+// The median is picked by SplitPolicy, see splitMedian, with key being the
+// key of the cell inserted after the split. The parent must have space for
+// one more internal cell.
+func (b *BTree) splitNode(parent, child *BTreeNode, parentNCell uint16, key treeKey) (uint32, error) {
+	cells, err := child.cells()
+	if err != nil {
+		return 0, err
+	}
+	if len(cells) == 0 {
+		return 0, fmt.Errorf("can't split empty node on page %d", child.page.number)
+	}
+
+	left, err := b.newNode(child.typ)
+	if err != nil {
+		return 0, err
+	}
+	left.order, left.byteKeys = child.order, child.byteKeys
+
+	var lower, upper []*BTreeCell
+	separator := &BTreeCell{}
+	m := b.splitMedian(child, cells, key)
+
+	switch child.typ {
+	case LeafTable:
+		lower, upper = cells[:m+1], cells[m+1:]
+
+		separator.typ = InternalTable
+		separator.key = cells[m].key
+		separator.fields.tableInternal.childPage = left.page.number
+	case InternalTable:
+		lower, upper = cells[:m], cells[m+1:]
+		left.rightPage = cells[m].fields.tableInternal.childPage
+
+		separator.typ = InternalTable
+		separator.key = cells[m].key
+		separator.fields.tableInternal.childPage = left.page.number
+	case LeafIndex:
+		lower, upper = cells[:m], cells[m+1:]
+
+		separator.typ = InternalIndex
+		separator.key = cells[m].key
+		separator.fields.indexInternal.keyPk = cells[m].fields.indexLeaf.keyPk
+		separator.fields.indexInternal.childPage = left.page.number
+	case InternalIndex:
+		lower, upper = cells[:m], cells[m+1:]
+		left.rightPage = cells[m].fields.indexInternal.childPage
+
+		separator.typ = InternalIndex
+		separator.key = cells[m].key
+		separator.fields.indexInternal.keyPk = cells[m].fields.indexInternal.keyPk
+		separator.fields.indexInternal.childPage = left.page.number
+	default:
+		return 0, fmt.Errorf("%w: %d", ErrInvalidNodeType, child.typ)
+	}
+	separator.keyBytes = cells[m].keyBytes
+
+	if err := left.appendCells(lower); err != nil {
+		return 0, err
+	}
+	if err := b.putNode(left); err != nil {
+		return 0, err
+	}
+
+	if err := child.reset(child.typ); err != nil {
+		return 0, err
+	}
+	if err := child.appendCells(upper); err != nil {
+		return 0, err
+	}
+	if err := b.putNode(child); err != nil {
+		return 0, err
+	}
+
+	if err := parent.InsertCell(parentNCell, separator); err != nil {
+		return 0, err
+	}
+	if err := b.putNode(parent); err != nil {
+		return 0, err
+	}
+
+	return left.page.number, nil
+}
+
+// childPageForPosition returns the page to descend on an internal node to
+// reach the keys that belong at position nCell as returned by searchKey.
+func (b *BTree) childPageForPosition(node *BTreeNode, nCell uint16) (uint32, error) {
+	if nCell <= node.nCells {
+		return b.ChildPage(node, nCell)
+	}
+
+	rightPage := node.rightPage
+	if err := b.pager.pageIsValid(rightPage); err != nil {
+		return 0, fmt.Errorf("right page %d of page %d: %w", rightPage, node.page.number, err)
+	}
+	return rightPage, nil
+}
+
+// ChildPage returns the child page pointed by a cell of an internal node
+//
+// The child page is validated against the pages allocated by the pager, so a
+// corrupt pointer is reported along with the page containing it instead of
+// failing later with a bare ErrIncorrectPageNumber deep in a traversal.
+func (b *BTree) ChildPage(node *BTreeNode, nCell uint16) (uint32, error) {
+	cell, err := node.GetCell(nCell)
+	if err != nil {
+		return 0, err
+	}
+
+	var childPage uint32
+	switch cell.typ {
+	case InternalTable:
+		childPage = cell.fields.tableInternal.childPage
+	case InternalIndex:
+		childPage = cell.fields.indexInternal.childPage
+	default:
+		return 0, fmt.Errorf("%s node has no child pages", node.typ)
+	}
+
+	if err := b.pager.pageIsValid(childPage); err != nil {
+		return 0, fmt.Errorf("child page %d of cell %d in page %d: %w", childPage, nCell, node.page.number, err)
+	}
+
+	return childPage, nil
+}
+
+// RootPage returns the root page of the schema table of the database
+//
+// Following the chidb file format, the schema table is the B-Tree on page 1,
+// which on a new database is an empty table leaf. The other tables have
+// their root pages stored on the schema table, so page 1 is the only root
+// page known without reading the file.
+// http://chi.cs.uchicago.edu/chidb/fileformat.html#the-schema-table
+func (b *BTree) RootPage() uint32 {
+	return 1
+}
+
+// Pager returns the pager used by the BTree
+func (b *BTree) Pager() *Pager {
+	return b.pager
+}
+
 // Close closes the btree buffer
+//
+// After Close every operation returns ErrClosed. Closing an already closed
+// BTree is a no-op. The pager of a BTree created by NewBTree is not closed.
 func (b *BTree) Close() error {
+	if !b.ownsPager {
+		return nil
+	}
 	return b.pager.Close()
 }
 
+// SaveAs writes the database into a new file and returns it opened
+//
+// Unlike copying the file, the new database gets a fresh default header, so
+// the file change counter, schema version and user cookie are reset. The
+// new file is created atomically like in Open.
+func (b *BTree) SaveAs(filename string) (*BTree, error) {
+	// Pages are copied as is, so they must keep their size and checksums
+	header, err := b.ReadHeader()
+	if err != nil {
+		return nil, err
+	}
+
+	return create(context.Background(), filename, b.pager.pageSize, func(dst *BTree) error {
+		if b.pager.Checksums() {
+			if err := dst.pager.EnableChecksums(); err != nil {
+				return err
+			}
+		}
+		if err := dst.initializeHeader(); err != nil {
+			return err
+		}
+
+		// Free pages are copied too, so keep them reusable
+		dstHeader, err := dst.ReadHeader()
+		if err != nil {
+			return err
+		}
+		dstHeader.firstFreePage = header.firstFreePage
+		if err := dst.writeHeader(dstHeader); err != nil {
+			return err
+		}
+
+		for nPage := uint32(1); nPage <= b.pager.totalPages; nPage++ {
+			page, err := b.pager.ReadPage(nPage)
+			if err != nil {
+				return err
+			}
+
+			dstPage, err := dst.allocatePage()
+			if err != nil {
+				return err
+			}
+
+			// Page one is written after the header, so the fresh
+			// header of the new file is kept.
+			if err := dstPage.Write(page.Read()); err != nil {
+				return err
+			}
+
+			if err := dst.pager.WritePage(dstPage); err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+}
+
+func (b *BTree) initialize() error {
+	if err := b.initializeHeader(); err != nil {
+		return err
+	}
+	return b.initializeEmptyTableLeaf()
+}
+
+func (b *BTree) allocatePage() (*MemPage, error) {
+	nPage, err := b.pager.AllocatePage()
+	if err != nil {
+		return nil, err
+	}
+	return b.pager.ReadPage(nPage)
+}
+
 func (b *BTree) initializeHeader() error {
 	header := DefaultBTreeHeader()
+	header.pageSize = uint16(b.pager.pageSize)
+	if b.pager.Checksums() {
+		header.flags |= HeaderFlagChecksums
+	}
 	bytes, err := header.Bytes()
 	if err != nil {
 		return err
@@ -149,31 +950,126 @@ func (b *BTree) initializeHeader() error {
 }
 
 func (b *BTree) initializeEmptyTableLeaf() error {
-	nPage := b.pager.AllocatePage()
-	page, err := b.pager.ReadPage(nPage)
+	nPage, err := b.pager.AllocatePage()
 	if err != nil {
 		return err
 	}
-	node := NewBTreeNode(page, LeafTable)
-	bytes, err := node.Bytes()
+	return b.InitEmptyNode(nPage, LeafTable)
+}
+
+func (b *BTree) validateHeader() error {
+	header, err := b.ReadHeader()
 	if err != nil {
 		return err
 	}
-	if err := page.Write(bytes); err != nil {
+	if !bytes.Equal(header.magicBytes, MagicBytes) {
+		return ErrCorruptHeader
+	}
+	if b.strict && !bytes.Equal(header.chidbMagicBytes, ChidbMagicBytes) {
+		return ErrNotChidbFile
+	}
+	if !validPageSize(uint32(header.pageSize)) {
+		return fmt.Errorf(
+			"%w: page size %d is not a power of two between %d and %d",
+			ErrCorruptHeader, header.pageSize, MinPageSize, MaxPageSize,
+		)
+	}
+	if header.formatVersion != FormatVersion {
+		return fmt.Errorf("%w: file has version %d, expected %d", ErrUnsupportedFormat, header.formatVersion, FormatVersion)
+	}
+	return nil
+}
+
+// LastModified returns the time of the last write on the database
+//
+// A zero time is returned if the database was never modified.
+func (b *BTree) LastModified() (time.Time, error) {
+	header, err := b.ReadHeader()
+	if err != nil {
+		return time.Time{}, err
+	}
+	if header.lastModified == 0 {
+		return time.Time{}, nil
+	}
+	return time.Unix(0, int64(header.lastModified)), nil
+}
+
+// touch records a modification on the header, incrementing the file change
+// counter and setting the last modification to the current time.
+//
+// The stored time always advances, even if the wall clock didn't move
+// (or moved backwards) since the previous write.
+func (b *BTree) touch() error {
+	header, err := b.ReadHeader()
+	if err != nil {
 		return err
 	}
-	return b.pager.WritePage(page)
+
+	header.fileChangeCounter++
+
+	now := uint64(time.Now().UnixNano())
+	if now <= header.lastModified {
+		now = header.lastModified + 1
+	}
+	header.lastModified = now
+
+	return b.writeHeader(header)
 }
 
-func (b *BTree) validateHeader() error {
+// UserCookie returns the user cookie stored on the header
+//
+// The user cookie is not used by chidb, applications can use it to store
+// any value (e.g. their own schema version) with SetUserCookie.
+func (b *BTree) UserCookie() (uint32, error) {
+	header, err := b.ReadHeader()
+	if err != nil {
+		return 0, err
+	}
+	return header.userCookie, nil
+}
+
+// SetUserCookie stores v as the user cookie on the header
+//
+// The other header fields are kept.
+func (b *BTree) SetUserCookie(v uint32) error {
 	header, err := b.ReadHeader()
 	if err != nil {
 		return err
 	}
-	if bytes.Equal(header.magicBytes, MagicBytes) {
-		return nil
+	header.userCookie = v
+	return b.writeHeader(header)
+}
+
+// SchemaVersion returns the schema version stored on the header
+func (b *BTree) SchemaVersion() (uint32, error) {
+	header, err := b.ReadHeader()
+	if err != nil {
+		return 0, err
+	}
+	return header.schemaVersion, nil
+}
+
+// BumpSchemaVersion increments the schema version stored on the header
+//
+// It must be called whenever the schema changes (e.g. a table B-Tree is
+// created or dropped), so anything derived from the schema (like cached
+// query plans) can notice that it is outdated.
+func (b *BTree) BumpSchemaVersion() error {
+	header, err := b.ReadHeader()
+	if err != nil {
+		return err
+	}
+	header.schemaVersion++
+	return b.writeHeader(header)
+}
+
+// writeHeader writes the header values to the btree file
+func (b *BTree) writeHeader(header *BTreeHeader) error {
+	bytes, err := header.Bytes()
+	if err != nil {
+		return err
 	}
-	return ErrCorruptHeader
+	return b.pager.WriteHeader(bytes)
 }
 
 // ReadHeader returns the header values of btree file
@@ -215,7 +1111,7 @@ func BTreeNodeTypeFromByte(b byte) (BTreeNodeType, error) {
 	case 0x0A:
 		return LeafIndex, nil
 	}
-	return BTreeNodeType(b), fmt.Errorf("invalid btree node type %v", b)
+	return BTreeNodeType(b), fmt.Errorf("%w: %#x", ErrInvalidNodeType, b)
 }
 
 // Value return the byte representation of BTreeNodeType
@@ -249,6 +1145,11 @@ type BTreeNode struct {
 	// In-memory page returned by the Pager
 	page *MemPage
 
+	// Pager used to read and write the overflow pages of the cells. Nodes
+	// created directly from a page have no pager, so they can't have cells
+	// with overflow pages.
+	pager *Pager
+
 	// The type of page
 	typ BTreeNodeType
 
@@ -259,26 +1160,42 @@ type BTreeNode struct {
 	// The number of cells stored in this page.
 	nCells uint16
 
-	// The byte offset at which the cells start. If the page contains no cells, this field contains the value PageSize.
+	// The byte offset at which the cells start. If the page contains no cells, this field contains the
+	// length of the page data (the page size, or the page size minus HeaderSize
+	// on page one).
 	// This value must be updated every time a cell is added.
 	cellsOffset uint16
 
 	// Right page (internal nodes only)
-	rightPage uint16
+	rightPage uint32
 
 	// Pointer to start of cell offset array in the in-memory page
 	cellOffsetArray byte
+
+	// Encoding of the cells stored in this page
+	cellFormat CellFormat
+
+	// Order of the cells of the B-Tree of this page
+	order KeyOrder
+
+	// Whether the page is a node of a byte-keyed index, whose cells store
+	// the key as bytes instead of a ChidbKey, see NewByteIndex
+	byteKeys bool
 }
 
 const PageHeaderSize = 12
 
+// leafTableCellHeaderSize is the size of the data size and the key stored
+// before the data of a leaf table cell
+const leafTableCellHeaderSize = 4 + 8
+
 // NewBTreeNode create a new BTreeNode with default values
 func NewBTreeNode(page *MemPage, typ BTreeNodeType) *BTreeNode {
 	return &BTreeNode{
 		page:            page,
 		typ:             typ,
 		freeOffset:      PageHeaderSize + 1,
-		cellsOffset:     PageSize,
+		cellsOffset:     uint16(page.Len()),
 		cellOffsetArray: PageHeaderSize + 1,
 		nCells:          0,
 		rightPage:       0,
@@ -316,19 +1233,36 @@ func BTreeNodeFromPage(page *MemPage) (*BTreeNode, error) {
 	if err != nil {
 		return nil, err
 	}
+	formatByte, err := buffer.ReadByte()
+	if err != nil {
+		return nil, err
+	}
+	cellFormat := CellFormat(formatByte &^ (nodeDescending | nodeByteKeys))
 
 	typ, err := BTreeNodeTypeFromByte(typeBytes)
 	if err != nil {
 		return nil, err
 	}
+	if cellFormat > CellFormatV2 {
+		return nil, fmt.Errorf("%w: %d on page %d", ErrUnknownCellFormat, cellFormat, page.number)
+	}
+	byteKeys := formatByte&nodeByteKeys != 0
+	if byteKeys && isTable(typ) {
+		return nil, fmt.Errorf("%w: %s node with byte keys on page %d", ErrInvalidNodeType, typ, page.number)
+	}
 
 	node.page = page
 	node.typ = typ
 	node.freeOffset = binary.LittleEndian.Uint16(freeOffset)
 	node.nCells = binary.LittleEndian.Uint16(nCells)
 	node.cellsOffset = binary.LittleEndian.Uint16(cellsOffset)
-	node.rightPage = binary.LittleEndian.Uint16(righPage)
+	node.rightPage = binary.LittleEndian.Uint32(righPage)
 	node.cellOffsetArray = cellOffsetArray
+	node.cellFormat = cellFormat
+	if formatByte&nodeDescending != 0 {
+		node.order = OrderDescending
+	}
+	node.byteKeys = byteKeys
 
 	return &node, nil
 }
@@ -339,14 +1273,64 @@ func BTreeNodeFromPage(page *MemPage) (*BTreeNode, error) {
 // This involves the following:
 //  1. Find out the offset of the requested cell in cell offset array.
 //  2. Read the cell from the in-memory page, and parse its contents
-// (refer to The chidb File Format document for the format of cells).
+//     (refer to The chidb File Format document for the format of cells).
+//
+// The data of a leaf table cell stored on overflow pages is read too, so the
+// returned cell has all of its data.
 func (n *BTreeNode) GetCell(nCell uint16) (*BTreeCell, error) {
-	_, offset, found := n.getCellOffset(nCell)
+	cell, err := n.getLocalCell(nCell)
+	if err != nil {
+		return nil, err
+	}
+
+	if cell.typ == LeafTable && cell.fields.tableLeaf.overflowPage != 0 {
+		if n.pager == nil {
+			return nil, fmt.Errorf("can't read overflow pages of cell %d without pager", nCell)
+		}
+
+		overflow, err := n.pager.readOverflow(
+			cell.fields.tableLeaf.overflowPage,
+			int(cell.fields.tableLeaf.size)-len(cell.fields.tableLeaf.data),
+		)
+		if err != nil {
+			return nil, fmt.Errorf("%w: cell %d of page %d: %v", ErrCorruptCell, nCell, n.page.number, err)
+		}
+
+		cell.fields.tableLeaf.data = append(cell.fields.tableLeaf.data, overflow...)
+		cell.fields.tableLeaf.overflowPage = 0
+	}
+
+	return cell, nil
+}
+
+// getLocalCell reads a cell like GetCell, but only the part stored on the
+// page. The overflow pages of a leaf table cell are kept on the returned
+// cell, so inserting it on a node moves the cell without copying them.
+func (n *BTreeNode) getLocalCell(nCell uint16) (*BTreeCell, error) {
+	// Cells are parsed according to n.typ, so make sure it still agrees
+	// with the type stored on the page before trusting it.
+	if typ := n.page.Read()[0]; typ != n.typ.Value() {
+		return nil, fmt.Errorf("%w: page %d has type %#x, node has %s", ErrNodeTypeDrift, n.page.number, typ, n.typ)
+	}
+
+	offset, found := n.getCellOffset(nCell)
 	if !found {
-		return nil, fmt.Errorf("not found cell %d", nCell)
+		return nil, fmt.Errorf("%w: cell %d of page %d", ErrCellNotFound, nCell, n.page.number)
+	}
+
+	data := n.page.Read()
+	if int(offset) < int(n.cellOffsetArray) || int(offset) >= len(data) {
+		return nil, fmt.Errorf("%w: cell %d offset %d is out of page bounds", ErrCorruptCell, nCell, offset)
 	}
 
-	buffer := bytes.NewReader(n.page.Read())
+	buffer := bytes.NewReader(data)
+
+	if n.byteKeys {
+		return n.byteKeyCell(nCell, data[offset:])
+	}
+	if n.cellFormat == CellFormatV2 {
+		return n.cellV2(nCell, data[offset:])
+	}
 
 	if _, err := buffer.Seek(int64(offset), io.SeekStart); err != nil {
 		return nil, err
@@ -366,7 +1350,7 @@ func (n *BTreeNode) GetCell(nCell uint16) (*BTreeCell, error) {
 		}
 
 		cell.typ = n.typ
-		cell.key = ChidbKey(binary.LittleEndian.Uint32(key))
+		cell.key = ChidbKey(binary.LittleEndian.Uint64(key))
 		cell.fields.tableInternal.childPage = binary.LittleEndian.Uint32(childPage)
 
 		return &cell, nil
@@ -385,15 +1369,39 @@ func (n *BTreeNode) GetCell(nCell uint16) (*BTreeCell, error) {
 
 		size := binary.LittleEndian.Uint32(sizeBytes)
 
-		data := make([]byte, size)
-		if _, err := buffer.Read(data); err != nil {
+		// Only a prefix of big data is stored on the page, followed by
+		// the first overflow page.
+		local, overflow := int64(size), false
+		if max := int64(n.maxLocal()); local > max {
+			local, overflow = max, true
+		}
+
+		cellSize := local
+		if overflow {
+			cellSize += int64(unsafe.Sizeof(cell.fields.tableLeaf.overflowPage))
+		}
+		if cellSize > int64(buffer.Len()) {
+			return nil, fmt.Errorf("%w: cell %d size %d exceeds page bounds", ErrCorruptCell, nCell, size)
+		}
+
+		// Read returns io.EOF for empty data at the end of the page
+		data := make([]byte, local)
+		if _, err := io.ReadFull(buffer, data); err != nil {
 			return nil, err
 		}
 
+		if overflow {
+			overflowPage := make([]byte, unsafe.Sizeof(cell.fields.tableLeaf.overflowPage))
+			if _, err := buffer.Read(overflowPage); err != nil {
+				return nil, err
+			}
+			cell.fields.tableLeaf.overflowPage = binary.LittleEndian.Uint32(overflowPage)
+		}
+
 		cell.typ = n.typ
 		cell.fields.tableLeaf.size = size
 		cell.fields.tableLeaf.data = data
-		cell.key = ChidbKey(binary.LittleEndian.Uint32(key))
+		cell.key = ChidbKey(binary.LittleEndian.Uint64(key))
 
 		return &cell, nil
 	case InternalIndex:
@@ -413,9 +1421,9 @@ func (n *BTreeNode) GetCell(nCell uint16) (*BTreeCell, error) {
 		}
 
 		cell.typ = n.typ
-		cell.key = ChidbKey(binary.LittleEndian.Uint32(key))
+		cell.key = ChidbKey(binary.LittleEndian.Uint64(key))
 		cell.fields.indexInternal.childPage = binary.LittleEndian.Uint32(childPage)
-		cell.fields.indexInternal.keyPk = binary.LittleEndian.Uint32(keyPk)
+		cell.fields.indexInternal.keyPk = binary.LittleEndian.Uint64(keyPk)
 
 		return &cell, nil
 	case LeafIndex:
@@ -431,12 +1439,12 @@ func (n *BTreeNode) GetCell(nCell uint16) (*BTreeCell, error) {
 		}
 
 		cell.typ = n.typ
-		cell.key = ChidbKey(binary.LittleEndian.Uint32(key))
-		cell.fields.indexLeaf.keyPk = binary.LittleEndian.Uint32(keyPk)
+		cell.key = ChidbKey(binary.LittleEndian.Uint64(key))
+		cell.fields.indexLeaf.keyPk = binary.LittleEndian.Uint64(keyPk)
 
 		return &cell, nil
 	default:
-		return nil, fmt.Errorf("invalid node type %d", n.typ)
+		return nil, fmt.Errorf("%w: %d", ErrInvalidNodeType, n.typ)
 	}
 }
 
@@ -452,14 +1460,73 @@ func (n *BTreeNode) GetCell(nCell uint16) (*BTreeCell, error) {
 //     are shifted one position forward in the array. Then, set the value of
 //     position ncell to be the offset of the newly added cell.
 //
-// This function assumes that there is enough space for this cell in this node.
+// Cell positions start at 1, so nCell must be between 1 and the number of
+// cells plus one (which appends the cell after the existing ones).
+//
+// The data of a leaf table cell bigger than what a cell can store on the page
+// is stored on overflow pages, see maxLocal.
+//
+// The cell must have the type of the node, so a table node only takes table
+// cells and an index node only index cells, and leaves only leaf cells.
+// Returns ErrInvalidNodeType otherwise.
+//
+// Cells are kept sorted by key, so a cell with the same key as the new one
+// would be next to it. Returns ErrCellExists in that case.
+//
+// If the cell doesn't fit, the node is defragmented to reclaim the space of
+// removed cells. Returns ErrNodeFull if there is still not enough space for
+// this cell in this node.
 func (n *BTreeNode) InsertCell(nCell uint16, cell *BTreeCell) error {
-	cellOffsetArray, _, found := n.getCellOffset(nCell)
-	if found {
-		return fmt.Errorf("cell %d already exists", nCell)
+	if cell.typ != n.typ {
+		return fmt.Errorf("%w: can't insert %s cell into %s node of page %d", ErrInvalidNodeType, cell.typ, n.typ, n.page.number)
+	}
+
+	cellOffsetArray := n.cellOffsets()
+	if nCell < 1 || int(nCell) > len(cellOffsetArray)+1 {
+		return fmt.Errorf("invalid cell %d to insert on node with %d cells", nCell, len(cellOffsetArray))
+	}
+
+	for _, neighbor := range []uint16{nCell - 1, nCell} {
+		if neighbor < 1 || int(neighbor) > len(cellOffsetArray) {
+			continue
+		}
+		key, err := n.cellTreeKey(neighbor)
+		if err != nil {
+			return err
+		}
+		if key.equal(cellTreeKey(cell)) {
+			return fmt.Errorf("%w: key %v is on cell %d of page %d", ErrCellExists, key, neighbor, n.page.number)
+		}
+	}
+
+	hasSpace, err := n.HasSpaceFor(cell)
+	if err != nil {
+		return err
+	}
+	if !hasSpace {
+		// Removed cells may have left enough dead space on the cell area
+		if err := n.Defragment(); err != nil {
+			return err
+		}
+		if hasSpace, err = n.HasSpaceFor(cell); err != nil {
+			return err
+		}
+		cellOffsetArray = n.cellOffsets()
+	}
+	if !hasSpace {
+		return fmt.Errorf("%w: cell offset array of page %d would overlap the cell area", ErrNodeFull, n.page.number)
+	}
+
+	if cell, err = n.respill(cell); err != nil {
+		return err
+	}
+	if n.overflows(cell) {
+		if cell, err = n.spill(cell); err != nil {
+			return err
+		}
 	}
 
-	bytes, err := cell.Bytes()
+	bytes, err := n.encodeCell(cell)
 	if err != nil {
 		return err
 	}
@@ -472,31 +1539,148 @@ func (n *BTreeNode) InsertCell(nCell uint16, cell *BTreeCell) error {
 	}
 	n.cellsOffset = cellOffset
 
-	// Add the new cell offset on existed cell offset array
-	// and convert this array to a slice of bytes
-	cellOffsetArray = append(cellOffsetArray, cellOffset)
-	cellOffsetArrayBytes := make([]byte, 0)
-	for _, offset := range cellOffsetArray {
-		b := make([]byte, unsafe.Sizeof(offset))
-		binary.LittleEndian.PutUint16(b, offset)
-		cellOffsetArrayBytes = append(cellOffsetArrayBytes, b...)
+	// Shift the offsets of cells at positions >= nCell one position
+	// forward and set the new cell offset at nCell
+	cellOffsetArray = append(cellOffsetArray, 0)
+	copy(cellOffsetArray[nCell:], cellOffsetArray[nCell-1:])
+	cellOffsetArray[nCell-1] = cellOffset
+
+	return n.setCellOffsets(cellOffsetArray)
+}
+
+// RemoveCell removes the cell at position nCell from a B-Tree node
+//
+// The offsets of the cells after nCell are shifted one position back in
+// the cell offset array. The bytes of the removed cell are left on the cell
+// area as dead space until the node is defragmented.
+func (n *BTreeNode) RemoveCell(nCell uint16) error {
+	cellOffsetArray := n.cellOffsets()
+	if nCell < 1 || int(nCell) > len(cellOffsetArray) {
+		return fmt.Errorf("%w: can't remove cell %d of node with %d cells", ErrCellNotFound, nCell, len(cellOffsetArray))
+	}
+
+	copy(cellOffsetArray[nCell-1:], cellOffsetArray[nCell:])
+	return n.setCellOffsets(cellOffsetArray[:len(cellOffsetArray)-1])
+}
+
+// UpdateCell replaces the cell at position nCell with cell, which must have
+// the same type and key
+//
+// If the new cell fits on the bytes of the old one it's written in place.
+// Otherwise it's added at the top of the cell area and its entry of the
+// cell offset array is repointed to it, leaving the old bytes as dead space
+// until the node is defragmented. Either way the position of the cell is
+// kept. The overflow pages of the old cell, if any, are released.
+//
+// Returns ErrInvalidNodeType if the type of cell isn't the type of the node,
+// like InsertCell, and ErrNodeFull if the new cell doesn't fit on the node
+// even after it's defragmented.
+func (n *BTreeNode) UpdateCell(nCell uint16, cell *BTreeCell) error {
+	if cell.typ != n.typ {
+		return fmt.Errorf("%w: can't update %s cell of %s node of page %d", ErrInvalidNodeType, cell.typ, n.typ, n.page.number)
+	}
+
+	old, err := n.getLocalCell(nCell)
+	if err != nil {
+		return err
+	}
+	if !cellTreeKey(old).equal(cellTreeKey(cell)) {
+		return fmt.Errorf("can't update cell %d with key %v to key %v", nCell, cellTreeKey(old), cellTreeKey(cell))
+	}
+
+	oldBytes, err := n.encodeCell(old)
+	if err != nil {
+		return err
+	}
+	size, err := n.cellSize(cell)
+	if err != nil {
+		return err
 	}
 
-	// Write the new cell offset array on page
-	// count the new cell added
-	// and updated the free offset start
-	if err := n.page.WriteAt(cellOffsetArrayBytes, uint16(n.cellOffsetArray)); err != nil {
+	cellOffsetArray := n.cellOffsets()
+	cellOffset := cellOffsetArray[nCell-1]
+
+	if size > len(oldBytes) {
+		if int(n.freeOffset)+size > int(n.cellsOffset) {
+			// The old cell is moved along with the others, but its
+			// position on the offset array stays the same
+			if err := n.Defragment(); err != nil {
+				return err
+			}
+			cellOffsetArray = n.cellOffsets()
+		}
+		if int(n.freeOffset)+size > int(n.cellsOffset) {
+			return fmt.Errorf("%w: no space to update cell %d of page %d", ErrNodeFull, nCell, n.page.number)
+		}
+		cellOffset = n.cellsOffset - uint16(size)
+	}
+
+	if cell, err = n.respill(cell); err != nil {
+		return err
+	}
+	if n.overflows(cell) {
+		if cell, err = n.spill(cell); err != nil {
+			return err
+		}
+	}
+
+	bytes, err := n.encodeCell(cell)
+	if err != nil {
+		return err
+	}
+	if err := n.page.WriteAt(bytes, cellOffset); err != nil {
 		return err
 	}
-	n.nCells++
-	n.freeOffset += n.nCells * uint16(unsafe.Sizeof(nCell))
 
+	if cellOffset != cellOffsetArray[nCell-1] {
+		n.cellsOffset = cellOffset
+		cellOffsetArray[nCell-1] = cellOffset
+		if err := n.setCellOffsets(cellOffsetArray); err != nil {
+			return err
+		}
+	}
+
+	if old.typ == LeafTable && old.fields.tableLeaf.overflowPage != 0 {
+		overflowSize := int(old.fields.tableLeaf.size) - len(old.fields.tableLeaf.data)
+		return n.pager.freeOverflow(old.fields.tableLeaf.overflowPage, overflowSize)
+	}
 	return nil
 }
 
+// Defragment rewrites the cells of the node contiguously at the end of the
+// page
+//
+// The bytes left on the cell area by removed cells are reclaimed as free
+// space: cellsOffset is recomputed from the live cells only and every entry
+// of the cell offset array is updated to the new location of its cell.
+func (n *BTreeNode) Defragment() error {
+	cells, err := n.cells()
+	if err != nil {
+		return err
+	}
+
+	cellsOffset := uint16(n.page.Len())
+	offsets := make([]uint16, 0, len(cells))
+	for _, cell := range cells {
+		bytes, err := n.encodeCell(cell)
+		if err != nil {
+			return err
+		}
+
+		cellsOffset -= uint16(len(bytes))
+		if err := n.page.WriteAt(bytes, cellsOffset); err != nil {
+			return err
+		}
+		offsets = append(offsets, cellsOffset)
+	}
+	n.cellsOffset = cellsOffset
+
+	return n.setCellOffsets(offsets)
+}
+
 func (n *BTreeNode) Bytes() ([]byte, error) {
 	buffer := bytes.NewBuffer([]byte(""))
-	buffer.Grow(PageSize)
+	buffer.Grow(n.page.Len())
 
 	freeOffset := make([]byte, unsafe.Sizeof(n.freeOffset))
 	nCells := make([]byte, unsafe.Sizeof(n.nCells))
@@ -506,7 +1690,7 @@ func (n *BTreeNode) Bytes() ([]byte, error) {
 	binary.LittleEndian.PutUint16(freeOffset, n.freeOffset)
 	binary.LittleEndian.PutUint16(nCells, n.nCells)
 	binary.LittleEndian.PutUint16(cellsOffset, n.cellsOffset)
-	binary.LittleEndian.PutUint16(righPage, n.rightPage)
+	binary.LittleEndian.PutUint32(righPage, n.rightPage)
 
 	if err := buffer.WriteByte(n.typ.Value()); err != nil {
 		return nil, err
@@ -530,6 +1714,17 @@ func (n *BTreeNode) Bytes() ([]byte, error) {
 		return nil, err
 	}
 
+	formatByte := byte(n.cellFormat)
+	if n.order == OrderDescending {
+		formatByte |= nodeDescending
+	}
+	if n.byteKeys {
+		formatByte |= nodeByteKeys
+	}
+	if err := buffer.WriteByte(formatByte); err != nil {
+		return nil, err
+	}
+
 	if _, err := buffer.Write(make([]byte, n.page.Len()-buffer.Len())); err != nil {
 		return nil, err
 	}
@@ -541,38 +1736,292 @@ func (b *BTreeNode) Type() BTreeNodeType {
 	return b.typ
 }
 
-func (n *BTreeNode) getCellOffset(nCell uint16) ([]uint16, uint16, bool) {
+// FillRatio returns the fraction of the usable page space that is in use
+//
+// The used space is the size of the live cells plus their cell offset array
+// entries, so the dead space left by removed cells isn't counted, and the
+// usable space is everything after the node header. A freshly created node
+// returns 0.
+func (n *BTreeNode) FillRatio() (float64, error) {
+	cells, err := n.cells()
+	if err != nil {
+		return 0, err
+	}
+	size, err := n.sizeOf(cells)
+	if err != nil {
+		return 0, err
+	}
+	return float64(size) / float64(n.usableSpace()), nil
+}
+
+// fragmentedBytes returns the dead space left on the cell area of the node
+// by removed and moved cells, which Defragment reclaims
+func (n *BTreeNode) fragmentedBytes() (int, error) {
+	cells, err := n.cells()
+	if err != nil {
+		return 0, err
+	}
+
+	live := 0
+	for _, cell := range cells {
+		size, err := n.cellSize(cell)
+		if err != nil {
+			return 0, err
+		}
+		live += size
+	}
+	return n.page.Len() - int(n.cellsOffset) - live, nil
+}
+
+// searchKey binary searches the cells of the node for key
+//
+// Returns the position of the first cell whose key is greater than or equal
+// to key, or nCells+1 if all keys are smaller, and whether that cell has
+// exactly the given key. On OrderDescending nodes it's the first cell whose
+// key is smaller than or equal to key.
+func (n *BTreeNode) searchKey(key ChidbKey) (uint16, bool, error) {
+	lo, hi := uint16(1), n.nCells+1
+	for lo < hi {
+		mid := lo + (hi-lo)/2
+
+		midKey, err := n.cellKey(mid)
+		if err != nil {
+			return 0, false, err
+		}
+
+		if n.order.before(midKey, key) {
+			lo = mid + 1
+		} else {
+			hi = mid
+		}
+	}
+
+	if lo > n.nCells {
+		return lo, false, nil
+	}
+
+	loKey, err := n.cellKey(lo)
+	if err != nil {
+		return 0, false, err
+	}
+	return lo, loKey == key, nil
+}
+
+// cellKey reads only the key of a cell, without decoding the rest of it
+//
+// The key is the first field of leaf index cells, and it follows the child
+// page or the data size on the other cells.
+func (n *BTreeNode) cellKey(nCell uint16) (ChidbKey, error) {
 	data := n.page.Read()
-	cellOffsetArray := data[n.cellOffsetArray:n.freeOffset]
+	if typ := data[0]; typ != n.typ.Value() {
+		return 0, fmt.Errorf("%w: page %d has type %#x, node has %s", ErrNodeTypeDrift, n.page.number, typ, n.typ)
+	}
+
+	offset, found := n.getCellOffset(nCell)
+	if !found {
+		return 0, fmt.Errorf("%w: cell %d of page %d", ErrCellNotFound, nCell, n.page.number)
+	}
+
+	if n.cellFormat == CellFormatV2 {
+		if int(offset) < int(n.cellOffsetArray) || int(offset) >= len(data) {
+			return 0, fmt.Errorf("%w: cell %d offset %d is out of page bounds", ErrCorruptCell, nCell, offset)
+		}
+		return n.cellKeyV2(nCell, data[offset:])
+	}
+
+	at := int(offset)
+	if n.typ != LeafIndex {
+		at += 4
+	}
+	if int(offset) < int(n.cellOffsetArray) || at+8 > len(data) {
+		return 0, fmt.Errorf("%w: cell %d offset %d is out of page bounds", ErrCorruptCell, nCell, offset)
+	}
+	return ChidbKey(binary.LittleEndian.Uint64(data[at:])), nil
+}
+
+// cells returns all cells of the node ordered by position
+//
+// Cells are read with getLocalCell, so they can be moved to other nodes
+// keeping their overflow pages.
+func (n *BTreeNode) cells() ([]*BTreeCell, error) {
+	cells := make([]*BTreeCell, 0, n.nCells)
+	for nCell := uint16(1); nCell <= n.nCells; nCell++ {
+		cell, err := n.getLocalCell(nCell)
+		if err != nil {
+			return nil, err
+		}
+		cells = append(cells, cell)
+	}
+	return cells, nil
+}
+
+// appendCells inserts cells after the existing cells of the node
+func (n *BTreeNode) appendCells(cells []*BTreeCell) error {
+	for _, cell := range cells {
+		if err := n.InsertCell(n.nCells+1, cell); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// reset turns the node into an empty node of type typ on the same page
+//
+// The right page is kept. The cell area is cleared on the in-memory page,
+// the node must be written to make it effective.
+func (n *BTreeNode) reset(typ BTreeNodeType) error {
+	empty := NewBTreeNode(n.page, typ)
+	empty.rightPage = n.rightPage
+	empty.pager = n.pager
+	empty.cellFormat = n.cellFormat
+	empty.order = n.order
+	empty.byteKeys = n.byteKeys
+
+	bytes, err := empty.Bytes()
+	if err != nil {
+		return err
+	}
+	if err := n.page.Write(bytes); err != nil {
+		return err
+	}
+
+	*n = *empty
+	return nil
+}
+
+// HasSpaceFor reports whether cell fits on the free space of the node
+//
+// Besides the serialized cell, inserting it takes an entry of the cell
+// offset array, which grows toward the cell area, so both must fit between
+// freeOffset and cellsOffset.
+func (n *BTreeNode) HasSpaceFor(cell *BTreeCell) (bool, error) {
+	size, err := n.cellSize(cell)
+	if err != nil {
+		return false, err
+	}
+	needed := size + int(unsafe.Sizeof(n.cellsOffset))
+	return int(n.freeOffset)+needed <= int(n.cellsOffset), nil
+}
+
+// cellSize returns the number of bytes the cell takes on the page, which
+// for a cell whose data overflows is the stored prefix and the overflow page.
+func (n *BTreeNode) cellSize(cell *BTreeCell) (int, error) {
+	// A cell moved from a node with another cell format may store another
+	// amount of data on the page, see respill
+	if n.overflows(cell) || cell.typ == LeafTable && cell.fields.tableLeaf.overflowPage != 0 {
+		header := leafTableCellHeaderSize
+		if n.cellFormat == CellFormatV2 {
+			size := uint64(len(cell.fields.tableLeaf.data))
+			if cell.fields.tableLeaf.overflowPage != 0 {
+				size = uint64(cell.fields.tableLeaf.size)
+			}
+			header = varintLen(size) + varintLen(uint64(cell.key))
+		}
+		return header + n.maxLocal() + int(unsafe.Sizeof(cell.fields.tableLeaf.overflowPage)), nil
+	}
+
+	bytes, err := n.encodeCell(cell)
+	if err != nil {
+		return 0, err
+	}
+	return len(bytes), nil
+}
+
+// overflows reports whether the data of cell must be stored on overflow
+// pages to be inserted on the node. Cells read with getLocalCell already
+// have their overflow pages.
+func (n *BTreeNode) overflows(cell *BTreeCell) bool {
+	return cell.typ == LeafTable &&
+		cell.fields.tableLeaf.overflowPage == 0 &&
+		len(cell.fields.tableLeaf.data) > n.maxLocal()
+}
 
-	if len(cellOffsetArray)%2 != 0 {
-		panic("invalid array of cellOffsetArray. This can't happen")
+// spill stores the data of cell that doesn't fit on the page on overflow
+// pages and returns the cell to be stored on the page.
+func (n *BTreeNode) spill(cell *BTreeCell) (*BTreeCell, error) {
+	if n.pager == nil {
+		return nil, fmt.Errorf("can't write overflow pages of cell %d without pager", cell.key)
 	}
 
-	if len(cellOffsetArray) == 0 {
-		return []uint16{}, 0, false
+	data := cell.fields.tableLeaf.data
+	local := n.maxLocal()
+
+	overflowPage, err := n.pager.writeOverflow(data[local:])
+	if err != nil {
+		return nil, err
 	}
 
-	// TODO: Find a better way to convert a slice of bytes to a slice of uint16
-	start := 0
-	offsets := make([]uint16, 0)
-	cellOffsetArrayLength := len(cellOffsetArray)
-	for range cellOffsetArray {
-		end := start + 2
-		if end > cellOffsetArrayLength {
-			break
+	spilled := *cell
+	spilled.fields.tableLeaf.size = uint32(len(data))
+	spilled.fields.tableLeaf.data = data[:local]
+	spilled.fields.tableLeaf.overflowPage = overflowPage
+	return &spilled, nil
+}
+
+// isFullFor reports whether the node lacks space for what inserting cell on
+// its subtree may add to it: cell itself on a leaf, or a promoted key on an
+// internal node. The keys promoted to byte-keyed index nodes may be any
+// other key of the subtree, so they're assumed to have the biggest size.
+func (n *BTreeNode) isFullFor(cell *BTreeCell) (bool, error) {
+	if n.typ == InternalTable || n.typ == InternalIndex {
+		cell = &BTreeCell{typ: n.typ}
+		if n.byteKeys {
+			cell.keyBytes = make([]byte, n.maxKeyBytes())
 		}
-		offsets = append(offsets, binary.LittleEndian.Uint16(cellOffsetArray[start:end]))
-		start += 2
 	}
 
-	// This means that the request nCell do not exists in cells offset array
-	// so we returned the existed array and false
-	if int(nCell) > len(offsets) {
-		return offsets, 0, false
+	hasSpace, err := n.HasSpaceFor(cell)
+	return !hasSpace, err
+}
+
+// getCellOffset returns the byte offset of the cell at position nCell
+//
+// Cell positions start at 1. The boolean return value is false if the
+// node has no cell at nCell.
+func (n *BTreeNode) getCellOffset(nCell uint16) (uint16, bool) {
+	offsets := n.cellOffsets()
+	if nCell < 1 || int(nCell) > len(offsets) {
+		return 0, false
+	}
+	return offsets[nCell-1], true
+}
+
+// cellOffsets returns the cell offset array, where the offset of the cell
+// at position nCell is stored at index nCell-1.
+func (n *BTreeNode) cellOffsets() []uint16 {
+	data := n.page.Read()
+
+	start := int(n.cellOffsetArray)
+	end := start + int(n.nCells)*2
+
+	// A corrupt number of cells can't make us read past the page
+	if end > len(data) {
+		end = len(data)
+	}
+
+	offsets := make([]uint16, 0, n.nCells)
+	for i := start; i+2 <= end; i += 2 {
+		offsets = append(offsets, binary.LittleEndian.Uint16(data[i:i+2]))
+	}
+	return offsets
+}
+
+// setCellOffsets writes the cell offset array on page and updates the
+// number of cells and the free offset accordingly.
+func (n *BTreeNode) setCellOffsets(offsets []uint16) error {
+	b := make([]byte, len(offsets)*2)
+	for i, offset := range offsets {
+		binary.LittleEndian.PutUint16(b[i*2:], offset)
+	}
+
+	if err := n.page.WriteAt(b, uint16(n.cellOffsetArray)); err != nil {
+		return err
 	}
 
-	return offsets, offsets[int(nCell-1)], true
+	n.nCells = uint16(len(offsets))
+	n.freeOffset = uint16(n.cellOffsetArray) + uint16(len(b))
+
+	return nil
 }
 
 // BTreeCell is an in-memory representation of a cell.
@@ -583,6 +2032,10 @@ type BTreeCell struct {
 	// Key of cell
 	key ChidbKey
 
+	// Key of a cell of a byte-keyed index, see NewByteIndex, which is
+	// stored in place of key. It's nil on the cells of other B-Trees.
+	keyBytes []byte
+
 	fields struct {
 		// Represents a table internal cell
 		tableInternal struct {
@@ -597,12 +2050,17 @@ type BTreeCell struct {
 
 			// Pointer to in-memory copy of data stored in this cell
 			data []byte
+
+			// First overflow page with the data that doesn't fit on the
+			// page, or 0 if all data is stored on the cell. When set, data
+			// only has the part of the data stored on the cell.
+			overflowPage uint32
 		}
 
 		// Represents a index internal cell
 		indexInternal struct {
 			// Primary key of row where the indexed field is equal to key
-			keyPk uint32
+			keyPk uint64
 
 			// Child page with keys
 			childPage uint32
@@ -611,15 +2069,37 @@ type BTreeCell struct {
 		// Represents a index leaf cell
 		indexLeaf struct {
 			// Primary key of row where the indexed field is equal to key
-			keyPk uint32
+			keyPk uint64
 		}
 	}
 }
 
+// NewLeafIndexCell creates a leaf index cell mapping key to the primary key
+// keyPk of a table row
+func NewLeafIndexCell(key ChidbKey, keyPk uint64) *BTreeCell {
+	cell := &BTreeCell{
+		typ: LeafIndex,
+		key: key,
+	}
+	cell.fields.indexLeaf.keyPk = keyPk
+	return cell
+}
+
+// NewLeafTableCell creates a leaf table cell storing data with key
+func NewLeafTableCell(key ChidbKey, data []byte) *BTreeCell {
+	cell := &BTreeCell{
+		typ: LeafTable,
+		key: key,
+	}
+	cell.fields.tableLeaf.size = uint32(len(data))
+	cell.fields.tableLeaf.data = data
+	return cell
+}
+
 func (b *BTreeCell) Bytes() ([]byte, error) {
 	buffer := bytes.NewBuffer([]byte(""))
 	key := make([]byte, unsafe.Sizeof(b.key))
-	binary.LittleEndian.PutUint32(key, uint32(b.key))
+	binary.LittleEndian.PutUint64(key, uint64(b.key))
 
 	switch b.typ {
 	case InternalTable:
@@ -645,11 +2125,18 @@ func (b *BTreeCell) Bytes() ([]byte, error) {
 		if _, err := buffer.Write(b.fields.tableLeaf.data); err != nil {
 			return nil, err
 		}
+		if b.fields.tableLeaf.overflowPage != 0 {
+			overflowPage := make([]byte, unsafe.Sizeof(b.fields.tableLeaf.overflowPage))
+			binary.LittleEndian.PutUint32(overflowPage, b.fields.tableLeaf.overflowPage)
+			if _, err := buffer.Write(overflowPage); err != nil {
+				return nil, err
+			}
+		}
 	case InternalIndex:
 		childPage := make([]byte, unsafe.Sizeof(b.fields.indexInternal.childPage))
 		keyPk := make([]byte, unsafe.Sizeof(b.fields.indexInternal.keyPk))
 		binary.LittleEndian.PutUint32(childPage, b.fields.indexInternal.childPage)
-		binary.LittleEndian.PutUint32(keyPk, b.fields.indexInternal.keyPk)
+		binary.LittleEndian.PutUint64(keyPk, b.fields.indexInternal.keyPk)
 		buffer.Grow(len(childPage) + len(key) + len(keyPk))
 		if _, err := buffer.Write(childPage); err != nil {
 			return nil, err
@@ -662,7 +2149,7 @@ func (b *BTreeCell) Bytes() ([]byte, error) {
 		}
 	case LeafIndex:
 		keyPk := make([]byte, unsafe.Sizeof(b.fields.indexLeaf.keyPk))
-		binary.LittleEndian.PutUint32(keyPk, b.fields.indexLeaf.keyPk)
+		binary.LittleEndian.PutUint64(keyPk, b.fields.indexLeaf.keyPk)
 		buffer.Grow(len(key) + len(keyPk))
 		if _, err := buffer.Write(key); err != nil {
 			return nil, err
@@ -671,7 +2158,7 @@ func (b *BTreeCell) Bytes() ([]byte, error) {
 			return nil, err
 		}
 	default:
-		return nil, fmt.Errorf("invalid cell type %d", b.typ)
+		return nil, fmt.Errorf("%w: cell type %d", ErrInvalidNodeType, b.typ)
 	}
 
 	return buffer.Bytes(), nil
@@ -681,7 +2168,7 @@ type BTreeHeader struct {
 	// Magic bytes of binary file
 	magicBytes []byte
 
-	// Size of database page
+	// Size of database page. Initialized to PageSize on new files
 	pageSize uint16
 
 	// Initialized to 0. Each time a modification is made to the database, this counter is increased.
@@ -695,6 +2182,23 @@ type BTreeHeader struct {
 
 	// Available to the user for read-write access. Initialized to 0
 	userCookie uint32
+
+	// Wall-clock time of the last write in nanoseconds since the Unix epoch.
+	// Initialized to 0, which means the database was never modified.
+	lastModified uint64
+
+	// Magic bytes identifying a chidb file. Initialized to ChidbMagicBytes
+	chidbMagicBytes []byte
+
+	// First page of the free page list. Initialized to 0, which means there
+	// are no free pages.
+	firstFreePage uint32
+
+	// Version of the file format. Initialized to FormatVersion
+	formatVersion uint8
+
+	// Features of the file, such as HeaderFlagChecksums. Initialized to 0
+	flags uint8
 }
 
 func DefaultBTreeHeader() BTreeHeader {
@@ -705,12 +2209,26 @@ func DefaultBTreeHeader() BTreeHeader {
 		fileChangeCounter: 0,
 		schemaVersion:     0,
 		userCookie:        0,
+		lastModified:      0,
+		chidbMagicBytes:   ChidbMagicBytes,
+		firstFreePage:     0,
+		formatVersion:     FormatVersion,
+		flags:             0,
 	}
 }
 
+// NewBtreeHeader parses the file header on the first HeaderSize bytes of b
+//
+// Returns ErrCorruptHeader if b is shorter than the header.
 func NewBtreeHeader(b []byte) (*BTreeHeader, error) {
 	var header BTreeHeader
 
+	// A header cut short, e.g. by a write interrupted while the file was
+	// created, must not be read as zeros
+	if len(b) < HeaderSize {
+		return nil, fmt.Errorf("%w: header has %d bytes, expected %d", ErrCorruptHeader, len(b), HeaderSize)
+	}
+
 	buffer := bytes.NewReader(b)
 
 	magicBytes := make([]byte, len(MagicBytes))
@@ -719,25 +2237,45 @@ func NewBtreeHeader(b []byte) (*BTreeHeader, error) {
 	schemaVersion := make([]byte, unsafe.Sizeof(header.schemaVersion))
 	pageCacheSize := make([]byte, unsafe.Sizeof(header.pageCacheSize))
 	userCookie := make([]byte, unsafe.Sizeof(header.userCookie))
+	lastModified := make([]byte, unsafe.Sizeof(header.lastModified))
+	chidbMagicBytes := make([]byte, len(ChidbMagicBytes))
+	firstFreePage := make([]byte, unsafe.Sizeof(header.firstFreePage))
 
-	if _, err := buffer.Read(magicBytes); err != nil {
-		return nil, err
+	if _, err := io.ReadFull(buffer, magicBytes); err != nil {
+		return nil, fmt.Errorf("%w: %v", ErrCorruptHeader, err)
 	}
 
-	if _, err := buffer.Read(pageSize); err != nil {
-		return nil, err
+	if _, err := io.ReadFull(buffer, pageSize); err != nil {
+		return nil, fmt.Errorf("%w: %v", ErrCorruptHeader, err)
 	}
-	if _, err := buffer.Read(fileChangeCounter); err != nil {
-		return nil, err
+	if _, err := io.ReadFull(buffer, fileChangeCounter); err != nil {
+		return nil, fmt.Errorf("%w: %v", ErrCorruptHeader, err)
 	}
-	if _, err := buffer.Read(schemaVersion); err != nil {
-		return nil, err
+	if _, err := io.ReadFull(buffer, schemaVersion); err != nil {
+		return nil, fmt.Errorf("%w: %v", ErrCorruptHeader, err)
 	}
-	if _, err := buffer.Read(pageCacheSize); err != nil {
-		return nil, err
+	if _, err := io.ReadFull(buffer, pageCacheSize); err != nil {
+		return nil, fmt.Errorf("%w: %v", ErrCorruptHeader, err)
 	}
-	if _, err := buffer.Read(userCookie); err != nil {
-		return nil, err
+	if _, err := io.ReadFull(buffer, userCookie); err != nil {
+		return nil, fmt.Errorf("%w: %v", ErrCorruptHeader, err)
+	}
+	if _, err := io.ReadFull(buffer, lastModified); err != nil {
+		return nil, fmt.Errorf("%w: %v", ErrCorruptHeader, err)
+	}
+	if _, err := io.ReadFull(buffer, chidbMagicBytes); err != nil {
+		return nil, fmt.Errorf("%w: %v", ErrCorruptHeader, err)
+	}
+	if _, err := io.ReadFull(buffer, firstFreePage); err != nil {
+		return nil, fmt.Errorf("%w: %v", ErrCorruptHeader, err)
+	}
+	formatVersion, err := buffer.ReadByte()
+	if err != nil {
+		return nil, fmt.Errorf("%w: %v", ErrCorruptHeader, err)
+	}
+	flags, err := buffer.ReadByte()
+	if err != nil {
+		return nil, fmt.Errorf("%w: %v", ErrCorruptHeader, err)
 	}
 
 	header.magicBytes = magicBytes
@@ -746,6 +2284,11 @@ func NewBtreeHeader(b []byte) (*BTreeHeader, error) {
 	header.schemaVersion = binary.LittleEndian.Uint32(schemaVersion)
 	header.pageCacheSize = binary.LittleEndian.Uint32(pageCacheSize)
 	header.userCookie = binary.LittleEndian.Uint32(userCookie)
+	header.lastModified = binary.LittleEndian.Uint64(lastModified)
+	header.chidbMagicBytes = chidbMagicBytes
+	header.firstFreePage = binary.LittleEndian.Uint32(firstFreePage)
+	header.formatVersion = formatVersion
+	header.flags = flags
 
 	return &header, nil
 }
@@ -759,12 +2302,16 @@ func (b *BTreeHeader) Bytes() ([]byte, error) {
 	schemaVersion := make([]byte, unsafe.Sizeof(b.schemaVersion))
 	pageCacheSize := make([]byte, unsafe.Sizeof(b.pageCacheSize))
 	userCookie := make([]byte, unsafe.Sizeof(b.userCookie))
+	lastModified := make([]byte, unsafe.Sizeof(b.lastModified))
+	firstFreePage := make([]byte, unsafe.Sizeof(b.firstFreePage))
 
 	binary.LittleEndian.PutUint16(pageSize, b.pageSize)
 	binary.LittleEndian.PutUint32(fileChangeCounter, b.fileChangeCounter)
 	binary.LittleEndian.PutUint32(schemaVersion, b.schemaVersion)
 	binary.LittleEndian.PutUint32(pageCacheSize, b.pageCacheSize)
 	binary.LittleEndian.PutUint32(userCookie, b.userCookie)
+	binary.LittleEndian.PutUint64(lastModified, b.lastModified)
+	binary.LittleEndian.PutUint32(firstFreePage, b.firstFreePage)
 
 	if _, err := buffer.Write(b.magicBytes); err != nil {
 		return nil, err
@@ -790,6 +2337,26 @@ func (b *BTreeHeader) Bytes() ([]byte, error) {
 		return nil, err
 	}
 
+	if _, err := buffer.Write(lastModified); err != nil {
+		return nil, err
+	}
+
+	if _, err := buffer.Write(b.chidbMagicBytes); err != nil {
+		return nil, err
+	}
+
+	if _, err := buffer.Write(firstFreePage); err != nil {
+		return nil, err
+	}
+
+	if err := buffer.WriteByte(b.formatVersion); err != nil {
+		return nil, err
+	}
+
+	if err := buffer.WriteByte(b.flags); err != nil {
+		return nil, err
+	}
+
 	if _, err := buffer.Write(make([]byte, HeaderSize-buffer.Len())); err != nil {
 		return nil, err
 	}
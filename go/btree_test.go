@@ -1,7 +1,13 @@
 package chidb
 
 import (
+	"context"
+	"errors"
+	"fmt"
+	"math"
 	"os"
+	"path/filepath"
+	"strings"
 	"testing"
 
 	"github.com/stretchr/testify/assert"
@@ -33,40 +39,57 @@ func TestInsertInternalIndexCellGetCell(t *testing.T) {
 	assert.Equal(t, cell.fields.indexInternal.keyPk, insertedCell.fields.indexInternal.keyPk, "Expected equal key pk after write and get")
 }
 
-func TestInsertLeafIndexCellGetCell(t *testing.T) {
+func TestInsertInternalIndexCellWriteNode(t *testing.T) {
 	btree := openBtree(t)
 
-	node, err := btree.NewNode(LeafIndex)
+	node, err := btree.NewNode(InternalIndex)
 	require.Nil(t, err, "Expected nil errro to create new node")
 
+	tableCell := BTreeCell{
+		typ: InternalTable,
+		key: 1,
+	}
+	tableCell.fields.tableInternal.childPage = 1
+
+	err = node.InsertCell(1, &tableCell)
+	assert.NotNil(t, err, "Expected error to insert table cell into index node")
+
 	cell := BTreeCell{
 		typ: node.typ,
 		key: 1,
 	}
-	cell.fields.indexLeaf.keyPk = 10
+	cell.fields.indexInternal.childPage = 1
+	cell.fields.indexInternal.keyPk = 20
 
 	err = node.InsertCell(1, &cell)
 	require.Nil(t, err, "Expected nil error to insert cell")
 
-	insertedCell, err := node.GetCell(1)
-	require.Nil(t, err, "Expected nil error to get cell after write")
+	require.Nil(t, btree.WriteNode(node), "Expected nil error to write node")
 
-	assert.Equal(t, cell.typ, insertedCell.typ, "Expected equal types after write and get")
-	assert.Equal(t, cell.key, insertedCell.key, "Expected equal keys after write and get")
-	assert.Equal(t, cell.fields.indexLeaf.keyPk, insertedCell.fields.indexLeaf.keyPk, "Expected equal key pk after write and get")
+	readNode, err := btree.GetNodeByPage(node.page.number)
+	require.Nil(t, err, "Expected nil error to read node after write")
+	assert.Equal(t, uint16(1), readNode.nCells, "Expected only the index cell to be inserted")
+
+	insertedCell, err := readNode.GetCell(1)
+	require.Nil(t, err, "Expected nil error to get cell after write node")
+
+	assert.Equal(t, cell.typ, insertedCell.typ, "Expected equal types after write node")
+	assert.Equal(t, cell.key, insertedCell.key, "Expected equal keys after write node")
+	assert.Equal(t, cell.fields.indexInternal.childPage, insertedCell.fields.indexInternal.childPage, "Expected equal child page after write node")
+	assert.Equal(t, cell.fields.indexInternal.keyPk, insertedCell.fields.indexInternal.keyPk, "Expected equal key pk after write node")
 }
 
-func TestInsertInternalTableCellGetCell(t *testing.T) {
+func TestInsertLeafIndexCellGetCell(t *testing.T) {
 	btree := openBtree(t)
 
-	node, err := btree.NewNode(InternalTable)
+	node, err := btree.NewNode(LeafIndex)
 	require.Nil(t, err, "Expected nil errro to create new node")
 
 	cell := BTreeCell{
 		typ: node.typ,
 		key: 1,
 	}
-	cell.fields.tableInternal.childPage = 2
+	cell.fields.indexLeaf.keyPk = 10
 
 	err = node.InsertCell(1, &cell)
 	require.Nil(t, err, "Expected nil error to insert cell")
@@ -76,168 +99,1875 @@ func TestInsertInternalTableCellGetCell(t *testing.T) {
 
 	assert.Equal(t, cell.typ, insertedCell.typ, "Expected equal types after write and get")
 	assert.Equal(t, cell.key, insertedCell.key, "Expected equal keys after write and get")
-	assert.Equal(t, cell.fields.tableInternal.childPage, insertedCell.fields.tableInternal.childPage, "Expected equal child page after write and get")
+	assert.Equal(t, cell.fields.indexLeaf.keyPk, insertedCell.fields.indexLeaf.keyPk, "Expected equal key pk after write and get")
 }
 
-func TestInsertLeafTableCellGetCell(t *testing.T) {
+func TestInsertCellFreeOffset(t *testing.T) {
 	btree := openBtree(t)
 
 	node, err := btree.NewNode(LeafTable)
-	require.Nil(t, err, "Expected nil errro to create new node")
+	require.Nil(t, err, "Expected nil error to create new node")
 
-	cell := BTreeCell{
-		typ: node.typ,
-		key: 1,
+	// Insert at the front so every insert shifts the whole offset array
+	for k := 1; k <= 10; k++ {
+		cell := NewLeafTableCell(ChidbKey(100-k), []byte("data"))
+		require.Nil(t, node.InsertCell(1, cell), "Expected nil error to insert cell %d", k)
+
+		assert.Equal(t, uint16(PageHeaderSize+1+2*k), node.freeOffset, "Expected free offset to grow 2 bytes on insert %d", k)
 	}
-	cell.fields.tableLeaf.data = []byte("Hello World")
-	cell.fields.tableLeaf.size = uint32(len(cell.fields.tableLeaf.data))
+}
 
-	err = node.InsertCell(1, &cell)
-	require.Nil(t, err, "Expected nil error to insert cell")
+func TestRemoveCell(t *testing.T) {
+	btree := openBtree(t)
 
-	insertedCell, err := node.GetCell(1)
-	require.Nil(t, err, "Expected nil error to get cell after write")
+	node, err := btree.NewNode(LeafTable)
+	require.Nil(t, err, "Expected nil error to create new node")
+	insertLeafTableCells(t, btree, node, 1, 2, 3)
 
-	assert.Equal(t, cell.typ, insertedCell.typ, "Expected equal types after write and get")
-	assert.Equal(t, cell.key, insertedCell.key, "Expected equal keys after write and get")
-	assert.Equal(t, cell.fields.tableLeaf.size, insertedCell.fields.tableLeaf.size, "Expected equal size after write and get")
-	assert.Equal(t, cell.fields.tableLeaf.data, insertedCell.fields.tableLeaf.data, "Expected equal data after write and get")
+	require.Nil(t, node.RemoveCell(2), "Expected nil error to remove middle cell")
+	require.Nil(t, btree.WriteNode(node))
+
+	node, err = btree.GetNodeByPage(node.page.number)
+	require.Nil(t, err, "Expected nil error to read node after remove")
+	assert.Equal(t, uint16(2), node.nCells)
+	assert.Equal(t, uint16(PageHeaderSize+1+2*2), node.freeOffset)
+
+	for nCell, key := range []ChidbKey{1, 3} {
+		cell, err := node.GetCell(uint16(nCell + 1))
+		require.Nil(t, err, "Expected nil error to get cell %d after remove", nCell+1)
+		assert.Equal(t, key, cell.key)
+		assert.Equal(t, []byte(fmt.Sprintf("data %d", key)), cell.fields.tableLeaf.data)
+	}
 
+	for _, nCell := range []uint16{0, 3} {
+		assert.NotNil(t, node.RemoveCell(nCell), "Expected error to remove invalid cell %d", nCell)
+	}
 }
 
-func TestWriteNode(t *testing.T) {
+func TestDefragment(t *testing.T) {
 	btree := openBtree(t)
 
-	node, err := btree.NewNode(InternalTable)
-	require.Nil(t, err, "Expected nil errro to create new node")
+	node, err := btree.NewNode(LeafTable)
+	require.Nil(t, err, "Expected nil error to create new node")
 
-	node.freeOffset++
-	node.nCells++
-	node.cellsOffset++
-	node.rightPage++
-	node.cellOffsetArray++
+	// Fill the node with cells until no other one fits
+	for key := ChidbKey(1); ; key++ {
+		err := node.InsertCell(node.nCells+1, NewLeafTableCell(key, make([]byte, 1000)))
+		if errors.Is(err, ErrNodeFull) {
+			break
+		}
+		require.Nil(t, err, "Expected nil error to insert cell %d", key)
+	}
+	nCells := node.nCells
 
-	err = btree.WriteNode(node)
-	require.Nil(t, err, "Expected nil error to write node")
+	// Removed cells are left as dead space on the cell area
+	for _, nCell := range []uint16{8, 5, 2} {
+		require.Nil(t, node.RemoveCell(nCell), "Expected nil error to remove cell %d", nCell)
+	}
+	cellsOffset := node.cellsOffset
 
-	updatedNode, err := btree.GetNodeByPage(node.page.number)
-	require.Nil(t, err, "Expected nil error to get updated node")
+	require.Nil(t, node.Defragment(), "Expected nil error to defragment node")
+	assert.Equal(t, cellsOffset+3*1012, node.cellsOffset, "Expected space of removed cells to be reclaimed")
+	require.Nil(t, btree.WriteNode(node))
 
-	assert.Equal(t, node.typ, updatedNode.typ, "Expected equals type after write and read")
-	assert.Equal(t, node.freeOffset, updatedNode.freeOffset, "Expected equals free offset after write and read")
-	assert.Equal(t, node.nCells, updatedNode.nCells, "Expected equals number cells after write and read")
-	assert.Equal(t, node.cellsOffset, updatedNode.cellsOffset, "Expected equals cells offset after write and read")
-	assert.Equal(t, node.rightPage, updatedNode.rightPage, "Expected equals righ page after write and read")
-	assert.Equal(t, node.cellOffsetArray, updatedNode.cellOffsetArray, "Expected equals cell offset array after write and read")
+	node, err = btree.GetNodeByPage(node.page.number)
+	require.Nil(t, err, "Expected nil error to read node after defragment")
+
+	keys := make([]ChidbKey, 0)
+	for nCell := uint16(1); nCell <= node.nCells; nCell++ {
+		cell, err := node.GetCell(nCell)
+		require.Nil(t, err, "Expected nil error to get cell %d after defragment", nCell)
+		assert.Equal(t, 1000, len(cell.fields.tableLeaf.data))
+		keys = append(keys, cell.key)
+	}
+	assert.Equal(t, []ChidbKey{1, 3, 4, 6, 7, 9}, keys[:6], "Expected cells order to be kept")
+
+	// The reclaimed space is usable by new cells
+	for i := 0; i < 3; i++ {
+		err := node.InsertCell(node.nCells+1, NewLeafTableCell(ChidbKey(100+i), make([]byte, 1000)))
+		require.Nil(t, err, "Expected nil error to insert cell on reclaimed space")
+	}
+	assert.Equal(t, nCells, node.nCells)
 }
 
-func TestBTreeFirtNodePageLeafTable(t *testing.T) {
+func TestDefragmentRatio(t *testing.T) {
+	// churn inserts cells of 1000 bytes on a leaf root and deletes every
+	// other one, returning the dead space of the node read back after each
+	// delete
+	churn := func(t *testing.T, btree *BTree) []int {
+		root, err := btree.NewNode(LeafTable)
+		require.Nil(t, err)
+		for key := ChidbKey(1); key <= 12; key++ {
+			require.Nil(t, btree.Insert(root.page.number, NewLeafTableCell(key, make([]byte, 1000))))
+		}
+
+		fragmented := make([]int, 0)
+		for key := ChidbKey(1); key <= 12; key += 2 {
+			require.Nil(t, btree.Delete(root.page.number, key))
+
+			node, err := btree.GetNodeByPage(root.page.number)
+			require.Nil(t, err)
+			bytes, err := node.fragmentedBytes()
+			require.Nil(t, err)
+			fragmented = append(fragmented, bytes)
+		}
+		assert.Equal(t, []ChidbKey{2, 4, 6, 8, 10, 12}, cursorKeys(t, btree, root.page.number))
+		return fragmented
+	}
+
+	t.Run("disabled", func(t *testing.T) {
+		fragmented := churn(t, openBtree(t))
+		assert.Equal(t, 6*1012, fragmented[5], "Expected dead space of deleted cells kept by default")
+	})
+
+	t.Run("enabled", func(t *testing.T) {
+		btree := openBtree(t)
+		btree.DefragmentRatio = 0.25
+
+		fragmented := churn(t, btree)
+
+		// The fifth delete leaves more than a quarter of the page dead
+		assert.Equal(t, []int{1012, 2 * 1012, 3 * 1012, 4 * 1012, 0, 1012}, fragmented)
+		for _, bytes := range fragmented {
+			assert.LessOrEqual(t, bytes, PageSize/4)
+		}
+	})
+}
+
+func TestInsertCellDefragments(t *testing.T) {
 	btree := openBtree(t)
 
-	node, err := btree.GetNodeByPage(1)
-	require.Nil(t, err, "Expected nil error to get first node page")
+	node, err := btree.NewNode(LeafTable)
+	require.Nil(t, err, "Expected nil error to create new node")
 
-	assert.Equal(t, LeafTable, node.Type())
+	for key := ChidbKey(1); ; key++ {
+		err := node.InsertCell(node.nCells+1, NewLeafTableCell(key, make([]byte, 1000)))
+		if errors.Is(err, ErrNodeFull) {
+			break
+		}
+		require.Nil(t, err, "Expected nil error to insert cell %d", key)
+	}
+
+	require.Nil(t, node.RemoveCell(1))
+	require.Nil(t, node.RemoveCell(1))
+
+	// The cell only fits on the space of the removed cells
+	cell := NewLeafTableCell(100, make([]byte, 2000))
+	hasSpace, err := node.HasSpaceFor(cell)
+	require.Nil(t, err)
+	require.False(t, hasSpace, "Expected no space for cell before defragment")
+
+	require.Nil(t, node.InsertCell(1, cell), "Expected InsertCell to defragment the node")
+
+	inserted, err := node.GetCell(1)
+	require.Nil(t, err)
+	assert.Equal(t, ChidbKey(100), inserted.key)
+
+	// The cells moved by the defragment are still found
+	for nCell := uint16(2); nCell <= node.nCells; nCell++ {
+		cell, err := node.GetCell(nCell)
+		require.Nil(t, err)
+		assert.Equal(t, ChidbKey(nCell+1), cell.key, "Expected key of cell %d after defragment", nCell)
+	}
+	assert.Nil(t, btree.WriteNode(node))
 }
 
-func TestWriteFirstNodeNotOverrideFileHeader(t *testing.T) {
+func TestUpdateCellInPlace(t *testing.T) {
 	btree := openBtree(t)
 
-	headerBeforeWrite, err := btree.ReadHeader()
-	require.Nil(t, err, "Expected nil error to read header before write node")
+	node, err := btree.NewNode(LeafTable)
+	require.Nil(t, err)
+	for key := ChidbKey(1); key <= 3; key++ {
+		require.Nil(t, node.InsertCell(uint16(key), NewLeafTableCell(key, []byte("data"))))
+	}
+	offsets := node.cellOffsets()
+	cellsOffset := node.cellsOffset
 
-	node, err := btree.GetNodeByPage(1)
-	require.Nil(t, err, "Expected nil error to get first node page")
+	require.Nil(t, node.UpdateCell(2, NewLeafTableCell(2, []byte("DATA"))), "Expected nil error to update cell with same size")
+	require.Nil(t, node.UpdateCell(3, NewLeafTableCell(3, []byte("d"))), "Expected nil error to update cell with smaller size")
 
-	node.freeOffset++
+	assert.Equal(t, offsets, node.cellOffsets(), "Expected cells to be updated in place")
+	assert.Equal(t, cellsOffset, node.cellsOffset)
 
-	err = btree.WriteNode(node)
-	require.Nil(t, err, "Expected nil error to write first node page")
+	require.Nil(t, btree.WriteNode(node))
+	node, err = btree.GetNodeByPage(node.page.number)
+	require.Nil(t, err)
 
-	updatedNode, err := btree.GetNodeByPage(node.page.number)
-	require.Nil(t, err, "Expected nil error to get first node page after write")
+	for nCell, data := range []string{"data", "DATA", "d"} {
+		cell, err := node.GetCell(uint16(nCell + 1))
+		require.Nil(t, err)
+		assert.Equal(t, ChidbKey(nCell+1), cell.key)
+		assert.Equal(t, []byte(data), cell.fields.tableLeaf.data)
+	}
+}
 
-	headerAfterWrite, err := btree.ReadHeader()
-	require.Nil(t, err, "Expected nil error to read header after write node")
+func TestUpdateCellLarger(t *testing.T) {
+	btree := openBtree(t)
 
-	// Assert that value is correct readed after header
-	assert.Equal(t, node.freeOffset, updatedNode.freeOffset)
+	node, err := btree.NewNode(LeafTable)
+	require.Nil(t, err)
+	for key := ChidbKey(1); key <= 3; key++ {
+		require.Nil(t, node.InsertCell(uint16(key), NewLeafTableCell(key, []byte("data"))))
+	}
+	offsets := node.cellOffsets()
+	cellsOffset := node.cellsOffset
 
-	// Assert that header is equal before and after write first node
-	assert.Equal(t, headerBeforeWrite, headerAfterWrite, "Expected equal headers before and after write first node")
+	require.Nil(t, node.UpdateCell(2, NewLeafTableCell(2, []byte("larger data"))), "Expected nil error to update cell with larger size")
+
+	assert.Equal(t, uint16(3), node.nCells)
+	assert.Equal(t, cellsOffset-leafTableCellHeaderSize-11, node.cellsOffset, "Expected cell to be written at the top of the cell area")
+	assert.Equal(t, []uint16{offsets[0], node.cellsOffset, offsets[2]}, node.cellOffsets(), "Expected offset of the cell to be repointed")
+
+	cell, err := node.GetCell(2)
+	require.Nil(t, err)
+	assert.Equal(t, []byte("larger data"), cell.fields.tableLeaf.data)
+
+	// The dead space left by the old cell is reclaimed
+	require.Nil(t, node.Defragment())
+	assert.Equal(t, uint16(node.page.Len()-3*leafTableCellHeaderSize-4-4-11), node.cellsOffset)
 }
 
-func TestCreateNewNode(t *testing.T) {
+func TestUpdateCellDefragments(t *testing.T) {
 	btree := openBtree(t)
 
-	node, err := btree.NewNode(InternalTable)
-	require.Nil(t, err, "Expected nil error to create new node")
+	node, err := btree.NewNode(LeafTable)
+	require.Nil(t, err)
+	for key := ChidbKey(1); ; key++ {
+		err := node.InsertCell(node.nCells+1, NewLeafTableCell(key, make([]byte, 1000)))
+		if errors.Is(err, ErrNodeFull) {
+			break
+		}
+		require.Nil(t, err)
+	}
+	require.Nil(t, node.RemoveCell(1))
 
-	assert.Equal(t, uint32(2), node.page.number, "Expected equal page number")
-	assert.Equal(t, InternalTable, node.typ, "Expected equal node type")
-	assert.Equal(t, PageHeaderSize+uint16(1), node.freeOffset, "Expected equal free offset")
-	assert.Equal(t, uint16(0), node.nCells, "Expected equal number cells")
-	assert.Equal(t, uint16(PageSize), node.cellsOffset, "Expected equal cells offset")
-	assert.Equal(t, uint16(0), node.rightPage, "Expected equal right page")
-	assert.Equal(t, byte(PageHeaderSize+1), node.cellOffsetArray, "Expected equal cell offset array")
+	// The new cell only fits on the space of the removed one
+	require.Nil(t, node.UpdateCell(1, NewLeafTableCell(2, make([]byte, 1100))), "Expected UpdateCell to defragment the node")
 
-	newNode, err := btree.GetNodeByPage(node.page.number)
-	require.Nil(t, err, "Expected nil error to get new node created")
+	cell, err := node.GetCell(1)
+	require.Nil(t, err)
+	assert.Equal(t, ChidbKey(2), cell.key)
+	assert.Equal(t, 1100, len(cell.fields.tableLeaf.data))
 
-	assert.Equal(t, node.page.number, newNode.page.number, "Expected equal page number after read from disk")
-	assert.Equal(t, node.typ, newNode.typ, "Expected equal node type after read from disk")
-	assert.Equal(t, node.freeOffset, newNode.freeOffset, "Expected equal free offset after read from disk")
-	assert.Equal(t, node.nCells, newNode.nCells, "Expected equal number cell after read from disks")
-	assert.Equal(t, node.cellsOffset, newNode.cellsOffset, "Expected equal cells offse after read from diskt")
-	assert.Equal(t, node.rightPage, newNode.rightPage, "Expected equal right page after read from disk")
-	assert.Equal(t, node.cellOffsetArray, newNode.cellOffsetArray, "Expected equal cell offset array after read from disk")
+	err = node.UpdateCell(1, NewLeafTableCell(2, make([]byte, 3000)))
+	assert.True(t, errors.Is(err, ErrNodeFull), "Expected node full error, got %v", err)
+}
+
+func TestUpdateCellOverflow(t *testing.T) {
+	btree := openBtree(t)
+
+	node, err := btree.NewNode(LeafTable)
+	require.Nil(t, err)
+
+	data := randomBytes(3 * int(btree.pager.PageSize()))
+	require.Nil(t, node.InsertCell(1, NewLeafTableCell(1, data)))
+	totalPages := btree.pager.totalPages
+
+	require.Nil(t, node.UpdateCell(1, NewLeafTableCell(1, []byte("small"))))
+	free, err := btree.pager.freePages()
+	require.Nil(t, err)
+	assert.Equal(t, 3, len(free), "Expected overflow pages of the old cell to be released")
+
+	require.Nil(t, node.UpdateCell(1, NewLeafTableCell(1, data)))
+	assert.Equal(t, totalPages, btree.pager.totalPages, "Expected released overflow pages to be reused")
 
+	cell, err := node.GetCell(1)
+	require.Nil(t, err)
+	assert.Equal(t, data, cell.fields.tableLeaf.data)
 }
 
-func TestBTreeOpen(t *testing.T) {
-	invalidDb, err := os.CreateTemp(os.TempDir(), t.Name())
+func TestUpdateCellErrors(t *testing.T) {
+	btree := openBtree(t)
+
+	node, err := btree.NewNode(LeafTable)
 	require.Nil(t, err)
-	_, err = invalidDb.WriteString("Invalid Header")
+	require.Nil(t, node.InsertCell(1, NewLeafTableCell(1, []byte("data"))))
+
+	assert.NotNil(t, node.UpdateCell(1, NewLeafTableCell(2, []byte("data"))), "Expected error to update cell with other key")
+	assert.NotNil(t, node.UpdateCell(2, NewLeafTableCell(2, []byte("data"))), "Expected error to update missing cell")
+	assert.NotNil(t, node.UpdateCell(1, &BTreeCell{typ: LeafIndex, key: 1}), "Expected error to update cell with other type")
+}
+
+func TestCellErrors(t *testing.T) {
+	btree := openBtree(t)
+
+	node, err := btree.NewNode(LeafTable)
 	require.Nil(t, err)
+	insertLeafTableCells(t, btree, node, 1, 2, 3)
 
-	db, err := os.CreateTemp(os.TempDir(), t.Name())
+	_, err = node.GetCell(4)
+	assert.True(t, errors.Is(err, ErrCellNotFound), "Expected cell not found error to get cell, got %v", err)
+
+	err = node.RemoveCell(4)
+	assert.True(t, errors.Is(err, ErrCellNotFound), "Expected cell not found error to remove cell, got %v", err)
+
+	err = node.UpdateCell(4, NewLeafTableCell(4, []byte("data")))
+	assert.True(t, errors.Is(err, ErrCellNotFound), "Expected cell not found error to update cell, got %v", err)
+
+	for _, nCell := range []uint16{2, 3} {
+		err = node.InsertCell(nCell, NewLeafTableCell(2, []byte("data")))
+		assert.True(t, errors.Is(err, ErrCellExists), "Expected cell exists error to insert at %d, got %v", nCell, err)
+	}
+	assert.Equal(t, uint16(3), node.nCells, "Expected rejected cells to leave the node unchanged")
+
+	_, err = BTreeNodeTypeFromByte(0xff)
+	assert.True(t, errors.Is(err, ErrInvalidNodeType), "Expected invalid node type error, got %v", err)
+
+	err = btree.Insert(1, NewLeafTableCell(1, []byte("data")))
 	require.Nil(t, err)
+	err = btree.Insert(1, NewLeafTableCell(1, []byte("data")))
+	assert.True(t, errors.Is(err, ErrDuplicateKey), "Expected duplicate key error, got %v", err)
+}
 
-	testcases := []struct {
-		name string
-		db   string
-		err  error
+func TestCellNodeTypeMismatch(t *testing.T) {
+	btree := openBtree(t)
+	types := []BTreeNodeType{InternalTable, LeafTable, InternalIndex, LeafIndex}
+
+	cells := map[BTreeNodeType]*BTreeCell{
+		InternalTable: {typ: InternalTable, key: 1},
+		LeafTable:     NewLeafTableCell(1, []byte("data")),
+		InternalIndex: {typ: InternalIndex, key: 1},
+		LeafIndex:     NewLeafIndexCell(1, 1),
+	}
+	cells[InternalTable].fields.tableInternal.childPage = 2
+	cells[InternalIndex].fields.indexInternal.childPage = 2
+
+	for _, nodeType := range types {
+		for _, cellType := range types {
+			if nodeType == cellType {
+				continue
+			}
+
+			node, err := btree.NewNode(nodeType)
+			require.Nil(t, err)
+
+			err = node.InsertCell(1, cells[cellType])
+			assert.True(t, errors.Is(err, ErrInvalidNodeType), "Expected invalid node type error to insert %s cell into %s node, got %v", cellType, nodeType, err)
+			assert.Equal(t, uint16(0), node.nCells)
+
+			require.Nil(t, node.InsertCell(1, cells[nodeType]))
+			err = node.UpdateCell(1, cells[cellType])
+			assert.True(t, errors.Is(err, ErrInvalidNodeType), "Expected invalid node type error to update %s node with %s cell, got %v", nodeType, cellType, err)
+		}
+	}
+}
+
+func TestInsertManyLeafIndexCellsGetCell(t *testing.T) {
+	btree := openBtree(t)
+
+	indexNode, err := btree.NewNode(LeafIndex)
+	require.Nil(t, err, "Expected nil errro to create new index node")
+
+	tableNode, err := btree.NewNode(LeafTable)
+	require.Nil(t, err, "Expected nil errro to create new table node")
+
+	cells := make([]BTreeCell, 0)
+	for i := uint16(1); i <= 5; i++ {
+		cell := BTreeCell{
+			typ: indexNode.typ,
+			key: ChidbKey(i * 10),
+		}
+		cell.fields.indexLeaf.keyPk = uint64(i * 100)
+		cells = append(cells, cell)
+
+		err = indexNode.InsertCell(i, &cell)
+		require.Nil(t, err, "Expected nil error to insert index cell %d", i)
+
+		// A table cell with 4 bytes of data has the same size of an index
+		// cell, so the node bookkeeping must be the same.
+		tableCell := BTreeCell{
+			typ: tableNode.typ,
+			key: cell.key,
+		}
+		tableCell.fields.tableLeaf.data = []byte("data")
+		tableCell.fields.tableLeaf.size = 4
+		err = tableNode.InsertCell(i, &tableCell)
+		require.Nil(t, err, "Expected nil error to insert table cell %d", i)
+
+		assert.Equal(t, tableNode.freeOffset, indexNode.freeOffset, "Expected equal free offset after insert %d", i)
+		assert.Equal(t, tableNode.cellsOffset, indexNode.cellsOffset, "Expected equal cells offset after insert %d", i)
+	}
+
+	require.Nil(t, btree.WriteNode(indexNode))
+
+	readNode, err := btree.GetNodeByPage(indexNode.page.number)
+	require.Nil(t, err, "Expected nil error to read index node")
+
+	for i, cell := range cells {
+		insertedCell, err := readNode.GetCell(uint16(i + 1))
+		require.Nil(t, err, "Expected nil error to get cell %d", i+1)
+
+		assert.Equal(t, cell.typ, insertedCell.typ, "Expected equal types of cell %d", i+1)
+		assert.Equal(t, cell.key, insertedCell.key, "Expected equal keys of cell %d", i+1)
+		assert.Equal(t, cell.fields.indexLeaf.keyPk, insertedCell.fields.indexLeaf.keyPk, "Expected equal key pk of cell %d", i+1)
+	}
+}
+
+func TestInsertCellAtPositions(t *testing.T) {
+	btree := openBtree(t)
+
+	node, err := btree.NewNode(LeafTable)
+	require.Nil(t, err, "Expected nil errro to create new node")
+
+	inserts := []struct {
+		nCell uint16
+		key   ChidbKey
 	}{
-		{
-			name: "TestOpenEmptyFile",
-			db:   db.Name(),
-			err:  nil,
-		},
-		{
-			name: "TestOpenFile",
-			db:   db.Name(),
-			err:  nil,
-		},
-		{
-			name: "TestOpenInvalidFile",
-			db:   invalidDb.Name(),
-			err:  ErrCorruptHeader,
-		},
+		{nCell: 1, key: 30},
+		{nCell: 1, key: 10},
+		{nCell: 3, key: 50},
+		{nCell: 2, key: 20},
+		{nCell: 4, key: 40},
 	}
 
-	for _, tt := range testcases {
-		t.Run(tt.name, func(t *testing.T) {
-			_, err := Open(tt.db)
-			assert.Equal(t, tt.err, err)
-		})
+	for _, insert := range inserts {
+		cell := BTreeCell{
+			typ: node.typ,
+			key: insert.key,
+		}
+		cell.fields.tableLeaf.data = []byte(fmt.Sprintf("data %d", insert.key))
+		cell.fields.tableLeaf.size = uint32(len(cell.fields.tableLeaf.data))
+
+		err = node.InsertCell(insert.nCell, &cell)
+		require.Nil(t, err, "Expected nil error to insert key %d at cell %d", insert.key, insert.nCell)
+	}
+
+	require.Nil(t, btree.WriteNode(node))
+
+	readNode, err := btree.GetNodeByPage(node.page.number)
+	require.Nil(t, err, "Expected nil error to read node")
+	assert.Equal(t, uint16(5), readNode.nCells, "Expected five cells on node")
+
+	for i, key := range []ChidbKey{10, 20, 30, 40, 50} {
+		cell, err := readNode.GetCell(uint16(i + 1))
+		require.Nil(t, err, "Expected nil error to get cell %d", i+1)
+
+		assert.Equal(t, key, cell.key, "Expected key %d at cell %d", key, i+1)
+		assert.Equal(t, []byte(fmt.Sprintf("data %d", key)), cell.fields.tableLeaf.data, "Expected data of key %d at cell %d", key, i+1)
+	}
+
+	cell := BTreeCell{
+		typ: node.typ,
+		key: 60,
 	}
+	assert.NotNil(t, node.InsertCell(0, &cell), "Expected error to insert at cell 0")
+	assert.NotNil(t, node.InsertCell(7, &cell), "Expected error to insert past the end of cells")
+
+	_, err = readNode.GetCell(6)
+	assert.NotNil(t, err, "Expected error to get cell past the end of cells")
 }
 
-func openBtree(tb testing.TB) *BTree {
-	db, err := os.CreateTemp(os.TempDir(), tb.Name())
-	require.Nil(tb, err)
+func TestInsertInternalTableCellGetCell(t *testing.T) {
+	btree := openBtree(t)
 
-	btree, err := Open(db.Name())
-	require.Nil(tb, err)
-	return btree
+	node, err := btree.NewNode(InternalTable)
+	require.Nil(t, err, "Expected nil errro to create new node")
+
+	cell := BTreeCell{
+		typ: node.typ,
+		key: 1,
+	}
+	cell.fields.tableInternal.childPage = 2
+
+	err = node.InsertCell(1, &cell)
+	require.Nil(t, err, "Expected nil error to insert cell")
+
+	insertedCell, err := node.GetCell(1)
+	require.Nil(t, err, "Expected nil error to get cell after write")
+
+	assert.Equal(t, cell.typ, insertedCell.typ, "Expected equal types after write and get")
+	assert.Equal(t, cell.key, insertedCell.key, "Expected equal keys after write and get")
+	assert.Equal(t, cell.fields.tableInternal.childPage, insertedCell.fields.tableInternal.childPage, "Expected equal child page after write and get")
+}
+
+func TestInsertInternalTableCellWriteNode(t *testing.T) {
+	btree := openBtree(t)
+
+	node, err := btree.NewNode(InternalTable)
+	require.Nil(t, err, "Expected nil errro to create new node")
+
+	cell := BTreeCell{
+		typ: node.typ,
+		key: 42,
+	}
+	cell.fields.tableInternal.childPage = 1
+
+	err = node.InsertCell(1, &cell)
+	require.Nil(t, err, "Expected nil error to insert cell")
+
+	err = btree.WriteNode(node)
+	require.Nil(t, err, "Expected nil error to write node")
+
+	readNode, err := btree.GetNodeByPage(node.page.number)
+	require.Nil(t, err, "Expected nil error to read node after write")
+
+	insertedCell, err := readNode.GetCell(1)
+	require.Nil(t, err, "Expected nil error to get cell after write node")
+
+	assert.Equal(t, InternalTable, insertedCell.typ, "Expected internal table cell after write node")
+	assert.Equal(t, cell.key, insertedCell.key, "Expected equal keys after write node")
+	assert.Equal(t, cell.fields.tableInternal.childPage, insertedCell.fields.tableInternal.childPage, "Expected equal child page after write node")
+}
+
+func TestInsertLeafTableCellGetCell(t *testing.T) {
+	btree := openBtree(t)
+
+	node, err := btree.NewNode(LeafTable)
+	require.Nil(t, err, "Expected nil errro to create new node")
+
+	cell := BTreeCell{
+		typ: node.typ,
+		key: 1,
+	}
+	cell.fields.tableLeaf.data = []byte("Hello World")
+	cell.fields.tableLeaf.size = uint32(len(cell.fields.tableLeaf.data))
+
+	err = node.InsertCell(1, &cell)
+	require.Nil(t, err, "Expected nil error to insert cell")
+
+	insertedCell, err := node.GetCell(1)
+	require.Nil(t, err, "Expected nil error to get cell after write")
+
+	assert.Equal(t, cell.typ, insertedCell.typ, "Expected equal types after write and get")
+	assert.Equal(t, cell.key, insertedCell.key, "Expected equal keys after write and get")
+	assert.Equal(t, cell.fields.tableLeaf.size, insertedCell.fields.tableLeaf.size, "Expected equal size after write and get")
+	assert.Equal(t, cell.fields.tableLeaf.data, insertedCell.fields.tableLeaf.data, "Expected equal data after write and get")
+
+}
+
+func TestGetCellNodeTypeDrift(t *testing.T) {
+	btree := openBtree(t)
+
+	node, err := btree.NewNode(LeafIndex)
+	require.Nil(t, err, "Expected nil errro to create new node")
+
+	cell := BTreeCell{
+		typ: node.typ,
+		key: 1,
+	}
+	cell.fields.indexLeaf.keyPk = 10
+	require.Nil(t, node.InsertCell(1, &cell))
+
+	// Change the in-memory type without rewriting the page
+	node.typ = InternalIndex
+
+	_, err = node.GetCell(1)
+	assert.True(t, errors.Is(err, ErrNodeTypeDrift), "Expected node type drift error, got %v", err)
+}
+
+func TestInsertCellOffsetArrayCollision(t *testing.T) {
+	btree := openBtree(t)
+
+	cell := NewLeafTableCell(1, nil)
+	cellBytes, err := cell.Bytes()
+	require.Nil(t, err)
+
+	// fillNode inserts cells that leave free bytes of free space
+	fillNode := func(free int) *BTreeNode {
+		node, err := btree.NewNode(LeafTable)
+		require.Nil(t, err, "Expected nil error to create new node")
+
+		// Each filler cell takes 12 bytes of size and key plus 2 bytes of
+		// cell offset array besides its data, which must be small enough
+		// to be stored on the page.
+		avail := int(node.cellsOffset) - int(node.freeOffset) - free
+		max := maxLocal(PageSize) + 14
+		fillers := (avail + max - 1) / max
+		for i := 0; i < fillers; i++ {
+			size := avail/fillers - 14
+			if i < avail%fillers {
+				size++
+			}
+			cell := NewLeafTableCell(ChidbKey(i+2), make([]byte, size))
+			require.Nil(t, node.InsertCell(node.nCells+1, cell))
+		}
+		return node
+	}
+
+	// Leave room for the cell itself but not for its cell offset array entry
+	node := fillNode(len(cellBytes) + 1)
+
+	err = node.InsertCell(1, cell)
+	assert.True(t, errors.Is(err, ErrNodeFull), "Expected node full error, got %v", err)
+
+	// With room for the offset array entry the cell fits exactly
+	node = fillNode(len(cellBytes) + 2)
+
+	err = node.InsertCell(1, cell)
+	assert.Nil(t, err, "Expected nil error to insert cell that fits exactly")
+}
+
+func TestInsertCellUntilNodeFull(t *testing.T) {
+	btree := openBtree(t)
+
+	node, err := btree.NewNode(LeafTable)
+	require.Nil(t, err, "Expected nil error to create new node")
+
+	inserted := 0
+	for key := ChidbKey(1); ; key++ {
+		cell := NewLeafTableCell(key, make([]byte, 1000))
+
+		hasSpace, err := node.HasSpaceFor(cell)
+		require.Nil(t, err, "Expected nil error to check space for cell")
+
+		err = node.InsertCell(node.nCells+1, cell)
+		if !hasSpace {
+			assert.True(t, errors.Is(err, ErrNodeFull), "Expected node full error, got %v", err)
+			break
+		}
+		require.Nil(t, err, "Expected nil error to insert cell %d", key)
+		inserted++
+	}
+
+	// Each cell takes 1012 bytes plus 2 bytes of cell offset array
+	assert.Equal(t, (PageSize-PageHeaderSize-1)/1014, inserted)
+	assert.Equal(t, uint16(inserted), node.nCells, "Expected rejected cell to leave the node unchanged")
+
+	for nCell := uint16(1); nCell <= node.nCells; nCell++ {
+		cell, err := node.GetCell(nCell)
+		require.Nil(t, err, "Expected nil error to get cell %d", nCell)
+		assert.Equal(t, ChidbKey(nCell), cell.key)
+	}
+}
+
+func TestWriteNode(t *testing.T) {
+	btree := openBtree(t)
+
+	node, err := btree.NewNode(InternalTable)
+	require.Nil(t, err, "Expected nil errro to create new node")
+
+	node.freeOffset++
+	node.nCells++
+	node.cellsOffset++
+	node.rightPage = math.MaxUint16 + 10 // Right pages take 32 bits
+	node.cellOffsetArray++
+
+	err = btree.WriteNode(node)
+	require.Nil(t, err, "Expected nil error to write node")
+
+	updatedNode, err := btree.GetNodeByPage(node.page.number)
+	require.Nil(t, err, "Expected nil error to get updated node")
+
+	assert.Equal(t, node.typ, updatedNode.typ, "Expected equals type after write and read")
+	assert.Equal(t, node.freeOffset, updatedNode.freeOffset, "Expected equals free offset after write and read")
+	assert.Equal(t, node.nCells, updatedNode.nCells, "Expected equals number cells after write and read")
+	assert.Equal(t, node.cellsOffset, updatedNode.cellsOffset, "Expected equals cells offset after write and read")
+	assert.Equal(t, node.rightPage, updatedNode.rightPage, "Expected equals righ page after write and read")
+	assert.Equal(t, node.cellOffsetArray, updatedNode.cellOffsetArray, "Expected equals cell offset array after write and read")
+}
+
+func TestBTreeFirtNodePageLeafTable(t *testing.T) {
+	btree := openBtree(t)
+
+	node, err := btree.GetNodeByPage(1)
+	require.Nil(t, err, "Expected nil error to get first node page")
+
+	assert.Equal(t, LeafTable, node.Type())
+}
+
+func TestWriteFirstNodeNotOverrideFileHeader(t *testing.T) {
+	btree := openBtree(t)
+
+	headerBeforeWrite, err := btree.ReadHeader()
+	require.Nil(t, err, "Expected nil error to read header before write node")
+
+	node, err := btree.GetNodeByPage(1)
+	require.Nil(t, err, "Expected nil error to get first node page")
+
+	node.freeOffset++
+
+	err = btree.WriteNode(node)
+	require.Nil(t, err, "Expected nil error to write first node page")
+
+	updatedNode, err := btree.GetNodeByPage(node.page.number)
+	require.Nil(t, err, "Expected nil error to get first node page after write")
+
+	headerAfterWrite, err := btree.ReadHeader()
+	require.Nil(t, err, "Expected nil error to read header after write node")
+
+	// Assert that value is correct readed after header
+	assert.Equal(t, node.freeOffset, updatedNode.freeOffset)
+
+	// The last modification time and the file change counter are
+	// expected to change after a write
+	assert.Greater(t, headerAfterWrite.lastModified, headerBeforeWrite.lastModified)
+	headerAfterWrite.lastModified = headerBeforeWrite.lastModified
+	assert.Equal(t, headerBeforeWrite.fileChangeCounter+1, headerAfterWrite.fileChangeCounter)
+	headerAfterWrite.fileChangeCounter = headerBeforeWrite.fileChangeCounter
+
+	// Assert that header is equal before and after write first node
+	assert.Equal(t, headerBeforeWrite, headerAfterWrite, "Expected equal headers before and after write first node")
+}
+
+func TestCreateNewNode(t *testing.T) {
+	btree := openBtree(t)
+
+	node, err := btree.NewNode(InternalTable)
+	require.Nil(t, err, "Expected nil error to create new node")
+
+	assert.Equal(t, uint32(2), node.page.number, "Expected equal page number")
+	assert.Equal(t, InternalTable, node.typ, "Expected equal node type")
+	assert.Equal(t, PageHeaderSize+uint16(1), node.freeOffset, "Expected equal free offset")
+	assert.Equal(t, uint16(0), node.nCells, "Expected equal number cells")
+	assert.Equal(t, uint16(PageSize), node.cellsOffset, "Expected equal cells offset")
+	assert.Equal(t, uint32(0), node.rightPage, "Expected equal right page")
+	assert.Equal(t, byte(PageHeaderSize+1), node.cellOffsetArray, "Expected equal cell offset array")
+
+	newNode, err := btree.GetNodeByPage(node.page.number)
+	require.Nil(t, err, "Expected nil error to get new node created")
+
+	assert.Equal(t, node.page.number, newNode.page.number, "Expected equal page number after read from disk")
+	assert.Equal(t, node.typ, newNode.typ, "Expected equal node type after read from disk")
+	assert.Equal(t, node.freeOffset, newNode.freeOffset, "Expected equal free offset after read from disk")
+	assert.Equal(t, node.nCells, newNode.nCells, "Expected equal number cell after read from disks")
+	assert.Equal(t, node.cellsOffset, newNode.cellsOffset, "Expected equal cells offse after read from diskt")
+	assert.Equal(t, node.rightPage, newNode.rightPage, "Expected equal right page after read from disk")
+	assert.Equal(t, node.cellOffsetArray, newNode.cellOffsetArray, "Expected equal cell offset array after read from disk")
+
+}
+
+func TestInitEmptyNode(t *testing.T) {
+	btree := openBtree(t)
+
+	nPage, err := btree.pager.AllocatePage()
+	require.Nil(t, err, "Expected nil error to allocate page")
+
+	err = btree.InitEmptyNode(nPage, LeafIndex)
+	require.Nil(t, err, "Expected nil error to init empty node")
+
+	node, err := btree.GetNodeByPage(nPage)
+	require.Nil(t, err, "Expected nil error to get initialized node")
+
+	assert.Equal(t, LeafIndex, node.typ, "Expected equal node type")
+	assert.Equal(t, PageHeaderSize+uint16(1), node.freeOffset, "Expected equal free offset")
+	assert.Equal(t, uint16(0), node.nCells, "Expected equal number cells")
+	assert.Equal(t, uint16(PageSize), node.cellsOffset, "Expected equal cells offset")
+	assert.Equal(t, uint32(0), node.rightPage, "Expected equal right page")
+	assert.Equal(t, byte(PageHeaderSize+1), node.cellOffsetArray, "Expected equal cell offset array")
+
+	// Formatting a page again discards the previous node
+	err = btree.InitEmptyNode(1, InternalTable)
+	require.Nil(t, err, "Expected nil error to init empty node on page 1")
+
+	node, err = btree.GetNodeByPage(1)
+	require.Nil(t, err, "Expected nil error to get first node page")
+	assert.Equal(t, InternalTable, node.typ, "Expected equal node type on page 1")
+	assert.Equal(t, uint16(PageSize-HeaderSize), node.cellsOffset, "Expected cells offset after header on page 1")
+
+	err = btree.InitEmptyNode(nPage+1, LeafTable)
+	assert.Equal(t, ErrIncorrectPageNumber, err, "Expected error to init a page not allocated")
+}
+
+func TestBTreeOpen(t *testing.T) {
+	invalidDb, err := os.CreateTemp(os.TempDir(), t.Name())
+	require.Nil(t, err)
+	_, err = invalidDb.WriteString("Invalid Header")
+	require.Nil(t, err)
+
+	db, err := os.CreateTemp(os.TempDir(), t.Name())
+	require.Nil(t, err)
+
+	testcases := []struct {
+		name string
+		db   string
+		err  error
+	}{
+		{
+			name: "TestOpenEmptyFile",
+			db:   db.Name(),
+			err:  nil,
+		},
+		{
+			name: "TestOpenFile",
+			db:   db.Name(),
+			err:  nil,
+		},
+		{
+			name: "TestOpenInvalidFile",
+			db:   invalidDb.Name(),
+			err:  ErrCorruptHeader,
+		},
+	}
+
+	for _, tt := range testcases {
+		t.Run(tt.name, func(t *testing.T) {
+			_, err := Open(tt.db)
+			if tt.err == nil {
+				assert.Nil(t, err)
+				return
+			}
+			assert.True(t, errors.Is(err, tt.err), "Expected error %v, got %v", tt.err, err)
+		})
+	}
+}
+
+func TestNewBtreeHeaderShort(t *testing.T) {
+	defaultHeader := DefaultBTreeHeader()
+	header, err := defaultHeader.Bytes()
+	require.Nil(t, err)
+
+	for _, size := range []int{0, 1, 50, HeaderSize - 1} {
+		_, err := NewBtreeHeader(header[:size])
+		assert.True(t, errors.Is(err, ErrCorruptHeader), "Expected corrupt header error for %d bytes, got %v", size, err)
+	}
+
+	_, err = NewBtreeHeader(header)
+	assert.Nil(t, err)
+}
+
+func TestOpenTruncatedHeader(t *testing.T) {
+	defaultHeader := DefaultBTreeHeader()
+	header, err := defaultHeader.Bytes()
+	require.Nil(t, err)
+
+	filename := filepath.Join(t.TempDir(), "truncated.db")
+	require.Nil(t, os.WriteFile(filename, header[:50], 0644))
+
+	_, err = Open(filename)
+	assert.True(t, errors.Is(err, ErrCorruptHeader), "Expected corrupt header error, got %v", err)
+
+	_, err = OpenReadOnly(filename)
+	assert.True(t, errors.Is(err, ErrCorruptHeader), "Expected corrupt header error, got %v", err)
+}
+
+func TestBTreeRootPage(t *testing.T) {
+	btree := openBtree(t)
+	assert.Equal(t, uint32(1), btree.RootPage())
+
+	node, err := btree.GetNodeByPage(btree.RootPage())
+	require.Nil(t, err)
+	assert.Equal(t, LeafTable, node.typ, "Expected empty table leaf on root page of new database")
+	assert.Equal(t, uint16(0), node.nCells)
+}
+
+func TestBTreeUseAfterClose(t *testing.T) {
+	btree := openBtree(t)
+
+	node, err := btree.GetNodeByPage(1)
+	require.Nil(t, err, "Expected nil error to get first node page")
+
+	require.Nil(t, btree.Close(), "Expected nil error to close btree")
+	assert.Nil(t, btree.Close(), "Expected nil error to close btree twice")
+
+	_, err = btree.GetNodeByPage(1)
+	assert.Equal(t, ErrClosed, err, "Expected closed error to get node")
+
+	_, err = btree.NewNode(LeafTable)
+	assert.Equal(t, ErrClosed, err, "Expected closed error to create node")
+
+	err = btree.WriteNode(node)
+	assert.Equal(t, ErrClosed, err, "Expected closed error to write node")
+
+	_, err = btree.ReadHeader()
+	assert.Equal(t, ErrClosed, err, "Expected closed error to read header")
+}
+
+func TestBTreeSharedPager(t *testing.T) {
+	first := openBtree(t)
+
+	second, err := NewBTree(first.Pager())
+	require.Nil(t, err, "Expected nil error to create btree over shared pager")
+
+	firstNode, err := first.NewNode(LeafTable)
+	require.Nil(t, err, "Expected nil error to create node on first btree")
+
+	secondNode, err := second.NewNode(LeafIndex)
+	require.Nil(t, err, "Expected nil error to create node on second btree")
+
+	assert.Equal(t, uint32(2), firstNode.page.number, "Expected first btree to allocate page 2")
+	assert.Equal(t, uint32(3), secondNode.page.number, "Expected second btree to allocate page 3")
+
+	cell := BTreeCell{
+		typ: secondNode.typ,
+		key: 1,
+	}
+	cell.fields.indexLeaf.keyPk = 10
+	require.Nil(t, secondNode.InsertCell(1, &cell))
+	require.Nil(t, second.WriteNode(secondNode))
+
+	// Nodes written by one btree are visible through the other
+	node, err := first.GetNodeByPage(secondNode.page.number)
+	require.Nil(t, err, "Expected nil error to get node written by second btree")
+	insertedCell, err := node.GetCell(1)
+	require.Nil(t, err, "Expected nil error to get cell written by second btree")
+	assert.Equal(t, cell.key, insertedCell.key)
+	assert.Equal(t, cell.fields.indexLeaf.keyPk, insertedCell.fields.indexLeaf.keyPk)
+
+	// Closing a btree that doesn't own the pager keeps the other usable
+	require.Nil(t, second.Close())
+	_, err = first.GetNodeByPage(firstNode.page.number)
+	assert.Nil(t, err, "Expected nil error to get node after closing shared btree")
+}
+
+func TestReadNodeHeader(t *testing.T) {
+	btree := openBtree(t)
+
+	for _, nPage := range []uint32{1, 2} {
+		if nPage != 1 {
+			_, err := btree.NewNode(InternalTable)
+			require.Nil(t, err, "Expected nil error to create new node")
+		}
+
+		node, err := btree.GetNodeByPage(nPage)
+		require.Nil(t, err, "Expected nil error to get node page %d", nPage)
+
+		cell := BTreeCell{
+			typ: node.typ,
+			key: 1,
+		}
+		cell.fields.tableLeaf.data = []byte("Hello World")
+		cell.fields.tableLeaf.size = uint32(len(cell.fields.tableLeaf.data))
+		cell.fields.tableInternal.childPage = 1
+		require.Nil(t, node.InsertCell(1, &cell))
+		node.rightPage = math.MaxUint16 + 7
+		require.Nil(t, btree.WriteNode(node))
+
+		typ, nCells, rightPage, err := btree.ReadNodeHeader(nPage)
+		require.Nil(t, err, "Expected nil error to read node header of page %d", nPage)
+
+		assert.Equal(t, node.typ, typ, "Expected equal node type of page %d", nPage)
+		assert.Equal(t, uint32(node.nCells), nCells, "Expected equal number of cells of page %d", nPage)
+		assert.Equal(t, node.rightPage, rightPage, "Expected equal right page of page %d", nPage)
+	}
+}
+
+func BenchmarkReadNodeHeader(b *testing.B) {
+	btree := openBtree(b)
+
+	b.SetBytes(PageHeaderSize)
+	for i := 0; i < b.N; i++ {
+		if _, _, _, err := btree.ReadNodeHeader(1); err != nil {
+			b.Fatal(err)
+		}
+	}
+}
+
+func BenchmarkGetNodeByPage(b *testing.B) {
+	btree := openBtree(b)
+
+	b.SetBytes(PageSize)
+	for i := 0; i < b.N; i++ {
+		if _, err := btree.GetNodeByPage(1); err != nil {
+			b.Fatal(err)
+		}
+	}
+}
+
+func TestBTreeOpenStrict(t *testing.T) {
+	chidbDb := filepath.Join(t.TempDir(), "chidb.db")
+	btree, err := Open(chidbDb)
+	require.Nil(t, err)
+	require.Nil(t, btree.Close())
+
+	// A file with the SQLite magic bytes but without the chidb ones
+	foreignDb := filepath.Join(t.TempDir(), "foreign.db")
+	header := DefaultBTreeHeader()
+	header.chidbMagicBytes = make([]byte, len(ChidbMagicBytes))
+	headerBytes, err := header.Bytes()
+	require.Nil(t, err)
+	require.Nil(t, os.WriteFile(foreignDb, headerBytes, os.ModePerm))
+
+	testcases := []struct {
+		name   string
+		db     string
+		strict bool
+		err    error
+	}{
+		{
+			name:   "TestOpenChidbFile",
+			db:     chidbDb,
+			strict: false,
+			err:    nil,
+		},
+		{
+			name:   "TestOpenStrictChidbFile",
+			db:     chidbDb,
+			strict: true,
+			err:    nil,
+		},
+		{
+			name:   "TestOpenForeignFile",
+			db:     foreignDb,
+			strict: false,
+			err:    nil,
+		},
+		{
+			name:   "TestOpenStrictForeignFile",
+			db:     foreignDb,
+			strict: true,
+			err:    ErrNotChidbFile,
+		},
+	}
+
+	for _, tt := range testcases {
+		t.Run(tt.name, func(t *testing.T) {
+			var err error
+			if tt.strict {
+				_, err = OpenStrict(tt.db)
+			} else {
+				_, err = Open(tt.db)
+			}
+			assert.Equal(t, tt.err, err)
+		})
+	}
+}
+
+func TestFind(t *testing.T) {
+	btree := openBtree(t)
+	root := twoLevelTree(t, btree)
+
+	for _, key := range []ChidbKey{5, 10, 15, 20, 25, 30} {
+		cell, err := btree.Find(root, key)
+		require.Nil(t, err, "Expected nil error to find key %d", key)
+
+		assert.Equal(t, key, cell.key, "Expected found cell to have key %d", key)
+		assert.Equal(t, []byte(fmt.Sprintf("data %d", key)), cell.fields.tableLeaf.data, "Expected data of key %d", key)
+	}
+
+	for _, key := range []ChidbKey{1, 12, 22, 35} {
+		_, err := btree.Find(root, key)
+		assert.True(t, errors.Is(err, ErrKeyNotFound), "Expected key not found error to find key %d, got %v", key, err)
+	}
+}
+
+func TestFindSingleLeaf(t *testing.T) {
+	btree := openBtree(t)
+
+	node, err := btree.GetNodeByPage(1)
+	require.Nil(t, err)
+	insertLeafTableCells(t, btree, node, 1, 2, 3)
+
+	cell, err := btree.Find(1, 2)
+	require.Nil(t, err, "Expected nil error to find key on single leaf")
+	assert.Equal(t, ChidbKey(2), cell.key)
+
+	_, err = btree.Find(1, 4)
+	assert.True(t, errors.Is(err, ErrKeyNotFound), "Expected key not found error, got %v", err)
+}
+
+func TestInsert(t *testing.T) {
+	btree := openBtree(t)
+	root := twoLevelTree(t, btree)
+
+	for _, key := range []ChidbKey{12, 1, 35, 22, 18} {
+		err := btree.Insert(root, NewLeafTableCell(key, []byte(fmt.Sprintf("data %d", key))))
+		require.Nil(t, err, "Expected nil error to insert key %d", key)
+	}
+
+	for _, key := range []ChidbKey{1, 5, 10, 12, 15, 18, 20, 22, 25, 30, 35} {
+		cell, err := btree.Find(root, key)
+		require.Nil(t, err, "Expected nil error to find key %d", key)
+		assert.Equal(t, []byte(fmt.Sprintf("data %d", key)), cell.fields.tableLeaf.data, "Expected data of key %d", key)
+	}
+
+	// Each leaf keeps its cells sorted by key
+	expected := map[int][]ChidbKey{
+		0: {1, 5, 10},
+		1: {12, 15, 18, 20},
+		2: {22, 25, 30, 35},
+	}
+	rootNode, err := btree.GetNodeByPage(root)
+	require.Nil(t, err)
+	for i := 0; i <= 2; i++ {
+		childPage, err := btree.childPageForPosition(rootNode, uint16(i+1))
+		require.Nil(t, err)
+
+		leaf, err := btree.GetNodeByPage(childPage)
+		require.Nil(t, err)
+
+		keys := make([]ChidbKey, 0)
+		for nCell := uint16(1); nCell <= leaf.nCells; nCell++ {
+			cell, err := leaf.GetCell(nCell)
+			require.Nil(t, err)
+			keys = append(keys, cell.key)
+		}
+		assert.Equal(t, expected[i], keys, "Expected sorted keys on leaf %d", i)
+	}
+}
+
+func TestInsertDuplicateKey(t *testing.T) {
+	btree := openBtree(t)
+	root := twoLevelTree(t, btree)
+
+	err := btree.Insert(root, NewLeafTableCell(15, []byte("duplicate")))
+	assert.True(t, errors.Is(err, ErrDuplicateKey), "Expected duplicate key error, got %v", err)
+
+	cell, err := btree.Find(root, 15)
+	require.Nil(t, err)
+	assert.Equal(t, []byte("data 15"), cell.fields.tableLeaf.data, "Expected original data after duplicate insert")
+}
+
+func TestInsertEmptyData(t *testing.T) {
+	btree := openSmallPageBtree(t)
+
+	// Empty data written last on a page ends the cell at the end of the page
+	data := make(map[ChidbKey][]byte)
+	keys := sequentialKeys(1, 1000)
+	for _, key := range shuffledKeys(keys) {
+		var d []byte
+		if key%2 == 0 {
+			d = randomBytes(int(key % 100))
+		}
+		data[key] = d
+		require.Nil(t, btree.Insert(1, NewLeafTableCell(key, d)), "Expected nil error to insert key %d", key)
+	}
+	require.Greater(t, treeHeight(t, btree, 1), 1, "Expected leaves split")
+
+	for _, key := range keys {
+		cell, err := btree.Find(1, key)
+		require.Nil(t, err, "Expected nil error to find key %d", key)
+		assert.Equal(t, len(data[key]), len(cell.fields.tableLeaf.data), "Expected data size of key %d", key)
+		if len(data[key]) > 0 {
+			assert.Equal(t, data[key], cell.fields.tableLeaf.data)
+		}
+	}
+	assert.Equal(t, keys, cursorKeys(t, btree, 1))
+	assert.Nil(t, btree.CheckIntegrity(1))
+}
+
+func TestInsertSplitsLeaves(t *testing.T) {
+	btree := openBtree(t)
+
+	// Each leaf fits less than a hundred cells, so the root leaf is split
+	// and then the new leaves are split as well.
+	keys := insertSequentialKeys(t, btree, 1, 500, 200)
+
+	root, err := btree.GetNodeByPage(1)
+	require.Nil(t, err)
+	assert.Equal(t, InternalTable, root.typ, "Expected root to become an internal node")
+	assert.True(t, root.nCells >= 2, "Expected at least two splits, got root with %d cells", root.nCells)
+
+	for _, key := range keys {
+		_, err := btree.Find(1, key)
+		require.Nil(t, err, "Expected nil error to find key %d", key)
+	}
+}
+
+func TestInsertSplitsInternalNodes(t *testing.T) {
+	btree := openBtree(t)
+
+	// Three cells fit on a leaf, so sequential inserts leave two cells on
+	// each leaf and the root fills with keys until it must be split.
+	keys := insertSequentialKeys(t, btree, 1, 3500, 5000)
+
+	root, err := btree.GetNodeByPage(1)
+	require.Nil(t, err)
+	require.Equal(t, InternalTable, root.typ, "Expected root to be an internal node")
+
+	for nCell := uint16(1); nCell <= root.nCells+1; nCell++ {
+		childPage, err := btree.childPageForPosition(root, nCell)
+		require.Nil(t, err)
+
+		child, err := btree.GetNodeByPage(childPage)
+		require.Nil(t, err)
+		assert.Equal(t, InternalTable, child.typ, "Expected internal node at child %d of root", nCell)
+	}
+
+	for _, key := range keys {
+		cell, err := btree.Find(1, key)
+		require.Nil(t, err, "Expected nil error to find key %d", key)
+		assert.Equal(t, uint32(5000), cell.fields.tableLeaf.size, "Expected data size of key %d", key)
+	}
+}
+
+func TestSplitNodeInternalTable(t *testing.T) {
+	btree := openBtree(t)
+	root := twoLevelTree(t, btree)
+
+	parent, err := btree.NewNode(InternalTable)
+	require.Nil(t, err)
+	parent.rightPage = root
+	require.Nil(t, btree.WriteNode(parent))
+
+	child, err := btree.GetNodeByPage(root)
+	require.Nil(t, err)
+
+	newPage, err := btree.splitNode(parent, child, 1, intKey(25))
+	require.Nil(t, err, "Expected nil error to split internal node")
+
+	// The median key 20 is promoted and its child becomes the right
+	// page of the new node, which keeps the key 10.
+	cell, err := parent.GetCell(1)
+	require.Nil(t, err)
+	assert.Equal(t, ChidbKey(20), cell.key)
+	assert.Equal(t, newPage, cell.fields.tableInternal.childPage)
+
+	left, err := btree.GetNodeByPage(newPage)
+	require.Nil(t, err)
+	assert.Equal(t, uint16(1), left.nCells)
+
+	right, err := btree.GetNodeByPage(root)
+	require.Nil(t, err)
+	assert.Equal(t, uint16(0), right.nCells)
+
+	for _, key := range []ChidbKey{5, 10, 15, 20, 25, 30} {
+		_, err := btree.Find(parent.page.number, key)
+		require.Nil(t, err, "Expected nil error to find key %d after split", key)
+	}
+}
+
+// insertSequentialKeys inserts count leaf table cells with dataSize bytes of
+// data and sequential keys starting at first on the tree rooted at page 1.
+func insertSequentialKeys(tb testing.TB, btree *BTree, first ChidbKey, count int, dataSize int) []ChidbKey {
+	keys := make([]ChidbKey, 0, count)
+	for i := 0; i < count; i++ {
+		key := first + ChidbKey(i)
+		require.Nil(tb, btree.Insert(1, NewLeafTableCell(key, make([]byte, dataSize))), "Expected nil error to insert key %d", key)
+		keys = append(keys, key)
+	}
+	return keys
+}
+
+func TestOpenReadOnly(t *testing.T) {
+	filename := filepath.Join(t.TempDir(), "readonly.db")
+
+	btree, err := Open(filename)
+	require.Nil(t, err)
+	keys := insertSequentialKeys(t, btree, 1, 200, 200)
+	require.Nil(t, btree.Close())
+
+	before, err := os.ReadFile(filename)
+	require.Nil(t, err)
+
+	btree, err = OpenReadOnly(filename)
+	require.Nil(t, err, "Expected nil error to open read-only database")
+
+	for _, key := range keys {
+		_, err := btree.Find(1, key)
+		require.Nil(t, err, "Expected nil error to find key %d on read-only database", key)
+	}
+	assert.Equal(t, keys, cursorKeys(t, btree, 1), "Expected cursor to read all keys on read-only database")
+
+	node, err := btree.GetNodeByPage(1)
+	require.Nil(t, err)
+	header, err := btree.pager.ReadHeader()
+	require.Nil(t, err)
+
+	_, err = btree.pager.AllocatePage()
+	assert.Equal(t, ErrReadOnly, err, "Expected read-only error to allocate page")
+
+	assert.Equal(t, ErrReadOnly, btree.pager.WritePage(node.page), "Expected read-only error to write page")
+	assert.Equal(t, ErrReadOnly, btree.pager.WriteHeader(header), "Expected read-only error to write header")
+	assert.Equal(t, ErrReadOnly, btree.WriteNode(node), "Expected read-only error to write node")
+
+	_, err = btree.NewNode(LeafTable)
+	assert.Equal(t, ErrReadOnly, err, "Expected read-only error to create node")
+
+	err = btree.Insert(1, NewLeafTableCell(1000, []byte("data")))
+	assert.True(t, errors.Is(err, ErrReadOnly), "Expected read-only error to insert, got %v", err)
+
+	require.Nil(t, btree.Close())
+
+	after, err := os.ReadFile(filename)
+	require.Nil(t, err)
+	assert.Equal(t, before, after, "Expected read-only database to not be modified")
+}
+
+func TestOpenContextCanceled(t *testing.T) {
+	filename := filepath.Join(t.TempDir(), "canceled.db")
+
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+
+	_, err := OpenContext(ctx, filename)
+	assert.True(t, errors.Is(err, context.Canceled), "Expected context canceled error to create database, got %v", err)
+
+	_, err = os.Stat(filename)
+	assert.True(t, errors.Is(err, os.ErrNotExist), "Expected database to not be created")
+
+	btree, err := OpenContext(context.Background(), filename)
+	require.Nil(t, err, "Expected nil error to create database")
+	require.Nil(t, btree.Close())
+
+	_, err = OpenContext(ctx, filename)
+	assert.True(t, errors.Is(err, context.Canceled), "Expected context canceled error to open database, got %v", err)
+
+	_, err = os.Stat(filename + CreateSuffix)
+	assert.True(t, errors.Is(err, os.ErrNotExist), "Expected no temporary file left behind")
+}
+
+func TestOpenReadOnlyEmptyFile(t *testing.T) {
+	filename := filepath.Join(t.TempDir(), "empty.db")
+	require.Nil(t, os.WriteFile(filename, nil, 0644))
+
+	btree, err := OpenReadOnly(filename)
+	require.Nil(t, err, "Expected nil error to open empty file read-only")
+	defer btree.Close()
+
+	info, err := os.Stat(filename)
+	require.Nil(t, err)
+	assert.Equal(t, int64(0), info.Size(), "Expected empty file to not be initialized")
+
+	_, err = OpenReadOnly(filepath.Join(t.TempDir(), "missing.db"))
+	assert.True(t, errors.Is(err, os.ErrNotExist), "Expected not exist error to open missing file, got %v", err)
+}
+
+func TestOpenPageSize(t *testing.T) {
+	for _, pageSize := range []uint32{1024, 8192} {
+		t.Run(fmt.Sprintf("%d", pageSize), func(t *testing.T) {
+			filename := filepath.Join(t.TempDir(), "pagesize.db")
+
+			pager, err := OpenPager(filename)
+			require.Nil(t, err)
+			require.Nil(t, pager.setPageSize(pageSize))
+
+			btree, err := NewBTree(pager)
+			require.Nil(t, err, "Expected nil error to create database with %d bytes pages", pageSize)
+			keys := insertSequentialKeys(t, btree, 1, 500, 200)
+			require.Nil(t, pager.Close())
+
+			info, err := os.Stat(filename)
+			require.Nil(t, err)
+			assert.Equal(t, int64(0), info.Size()%int64(pageSize), "Expected file with whole pages")
+
+			btree, err = Open(filename)
+			require.Nil(t, err, "Expected nil error to open database with %d bytes pages", pageSize)
+			defer btree.Close()
+
+			assert.Equal(t, pageSize, btree.Pager().PageSize(), "Expected page size from header")
+			assert.Equal(t, uint32(info.Size())/pageSize, btree.pager.totalPages)
+
+			for _, key := range keys {
+				_, err := btree.Find(1, key)
+				require.Nil(t, err, "Expected nil error to find key %d", key)
+			}
+			assert.Equal(t, keys, cursorKeys(t, btree, 1))
+		})
+	}
+}
+
+func TestOpenUnsupportedFormat(t *testing.T) {
+	filename := filepath.Join(t.TempDir(), "old.db")
+
+	// Files written before the format version have zeros on its byte
+	header := DefaultBTreeHeader()
+	header.formatVersion = 0
+	b, err := header.Bytes()
+	require.Nil(t, err)
+	require.Nil(t, os.WriteFile(filename, b, 0644))
+
+	_, err = Open(filename)
+	assert.True(t, errors.Is(err, ErrUnsupportedFormat), "Expected unsupported format error, got %v", err)
+}
+
+func TestInsert64BitKeys(t *testing.T) {
+	filename := filepath.Join(t.TempDir(), "keys.db")
+
+	btree, err := Open(filename)
+	require.Nil(t, err)
+
+	keys := []ChidbKey{1, math.MaxUint32, math.MaxUint32 + 1, 1 << 40, math.MaxUint64}
+	for _, key := range keys {
+		require.Nil(t, btree.Insert(1, NewLeafTableCell(key, []byte(fmt.Sprint(key)))), "Expected nil error to insert key %d", key)
+	}
+	insertSequentialKeys(t, btree, 1<<33, 1000, 200)
+	require.Nil(t, btree.Close())
+
+	btree, err = Open(filename)
+	require.Nil(t, err)
+	defer btree.Close()
+
+	for _, key := range keys {
+		cell, err := btree.Find(1, key)
+		require.Nil(t, err, "Expected nil error to find key %d", key)
+		assert.Equal(t, key, cell.key)
+		assert.Equal(t, []byte(fmt.Sprint(key)), cell.fields.tableLeaf.data)
+	}
+	_, err = btree.Find(1, 1<<33+999)
+	assert.Nil(t, err, "Expected to find key inserted after a split")
+	_, err = btree.Find(1, 1<<33+1000)
+	assert.True(t, errors.Is(err, ErrKeyNotFound), "Expected key not found error, got %v", err)
+	assert.Nil(t, btree.CheckIntegrity(1))
+}
+
+func TestOpenValidatesPageSize(t *testing.T) {
+	tests := []struct {
+		name     string
+		pageSize uint16
+		valid    bool
+	}{
+		{name: "default", pageSize: PageSize, valid: true},
+		{name: "minimum", pageSize: MinPageSize, valid: true},
+		{name: "maximum", pageSize: MaxPageSize, valid: true},
+		{name: "not power of two", pageSize: 1000, valid: false},
+		{name: "too small", pageSize: 256, valid: false},
+		{name: "zero", pageSize: 0, valid: false},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			filename := filepath.Join(t.TempDir(), "pagesize.db")
+
+			header := DefaultBTreeHeader()
+			header.pageSize = tt.pageSize
+			b, err := header.Bytes()
+			require.Nil(t, err)
+			require.Nil(t, os.WriteFile(filename, b, 0644))
+
+			btree, err := Open(filename)
+			if btree != nil {
+				defer btree.Close()
+			}
+
+			if tt.valid {
+				assert.Nil(t, err, "Expected nil error to open file with page size %d", tt.pageSize)
+			} else {
+				assert.True(t, errors.Is(err, ErrCorruptHeader), "Expected corrupt header error, got %v", err)
+			}
+		})
+	}
+}
+
+// twoLevelTree builds a table B-Tree with an internal root node and three
+// leaves with keys 5 and 10, 15 and 20 and 25 and 30, returning the root page.
+func twoLevelTree(tb testing.TB, btree *BTree) uint32 {
+	root, err := btree.NewNode(InternalTable)
+	require.Nil(tb, err)
+
+	leaves := make([]*BTreeNode, 0)
+	for _, keys := range [][]ChidbKey{{5, 10}, {15, 20}, {25, 30}} {
+		leaf, err := btree.NewNode(LeafTable)
+		require.Nil(tb, err)
+		insertLeafTableCells(tb, btree, leaf, keys...)
+		leaves = append(leaves, leaf)
+	}
+
+	for i, key := range []ChidbKey{10, 20} {
+		cell := BTreeCell{
+			typ: InternalTable,
+			key: key,
+		}
+		cell.fields.tableInternal.childPage = leaves[i].page.number
+		require.Nil(tb, root.InsertCell(uint16(i+1), &cell))
+	}
+	root.rightPage = leaves[2].page.number
+	require.Nil(tb, btree.WriteNode(root))
+
+	return root.page.number
+}
+
+// insertLeafTableCells appends cells with the given keys on a leaf table
+// node and writes it.
+func insertLeafTableCells(tb testing.TB, btree *BTree, node *BTreeNode, keys ...ChidbKey) {
+	for _, key := range keys {
+		cell := BTreeCell{
+			typ: LeafTable,
+			key: key,
+		}
+		cell.fields.tableLeaf.data = []byte(fmt.Sprintf("data %d", key))
+		cell.fields.tableLeaf.size = uint32(len(cell.fields.tableLeaf.data))
+		require.Nil(tb, node.InsertCell(node.nCells+1, &cell))
+	}
+	require.Nil(tb, btree.WriteNode(node))
+}
+
+func openBtree(tb testing.TB) *BTree {
+	if memoryBackend {
+		btree, err := OpenMemory()
+		require.Nil(tb, err)
+		tb.Cleanup(func() { btree.Close() })
+		return btree
+	}
+
+	// Subtest names have slashes, which can't be on the file name pattern
+	db, err := os.CreateTemp(os.TempDir(), strings.ReplaceAll(tb.Name(), "/", "_"))
+	require.Nil(tb, err)
+
+	btree, err := Open(db.Name())
+	require.Nil(tb, err)
+	return btree
+}
+
+func TestNodeFillRatio(t *testing.T) {
+	btree := openBtree(t)
+
+	node, err := btree.NewNode(LeafTable)
+	require.Nil(t, err, "Expected nil error to create new node")
+
+	ratio, err := node.FillRatio()
+	require.Nil(t, err)
+	assert.Equal(t, float64(0), ratio, "Expected empty node to have no fill")
+
+	for i := uint16(1); i <= 2; i++ {
+		cell := BTreeCell{
+			typ: node.typ,
+			key: ChidbKey(i),
+		}
+		cell.fields.tableLeaf.data = []byte("Hello World")
+		cell.fields.tableLeaf.size = uint32(len(cell.fields.tableLeaf.data))
+
+		err = node.InsertCell(i, &cell)
+		require.Nil(t, err, "Expected nil error to insert cell %d", i)
+	}
+
+	// Each cell has 4 bytes of size, 8 bytes of key and 11 bytes of data,
+	// plus 2 bytes on cell offset array.
+	expected := float64(2*(4+8+11)+2*2) / float64(PageSize-PageHeaderSize-1)
+	ratio, err = node.FillRatio()
+	require.Nil(t, err)
+	assert.InDelta(t, expected, ratio, 1e-9, "Expected fill ratio of two inserted cells")
+
+	// The space of a removed cell is dead until the node is defragmented,
+	// but it's not in use
+	require.Nil(t, node.RemoveCell(1))
+	ratio, err = node.FillRatio()
+	require.Nil(t, err)
+	assert.InDelta(t, expected/2, ratio, 1e-9, "Expected fill ratio of the cell left")
+
+	// Stats reports the same fill as FillRatio
+	require.Nil(t, btree.WriteNode(node))
+	stats, err := btree.Stats(node.page.number)
+	require.Nil(t, err)
+	assert.InDelta(t, 100*ratio, stats.AvgLeafFillPercent, 1e-9)
+}
+
+func TestBTreeOpenCreateIsAtomic(t *testing.T) {
+	filename := filepath.Join(t.TempDir(), "test.db")
+
+	// Simulate a crash in the middle of a previous create, which left a
+	// partial temporary file behind and never renamed it to filename.
+	err := os.WriteFile(filename+CreateSuffix, []byte("partial"), os.ModePerm)
+	require.Nil(t, err)
+
+	_, err = os.Stat(filename)
+	assert.True(t, errors.Is(err, os.ErrNotExist), "Expected no database file after a crashed create")
+
+	btree, err := Open(filename)
+	require.Nil(t, err, "Expected nil error to create database after a crashed create")
+
+	_, err = os.Stat(filename + CreateSuffix)
+	assert.True(t, errors.Is(err, os.ErrNotExist), "Expected temporary create file to be renamed")
+
+	node, err := btree.GetNodeByPage(1)
+	require.Nil(t, err, "Expected nil error to get first node page")
+	assert.Equal(t, LeafTable, node.Type())
+
+	require.Nil(t, btree.Close())
+
+	_, err = Open(filename)
+	assert.Nil(t, err, "Expected nil error to reopen created database")
+}
+
+func TestBTreeCreateFault(t *testing.T) {
+	filename := filepath.Join(t.TempDir(), "test.db")
+
+	// Fail each write and sync of the create in turn, until the create
+	// succeeds
+	faults := 0
+	for {
+		require.Less(t, faults, 100, "Expected create to succeed without faults")
+
+		// Like create, the partial file left by the previous fault is
+		// discarded
+		err := os.Remove(filename + CreateSuffix)
+		require.True(t, err == nil || errors.Is(err, os.ErrNotExist))
+		f, err := os.OpenFile(filename+CreateSuffix, os.O_CREATE|os.O_RDWR, os.ModePerm)
+		require.Nil(t, err)
+		s := &faultStorage{Storage: &fileStorage{f}, failAfter: faults}
+
+		btree, err := createStorage(context.Background(), s, filename, PageSize, (*BTree).initialize)
+		if err == nil {
+			s.failAfter = -1
+			require.Nil(t, btree.Close())
+			break
+		}
+		assert.True(t, errors.Is(err, errFault), "Expected fault error to create database, got %v", err)
+		assert.True(t, s.closed, "Expected storage closed after fault %d", faults)
+
+		_, err = os.Stat(filename)
+		require.True(t, errors.Is(err, os.ErrNotExist), "Expected no database file after fault %d", faults)
+		faults++
+	}
+	require.Greater(t, faults, 1, "Expected create to write and sync the file")
+
+	btree, err := Open(filename)
+	require.Nil(t, err, "Expected nil error to open created database")
+	defer btree.Close()
+	node, err := btree.GetNodeByPage(1)
+	require.Nil(t, err)
+	assert.Equal(t, LeafTable, node.Type())
+}
+
+func TestBTreeOpenFaultClosesPager(t *testing.T) {
+	filename := filepath.Join(t.TempDir(), "test.db")
+
+	s := &faultStorage{Storage: &memoryStorage{}, failAfter: -1}
+	pager, err := OpenPagerStorage(s)
+	require.Nil(t, err)
+	s.failSize = true
+
+	_, err = openOnPager(context.Background(), pager, filename, false)
+	assert.True(t, errors.Is(err, errFault), "Expected fault error to check empty file, got %v", err)
+	assert.True(t, s.closed, "Expected storage closed after failing to check empty file")
+
+	header := DefaultBTreeHeader()
+	header.formatVersion = 0
+	b, err := header.Bytes()
+	require.Nil(t, err)
+	s = &faultStorage{Storage: &memoryStorage{data: b}, failAfter: -1}
+	pager, err = OpenPagerStorage(s)
+	require.Nil(t, err)
+
+	_, err = openOnPager(context.Background(), pager, filename, false)
+	assert.True(t, errors.Is(err, ErrUnsupportedFormat), "Expected unsupported format error, got %v", err)
+	assert.True(t, s.closed, "Expected storage closed after failing to validate header")
+}
+
+// errFault is returned by the operations of a faultStorage that fail
+var errFault = errors.New("injected storage fault")
+
+// faultStorage is a storage whose writes and syncs fail with errFault after
+// failAfter of them succeeded, like a crash, and whose Size fails when
+// failSize is set. A negative failAfter never fails.
+type faultStorage struct {
+	Storage
+
+	failAfter int
+	failSize  bool
+	ops       int
+	closed    bool
+}
+
+func (s *faultStorage) fail() bool {
+	if s.failAfter < 0 {
+		return false
+	}
+	s.ops++
+	return s.ops > s.failAfter
+}
+
+func (s *faultStorage) WriteAt(b []byte, off int64) (int, error) {
+	if s.fail() {
+		return 0, errFault
+	}
+	return s.Storage.WriteAt(b, off)
+}
+
+func (s *faultStorage) Sync() error {
+	if s.fail() {
+		return errFault
+	}
+	return s.Storage.Sync()
+}
+
+func (s *faultStorage) Size() (int64, error) {
+	if s.failSize {
+		return 0, errFault
+	}
+	return s.Storage.Size()
+}
+
+func (s *faultStorage) Close() error {
+	s.closed = true
+	return s.Storage.Close()
+}
+
+func TestChildPageOutOfRange(t *testing.T) {
+	btree := openBtree(t)
+
+	node, err := btree.NewNode(InternalTable)
+	require.Nil(t, err, "Expected nil error to create new node")
+
+	valid := BTreeCell{
+		typ: node.typ,
+		key: 1,
+	}
+	valid.fields.tableInternal.childPage = 1
+
+	invalid := BTreeCell{
+		typ: node.typ,
+		key: 2,
+	}
+	invalid.fields.tableInternal.childPage = 99
+
+	require.Nil(t, node.InsertCell(1, &valid))
+	require.Nil(t, node.InsertCell(2, &invalid))
+
+	childPage, err := btree.ChildPage(node, 1)
+	require.Nil(t, err, "Expected nil error to get valid child page")
+	assert.Equal(t, uint32(1), childPage)
+
+	_, err = btree.ChildPage(node, 2)
+	assert.True(t, errors.Is(err, ErrIncorrectPageNumber), "Expected incorrect page number error, got %v", err)
+	assert.Contains(t, err.Error(), "in page 2", "Expected error to contain the page of the internal node")
+}
+
+func TestBTreeSaveAs(t *testing.T) {
+	btree := openBtree(t)
+
+	node, err := btree.GetNodeByPage(1)
+	require.Nil(t, err, "Expected nil error to get first node page")
+
+	cell := BTreeCell{
+		typ: node.typ,
+		key: 1,
+	}
+	cell.fields.tableLeaf.data = []byte("Hello World")
+	cell.fields.tableLeaf.size = uint32(len(cell.fields.tableLeaf.data))
+
+	require.Nil(t, node.InsertCell(1, &cell))
+	require.Nil(t, btree.WriteNode(node))
+
+	// Change the header of the source database, the copy must have a fresh one.
+	header, err := btree.ReadHeader()
+	require.Nil(t, err)
+	header.fileChangeCounter = 10
+	header.userCookie = 42
+	headerBytes, err := header.Bytes()
+	require.Nil(t, err)
+	require.Nil(t, btree.pager.WriteHeader(headerBytes))
+
+	saved, err := btree.SaveAs(filepath.Join(t.TempDir(), "saved.db"))
+	require.Nil(t, err, "Expected nil error to save database as a new file")
+
+	savedHeader, err := saved.ReadHeader()
+	require.Nil(t, err)
+	defaultHeader := DefaultBTreeHeader()
+	assert.Equal(t, &defaultHeader, savedHeader, "Expected default header on saved database")
+
+	savedNode, err := saved.GetNodeByPage(1)
+	require.Nil(t, err, "Expected nil error to get first node page of saved database")
+
+	savedCell, err := savedNode.GetCell(1)
+	require.Nil(t, err, "Expected nil error to get cell of saved database")
+	assert.Equal(t, cell.key, savedCell.key)
+	assert.Equal(t, cell.fields.tableLeaf.data, savedCell.fields.tableLeaf.data)
+}
+
+func TestWriteNodeIncrementsFileChangeCounter(t *testing.T) {
+	btree := openBtree(t)
+
+	header, err := btree.ReadHeader()
+	require.Nil(t, err)
+	assert.Equal(t, uint32(0), header.fileChangeCounter, "Expected zero file change counter on new database")
+
+	first, err := btree.GetNodeByPage(1)
+	require.Nil(t, err)
+	second, err := btree.NewNode(LeafTable)
+	require.Nil(t, err)
+
+	require.Nil(t, btree.WriteNode(first))
+	require.Nil(t, btree.WriteNode(second))
+
+	header, err = btree.ReadHeader()
+	require.Nil(t, err)
+	assert.Equal(t, uint32(2), header.fileChangeCounter, "Expected file change counter to be incremented on each node write")
+}
+
+func TestOperationsIncrementFileChangeCounterOnce(t *testing.T) {
+	btree := openSmallPageBtree(t)
+	keys := insertSequentialKeys(t, btree, 1, 500, 200)
+	require.Greater(t, treeHeight(t, btree, 1), 2)
+
+	counter := func() uint32 {
+		header, err := btree.ReadHeader()
+		require.Nil(t, err)
+		return header.fileChangeCounter
+	}
+
+	// Each of these writes several nodes, but counts as calls operations
+	operations := []struct {
+		name      string
+		calls     uint32
+		operation func() error
+	}{
+		{"insert", 1, func() error {
+			return btree.Insert(1, NewLeafTableCell(501, randomBytes(200)))
+		}},
+		{"delete", 4, func() error {
+			for _, key := range keys[:4] {
+				if err := btree.Delete(1, key); err != nil {
+					return err
+				}
+			}
+			return nil
+		}},
+		{"insert many", 1, func() error {
+			return btree.InsertMany(1, leafTableCells(sequentialKeys(1000, 100), 200))
+		}},
+		{"bulk load", 1, func() error {
+			_, err := btree.BulkLoad(leafTableCells(sequentialKeys(1, 100), 200))
+			return err
+		}},
+	}
+	for _, op := range operations {
+		before := counter()
+		require.Nil(t, op.operation(), "Expected nil error to %s", op.name)
+		assert.Equal(t, before+op.calls, counter(), "Expected file change counter incremented once per %s", op.name)
+	}
+}
+
+func TestBTreeUserCookie(t *testing.T) {
+	filename := filepath.Join(t.TempDir(), "cookie.db")
+
+	btree, err := Open(filename)
+	require.Nil(t, err)
+
+	cookie, err := btree.UserCookie()
+	require.Nil(t, err, "Expected nil error to read user cookie")
+	assert.Equal(t, uint32(0), cookie, "Expected zero user cookie on new database")
+
+	before, err := btree.ReadHeader()
+	require.Nil(t, err)
+
+	require.Nil(t, btree.SetUserCookie(42), "Expected nil error to set user cookie")
+	require.Nil(t, btree.Close())
+
+	btree, err = Open(filename)
+	require.Nil(t, err)
+	defer btree.Close()
+
+	cookie, err = btree.UserCookie()
+	require.Nil(t, err, "Expected nil error to read user cookie after reopen")
+	assert.Equal(t, uint32(42), cookie, "Expected user cookie to be persisted")
+
+	// The other header fields are kept
+	after, err := btree.ReadHeader()
+	require.Nil(t, err)
+	after.userCookie = before.userCookie
+	assert.Equal(t, before, after)
+}
+
+func TestBTreeSchemaVersion(t *testing.T) {
+	filename := filepath.Join(t.TempDir(), "schema.db")
+
+	btree, err := Open(filename)
+	require.Nil(t, err)
+
+	version, err := btree.SchemaVersion()
+	require.Nil(t, err, "Expected nil error to read schema version")
+	assert.Equal(t, uint32(0), version, "Expected zero schema version on new database")
+
+	require.Nil(t, btree.BumpSchemaVersion(), "Expected nil error to bump schema version")
+	require.Nil(t, btree.BumpSchemaVersion(), "Expected nil error to bump schema version")
+	require.Nil(t, btree.Close())
+
+	btree, err = Open(filename)
+	require.Nil(t, err)
+	defer btree.Close()
+
+	version, err = btree.SchemaVersion()
+	require.Nil(t, err, "Expected nil error to read schema version after reopen")
+	assert.Equal(t, uint32(2), version, "Expected bumped schema version to be persisted")
+}
+
+func TestBTreeLastModified(t *testing.T) {
+	btree := openBtree(t)
+
+	lastModified, err := btree.LastModified()
+	require.Nil(t, err, "Expected nil error to get last modified of new database")
+	assert.True(t, lastModified.IsZero(), "Expected zero last modified on new database")
+
+	node, err := btree.GetNodeByPage(1)
+	require.Nil(t, err, "Expected nil error to get first node page")
+
+	require.Nil(t, btree.WriteNode(node), "Expected nil error to write node")
+	first, err := btree.LastModified()
+	require.Nil(t, err, "Expected nil error to get last modified after first write")
+	assert.False(t, first.IsZero(), "Expected last modified to be set after write")
+
+	require.Nil(t, btree.WriteNode(node), "Expected nil error to write node")
+	second, err := btree.LastModified()
+	require.Nil(t, err, "Expected nil error to get last modified after second write")
+	assert.True(t, second.After(first), "Expected last modified to advance after second write")
 }
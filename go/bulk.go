@@ -0,0 +1,232 @@
+package chidb
+
+import (
+	"errors"
+	"fmt"
+)
+
+// ErrNotSorted is returned by BulkLoad when the cells are not in the order
+// of the B-Tree
+var ErrNotSorted = errors.New("cells not sorted")
+
+// BulkLoad builds a new B-Tree with sorted cells and returns its root page
+//
+// Instead of inserting the cells one by one, the tree is built bottom-up:
+// the cells are packed on leaves as full as they fit, then the separators
+// between the leaves are packed on the internal nodes of the level above,
+// and so on until a level has a single node, the root. Nodes are never
+// split, so they end up full and every leaf is on the same level. Only the
+// last node of each level may be left with few cells, in which case they
+// are evened out with the node before it.
+//
+// The cells must be all leaf table cells or all leaf index cells, in
+// strictly ascending order of their keys. Leaf index cells of a byte-keyed
+// index, see NewLeafIndexCellBytes, are ordered by Comparator and build a
+// byte-keyed index. Otherwise an error wrapping ErrInvalidNodeType,
+// ErrKeyType or ErrNotSorted is returned and no page is written.
+// With no cells, the tree is an empty table leaf.
+//
+// The file change counter and the last modification time on the file
+// header are updated once, after the nodes are written.
+func (b *BTree) BulkLoad(sorted []*BTreeCell) (uint32, error) {
+	root, err := b.bulkLoad(sorted, OrderAscending)
+	if err != nil {
+		return 0, err
+	}
+	return root, b.touch()
+}
+
+// bulkLoad builds a B-Tree like BulkLoad without updating the header, with
+// its cells in order
+func (b *BTree) bulkLoad(sorted []*BTreeCell, order KeyOrder) (uint32, error) {
+	typ := LeafTable
+	if len(sorted) > 0 {
+		typ = sorted[0].typ
+	}
+	if typ != LeafTable && typ != LeafIndex {
+		return 0, fmt.Errorf("%w: can't bulk load cells of type %d", ErrInvalidNodeType, typ)
+	}
+	byteKeys := len(sorted) > 0 && sorted[0].keyBytes != nil
+
+	for i, cell := range sorted {
+		if cell.typ != typ {
+			return 0, fmt.Errorf("%w: cell %d of type %d among cells of type %d", ErrInvalidNodeType, i, cell.typ, typ)
+		}
+		if (cell.keyBytes != nil) != byteKeys {
+			return 0, fmt.Errorf("%w: cell %d with key %v", ErrKeyType, i, cellTreeKey(cell))
+		}
+		if i > 0 && b.compareKeys(order, cellTreeKey(sorted[i-1]), cellTreeKey(cell)) >= 0 {
+			return 0, fmt.Errorf("%w: key %v after key %v", ErrNotSorted, cellTreeKey(cell), cellTreeKey(sorted[i-1]))
+		}
+	}
+
+	internal := InternalTable
+	if typ == LeafIndex {
+		internal = InternalIndex
+	}
+
+	nodes, separators, err := b.bulkLevel(typ, sorted, 0, order)
+	if err != nil {
+		return 0, err
+	}
+	for len(nodes) > 1 {
+		cells := make([]*BTreeCell, 0, len(separators))
+		for i, separator := range separators {
+			cells = append(cells, separatorCell(internal, separator, nodes[i].page.number))
+		}
+
+		nodes, separators, err = b.bulkLevel(internal, cells, nodes[len(nodes)-1].page.number, order)
+		if err != nil {
+			return 0, err
+		}
+	}
+	return nodes[0].page.number, nil
+}
+
+// bulkLevel packs cells in order on new nodes of type typ and returns the
+// nodes with the cells separating them.
+//
+// On table leaves the separator of two nodes is the last cell of the first
+// one. On the other levels it's the cell between them, which isn't stored on
+// either node, and on internal nodes its child page is the right page of the
+// first one. rightPage is the right page of the last node.
+func (b *BTree) bulkLevel(typ BTreeNodeType, cells []*BTreeCell, rightPage uint32, order KeyOrder) ([]*BTreeNode, []*BTreeCell, error) {
+	byteKeys := len(cells) > 0 && cells[0].keyBytes != nil
+	node, err := b.newNode(typ)
+	if err != nil {
+		return nil, nil, err
+	}
+	node.order, node.byteKeys = order, byteKeys
+	nodes := []*BTreeNode{node}
+	separators := make([]*BTreeCell, 0)
+
+	for i, cell := range cells {
+		fits, err := node.HasSpaceFor(cell)
+		if err != nil {
+			return nil, nil, err
+		}
+
+		if !fits && node.nCells > 0 {
+			if typ == LeafTable {
+				separators = append(separators, cells[i-1])
+			} else {
+				separators = append(separators, cell)
+				node.rightPage = cellChildPage(cell)
+			}
+
+			node, err = b.newNode(typ)
+			if err != nil {
+				return nil, nil, err
+			}
+			node.order, node.byteKeys = order, byteKeys
+			nodes = append(nodes, node)
+
+			if typ != LeafTable {
+				continue
+			}
+		}
+
+		if err := node.InsertCell(node.nCells+1, cell); err != nil {
+			return nil, nil, err
+		}
+	}
+	if typ != LeafTable && typ != LeafIndex {
+		node.rightPage = rightPage
+	}
+
+	if err := b.bulkBalanceLast(nodes, separators); err != nil {
+		return nil, nil, err
+	}
+
+	for _, node := range nodes {
+		if err := b.putNode(node); err != nil {
+			return nil, nil, err
+		}
+	}
+	return nodes, separators, nil
+}
+
+// bulkBalanceLast evens out the cells of the last two nodes of a level when
+// the last one underflows, updating the separator between them.
+func (b *BTree) bulkBalanceLast(nodes []*BTreeNode, separators []*BTreeCell) error {
+	if len(nodes) < 2 {
+		return nil
+	}
+	left, right := nodes[len(nodes)-2], nodes[len(nodes)-1]
+
+	underflows, err := right.underflows()
+	if err != nil || !underflows {
+		return err
+	}
+
+	cells, err := left.cells()
+	if err != nil {
+		return err
+	}
+	if left.typ != LeafTable {
+		cells = append(cells, separators[len(separators)-1])
+	}
+	upper, err := right.cells()
+	if err != nil {
+		return err
+	}
+	cells = append(cells, upper...)
+
+	m, err := left.splitPoint(cells)
+	if err != nil {
+		return err
+	}
+
+	if err := left.reset(left.typ); err != nil {
+		return err
+	}
+	if err := right.reset(right.typ); err != nil {
+		return err
+	}
+
+	var lower []*BTreeCell
+	if left.typ == LeafTable {
+		lower, upper = cells[:m], cells[m:]
+		separators[len(separators)-1] = cells[m-1]
+	} else {
+		lower, upper = cells[:m], cells[m+1:]
+		separators[len(separators)-1] = cells[m]
+		if left.typ != LeafIndex {
+			left.rightPage = cellChildPage(cells[m])
+		}
+	}
+
+	if err := left.appendCells(lower); err != nil {
+		return err
+	}
+	return right.appendCells(upper)
+}
+
+// separatorCell returns the internal cell of type typ with the key of cell
+// pointing to childPage
+func separatorCell(typ BTreeNodeType, cell *BTreeCell, childPage uint32) *BTreeCell {
+	separator := &BTreeCell{
+		typ:      typ,
+		key:      cell.key,
+		keyBytes: cell.keyBytes,
+	}
+	if typ == InternalTable {
+		separator.fields.tableInternal.childPage = childPage
+		return separator
+	}
+
+	separator.fields.indexInternal.childPage = childPage
+	separator.fields.indexInternal.keyPk = cell.fields.indexInternal.keyPk
+	if cell.typ == LeafIndex {
+		separator.fields.indexInternal.keyPk = cell.fields.indexLeaf.keyPk
+	}
+	return separator
+}
+
+// cellChildPage returns the child page of an internal cell
+func cellChildPage(cell *BTreeCell) uint32 {
+	if cell.typ == InternalIndex {
+		return cell.fields.indexInternal.childPage
+	}
+	return cell.fields.tableInternal.childPage
+}
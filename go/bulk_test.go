@@ -0,0 +1,153 @@
+package chidb
+
+import (
+	"errors"
+	"math"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestBulkLoad(t *testing.T) {
+	for _, count := range []int{0, 1, 10, 100, 1000, 5000} {
+		btree := openSmallPageBtree(t)
+		keys := sequentialKeys(1, count)
+
+		root, err := btree.BulkLoad(leafTableCells(keys, 50))
+		require.Nil(t, err, "Expected nil error to bulk load %d cells", count)
+
+		assert.Equal(t, keys, cursorKeys(t, btree, root))
+		assert.Nil(t, btree.CheckIntegrity(root))
+		treeHeight(t, btree, root)
+		for _, key := range keys {
+			_, err := btree.Find(root, key)
+			require.Nil(t, err, "Expected to find key %d of %d bulk loaded cells", key, count)
+		}
+	}
+}
+
+func TestBulkLoadDenserThanInsert(t *testing.T) {
+	keys := sequentialKeys(1, 2000)
+
+	inserted := openSmallPageBtree(t)
+	for _, cell := range leafTableCells(keys, 50) {
+		require.Nil(t, inserted.Insert(1, cell))
+	}
+	insertedStats, err := inserted.Stats(1)
+	require.Nil(t, err)
+
+	loaded := openSmallPageBtree(t)
+	root, err := loaded.BulkLoad(leafTableCells(keys, 50))
+	require.Nil(t, err)
+	loadedStats, err := loaded.Stats(root)
+	require.Nil(t, err)
+
+	assert.Less(t, loadedStats.Nodes, insertedStats.Nodes, "Expected less nodes than inserting cells")
+	assert.Greater(t, loadedStats.AvgLeafFillPercent, insertedStats.AvgLeafFillPercent)
+	assert.Greater(t, loadedStats.AvgLeafFillPercent, 90.0)
+	assert.LessOrEqual(t, loadedStats.Height, insertedStats.Height)
+}
+
+func TestBulkLoadOverflow(t *testing.T) {
+	btree := openSmallPageBtree(t)
+
+	cells := make([]*BTreeCell, 0)
+	data := make(map[ChidbKey][]byte)
+	for key := ChidbKey(1); key <= 100; key++ {
+		size := 20
+		if key%10 == 0 {
+			size = 3 * int(btree.pager.PageSize())
+		}
+		data[key] = randomBytes(size)
+		cells = append(cells, NewLeafTableCell(key, data[key]))
+	}
+
+	root, err := btree.BulkLoad(cells)
+	require.Nil(t, err)
+	assert.Nil(t, btree.CheckIntegrity(root))
+
+	for key, expected := range data {
+		cell, err := btree.Find(root, key)
+		require.Nil(t, err)
+		assert.Equal(t, expected, cell.fields.tableLeaf.data, "Expected data of key %d", key)
+	}
+}
+
+func TestBulkLoadIndex(t *testing.T) {
+	btree := openSmallPageBtree(t)
+
+	keys := sequentialKeys(1, 5000)
+	cells := make([]*BTreeCell, 0, len(keys))
+	for _, key := range keys {
+		cells = append(cells, NewLeafIndexCell(key, uint64(key)*10))
+	}
+
+	root, err := btree.BulkLoad(cells)
+	require.Nil(t, err)
+	require.Greater(t, treeHeight(t, btree, root), 2, "Expected index with many levels")
+
+	assert.Equal(t, keys, cursorKeys(t, btree, root))
+	assert.Nil(t, btree.CheckIntegrity(root))
+	for _, key := range keys {
+		cell, err := btree.Find(root, key)
+		require.Nil(t, err, "Expected nil error to find key %d", key)
+		assert.Equal(t, uint64(key)*10, cell.fields.indexLeaf.keyPk+cell.fields.indexInternal.keyPk)
+	}
+
+	// Inserting on a bulk loaded index keeps it valid
+	require.Nil(t, btree.Insert(root, NewLeafIndexCell(10000, 100000)))
+	assert.Nil(t, btree.CheckIntegrity(root))
+}
+
+func TestBulkLoadErrors(t *testing.T) {
+	btree := openBtree(t)
+
+	_, err := btree.BulkLoad(leafTableCells([]ChidbKey{1, 3, 2}, 10))
+	assert.True(t, errors.Is(err, ErrNotSorted), "Expected not sorted error, got %v", err)
+
+	_, err = btree.BulkLoad(leafTableCells([]ChidbKey{1, 2, 2}, 10))
+	assert.True(t, errors.Is(err, ErrNotSorted), "Expected not sorted error for duplicated key, got %v", err)
+
+	_, err = btree.BulkLoad([]*BTreeCell{NewLeafTableCell(1, nil), NewLeafIndexCell(2, 20)})
+	assert.True(t, errors.Is(err, ErrInvalidNodeType), "Expected invalid node type error, got %v", err)
+
+	totalPages := btree.pager.totalPages
+	_, err = btree.BulkLoad([]*BTreeCell{{typ: InternalTable, key: 1}})
+	assert.True(t, errors.Is(err, ErrInvalidNodeType), "Expected invalid node type error, got %v", err)
+	assert.Equal(t, totalPages, btree.pager.totalPages, "Expected no pages allocated")
+}
+
+func TestBulkLoadPastPage65535(t *testing.T) {
+	if testing.Short() {
+		t.Skip("bulk loads more than 65535 pages")
+	}
+	btree := openTinyPageBtree(t)
+
+	// Leaves of 512 bytes fit two cells, so the nodes take more pages than
+	// 16 bit page numbers reach
+	keys := sequentialKeys(1, 140000)
+	root, err := btree.BulkLoad(leafTableCells(keys, 200))
+	require.Nil(t, err)
+	require.Greater(t, btree.pager.totalPages, uint32(math.MaxUint16))
+
+	assert.Equal(t, keys, cursorKeys(t, btree, root))
+	assert.Nil(t, btree.CheckIntegrity(root))
+	for _, key := range []ChidbKey{1, 70000, 139999, 140000} {
+		_, err := btree.Find(root, key)
+		assert.Nil(t, err, "Expected to find key %d", key)
+	}
+}
+
+// openTinyPageBtree opens a B-Tree kept in memory with pages of MinPageSize
+// bytes, so trees with many pages are cheap to build
+func openTinyPageBtree(tb testing.TB) *BTree {
+	pager, err := openPagerMemory()
+	require.Nil(tb, err)
+	require.Nil(tb, pager.setPageSize(MinPageSize))
+
+	btree, err := NewBTree(pager)
+	require.Nil(tb, err)
+	tb.Cleanup(func() { pager.Close() })
+	return btree
+}
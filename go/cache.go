@@ -0,0 +1,185 @@
+package chidb
+
+import (
+	"container/list"
+	"context"
+	"sort"
+	"sync"
+)
+
+// pageCache is an in-memory cache of pages with LRU eviction
+//
+// The cache keeps its own copies of the pages, so changes done to a page
+// returned by get are not seen by other readers until the page is put back.
+// Dirty pages are written with writeBack before being evicted.
+type pageCache struct {
+	mu sync.Mutex
+
+	// Maximum number of cached pages
+	capacity int
+
+	// Cached pages by page number
+	pages map[uint32]*list.Element
+
+	// Cached pages ordered from the most to the least recently used
+	lru *list.List
+
+	// Writes a dirty page to the file
+	writeBack func(*MemPage) error
+
+	// Number of pages evicted to keep the cache within its capacity
+	evictions uint64
+}
+
+// cacheEntry is a page on the cache
+type cacheEntry struct {
+	page *MemPage
+
+	// Whether the page was changed after it was read from or written to
+	// the file
+	dirty bool
+}
+
+func newPageCache(capacity int, writeBack func(*MemPage) error) *pageCache {
+	return &pageCache{
+		capacity:  capacity,
+		pages:     make(map[uint32]*list.Element),
+		lru:       list.New(),
+		writeBack: writeBack,
+	}
+}
+
+// get returns a copy of the cached page, marking it as the most recently used
+func (c *pageCache) get(nPage uint32) (*MemPage, bool) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	e, ok := c.pages[nPage]
+	if !ok {
+		return nil, false
+	}
+	c.lru.MoveToFront(e)
+	return e.Value.(*cacheEntry).page.clone(), true
+}
+
+// getInto copies the cached page into dst like get, reusing the data of dst
+func (c *pageCache) getInto(nPage uint32, dst *MemPage) bool {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	e, ok := c.pages[nPage]
+	if !ok {
+		return false
+	}
+	c.lru.MoveToFront(e)
+	e.Value.(*cacheEntry).page.copyTo(dst)
+	return true
+}
+
+// put stores a copy of page as the most recently used page, evicting the
+// least recently used pages if the cache is full
+//
+// A page put as dirty stays dirty until flush, even if it's put again as
+// clean.
+func (c *pageCache) put(page *MemPage, dirty bool) error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if e, ok := c.pages[page.number]; ok {
+		entry := e.Value.(*cacheEntry)
+		entry.page = page.clone()
+		entry.dirty = entry.dirty || dirty
+		c.lru.MoveToFront(e)
+		return nil
+	}
+
+	c.pages[page.number] = c.lru.PushFront(&cacheEntry{page: page.clone(), dirty: dirty})
+	return c.evict()
+}
+
+// remove drops the page from the cache without writing it
+func (c *pageCache) remove(nPage uint32) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if e, ok := c.pages[nPage]; ok {
+		c.lru.Remove(e)
+		delete(c.pages, nPage)
+	}
+}
+
+// clear drops all pages from the cache without writing them
+func (c *pageCache) clear() {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	c.pages = make(map[uint32]*list.Element)
+	c.lru.Init()
+}
+
+// resize changes the capacity of the cache, evicting pages if needed
+func (c *pageCache) resize(capacity int) error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	c.capacity = capacity
+	return c.evict()
+}
+
+// flush writes all dirty pages ordered by page number and marks them clean
+//
+// ctx is checked before writing each page. If it's done, flush stops with
+// the context error and the pages not written yet are kept dirty.
+func (c *pageCache) flush(ctx context.Context) error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	dirty := make([]*cacheEntry, 0)
+	for _, e := range c.pages {
+		if entry := e.Value.(*cacheEntry); entry.dirty {
+			dirty = append(dirty, entry)
+		}
+	}
+	sort.Slice(dirty, func(i, j int) bool {
+		return dirty[i].page.number < dirty[j].page.number
+	})
+
+	for _, entry := range dirty {
+		if err := ctx.Err(); err != nil {
+			return err
+		}
+		if err := c.writeBack(entry.page); err != nil {
+			return err
+		}
+		entry.dirty = false
+	}
+	return nil
+}
+
+func (c *pageCache) evict() error {
+	for c.lru.Len() > c.capacity {
+		e := c.lru.Back()
+		entry := e.Value.(*cacheEntry)
+
+		// A dirty page that fails to be written is kept, so its
+		// changes are not lost.
+		if entry.dirty {
+			if err := c.writeBack(entry.page); err != nil {
+				return err
+			}
+		}
+
+		c.lru.Remove(e)
+		delete(c.pages, entry.page.number)
+		c.evictions++
+	}
+	return nil
+}
+
+// evicted returns the number of pages evicted from the cache
+func (c *pageCache) evicted() uint64 {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	return c.evictions
+}
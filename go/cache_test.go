@@ -0,0 +1,104 @@
+package chidb
+
+import (
+	"context"
+	"errors"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestPageCacheLRU(t *testing.T) {
+	cache := newPageCache(3, nil)
+
+	for nPage := uint32(1); nPage <= 3; nPage++ {
+		require.Nil(t, cache.put(&MemPage{number: nPage}, false))
+	}
+
+	// Page 1 becomes the most recently used, so page 2 is evicted first
+	_, ok := cache.get(1)
+	assert.True(t, ok)
+
+	require.Nil(t, cache.put(&MemPage{number: 4}, false))
+	_, ok = cache.get(2)
+	assert.False(t, ok, "Expected least recently used page 2 to be evicted")
+
+	require.Nil(t, cache.put(&MemPage{number: 5}, false))
+	_, ok = cache.get(3)
+	assert.False(t, ok, "Expected least recently used page 3 to be evicted")
+
+	for _, nPage := range []uint32{1, 4, 5} {
+		_, ok := cache.get(nPage)
+		assert.True(t, ok, "Expected page %d to be cached", nPage)
+	}
+
+	require.Nil(t, cache.resize(1))
+	_, ok = cache.get(5)
+	assert.True(t, ok, "Expected most recently used page to be kept on resize")
+	_, ok = cache.get(1)
+	assert.False(t, ok, "Expected other pages to be evicted on resize")
+}
+
+func TestPageCacheWriteBackDirty(t *testing.T) {
+	written := make([]uint32, 0)
+	cache := newPageCache(2, func(page *MemPage) error {
+		written = append(written, page.number)
+		return nil
+	})
+
+	require.Nil(t, cache.put(&MemPage{number: 1}, true))
+	require.Nil(t, cache.put(&MemPage{number: 2}, false))
+
+	// Putting a dirty page as clean keeps it dirty
+	require.Nil(t, cache.put(&MemPage{number: 1}, false))
+	require.Nil(t, cache.put(&MemPage{number: 3}, true))
+	assert.Empty(t, written, "Expected clean page 2 to be evicted without write")
+
+	require.Nil(t, cache.put(&MemPage{number: 4}, false))
+	assert.Equal(t, []uint32{1}, written, "Expected dirty page 1 to be written when evicted")
+
+	require.Nil(t, cache.flush(context.Background()))
+	assert.Equal(t, []uint32{1, 3}, written, "Expected flush to write dirty page 3")
+
+	require.Nil(t, cache.flush(context.Background()))
+	assert.Equal(t, []uint32{1, 3}, written, "Expected flushed pages to be clean")
+}
+
+func TestPageCacheKeepDirtyOnWriteBackError(t *testing.T) {
+	errWrite := errors.New("write failed")
+	cache := newPageCache(1, func(page *MemPage) error {
+		return errWrite
+	})
+
+	require.Nil(t, cache.put(&MemPage{number: 1}, true))
+
+	err := cache.put(&MemPage{number: 2}, false)
+	assert.True(t, errors.Is(err, errWrite), "Expected write error, got %v", err)
+
+	_, ok := cache.get(1)
+	assert.True(t, ok, "Expected dirty page to be kept when write fails")
+}
+
+func TestPageCacheFlushCanceled(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	written := make([]uint32, 0)
+	cache := newPageCache(10, func(page *MemPage) error {
+		written = append(written, page.number)
+		cancel()
+		return nil
+	})
+
+	for nPage := uint32(1); nPage <= 3; nPage++ {
+		require.Nil(t, cache.put(&MemPage{number: nPage}, true))
+	}
+
+	err := cache.flush(ctx)
+	assert.True(t, errors.Is(err, context.Canceled), "Expected context canceled error, got %v", err)
+	assert.Equal(t, []uint32{1}, written, "Expected flush to stop after the context is canceled")
+
+	require.Nil(t, cache.flush(context.Background()))
+	assert.Equal(t, []uint32{1, 2, 3}, written, "Expected pages not written to be kept dirty")
+}
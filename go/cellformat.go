@@ -0,0 +1,261 @@
+package chidb
+
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+)
+
+var ErrUnknownCellFormat = errors.New("unknown cell format")
+
+// CellFormat is the encoding of the cells of a node
+//
+// The format is stored on the node header, on the byte after the pointer to
+// the cell offset array, so nodes written with different formats can be read
+// from the same file. The high bit of the byte flags OrderDescending nodes,
+// see KeyOrder, and the next one flags the nodes of byte-keyed indexes, see
+// NewByteIndex. The cells of a node are always encoded with its format,
+// including the cells moved from nodes with another format.
+type CellFormat uint8
+
+const (
+	// CellFormatV1 stores the fields of cells as fixed-size little-endian
+	// integers. Nodes written before cell formats were added have it, as
+	// the byte of the format was always zero.
+	CellFormatV1 CellFormat = iota
+
+	// CellFormatV2 stores the key, the child page, the data size and the
+	// primary key of cells as varints, see PutVarint, so small values take
+	// less space. The overflow page of leaf table cells is still stored on
+	// 4 bytes.
+	CellFormatV2
+)
+
+// maxLeafTableCellHeaderSizeV2 is the biggest size of the data size and the
+// key stored before the data of a leaf table cell on CellFormatV2
+const maxLeafTableCellHeaderSizeV2 = 5 + MaxVarintLen
+
+func (f CellFormat) String() string {
+	switch f {
+	case CellFormatV1:
+		return "v1"
+	case CellFormatV2:
+		return "v2"
+	}
+	return "<invalid cell format>"
+}
+
+// encodeCell serializes cell with the cell format of the node
+func (n *BTreeNode) encodeCell(cell *BTreeCell) ([]byte, error) {
+	if n.byteKeys {
+		return cell.bytesKeyed(n.cellFormat)
+	}
+	if n.cellFormat == CellFormatV2 {
+		return cell.bytesV2()
+	}
+	return cell.Bytes()
+}
+
+// maxLocal returns how many bytes of data a leaf table cell stores on the
+// node, see maxLocal. The varints of CellFormatV2 may take more than the
+// fixed-size fields of CellFormatV1, so less data is stored on the page to
+// keep the cell within a third of the page.
+func (n *BTreeNode) maxLocal() int {
+	max := maxLocal(n.page.usableSize())
+	if n.cellFormat == CellFormatV2 {
+		max -= maxLeafTableCellHeaderSizeV2 - leafTableCellHeaderSize
+	}
+	return max
+}
+
+// bytesV2 serializes the cell on CellFormatV2
+func (b *BTreeCell) bytesV2() ([]byte, error) {
+	buf := make([]byte, 0, 3*MaxVarintLen+len(b.fields.tableLeaf.data)+4)
+	varint := make([]byte, MaxVarintLen)
+	putVarint := func(v uint64) {
+		buf = append(buf, varint[:PutVarint(varint, v)]...)
+	}
+
+	switch b.typ {
+	case InternalTable:
+		putVarint(uint64(b.fields.tableInternal.childPage))
+		putVarint(uint64(b.key))
+	case LeafTable:
+		putVarint(uint64(b.fields.tableLeaf.size))
+		putVarint(uint64(b.key))
+		buf = append(buf, b.fields.tableLeaf.data...)
+		if b.fields.tableLeaf.overflowPage != 0 {
+			overflowPage := make([]byte, 4)
+			binary.LittleEndian.PutUint32(overflowPage, b.fields.tableLeaf.overflowPage)
+			buf = append(buf, overflowPage...)
+		}
+	case InternalIndex:
+		putVarint(uint64(b.fields.indexInternal.childPage))
+		putVarint(uint64(b.key))
+		putVarint(b.fields.indexInternal.keyPk)
+	case LeafIndex:
+		putVarint(uint64(b.key))
+		putVarint(b.fields.indexLeaf.keyPk)
+	default:
+		return nil, fmt.Errorf("%w: cell type %d", ErrInvalidNodeType, b.typ)
+	}
+
+	return buf, nil
+}
+
+// cellV2 parses the CellFormatV2 cell nCell of the node stored at the start
+// of data
+func (n *BTreeNode) cellV2(nCell uint16, data []byte) (*BTreeCell, error) {
+	cell := BTreeCell{typ: n.typ}
+
+	readVarint := func() (uint64, error) {
+		v, size := Varint(data)
+		if size == 0 {
+			return 0, fmt.Errorf("%w: cell %d of page %d is cut off by the end of the page", ErrCorruptCell, nCell, n.page.number)
+		}
+		data = data[size:]
+		return v, nil
+	}
+	readUint32 := func() (uint32, error) {
+		v, err := readVarint()
+		if err != nil {
+			return 0, err
+		}
+		if v > 1<<32-1 {
+			return 0, fmt.Errorf("%w: cell %d of page %d has a field of %d bytes", ErrCorruptCell, nCell, n.page.number, v)
+		}
+		return uint32(v), nil
+	}
+
+	switch n.typ {
+	case InternalTable:
+		childPage, err := readUint32()
+		if err != nil {
+			return nil, err
+		}
+		key, err := readVarint()
+		if err != nil {
+			return nil, err
+		}
+		cell.key = ChidbKey(key)
+		cell.fields.tableInternal.childPage = childPage
+	case LeafTable:
+		size, err := readUint32()
+		if err != nil {
+			return nil, err
+		}
+		key, err := readVarint()
+		if err != nil {
+			return nil, err
+		}
+
+		// Only a prefix of big data is stored on the page, followed by
+		// the first overflow page.
+		local, overflow := int64(size), false
+		if max := int64(n.maxLocal()); local > max {
+			local, overflow = max, true
+		}
+
+		cellSize := local
+		if overflow {
+			cellSize += 4
+		}
+		if cellSize > int64(len(data)) {
+			return nil, fmt.Errorf("%w: cell %d size %d exceeds page bounds", ErrCorruptCell, nCell, size)
+		}
+
+		cell.key = ChidbKey(key)
+		cell.fields.tableLeaf.size = size
+		cell.fields.tableLeaf.data = append([]byte{}, data[:local]...)
+		if overflow {
+			cell.fields.tableLeaf.overflowPage = binary.LittleEndian.Uint32(data[local:])
+		}
+	case InternalIndex:
+		childPage, err := readUint32()
+		if err != nil {
+			return nil, err
+		}
+		key, err := readVarint()
+		if err != nil {
+			return nil, err
+		}
+		keyPk, err := readVarint()
+		if err != nil {
+			return nil, err
+		}
+		cell.key = ChidbKey(key)
+		cell.fields.indexInternal.childPage = childPage
+		cell.fields.indexInternal.keyPk = keyPk
+	case LeafIndex:
+		key, err := readVarint()
+		if err != nil {
+			return nil, err
+		}
+		keyPk, err := readVarint()
+		if err != nil {
+			return nil, err
+		}
+		cell.key = ChidbKey(key)
+		cell.fields.indexLeaf.keyPk = keyPk
+	default:
+		return nil, fmt.Errorf("%w: %d", ErrInvalidNodeType, n.typ)
+	}
+
+	return &cell, nil
+}
+
+// cellKeyV2 reads only the key of the CellFormatV2 cell nCell of the node
+// stored at the start of data
+func (n *BTreeNode) cellKeyV2(nCell uint16, data []byte) (ChidbKey, error) {
+	// The key is the first field of leaf index cells, and it follows the
+	// child page or the data size on the other cells.
+	if n.typ != LeafIndex {
+		_, size := Varint(data)
+		if size == 0 {
+			return 0, fmt.Errorf("%w: cell %d of page %d is cut off by the end of the page", ErrCorruptCell, nCell, n.page.number)
+		}
+		data = data[size:]
+	}
+
+	key, size := Varint(data)
+	if size == 0 {
+		return 0, fmt.Errorf("%w: cell %d of page %d is cut off by the end of the page", ErrCorruptCell, nCell, n.page.number)
+	}
+	return ChidbKey(key), nil
+}
+
+// respill stores the data of a leaf table cell read from a node with
+// another cell format again, so the part of the data stored on the page is
+// the one the node stores. Other cells are returned as they are.
+//
+// The part of the data stored on the page depends on the cell format, see
+// maxLocal, so the overflow pages of the cell are read and released, and the
+// data is spilled again on new overflow pages.
+func (n *BTreeNode) respill(cell *BTreeCell) (*BTreeCell, error) {
+	if cell.typ != LeafTable || cell.fields.tableLeaf.overflowPage == 0 ||
+		len(cell.fields.tableLeaf.data) == n.maxLocal() {
+		return cell, nil
+	}
+	if n.pager == nil {
+		return nil, fmt.Errorf("can't read overflow pages of cell %d without pager", cell.key)
+	}
+
+	overflowPage := cell.fields.tableLeaf.overflowPage
+	overflowSize := int(cell.fields.tableLeaf.size) - len(cell.fields.tableLeaf.data)
+	overflow, err := n.pager.readOverflow(overflowPage, overflowSize)
+	if err != nil {
+		return nil, err
+	}
+	if err := n.pager.freeOverflow(overflowPage, overflowSize); err != nil {
+		return nil, err
+	}
+
+	data := make([]byte, 0, cell.fields.tableLeaf.size)
+	data = append(data, cell.fields.tableLeaf.data...)
+	data = append(data, overflow...)
+
+	whole := *cell
+	whole.fields.tableLeaf.data = data
+	whole.fields.tableLeaf.overflowPage = 0
+	return n.spill(&whole)
+}
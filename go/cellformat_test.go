@@ -0,0 +1,167 @@
+package chidb
+
+import (
+	"errors"
+	"path/filepath"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestCellFormatV2GetCell(t *testing.T) {
+	btree := openBtree(t)
+	btree.CellFormat = CellFormatV2
+
+	leafTable := NewLeafTableCell(300, []byte("Hello World"))
+	overflow := NewLeafTableCell(1<<40, make([]byte, 3*btree.pager.usableSize()))
+	internalTable := &BTreeCell{typ: InternalTable, key: 70000}
+	internalTable.fields.tableInternal.childPage = 12
+	leafIndex := NewLeafIndexCell(5, 1<<62)
+	internalIndex := &BTreeCell{typ: InternalIndex, key: 1 << 20}
+	internalIndex.fields.indexInternal.childPage = 200
+	internalIndex.fields.indexInternal.keyPk = 99
+
+	tests := []struct {
+		name string
+		cell *BTreeCell
+	}{
+		{name: "leaf table", cell: leafTable},
+		{name: "leaf table with overflow", cell: overflow},
+		{name: "internal table", cell: internalTable},
+		{name: "leaf index", cell: leafIndex},
+		{name: "internal index", cell: internalIndex},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			node, err := btree.NewNode(tt.cell.typ)
+			require.Nil(t, err, "Expected nil error to create new node")
+			require.Equal(t, CellFormatV2, node.cellFormat)
+			require.Nil(t, node.InsertCell(1, tt.cell), "Expected nil error to insert cell")
+			require.Nil(t, btree.WriteNode(node))
+
+			node, err = btree.GetNodeByPage(node.page.number)
+			require.Nil(t, err)
+			assert.Equal(t, CellFormatV2, node.cellFormat, "Expected cell format to be read from the node header")
+
+			cell, err := node.GetCell(1)
+			require.Nil(t, err, "Expected nil error to get cell")
+			assert.Equal(t, tt.cell, cell)
+
+			key, err := node.cellKey(1)
+			require.Nil(t, err)
+			assert.Equal(t, tt.cell.key, key)
+		})
+	}
+}
+
+func TestCellFormatV2IsSmaller(t *testing.T) {
+	btree := openBtree(t)
+
+	v1, err := btree.NewNode(LeafTable)
+	require.Nil(t, err)
+	btree.CellFormat = CellFormatV2
+	v2, err := btree.NewNode(LeafTable)
+	require.Nil(t, err)
+
+	cell := NewLeafTableCell(10, []byte("data"))
+	v1Size, err := v1.cellSize(cell)
+	require.Nil(t, err)
+	v2Size, err := v2.cellSize(cell)
+	require.Nil(t, err)
+
+	assert.Equal(t, leafTableCellHeaderSize+4, v1Size)
+	assert.Equal(t, 2+4, v2Size, "Expected small size and key to take a byte each")
+}
+
+func TestCellFormatMixed(t *testing.T) {
+	filename := filepath.Join(t.TempDir(), "mixed.db")
+
+	btree, err := Open(filename)
+	require.Nil(t, err)
+	keys := insertSequentialKeys(t, btree, 1, 300, 100)
+	keys = append(keys, insertSequentialKeys(t, btree, 301, 4, 8000)...)
+
+	// Cells moved by splits from the nodes written before go to v2 nodes,
+	// including the ones with overflow pages
+	btree.CellFormat = CellFormatV2
+	keys = append(keys, insertSequentialKeys(t, btree, 305, 300, 100)...)
+	require.Nil(t, btree.Close())
+
+	btree, err = Open(filename)
+	require.Nil(t, err)
+	defer btree.Close()
+
+	formats := nodeFormats(t, btree, 1)
+	assert.NotZero(t, formats[CellFormatV1], "Expected nodes written with v1 cells")
+	assert.NotZero(t, formats[CellFormatV2], "Expected nodes written with v2 cells")
+
+	assert.Equal(t, keys, cursorKeys(t, btree, 1))
+	for _, key := range keys {
+		cell, err := btree.Find(1, key)
+		require.Nil(t, err, "Expected nil error to find key %d", key)
+		if key > 300 && key < 305 {
+			assert.Len(t, cell.fields.tableLeaf.data, 8000)
+		}
+	}
+	assert.Nil(t, btree.CheckIntegrity(1))
+}
+
+func TestCellFormatMoveOverflowCell(t *testing.T) {
+	btree := openBtree(t)
+
+	v1, err := btree.NewNode(LeafTable)
+	require.Nil(t, err)
+	data := randomBytes(3 * btree.pager.usableSize())
+	require.Nil(t, v1.InsertCell(1, NewLeafTableCell(1, data)))
+
+	btree.CellFormat = CellFormatV2
+	v2, err := btree.NewNode(LeafTable)
+	require.Nil(t, err)
+
+	// The cell keeps its overflow pages, which store less data than v2 cells
+	local, err := v1.getLocalCell(1)
+	require.Nil(t, err)
+	require.NotZero(t, local.fields.tableLeaf.overflowPage)
+	require.Nil(t, v2.InsertCell(1, local), "Expected nil error to insert v1 cell on v2 node")
+
+	moved, err := v2.getLocalCell(1)
+	require.Nil(t, err)
+	assert.Len(t, moved.fields.tableLeaf.data, v2.maxLocal())
+
+	cell, err := v2.GetCell(1)
+	require.Nil(t, err)
+	assert.Equal(t, data, cell.fields.tableLeaf.data)
+}
+
+func TestCellFormatUnknown(t *testing.T) {
+	btree := openBtree(t)
+
+	node, err := btree.NewNode(LeafTable)
+	require.Nil(t, err)
+	node.cellFormat = CellFormatV2 + 1
+	require.Nil(t, btree.WriteNode(node))
+
+	_, err = btree.GetNodeByPage(node.page.number)
+	assert.True(t, errors.Is(err, ErrUnknownCellFormat), "Expected unknown cell format error, got %v", err)
+}
+
+// nodeFormats counts the nodes of the B-Tree on nPage by cell format
+func nodeFormats(tb testing.TB, btree *BTree, nPage uint32) map[CellFormat]int {
+	node, err := btree.GetNodeByPage(nPage)
+	require.Nil(tb, err)
+
+	formats := map[CellFormat]int{node.cellFormat: 1}
+	if node.typ == LeafTable || node.typ == LeafIndex {
+		return formats
+	}
+	for nCell := uint16(1); nCell <= node.nCells+1; nCell++ {
+		childPage, err := btree.childPageForPosition(node, nCell)
+		require.Nil(tb, err)
+		for format, count := range nodeFormats(tb, btree, childPage) {
+			formats[format] += count
+		}
+	}
+	return formats
+}
@@ -0,0 +1,362 @@
+package chidb
+
+import "fmt"
+
+// BTreeCursor iterates over the leaf cells of a table B-Tree in ascending
+// key order with Next, or in descending key order with Prev. On tables
+// created with OrderDescending the cells are stored from the largest key,
+// so Next returns them in descending key order and Prev in ascending order.
+//
+// The cursor keeps the path from the root to the current leaf, so after
+// the last cell of a leaf it goes back to the parent and descends to the
+// next child (or the right page) to reach the next leaf.
+//
+// The cursor is positioned between two cells: Next returns the cell after
+// the position and Prev the cell before it, moving the position past the
+// returned cell. So calling Prev after Next returns the same cell again.
+//
+// On index B-Trees, whose internal cells are entries too, the cells of
+// internal nodes are returned between their children.
+type BTreeCursor struct {
+	btree *BTree
+
+	// Root page of the B-Tree
+	rootPage uint32
+
+	// Order of the cells of the B-Tree
+	order KeyOrder
+
+	// Nodes from the root to the current leaf
+	stack []cursorFrame
+
+	// Page of the last node left by the cursor, reused to read the next
+	// node so that iterating doesn't allocate a page for every node
+	spare *MemPage
+
+	// Whether the cursor is before the first cell or after the last cell
+	// of the tree, which leaves stack empty
+	beforeFirst, afterLast bool
+}
+
+// cursorFrame is a node on the path of a cursor
+type cursorFrame struct {
+	node *BTreeNode
+
+	// On internal nodes, the position of the child being visited, where
+	// nCells+1 is the right page. On leaves, the position of the last
+	// returned cell, or zero if no cell was returned yet.
+	nCell uint16
+
+	// On internal index nodes, whether the cell at nCell was returned,
+	// which happens after its child is visited
+	returned bool
+}
+
+// NewCursor create a new BTreeCursor positioned before the first cell of
+// the table or index B-Tree on rootPage
+func (b *BTree) NewCursor(rootPage uint32) (*BTreeCursor, error) {
+	c := &BTreeCursor{
+		btree:    b,
+		rootPage: rootPage,
+	}
+	if err := c.descendLeftmost(rootPage); err != nil {
+		return nil, err
+	}
+	c.order = c.stack[0].node.order
+	return c, nil
+}
+
+// Range returns the leaf cells of the table B-Tree on rootPage whose keys
+// are between lo and hi (inclusive), in the order of the B-Tree
+//
+// The cursor seeks lo and reads cells until a key greater than hi is found,
+// so only the leaves holding keys of the range are read. On OrderDescending
+// B-Trees it seeks hi and reads until a key smaller than lo instead. No
+// cells are returned if lo is greater than hi.
+func (b *BTree) Range(rootPage uint32, lo, hi ChidbKey) ([]*BTreeCell, error) {
+	cells := make([]*BTreeCell, 0)
+	if lo > hi {
+		return cells, nil
+	}
+
+	cursor, err := b.NewCursor(rootPage)
+	if err != nil {
+		return nil, err
+	}
+	last, err := cursor.seekRange(lo, hi)
+	if err != nil {
+		return nil, err
+	}
+
+	for {
+		cell, ok, err := cursor.Next()
+		if err != nil {
+			return nil, err
+		}
+		if !ok || cursor.order.before(last, cell.key) {
+			return cells, nil
+		}
+		cells = append(cells, cell)
+	}
+}
+
+// seekRange positions the cursor at the first cell of the keys between lo
+// and hi in the order of the B-Tree and returns the last key of the range
+// in that order
+func (c *BTreeCursor) seekRange(lo, hi ChidbKey) (ChidbKey, error) {
+	first, last := lo, hi
+	if c.order == OrderDescending {
+		first, last = hi, lo
+	}
+	_, err := c.Seek(first)
+	return last, err
+}
+
+// Next returns the next leaf cell of the B-Tree
+//
+// The boolean return value is false when there are no more cells to read.
+func (c *BTreeCursor) Next() (*BTreeCell, bool, error) {
+	if len(c.stack) == 0 && c.beforeFirst {
+		c.beforeFirst = false
+		if err := c.descendLeftmost(c.rootPage); err != nil {
+			return nil, false, err
+		}
+	}
+
+	for len(c.stack) > 0 {
+		top := &c.stack[len(c.stack)-1]
+
+		if top.node.typ == LeafTable || top.node.typ == LeafIndex {
+			if top.nCell < top.node.nCells {
+				top.nCell++
+				cell, err := top.node.GetCell(top.nCell)
+				if err != nil {
+					return nil, false, err
+				}
+				return cell, true, nil
+			}
+		} else if top.node.typ == InternalIndex && top.nCell >= 1 && top.nCell <= top.node.nCells && !top.returned {
+			top.returned = true
+			cell, err := top.node.GetCell(top.nCell)
+			if err != nil {
+				return nil, false, err
+			}
+			return cell, true, nil
+		} else if top.nCell <= top.node.nCells {
+			top.nCell++
+			top.returned = false
+			childPage, err := c.btree.childPageForPosition(top.node, top.nCell)
+			if err != nil {
+				return nil, false, err
+			}
+			if err := c.descendLeftmost(childPage); err != nil {
+				return nil, false, err
+			}
+			continue
+		}
+
+		// All cells of the node were visited
+		c.spare = top.node.page
+		c.stack = c.stack[:len(c.stack)-1]
+	}
+
+	c.afterLast = true
+	return nil, false, nil
+}
+
+// Prev returns the previous leaf cell of the B-Tree, walking backward from
+// the position of the cursor
+//
+// The boolean return value is false when there are no more cells to read.
+// After the last cell of the tree (e.g. once Next returned no cell), Prev
+// starts from the rightmost leaf.
+func (c *BTreeCursor) Prev() (*BTreeCell, bool, error) {
+	if len(c.stack) == 0 && c.afterLast {
+		c.afterLast = false
+		if err := c.descendRightmost(c.rootPage); err != nil {
+			return nil, false, err
+		}
+	}
+
+	// Whether the child of the top node was just left, so all cells before
+	// the child were returned
+	popped := false
+	for len(c.stack) > 0 {
+		top := &c.stack[len(c.stack)-1]
+
+		if top.node.typ == LeafTable || top.node.typ == LeafIndex {
+			if top.nCell >= 1 {
+				cell, err := top.node.GetCell(top.nCell)
+				if err != nil {
+					return nil, false, err
+				}
+				top.nCell--
+				return cell, true, nil
+			}
+		} else if top.node.typ == InternalIndex && top.returned {
+			// The cell at nCell is after its child, so it's returned
+			// before walking into the child
+			top.returned = false
+			cell, err := top.node.GetCell(top.nCell)
+			if err != nil {
+				return nil, false, err
+			}
+			return cell, true, nil
+		} else if top.node.typ == InternalIndex && !popped {
+			if err := c.descendChildRightmost(top); err != nil {
+				return nil, false, err
+			}
+			continue
+		} else if top.nCell > 1 {
+			top.nCell--
+			popped = false
+			if top.node.typ == InternalIndex {
+				top.returned = true
+				continue
+			}
+			if err := c.descendChildRightmost(top); err != nil {
+				return nil, false, err
+			}
+			continue
+		}
+
+		// All cells of the node were visited
+		c.spare = top.node.page
+		c.stack = c.stack[:len(c.stack)-1]
+		popped = true
+	}
+
+	c.beforeFirst = true
+	return nil, false, nil
+}
+
+// Seek positions the cursor at the first cell whose key is greater than or
+// equal to key, so that it's the cell returned by the following Next
+//
+// The tree is descended from the root following the keys of internal nodes
+// like Find. Returns whether a cell with exactly key was found. If all keys
+// are smaller than key, the following Next returns no cell. On
+// OrderDescending B-Trees it's the first cell whose key is smaller than or
+// equal to key instead.
+func (c *BTreeCursor) Seek(key ChidbKey) (bool, error) {
+	return c.seek(intKey(key))
+}
+
+// seek positions the cursor at key like Seek
+func (c *BTreeCursor) seek(key treeKey) (bool, error) {
+	c.stack = c.stack[:0]
+	c.beforeFirst, c.afterLast = false, false
+
+	nPage := c.rootPage
+	for {
+		node, err := c.push(nPage)
+		if err != nil {
+			return false, err
+		}
+
+		nCell, found, err := c.btree.search(node, key)
+		if err != nil {
+			return false, err
+		}
+
+		if node.typ == LeafTable || node.typ == LeafIndex {
+			// Next advances before reading the cell
+			c.stack[len(c.stack)-1].nCell = nCell - 1
+			return found, nil
+		}
+
+		c.stack[len(c.stack)-1].nCell = nCell
+		if found && node.typ == InternalIndex {
+			// The cell is returned by Next before visiting its child
+			return true, nil
+		}
+		nPage, err = c.btree.childPageForPosition(node, nCell)
+		if err != nil {
+			return false, err
+		}
+	}
+}
+
+// SeekLast positions the cursor after the last cell of the B-Tree, so that
+// Prev returns the cells in descending order
+func (c *BTreeCursor) SeekLast() error {
+	c.stack = c.stack[:0]
+	c.beforeFirst, c.afterLast = false, false
+	return c.descendRightmost(c.rootPage)
+}
+
+// descendLeftmost pushes the nodes from nPage to its leftmost leaf
+func (c *BTreeCursor) descendLeftmost(nPage uint32) error {
+	for {
+		node, err := c.push(nPage)
+		if err != nil {
+			return err
+		}
+		if node.typ == LeafTable || node.typ == LeafIndex {
+			return nil
+		}
+
+		c.stack[len(c.stack)-1].nCell = 1
+		nPage, err = c.btree.childPageForPosition(node, 1)
+		if err != nil {
+			return err
+		}
+	}
+}
+
+// descendRightmost pushes the nodes from nPage to its rightmost leaf,
+// positioned after their last cell
+func (c *BTreeCursor) descendRightmost(nPage uint32) error {
+	for {
+		node, err := c.push(nPage)
+		if err != nil {
+			return err
+		}
+		top := &c.stack[len(c.stack)-1]
+		if node.typ == LeafTable || node.typ == LeafIndex {
+			top.nCell = node.nCells
+			return nil
+		}
+
+		top.nCell = node.nCells + 1
+		nPage, err = c.btree.childPageForPosition(node, top.nCell)
+		if err != nil {
+			return err
+		}
+	}
+}
+
+// descendChildRightmost pushes the nodes from the child at the position of
+// frame to its rightmost leaf
+func (c *BTreeCursor) descendChildRightmost(frame *cursorFrame) error {
+	childPage, err := c.btree.childPageForPosition(frame.node, frame.nCell)
+	if err != nil {
+		return err
+	}
+	return c.descendRightmost(childPage)
+}
+
+// push reads the node on nPage and adds it to the path of the cursor
+func (c *BTreeCursor) push(nPage uint32) (*BTreeNode, error) {
+	page := c.spare
+	if page == nil {
+		page = &MemPage{}
+	}
+	c.spare = nil
+
+	if err := c.btree.pager.ReadPageInto(nPage, page); err != nil {
+		return nil, err
+	}
+	node, err := BTreeNodeFromPage(page)
+	if err != nil {
+		return nil, err
+	}
+	node.pager = c.btree.pager
+
+	if len(c.stack) > 0 && isTable(node.typ) != isTable(c.stack[0].node.typ) {
+		return nil, fmt.Errorf("unexpected %s node on page %d of B-Tree with %s root", node.typ, nPage, c.stack[0].node.typ)
+	}
+
+	c.stack = append(c.stack, cursorFrame{node: node})
+	return node, nil
+}
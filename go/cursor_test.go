@@ -0,0 +1,309 @@
+package chidb
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestCursorNext(t *testing.T) {
+	btree := openBtree(t)
+	root := twoLevelTree(t, btree)
+
+	assert.Equal(t, []ChidbKey{5, 10, 15, 20, 25, 30}, cursorKeys(t, btree, root))
+}
+
+func TestCursorNextMultiLevel(t *testing.T) {
+	btree := openBtree(t)
+
+	// Three cells fit on a leaf, so the tree gets three levels
+	keys := insertSequentialKeys(t, btree, 1, 3500, 5000)
+
+	assert.Equal(t, keys, cursorKeys(t, btree, 1), "Expected every key once in ascending order")
+}
+
+func TestCursorNextEmptyTree(t *testing.T) {
+	btree := openBtree(t)
+
+	cursor, err := btree.NewCursor(1)
+	require.Nil(t, err, "Expected nil error to create cursor")
+
+	_, ok, err := cursor.Next()
+	require.Nil(t, err)
+	assert.False(t, ok, "Expected no cells on empty tree")
+}
+
+func TestCursorSeek(t *testing.T) {
+	btree := openBtree(t)
+	root := twoLevelTree(t, btree)
+
+	tests := []struct {
+		key   ChidbKey
+		found bool
+		next  []ChidbKey
+	}{
+		{key: 5, found: true, next: []ChidbKey{5, 10, 15, 20, 25, 30}},
+		{key: 20, found: true, next: []ChidbKey{20, 25, 30}},
+		{key: 1, found: false, next: []ChidbKey{5, 10, 15, 20, 25, 30}},
+		{key: 12, found: false, next: []ChidbKey{15, 20, 25, 30}},
+		{key: 21, found: false, next: []ChidbKey{25, 30}},
+		{key: 30, found: true, next: []ChidbKey{30}},
+		{key: 31, found: false, next: []ChidbKey{}},
+	}
+
+	cursor, err := btree.NewCursor(root)
+	require.Nil(t, err, "Expected nil error to create cursor")
+
+	for _, tt := range tests {
+		found, err := cursor.Seek(tt.key)
+		require.Nil(t, err, "Expected nil error to seek key %d", tt.key)
+		assert.Equal(t, tt.found, found, "Expected found to be %v seeking key %d", tt.found, tt.key)
+
+		keys := make([]ChidbKey, 0)
+		for {
+			cell, ok, err := cursor.Next()
+			require.Nil(t, err)
+			if !ok {
+				break
+			}
+			keys = append(keys, cell.key)
+		}
+		assert.Equal(t, tt.next, keys, "Expected keys after seeking key %d", tt.key)
+	}
+}
+
+func TestCursorSeekMultiLevel(t *testing.T) {
+	btree := openBtree(t)
+	insertSequentialKeys(t, btree, 1, 3500, 5000)
+
+	cursor, err := btree.NewCursor(1)
+	require.Nil(t, err, "Expected nil error to create cursor")
+
+	for _, key := range []ChidbKey{1, 1000, 2345, 3500} {
+		found, err := cursor.Seek(key)
+		require.Nil(t, err, "Expected nil error to seek key %d", key)
+		assert.True(t, found, "Expected to find key %d", key)
+
+		cell, ok, err := cursor.Next()
+		require.Nil(t, err)
+		require.True(t, ok)
+		assert.Equal(t, key, cell.key)
+	}
+
+	found, err := cursor.Seek(3501)
+	require.Nil(t, err)
+	assert.False(t, found, "Expected to not find key larger than all keys")
+
+	_, ok, err := cursor.Next()
+	require.Nil(t, err)
+	assert.False(t, ok, "Expected no cells after seeking key larger than all keys")
+}
+
+func TestCursorPrev(t *testing.T) {
+	btree := openSmallPageBtree(t)
+
+	// Only even keys, so odd keys are sought between cells
+	keys := make([]ChidbKey, 0)
+	for key := ChidbKey(2); key <= 1000; key += 2 {
+		require.Nil(t, btree.Insert(1, NewLeafTableCell(key, make([]byte, 100))))
+		keys = append(keys, key)
+	}
+	require.Greater(t, treeHeight(t, btree, 1), 2, "Expected tree with many levels")
+
+	cursor, err := btree.NewCursor(1)
+	require.Nil(t, err)
+
+	_, ok, err := cursor.Prev()
+	require.Nil(t, err)
+	assert.False(t, ok, "Expected no cells before the first cell")
+
+	require.Nil(t, cursor.SeekLast())
+	assert.Equal(t, reversed(keys), prevKeys(t, cursor), "Expected every key once in descending order")
+
+	// Prev after walking past the first cell and Next after walking past
+	// the last cell start over from the other end
+	assert.Equal(t, keys, nextKeys(t, cursor))
+	assert.Equal(t, reversed(keys), prevKeys(t, cursor))
+
+	for _, key := range []ChidbKey{2, 3, 100, 101, 555, 1000, 1001} {
+		_, err := cursor.Seek(key)
+		require.Nil(t, err)
+
+		expected := make([]ChidbKey, 0)
+		for _, k := range keys {
+			if k < key {
+				expected = append([]ChidbKey{k}, expected...)
+			}
+		}
+		assert.Equal(t, expected, prevKeys(t, cursor), "Expected keys before %d", key)
+	}
+}
+
+func TestCursorPrevAfterNext(t *testing.T) {
+	btree := openSmallPageBtree(t)
+	insertSequentialKeys(t, btree, 1, 500, 100)
+
+	cursor, err := btree.NewCursor(1)
+	require.Nil(t, err)
+
+	// Walking back and forth returns each cell twice
+	for key := ChidbKey(1); key <= 500; key++ {
+		cell, ok, err := cursor.Next()
+		require.Nil(t, err)
+		require.True(t, ok)
+		require.Equal(t, key, cell.key)
+
+		cell, ok, err = cursor.Prev()
+		require.Nil(t, err)
+		require.True(t, ok)
+		require.Equal(t, key, cell.key, "Expected Prev to return the cell returned by Next")
+
+		_, _, err = cursor.Next()
+		require.Nil(t, err)
+	}
+}
+
+func TestCursorPrevIndex(t *testing.T) {
+	btree := openSmallPageBtree(t)
+	root := newIndex(t, btree)
+	insertIndexKeys(t, btree, root, shuffledKeys(sequentialKeys(1, 500)))
+
+	keys := cursorKeys(t, btree, root)
+
+	cursor, err := btree.NewCursor(root)
+	require.Nil(t, err)
+	require.Nil(t, cursor.SeekLast())
+	assert.Equal(t, reversed(keys), prevKeys(t, cursor), "Expected every key once in descending order")
+
+	// Keys on internal nodes are sought and walked back from too
+	for _, key := range keys {
+		found, err := cursor.Seek(key)
+		require.Nil(t, err)
+		require.True(t, found)
+
+		cell, ok, err := cursor.Prev()
+		require.Nil(t, err)
+		if key == 1 {
+			assert.False(t, ok)
+			continue
+		}
+		require.True(t, ok, "Expected key before %d", key)
+		require.Equal(t, key-1, cell.key)
+
+		cell, ok, err = cursor.Next()
+		require.Nil(t, err)
+		require.True(t, ok)
+		require.Equal(t, key-1, cell.key)
+
+		cell, ok, err = cursor.Next()
+		require.Nil(t, err)
+		require.True(t, ok)
+		require.Equal(t, key, cell.key)
+	}
+}
+
+func TestRange(t *testing.T) {
+	btree := openBtree(t)
+	root := twoLevelTree(t, btree)
+
+	tests := []struct {
+		name   string
+		lo, hi ChidbKey
+		keys   []ChidbKey
+	}{
+		{name: "whole tree", lo: 0, hi: 100, keys: []ChidbKey{5, 10, 15, 20, 25, 30}},
+		{name: "exact bounds", lo: 10, hi: 25, keys: []ChidbKey{10, 15, 20, 25}},
+		{name: "bounds between keys", lo: 11, hi: 24, keys: []ChidbKey{15, 20}},
+		{name: "single key", lo: 20, hi: 20, keys: []ChidbKey{20}},
+		{name: "empty range", lo: 11, hi: 14, keys: []ChidbKey{}},
+		{name: "after all keys", lo: 31, hi: 100, keys: []ChidbKey{}},
+		{name: "lo greater than hi", lo: 20, hi: 10, keys: []ChidbKey{}},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			cells, err := btree.Range(root, tt.lo, tt.hi)
+			require.Nil(t, err, "Expected nil error to read range")
+
+			keys := make([]ChidbKey, 0)
+			for _, cell := range cells {
+				keys = append(keys, cell.key)
+			}
+			assert.Equal(t, tt.keys, keys)
+		})
+	}
+}
+
+// cursorKeys returns the keys of all cells read by a cursor on rootPage
+func cursorKeys(tb testing.TB, btree *BTree, rootPage uint32) []ChidbKey {
+	cursor, err := btree.NewCursor(rootPage)
+	require.Nil(tb, err, "Expected nil error to create cursor")
+
+	keys := make([]ChidbKey, 0)
+	for {
+		cell, ok, err := cursor.Next()
+		require.Nil(tb, err, "Expected nil error to read next cell")
+		if !ok {
+			return keys
+		}
+		keys = append(keys, cell.key)
+	}
+}
+
+// nextKeys returns the keys of the cells read by Next until the last cell
+func nextKeys(tb testing.TB, cursor *BTreeCursor) []ChidbKey {
+	keys := make([]ChidbKey, 0)
+	for {
+		cell, ok, err := cursor.Next()
+		require.Nil(tb, err, "Expected nil error to read next cell")
+		if !ok {
+			return keys
+		}
+		keys = append(keys, cell.key)
+	}
+}
+
+// prevKeys returns the keys of the cells read by Prev until the first cell
+func prevKeys(tb testing.TB, cursor *BTreeCursor) []ChidbKey {
+	keys := make([]ChidbKey, 0)
+	for {
+		cell, ok, err := cursor.Prev()
+		require.Nil(tb, err, "Expected nil error to read previous cell")
+		if !ok {
+			return keys
+		}
+		keys = append(keys, cell.key)
+	}
+}
+
+func reversed(keys []ChidbKey) []ChidbKey {
+	r := make([]ChidbKey, 0, len(keys))
+	for i := len(keys) - 1; i >= 0; i-- {
+		r = append(r, keys[i])
+	}
+	return r
+}
+
+func BenchmarkCursorScan(b *testing.B) {
+	btree := openBtree(b)
+	insertSequentialKeys(b, btree, 1, 5000, 100)
+	require.Nil(b, btree.pager.Flush())
+
+	b.ReportAllocs()
+	for i := 0; i < b.N; i++ {
+		cursor, err := btree.NewCursor(1)
+		if err != nil {
+			b.Fatal(err)
+		}
+		for {
+			_, ok, err := cursor.Next()
+			if err != nil {
+				b.Fatal(err)
+			}
+			if !ok {
+				break
+			}
+		}
+	}
+}
@@ -0,0 +1,540 @@
+package chidb
+
+import "fmt"
+
+// minFillRatio is the fraction of the usable space of a node below which
+// Delete rebalances the node with a sibling.
+const minFillRatio = 1.0 / 3
+
+// Delete removes the cell with key from a table or index B-Tree
+//
+// Starting at rootPage, descends the tree to the leaf containing key and
+// removes its cell, releasing its overflow pages. Returns ErrKeyNotFound if
+// the tree doesn't contain the key. Index B-Trees also store entries on
+// internal nodes: an internal entry with key is replaced by the greatest
+// entry of its left subtree, which is removed from its leaf instead.
+//
+// Nodes are rebalanced on the way up: a node whose cells take less than
+// minFillRatio of its space is merged with a sibling if the cells of both
+// fit on a single node, or otherwise the cells of both are redistributed
+// evenly and the separator key on the parent is updated. A merge removes a
+// cell from the parent, which may underflow in turn. When the root is left
+// with a single child, the child is moved to the root page and the tree gets
+// shorter. The root stays on rootPage.
+//
+// The file change counter and the last modification time on the file
+// header are updated once, after the nodes are written.
+func (b *BTree) Delete(rootPage uint32, key ChidbKey) error {
+	if err := b.deleteKey(rootPage, intKey(key)); err != nil {
+		return err
+	}
+	return b.touch()
+}
+
+// deleteKey removes the cell with key like Delete without updating the
+// header
+//
+// The entry replacing a removed internal entry of a byte-keyed index, or a
+// separator updated by rebalance, may have a bigger key than the one it
+// replaces, so full internal nodes of byte-keyed indexes are split on the
+// way down, like Insert does.
+func (b *BTree) deleteKey(rootPage uint32, key treeKey) error {
+	// The nodes from the root to the leaf, and the position followed on
+	// each internal node as returned by searchKey
+	nodes := make([]*BTreeNode, 0)
+	positions := make([]uint16, 0)
+
+	for nPage := rootPage; ; {
+		node, err := b.getNode(nPage)
+		if err != nil {
+			return err
+		}
+
+		if node.byteKeys && node.typ == InternalIndex {
+			full, err := node.isFullFor(&BTreeCell{typ: InternalIndex})
+			if err != nil {
+				return err
+			}
+			if full {
+				// The parent is searched again to pick the half where
+				// key belongs
+				if len(nodes) == 0 {
+					err = b.splitRoot(node, key)
+				} else {
+					parent := nodes[len(nodes)-1]
+					_, err = b.splitNode(parent, node, positions[len(positions)-1], key)
+					nodes, positions = nodes[:len(nodes)-1], positions[:len(positions)-1]
+					nPage = parent.page.number
+				}
+				if err != nil {
+					return err
+				}
+				continue
+			}
+		}
+		nodes = append(nodes, node)
+
+		nCell, found, err := b.search(node, key)
+		if err != nil {
+			return err
+		}
+
+		if node.typ == LeafTable || node.typ == LeafIndex {
+			if !found {
+				return fmt.Errorf("%w: %v", ErrKeyNotFound, key)
+			}
+			if err := b.removeLeafCell(node, nCell); err != nil {
+				return err
+			}
+			break
+		}
+		if node.typ != InternalTable && node.typ != InternalIndex {
+			return fmt.Errorf("unexpected %s node on page %d", node.typ, nPage)
+		}
+
+		positions = append(positions, nCell)
+		if nPage, err = b.childPageForPosition(node, nCell); err != nil {
+			return err
+		}
+
+		if found && node.typ == InternalIndex {
+			if nodes, positions, err = b.replaceWithPredecessor(node, nCell, nodes, positions); err != nil {
+				return err
+			}
+			break
+		}
+	}
+
+	for i := len(nodes) - 1; i > 0; i-- {
+		underflows, err := nodes[i].underflows()
+		if err != nil {
+			return err
+		}
+		if !underflows {
+			break
+		}
+
+		merged, err := b.rebalance(nodes[i-1], nodes[i], positions[i-1])
+		if err != nil {
+			return err
+		}
+		// Only a merge changes the space used by the parent
+		if !merged {
+			break
+		}
+	}
+
+	return b.collapseRoot(nodes[0])
+}
+
+// DeleteRange removes the cells of the table B-Tree on rootPage whose keys
+// are between lo and hi (inclusive) and returns the number of removed cells
+//
+// The keys of the range are read with a cursor like Range, and then each
+// of them is removed like Delete, so nodes are rebalanced and the root
+// collapses as the cells are removed. Nothing is removed if lo is greater
+// than hi. On error, the cells removed before it stay removed and their
+// number is returned with the error.
+func (b *BTree) DeleteRange(rootPage uint32, lo, hi ChidbKey) (int, error) {
+	if lo > hi {
+		return 0, nil
+	}
+
+	cursor, err := b.NewCursor(rootPage)
+	if err != nil {
+		return 0, err
+	}
+	last, err := cursor.seekRange(lo, hi)
+	if err != nil {
+		return 0, err
+	}
+
+	keys := make([]ChidbKey, 0)
+	for {
+		cell, ok, err := cursor.Next()
+		if err != nil {
+			return 0, err
+		}
+		if !ok || cursor.order.before(last, cell.key) {
+			break
+		}
+		keys = append(keys, cell.key)
+	}
+
+	deleted := 0
+	for _, key := range keys {
+		if err = b.deleteKey(rootPage, intKey(key)); err != nil {
+			break
+		}
+		deleted++
+	}
+
+	if deleted > 0 {
+		if touchErr := b.touch(); err == nil {
+			err = touchErr
+		}
+	}
+	return deleted, err
+}
+
+// replaceWithPredecessor replaces the cell at nCell of an internal index
+// node with the greatest entry of its left subtree, which is removed from
+// its leaf. nodes and positions are the path to node, and are returned
+// extended with the path to the leaf.
+func (b *BTree) replaceWithPredecessor(node *BTreeNode, nCell uint16, nodes []*BTreeNode, positions []uint16) ([]*BTreeNode, []uint16, error) {
+	cell, err := node.getLocalCell(nCell)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	leaf, err := b.getNode(cell.fields.indexInternal.childPage)
+	if err != nil {
+		return nil, nil, err
+	}
+	nodes = append(nodes, leaf)
+	for leaf.typ == InternalIndex {
+		positions = append(positions, leaf.nCells+1)
+		if leaf, err = b.getNode(leaf.rightPage); err != nil {
+			return nil, nil, err
+		}
+		nodes = append(nodes, leaf)
+	}
+	if leaf.typ != LeafIndex || leaf.nCells == 0 {
+		return nil, nil, fmt.Errorf("no entry to replace cell %d of page %d with on page %d", nCell, node.page.number, leaf.page.number)
+	}
+
+	predecessor, err := leaf.getLocalCell(leaf.nCells)
+	if err != nil {
+		return nil, nil, err
+	}
+	if err := b.removeLeafCell(leaf, leaf.nCells); err != nil {
+		return nil, nil, err
+	}
+
+	if err := node.RemoveCell(nCell); err != nil {
+		return nil, nil, err
+	}
+	if err := node.InsertCell(nCell, separatorCell(InternalIndex, predecessor, cell.fields.indexInternal.childPage)); err != nil {
+		return nil, nil, err
+	}
+	return nodes, positions, b.putNode(node)
+}
+
+// freeTree releases every page of the B-Tree on rootPage, including the
+// overflow pages of its cells. Children are released before their parent,
+// so rootPage is the last released page.
+func (b *BTree) freeTree(rootPage uint32) error {
+	if err := b.freeChildren(rootPage); err != nil {
+		return err
+	}
+	return b.pager.DeallocatePage(rootPage)
+}
+
+// freeChildren releases the pages of the B-Tree on rootPage like freeTree,
+// but rootPage itself. Its cells are left pointing to released pages, so
+// the root must be reset before it's used again.
+func (b *BTree) freeChildren(rootPage uint32) error {
+	node, err := b.getNode(rootPage)
+	if err != nil {
+		return err
+	}
+
+	switch node.typ {
+	case InternalTable, InternalIndex:
+		for nCell := uint16(1); nCell <= node.nCells+1; nCell++ {
+			childPage, err := b.childPageForPosition(node, nCell)
+			if err != nil {
+				return err
+			}
+			if err := b.freeTree(childPage); err != nil {
+				return err
+			}
+		}
+	case LeafTable:
+		for nCell := uint16(1); nCell <= node.nCells; nCell++ {
+			cell, err := node.getLocalCell(nCell)
+			if err != nil {
+				return err
+			}
+			if cell.fields.tableLeaf.overflowPage == 0 {
+				continue
+			}
+			overflowSize := int(cell.fields.tableLeaf.size) - len(cell.fields.tableLeaf.data)
+			if err := b.pager.freeOverflow(cell.fields.tableLeaf.overflowPage, overflowSize); err != nil {
+				return err
+			}
+		}
+	}
+
+	return nil
+}
+
+// removeLeafCell removes the cell at nCell from a leaf table node, writes
+// the node and releases the overflow pages of the cell
+func (b *BTree) removeLeafCell(leaf *BTreeNode, nCell uint16) error {
+	cell, err := leaf.getLocalCell(nCell)
+	if err != nil {
+		return err
+	}
+
+	if err := leaf.RemoveCell(nCell); err != nil {
+		return err
+	}
+	if err := b.putNode(leaf); err != nil {
+		return err
+	}
+
+	if cell.fields.tableLeaf.overflowPage == 0 {
+		return nil
+	}
+	overflowSize := int(cell.fields.tableLeaf.size) - len(cell.fields.tableLeaf.data)
+	return b.pager.freeOverflow(cell.fields.tableLeaf.overflowPage, overflowSize)
+}
+
+// rebalance merges or redistributes the cells of child, which is reached on
+// parent through position nCell, and one of its siblings. Returns whether
+// the nodes were merged, removing a cell from parent.
+func (b *BTree) rebalance(parent, child *BTreeNode, nCell uint16) (bool, error) {
+	// The sibling is the node after child, or the node before it if child
+	// is the right page of parent. s is the position of the parent cell
+	// separating both nodes, which points to the left one.
+	s := nCell
+	if nCell > parent.nCells {
+		s = nCell - 1
+	}
+	if s == 0 {
+		// An internal node with no cells has no siblings to rebalance
+		// with, it's only left on the root by collapseRoot.
+		return false, nil
+	}
+
+	leftPage, err := b.ChildPage(parent, s)
+	if err != nil {
+		return false, err
+	}
+	rightPage, err := b.childPageForPosition(parent, s+1)
+	if err != nil {
+		return false, err
+	}
+
+	left, err := b.getNode(leftPage)
+	if err != nil {
+		return false, err
+	}
+	right, err := b.getNode(rightPage)
+	if err != nil {
+		return false, err
+	}
+	if left.typ != child.typ || right.typ != child.typ {
+		return false, fmt.Errorf("siblings on pages %d and %d have different types", leftPage, rightPage)
+	}
+
+	separator, err := parent.getLocalCell(s)
+	if err != nil {
+		return false, err
+	}
+
+	leftCells, err := left.cells()
+	if err != nil {
+		return false, err
+	}
+	rightCells, err := right.cells()
+	if err != nil {
+		return false, err
+	}
+
+	// On internal nodes the separator key moves down between the cells
+	// of both nodes, pointing to the right page of the left node. On index
+	// leaves the separator is an entry, so it moves down too.
+	cells := append([]*BTreeCell{}, leftCells...)
+	switch child.typ {
+	case InternalTable, InternalIndex:
+		cells = append(cells, separatorCell(child.typ, separator, left.rightPage))
+	case LeafIndex:
+		cells = append(cells, indexLeafCell(separator))
+	}
+	cells = append(cells, rightCells...)
+
+	size, err := right.sizeOf(cells)
+	if err != nil {
+		return false, err
+	}
+
+	if size <= right.usableSpace() {
+		// The right node is kept, so the parent cell pointing to it
+		// (or its right page) stays valid.
+		if err := right.reset(right.typ); err != nil {
+			return false, err
+		}
+		if err := right.appendCells(cells); err != nil {
+			return false, err
+		}
+		if err := b.putNode(right); err != nil {
+			return false, err
+		}
+
+		if err := parent.RemoveCell(s); err != nil {
+			return false, err
+		}
+		if err := b.putNode(parent); err != nil {
+			return false, err
+		}
+		return true, b.pager.DeallocatePage(leftPage)
+	}
+
+	m, err := right.splitPoint(cells)
+	if err != nil {
+		return false, err
+	}
+
+	// Table leaves keep every cell, the others move the cell at m up to
+	// the parent
+	lower, upper := cells[:m], cells[m:]
+	middle := cells[m-1]
+	if child.typ != LeafTable {
+		lower, upper = cells[:m], cells[m+1:]
+		middle = cells[m]
+	}
+
+	// The keys of byte-keyed indexes have different sizes, so the new
+	// separator may not fit on the parent. The nodes are left as they are
+	// then, which keeps the tree valid with an underflowing node.
+	if parent.byteKeys {
+		fits, err := parent.fitsReplacing(s, separatorCell(parent.typ, middle, leftPage))
+		if err != nil || !fits {
+			return false, err
+		}
+	}
+
+	if err := left.reset(left.typ); err != nil {
+		return false, err
+	}
+	if child.typ == InternalTable || child.typ == InternalIndex {
+		left.rightPage = cellChildPage(middle)
+	}
+	if err := left.appendCells(lower); err != nil {
+		return false, err
+	}
+	if err := b.putNode(left); err != nil {
+		return false, err
+	}
+
+	if err := right.reset(right.typ); err != nil {
+		return false, err
+	}
+	if err := right.appendCells(upper); err != nil {
+		return false, err
+	}
+	if err := b.putNode(right); err != nil {
+		return false, err
+	}
+
+	cell := separatorCell(parent.typ, middle, leftPage)
+	if err := parent.RemoveCell(s); err != nil {
+		return false, err
+	}
+	if err := parent.InsertCell(s, cell); err != nil {
+		return false, err
+	}
+	return false, b.putNode(parent)
+}
+
+// collapseRoot moves the only child of an internal root with no cells to
+// the root page, as many times as needed. The child is kept if its cells
+// don't fit on the root, which may happen on page 1 since it also holds the
+// file header.
+func (b *BTree) collapseRoot(root *BTreeNode) error {
+	for (root.typ == InternalTable || root.typ == InternalIndex) && root.nCells == 0 {
+		childPage := root.rightPage
+		child, err := b.getNode(childPage)
+		if err != nil {
+			return err
+		}
+
+		cells, err := child.cells()
+		if err != nil {
+			return err
+		}
+		size, err := root.sizeOf(cells)
+		if err != nil {
+			return err
+		}
+		if size > root.usableSpace() {
+			return nil
+		}
+
+		if err := root.reset(child.typ); err != nil {
+			return err
+		}
+		root.rightPage = child.rightPage
+		if err := root.appendCells(cells); err != nil {
+			return err
+		}
+		if err := b.putNode(root); err != nil {
+			return err
+		}
+		if err := b.pager.DeallocatePage(childPage); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// underflows reports whether the live cells of the node take less than
+// minFillRatio of its usable space, see FillRatio
+func (n *BTreeNode) underflows() (bool, error) {
+	ratio, err := n.FillRatio()
+	if err != nil {
+		return false, err
+	}
+	return ratio < minFillRatio, nil
+}
+
+// usableSpace returns the space of the node after its header, where the
+// cell offset array and the cell area are stored
+func (n *BTreeNode) usableSpace() int {
+	return n.page.Len() - int(n.cellOffsetArray)
+}
+
+// sizeOf returns the space that cells take on the node, including their
+// entries on the cell offset array
+func (n *BTreeNode) sizeOf(cells []*BTreeCell) (int, error) {
+	total := 0
+	for _, cell := range cells {
+		size, err := n.cellSize(cell)
+		if err != nil {
+			return 0, err
+		}
+		total += size + 2
+	}
+	return total, nil
+}
+
+// splitPoint returns the position where cells are split in two halves of
+// about the same size, with at least one cell on each half and, on nodes
+// other than table leaves, a cell left between them to be the separator
+func (n *BTreeNode) splitPoint(cells []*BTreeCell) (int, error) {
+	total, err := n.sizeOf(cells)
+	if err != nil {
+		return 0, err
+	}
+
+	max := len(cells) - 1
+	if n.typ != LeafTable {
+		max = len(cells) - 2
+	}
+
+	m, size := 0, 0
+	for m < max && size < total/2 {
+		cellSize, err := n.sizeOf(cells[m : m+1])
+		if err != nil {
+			return 0, err
+		}
+		size += cellSize
+		m++
+	}
+	if m == 0 {
+		m = 1
+	}
+	return m, nil
+}
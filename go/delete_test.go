@@ -0,0 +1,189 @@
+package chidb
+
+import (
+	"errors"
+	"math"
+	"math/rand"
+	"path/filepath"
+	"sort"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestDelete(t *testing.T) {
+	orders := map[string]func(keys []ChidbKey){
+		"ascending": func(keys []ChidbKey) {},
+		"descending": func(keys []ChidbKey) {
+			sort.Slice(keys, func(i, j int) bool { return keys[i] > keys[j] })
+		},
+		"random": func(keys []ChidbKey) {
+			rand.Shuffle(len(keys), func(i, j int) { keys[i], keys[j] = keys[j], keys[i] })
+		},
+		"interleaved": func(keys []ChidbKey) {
+			sort.SliceStable(keys, func(i, j int) bool { return keys[i]%2 < keys[j]%2 })
+		},
+	}
+
+	for name, order := range orders {
+		t.Run(name, func(t *testing.T) {
+			btree := openSmallPageBtree(t)
+			keys := insertSequentialKeys(t, btree, 1, 500, 200)
+			require.Equal(t, 3, treeHeight(t, btree, 1), "Expected tree with three levels")
+
+			deleted := append([]ChidbKey{}, keys...)
+			order(deleted)
+
+			remaining := make(map[ChidbKey]bool)
+			for _, key := range keys {
+				remaining[key] = true
+			}
+
+			for i, key := range deleted {
+				require.Nil(t, btree.Delete(1, key), "Expected nil error to delete key %d", key)
+				delete(remaining, key)
+
+				if i%50 != 0 {
+					continue
+				}
+				require.Nil(t, btree.CheckIntegrity(1))
+				treeHeight(t, btree, 1)
+				for key := range remaining {
+					_, err := btree.Find(1, key)
+					require.Nil(t, err, "Expected to find key %d after deleting %d keys", key, i+1)
+				}
+			}
+
+			assert.Empty(t, cursorKeys(t, btree, 1))
+			assert.Equal(t, 1, treeHeight(t, btree, 1), "Expected root to collapse into a leaf")
+		})
+	}
+}
+
+func TestDeleteRange(t *testing.T) {
+	btree := openSmallPageBtree(t)
+	keys := insertSequentialKeys(t, btree, 1, 500, 200)
+	require.Equal(t, 3, treeHeight(t, btree, 1), "Expected tree with three levels")
+
+	// The range spans most leaves, so nodes are merged on the way
+	deleted, err := btree.DeleteRange(1, 21, 480)
+	require.Nil(t, err)
+	assert.Equal(t, 460, deleted)
+
+	remaining := append(keys[:20:20], keys[480:]...)
+	assert.Equal(t, remaining, cursorKeys(t, btree, 1))
+	assert.Nil(t, btree.CheckIntegrity(1))
+	assert.Equal(t, 2, treeHeight(t, btree, 1), "Expected root to collapse")
+
+	deleted, err = btree.DeleteRange(1, 600, 700)
+	require.Nil(t, err)
+	assert.Equal(t, 0, deleted, "Expected no cells deleted past the last key")
+
+	deleted, err = btree.DeleteRange(1, 10, 5)
+	require.Nil(t, err)
+	assert.Equal(t, 0, deleted, "Expected no cells deleted with lo greater than hi")
+
+	deleted, err = btree.DeleteRange(1, 0, math.MaxUint64)
+	require.Nil(t, err)
+	assert.Equal(t, len(remaining), deleted)
+	assert.Empty(t, cursorKeys(t, btree, 1))
+	assert.Equal(t, 1, treeHeight(t, btree, 1), "Expected root to collapse into a leaf")
+}
+
+func TestDeleteReleasesPages(t *testing.T) {
+	btree := openSmallPageBtree(t)
+	keys := insertSequentialKeys(t, btree, 1, 200, 200)
+
+	for _, key := range keys[:150] {
+		require.Nil(t, btree.Delete(1, key))
+	}
+	assert.Equal(t, keys[150:], cursorKeys(t, btree, 1))
+	assert.Nil(t, btree.CheckIntegrity(1))
+
+	free, err := btree.pager.freePages()
+	require.Nil(t, err)
+	assert.NotEmpty(t, free, "Expected pages of merged nodes to be released")
+
+	// Pages of merged nodes are reused
+	totalPages := btree.pager.totalPages
+	insertSequentialKeys(t, btree, 1, len(free), 200)
+	assert.Equal(t, totalPages, btree.pager.totalPages)
+}
+
+func TestDeletePastPage65535(t *testing.T) {
+	if testing.Short() {
+		t.Skip("bulk loads more than 65535 pages")
+	}
+	btree := openTinyPageBtree(t)
+	keys := sequentialKeys(1, 140000)
+	root, err := btree.BulkLoad(leafTableCells(keys, 200))
+	require.Nil(t, err)
+	require.Greater(t, btree.pager.totalPages, uint32(math.MaxUint16))
+
+	// Merging the last nodes rewrites right pages past page 65535
+	for _, key := range keys[100000:130000] {
+		require.Nil(t, btree.Delete(root, key), "Expected nil error to delete key %d", key)
+	}
+
+	remaining := append(keys[:100000:100000], keys[130000:]...)
+	assert.Equal(t, remaining, cursorKeys(t, btree, root))
+	assert.Nil(t, btree.CheckIntegrity(root))
+	treeHeight(t, btree, root)
+}
+
+func TestDeleteOverflow(t *testing.T) {
+	btree := openBtree(t)
+
+	data := randomBytes(3 * int(btree.pager.PageSize()))
+	require.Nil(t, btree.Insert(1, NewLeafTableCell(1, data)))
+
+	require.Nil(t, btree.Delete(1, 1))
+	free, err := btree.pager.freePages()
+	require.Nil(t, err)
+	assert.Equal(t, 3, len(free), "Expected overflow pages to be released")
+}
+
+func TestDeleteKeyNotFound(t *testing.T) {
+	btree := openBtree(t)
+	insertSequentialKeys(t, btree, 1, 10, 10)
+
+	err := btree.Delete(1, 11)
+	assert.True(t, errors.Is(err, ErrKeyNotFound), "Expected key not found error, got %v", err)
+}
+
+// openSmallPageBtree opens a BTree with 1024 bytes pages, so a few hundred
+// cells make a tree with many levels
+func openSmallPageBtree(tb testing.TB) *BTree {
+	pager, err := OpenPager(filepath.Join(tb.TempDir(), "small.db"))
+	require.Nil(tb, err)
+	require.Nil(tb, pager.setPageSize(1024))
+
+	btree, err := NewBTree(pager)
+	require.Nil(tb, err)
+	tb.Cleanup(func() { pager.Close() })
+	return btree
+}
+
+// treeHeight returns the height of the tree on rootPage, failing if its
+// leaves are on different levels
+func treeHeight(tb testing.TB, btree *BTree, rootPage uint32) int {
+	node, err := btree.GetNodeByPage(rootPage)
+	require.Nil(tb, err)
+	if node.typ == LeafTable || node.typ == LeafIndex {
+		return 1
+	}
+
+	height := 0
+	for nCell := uint16(1); nCell <= node.nCells+1; nCell++ {
+		childPage, err := btree.childPageForPosition(node, nCell)
+		require.Nil(tb, err)
+
+		h := treeHeight(tb, btree, childPage)
+		if height != 0 {
+			require.Equal(tb, height, h, "Expected children of page %d with same height", rootPage)
+		}
+		height = h
+	}
+	return height + 1
+}
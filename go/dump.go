@@ -0,0 +1,80 @@
+package chidb
+
+import (
+	"fmt"
+	"io"
+	"strings"
+)
+
+// Dump writes a human-readable representation of the B-Tree on rootPage to w
+//
+// Each node is written as a line with its page number, type and number of
+// cells, followed by a line for each cell indented by the depth of the node.
+// Cells of internal nodes show the child page, which is dumped right after
+// the cell, and the right page is dumped after the last cell. For example:
+//
+//	page 2: internal table, 1 cells
+//	  key 10 -> page 3
+//	  page 3: leaf table, 2 cells
+//	    key 5
+//	    key 10
+//	  right -> page 4
+//	  page 4: leaf table, 1 cells
+//	    key 15
+//
+// The output only depends on the content of the tree, so it can be compared
+// against an expected dump on tests.
+func (b *BTree) Dump(rootPage uint32, w io.Writer) error {
+	return b.dumpNode(rootPage, w, 0)
+}
+
+func (b *BTree) dumpNode(nPage uint32, w io.Writer, depth int) error {
+	node, err := b.GetNodeByPage(nPage)
+	if err != nil {
+		return err
+	}
+
+	indent := strings.Repeat("  ", depth)
+	if _, err := fmt.Fprintf(w, "%spage %d: %s, %d cells\n", indent, nPage, node.typ, node.nCells); err != nil {
+		return err
+	}
+
+	indent += "  "
+	for nCell := uint16(1); nCell <= node.nCells; nCell++ {
+		cell, err := node.getLocalCell(nCell)
+		if err != nil {
+			return err
+		}
+
+		switch cell.typ {
+		case InternalTable, InternalIndex:
+			childPage, err := b.ChildPage(node, nCell)
+			if err != nil {
+				return err
+			}
+			if _, err := fmt.Fprintf(w, "%skey %v -> page %d\n", indent, cellTreeKey(cell), childPage); err != nil {
+				return err
+			}
+			if err := b.dumpNode(childPage, w, depth+1); err != nil {
+				return err
+			}
+		default:
+			if _, err := fmt.Fprintf(w, "%skey %v\n", indent, cellTreeKey(cell)); err != nil {
+				return err
+			}
+		}
+	}
+
+	if node.typ == LeafTable || node.typ == LeafIndex {
+		return nil
+	}
+
+	rightPage, err := b.childPageForPosition(node, node.nCells+1)
+	if err != nil {
+		return err
+	}
+	if _, err := fmt.Fprintf(w, "%sright -> page %d\n", indent, rightPage); err != nil {
+		return err
+	}
+	return b.dumpNode(rightPage, w, depth+1)
+}
@@ -0,0 +1,42 @@
+package chidb
+
+import (
+	"bytes"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestDump(t *testing.T) {
+	btree := openBtree(t)
+	root := twoLevelTree(t, btree)
+
+	var out bytes.Buffer
+	require.Nil(t, btree.Dump(root, &out), "Expected nil error to dump tree")
+
+	expected := `page 2: internal table, 2 cells
+  key 10 -> page 3
+  page 3: leaf table, 2 cells
+    key 5
+    key 10
+  key 20 -> page 4
+  page 4: leaf table, 2 cells
+    key 15
+    key 20
+  right -> page 5
+  page 5: leaf table, 2 cells
+    key 25
+    key 30
+`
+	assert.Equal(t, expected, out.String())
+}
+
+func TestDumpEmptyTree(t *testing.T) {
+	btree := openBtree(t)
+
+	var out bytes.Buffer
+	require.Nil(t, btree.Dump(1, &out), "Expected nil error to dump tree")
+
+	assert.Equal(t, "page 1: leaf table, 0 cells\n", out.String())
+}
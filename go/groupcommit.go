@@ -0,0 +1,107 @@
+package chidb
+
+import "context"
+
+// commitGroup is a group of commits waiting for the file to be synced, see
+// Pager.GroupCommit
+//
+// The first commit of the group syncs the file while the next transactions
+// run and commit, so it syncs again until no commit joined the group during
+// the last sync. The journal of the committed transactions is kept until
+// then, since a crash before their pages are synced must undo all of them.
+type commitGroup struct {
+	// Number of commits and syncs that joined the group
+	commits int
+
+	// Set while the group waits for the active transaction to end before
+	// its last sync, new transactions wait for the group to end
+	closing bool
+
+	// Set when the group ended, with the error of its syncs
+	done bool
+	err  error
+}
+
+// groupCommit writes the pages of the active transaction and commits it
+// with the commits of its group
+func (p *Pager) groupCommit() error {
+	if err := p.flush(context.Background()); err != nil {
+		return err
+	}
+	p.endGroupTransaction()
+	return p.groupSync()
+}
+
+// endGroupTransaction ends the active transaction keeping its journal, for
+// the commit group to delete it
+func (p *Pager) endGroupTransaction() {
+	p.journal.active = false
+	p.journal.begin = nil
+	p.journal.savepoints = nil
+	p.groupCond.Broadcast()
+}
+
+// groupSync waits for the file to be synced by the commit group, leading
+// the group if there is none
+//
+// The flushed pages are synced when it returns.
+func (p *Pager) groupSync() error {
+	if g := p.group; g != nil {
+		g.commits++
+		for !g.done {
+			p.groupCond.Wait()
+		}
+		return g.err
+	}
+
+	g := &commitGroup{commits: 1}
+	p.group = g
+	g.err = p.leadGroup(g)
+	g.done = true
+	p.group = nil
+	p.groupCond.Broadcast()
+	return g.err
+}
+
+// leadGroup syncs the file until the commits of the group are synced, then
+// deletes their journal
+//
+// p.mu is released during the syncs, so other transactions can run.
+func (p *Pager) leadGroup(g *commitGroup) error {
+	for {
+		commits := g.commits
+
+		p.mu.Unlock()
+		err := p.buffer.Sync()
+		p.mu.Lock()
+		if err != nil {
+			return err
+		}
+
+		if p.inTransaction() {
+			// The journal is shared with the active transaction, the group
+			// ends after it
+			g.closing = true
+			for p.inTransaction() {
+				p.groupCond.Wait()
+			}
+			continue
+		}
+		if g.commits == commits {
+			break
+		}
+	}
+
+	if p.journal == nil {
+		return nil
+	}
+	return p.endTransaction()
+}
+
+// waitTransaction waits for the active transaction to end and for a closing
+// commit group, so a new transaction can begin
+func (p *Pager) waitTransaction() {
+	for !p.closed && (p.inTransaction() || p.group != nil && p.group.closing) {
+		p.groupCond.Wait()
+	}
+}
@@ -0,0 +1,130 @@
+package chidb
+
+import (
+	"errors"
+	"fmt"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestGroupCommit(t *testing.T) {
+	s := &syncCountingStorage{}
+	pager, err := OpenPagerStorage(s)
+	require.Nil(t, err)
+	defer pager.Close()
+	pager.GroupCommit = true
+	btree, err := NewBTree(pager)
+	require.Nil(t, err)
+
+	const goroutines, commits = 8, 25
+	var wg sync.WaitGroup
+	errs := make(chan error, goroutines)
+	for g := 0; g < goroutines; g++ {
+		wg.Add(1)
+		go func(g int) {
+			defer wg.Done()
+			for i := 0; i < commits; i++ {
+				key := ChidbKey(g*commits + i + 1)
+				if err := btree.BeginTransaction(); err != nil {
+					errs <- err
+					return
+				}
+				if err := btree.Insert(1, NewLeafTableCell(key, randomBytes(100))); err != nil {
+					errs <- err
+					return
+				}
+
+				syncs := s.syncCount()
+				if err := btree.Commit(); err != nil {
+					errs <- err
+					return
+				}
+				if s.syncCount() == syncs {
+					errs <- fmt.Errorf("commit of key %d returned before the file was synced", key)
+					return
+				}
+			}
+		}(g)
+	}
+	wg.Wait()
+	close(errs)
+	for err := range errs {
+		require.Nil(t, err)
+	}
+
+	assert.Equal(t, sequentialKeys(1, goroutines*commits), cursorKeys(t, btree, 1))
+	assert.Nil(t, btree.CheckIntegrity(1))
+	assert.Less(t, s.syncCount(), goroutines*commits, "Expected commits to share syncs")
+	assert.Nil(t, pager.journal, "Expected journal deleted after the last group")
+}
+
+func TestGroupCommitRollback(t *testing.T) {
+	s := &syncCountingStorage{}
+	pager, err := OpenPagerStorage(s)
+	require.Nil(t, err)
+	defer pager.Close()
+	pager.GroupCommit = true
+	btree, err := NewBTree(pager)
+	require.Nil(t, err)
+
+	keys := insertSequentialKeys(t, btree, 1, 100, 100)
+
+	// A slow sync keeps the group of the first commit waiting, so the
+	// other transactions begin on its journal
+	s.delay = 50 * time.Millisecond
+	committed := make(chan error)
+	require.Nil(t, btree.BeginTransaction())
+	require.Nil(t, btree.Insert(1, NewLeafTableCell(101, randomBytes(100))))
+	go func() { committed <- btree.Commit() }()
+
+	rollback := func() error {
+		if err := btree.BeginTransaction(); err != nil {
+			return err
+		}
+		for _, key := range keys[:50] {
+			if err := btree.Delete(1, key); err != nil {
+				return err
+			}
+		}
+		return btree.Rollback()
+	}
+	require.Nil(t, rollback())
+	require.Nil(t, <-committed)
+
+	assert.Equal(t, append(keys, 101), cursorKeys(t, btree, 1), "Expected committed key and no deleted keys")
+	assert.Nil(t, btree.CheckIntegrity(1))
+
+	err = btree.Rollback()
+	assert.True(t, errors.Is(err, ErrNoTransaction), "Expected no transaction after rollback, got %v", err)
+}
+
+// syncCountingStorage is a storage kept in memory that counts its syncs,
+// which take delay
+type syncCountingStorage struct {
+	memoryStorage
+
+	delay time.Duration
+
+	syncMu sync.Mutex
+	syncs  int
+}
+
+func (s *syncCountingStorage) Sync() error {
+	// Syncs are slow enough for commits to pile up meanwhile
+	time.Sleep(s.delay + time.Millisecond)
+
+	s.syncMu.Lock()
+	defer s.syncMu.Unlock()
+	s.syncs++
+	return nil
+}
+
+func (s *syncCountingStorage) syncCount() int {
+	s.syncMu.Lock()
+	defer s.syncMu.Unlock()
+	return s.syncs
+}
@@ -0,0 +1,167 @@
+package chidb
+
+import (
+	"errors"
+	"fmt"
+	"sort"
+)
+
+// FindInIndex searches key on the index B-Tree on rootPage and returns the
+// primary key of its entry
+//
+// Like Find, the search stops at an internal cell with key, so entries on
+// internal nodes are found too. found is false if the index has no entry
+// for key. Returns ErrInvalidNodeType if rootPage is a table B-Tree.
+func (b *BTree) FindInIndex(rootPage uint32, key ChidbKey) (keyPk uint64, found bool, err error) {
+	return b.findInIndex(rootPage, intKey(key))
+}
+
+// findInIndex searches key like FindInIndex
+func (b *BTree) findInIndex(rootPage uint32, key treeKey) (keyPk uint64, found bool, err error) {
+	root, err := b.GetNodeByPage(rootPage)
+	if err != nil {
+		return 0, false, err
+	}
+	if isTable(root.typ) {
+		return 0, false, fmt.Errorf("%w: can't search index on %s node of page %d", ErrInvalidNodeType, root.typ, rootPage)
+	}
+
+	cell, err := b.find(rootPage, key)
+	if errors.Is(err, ErrKeyNotFound) {
+		return 0, false, nil
+	}
+	if err != nil {
+		return 0, false, err
+	}
+
+	if cell.typ == InternalIndex {
+		return cell.fields.indexInternal.keyPk, true, nil
+	}
+	return cell.fields.indexLeaf.keyPk, true, nil
+}
+
+// IndexRange returns the primary keys of the entries of the index B-Tree on
+// rootPage whose keys are between lo and hi (inclusive), ordered by key
+//
+// Index keys are ordered numerically, like the keys of table B-Trees, and
+// entries are read with a cursor like Range does, including the entries on
+// internal nodes. Returns ErrInvalidNodeType if rootPage is a table B-Tree,
+// or ErrKeyType if it's a byte-keyed index, see NewByteIndex.
+func (b *BTree) IndexRange(rootPage uint32, lo, hi ChidbKey) ([]uint64, error) {
+	root, err := b.GetNodeByPage(rootPage)
+	if err != nil {
+		return nil, err
+	}
+	if isTable(root.typ) {
+		return nil, fmt.Errorf("%w: can't scan index on %s node of page %d", ErrInvalidNodeType, root.typ, rootPage)
+	}
+
+	cells, err := b.Range(rootPage, lo, hi)
+	if err != nil {
+		return nil, err
+	}
+
+	keyPks := make([]uint64, 0, len(cells))
+	for _, cell := range cells {
+		if cell.typ == InternalIndex {
+			keyPks = append(keyPks, cell.fields.indexInternal.keyPk)
+		} else {
+			keyPks = append(keyPks, cell.fields.indexLeaf.keyPk)
+		}
+	}
+	return keyPks, nil
+}
+
+// InsertWithIndex inserts a row with key and data on the table B-Tree on
+// tableRoot and its entry mapping indexedValue to key on the index B-Tree on
+// indexRoot
+//
+// Both are inserted on their own transaction, so if either insert fails
+// (e.g. the index already has an entry for indexedValue) neither tree is
+// changed. Like Vacuum, it fails with ErrTransactionActive during a
+// transaction.
+func (b *BTree) InsertWithIndex(tableRoot, indexRoot uint32, key, indexedValue ChidbKey, data []byte) error {
+	return b.transaction(func() error {
+		if err := b.Insert(tableRoot, NewLeafTableCell(key, data)); err != nil {
+			return err
+		}
+		return b.Insert(indexRoot, NewLeafIndexCell(indexedValue, uint64(key)))
+	})
+}
+
+// DeleteWithIndex removes the row with key from the table B-Tree on
+// tableRoot and its entry for indexedValue from the index B-Tree on
+// indexRoot
+//
+// Each indexed value has a single entry, so the entry is only removed if
+// it maps indexedValue to key. Otherwise, or if the table has no row with
+// key, ErrKeyNotFound is returned. Like InsertWithIndex, both are removed on
+// their own transaction, so neither tree is changed on error.
+func (b *BTree) DeleteWithIndex(tableRoot, indexRoot uint32, key, indexedValue ChidbKey) error {
+	return b.transaction(func() error {
+		keyPk, found, err := b.FindInIndex(indexRoot, indexedValue)
+		if err != nil {
+			return err
+		}
+		if !found || keyPk != uint64(key) {
+			return fmt.Errorf("%w: no entry mapping %d to key %d on index %d", ErrKeyNotFound, indexedValue, key, indexRoot)
+		}
+
+		if err := b.Delete(tableRoot, key); err != nil {
+			return err
+		}
+		return b.Delete(indexRoot, indexedValue)
+	})
+}
+
+// BuildIndex builds a new index B-Tree over the rows of the table B-Tree on
+// tableRoot and returns its root page
+//
+// The table is scanned with a cursor, extract returns the indexed value of
+// the data of each row, and the entries mapping each value to the key of
+// its row are bulk loaded in order of value, see BulkLoad. Each indexed
+// value can only have one entry, so ErrDuplicateKey is returned if two rows
+// have the same value, without writing any page.
+func (b *BTree) BuildIndex(tableRoot uint32, extract func(data []byte) ChidbKey) (uint32, error) {
+	cursor, err := b.NewCursor(tableRoot)
+	if err != nil {
+		return 0, err
+	}
+
+	entries := make([]*BTreeCell, 0)
+	for {
+		cell, ok, err := cursor.Next()
+		if err != nil {
+			return 0, err
+		}
+		if !ok {
+			break
+		}
+		if cell.typ != LeafTable {
+			return 0, fmt.Errorf("%w: can't index %s cell of page %d", ErrInvalidNodeType, cell.typ, tableRoot)
+		}
+		entries = append(entries, NewLeafIndexCell(extract(cell.fields.tableLeaf.data), uint64(cell.key)))
+	}
+
+	sort.Slice(entries, func(i, j int) bool {
+		return entries[i].key < entries[j].key
+	})
+	for i := 1; i < len(entries); i++ {
+		if entries[i].key == entries[i-1].key {
+			return 0, fmt.Errorf(
+				"%w: keys %d and %d have the same indexed value %d", ErrDuplicateKey,
+				entries[i-1].fields.indexLeaf.keyPk, entries[i].fields.indexLeaf.keyPk, entries[i].key,
+			)
+		}
+	}
+
+	// BulkLoad makes a table leaf of no cells
+	if len(entries) == 0 {
+		root, err := b.NewNode(LeafIndex)
+		if err != nil {
+			return 0, err
+		}
+		return root.page.number, nil
+	}
+	return b.BulkLoad(entries)
+}
@@ -0,0 +1,391 @@
+package chidb
+
+import (
+	"encoding/binary"
+	"errors"
+	"math/rand"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestIndexKeyOrder(t *testing.T) {
+	btree := openSmallPageBtree(t)
+	root := newIndex(t, btree)
+
+	keys := sequentialKeys(1, 500)
+	insertIndexKeys(t, btree, root, shuffledKeys(keys))
+	require.Greater(t, treeHeight(t, btree, root), 1, "Expected index with many levels")
+
+	assert.Equal(t, keys, cursorKeys(t, btree, root), "Expected keys in numeric order")
+	assert.Nil(t, btree.CheckIntegrity(root))
+
+	for _, key := range keys {
+		cell, err := btree.Find(root, key)
+		require.Nil(t, err, "Expected nil error to find key %d", key)
+		assert.Equal(t, uint64(key)*10, cell.fields.indexLeaf.keyPk+cell.fields.indexInternal.keyPk)
+	}
+
+	err := btree.Insert(root, NewLeafIndexCell(250, 0))
+	assert.True(t, errors.Is(err, ErrDuplicateKey), "Expected duplicate key error, got %v", err)
+}
+
+func TestIndexSeek(t *testing.T) {
+	btree := openSmallPageBtree(t)
+	root := newIndex(t, btree)
+
+	// Even keys only, so odd keys are missing from the index
+	keys := make([]ChidbKey, 0, 500)
+	for key := ChidbKey(2); key <= 1000; key += 2 {
+		keys = append(keys, key)
+	}
+	insertIndexKeys(t, btree, root, shuffledKeys(keys))
+	require.Greater(t, treeHeight(t, btree, root), 1, "Expected index with many levels")
+
+	cursor, err := btree.NewCursor(root)
+	require.Nil(t, err)
+
+	for _, key := range keys {
+		found, err := cursor.Seek(key)
+		require.Nil(t, err)
+		assert.True(t, found, "Expected to seek key %d", key)
+
+		cell, ok, err := cursor.Next()
+		require.Nil(t, err)
+		require.True(t, ok)
+		assert.Equal(t, key, cell.key)
+
+		if key == 1000 {
+			continue
+		}
+		cell, ok, err = cursor.Next()
+		require.Nil(t, err)
+		require.True(t, ok)
+		assert.Equal(t, key+2, cell.key, "Expected key after %d", key)
+	}
+
+	// Keys missing from the index are sought before the next key
+	found, err := cursor.Seek(501)
+	require.Nil(t, err)
+	assert.False(t, found)
+	cell, ok, err := cursor.Next()
+	require.Nil(t, err)
+	require.True(t, ok)
+	assert.Equal(t, ChidbKey(502), cell.key)
+
+	_, err = cursor.Seek(1001)
+	require.Nil(t, err)
+	_, ok, err = cursor.Next()
+	require.Nil(t, err)
+	assert.False(t, ok, "Expected no key after the last key")
+}
+
+func TestIndexRange(t *testing.T) {
+	btree := openSmallPageBtree(t)
+	root := newIndex(t, btree)
+
+	// Only even keys, on an index deep enough to have entries on internal
+	// nodes
+	keys := make([]ChidbKey, 0)
+	for key := ChidbKey(2); len(keys) < 200; key += 2 {
+		keys = append(keys, key)
+	}
+	insertIndexKeys(t, btree, root, shuffledKeys(keys))
+	require.Greater(t, treeHeight(t, btree, root), 1, "Expected index with internal nodes")
+
+	keyPks := func(from, to ChidbKey) []uint64 {
+		pks := make([]uint64, 0)
+		for key := from; key <= to; key += 2 {
+			pks = append(pks, uint64(key)*10)
+		}
+		return pks
+	}
+
+	tests := []struct {
+		name   string
+		lo, hi ChidbKey
+		keyPks []uint64
+	}{
+		{name: "whole index", lo: 0, hi: 1000, keyPks: keyPks(2, 400)},
+		{name: "exact bounds", lo: 100, hi: 250, keyPks: keyPks(100, 250)},
+		{name: "bounds between keys", lo: 101, hi: 249, keyPks: keyPks(102, 248)},
+		{name: "single key", lo: 200, hi: 200, keyPks: []uint64{2000}},
+		{name: "empty range", lo: 201, hi: 201, keyPks: []uint64{}},
+		{name: "after all keys", lo: 401, hi: 1000, keyPks: []uint64{}},
+		{name: "lo greater than hi", lo: 200, hi: 100, keyPks: []uint64{}},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			pks, err := btree.IndexRange(root, tt.lo, tt.hi)
+			require.Nil(t, err, "Expected nil error to read index range")
+			assert.Equal(t, tt.keyPks, pks)
+		})
+	}
+}
+
+func TestIndexRangeOnTable(t *testing.T) {
+	btree := openBtree(t)
+
+	_, err := btree.IndexRange(1, 0, 10)
+	assert.True(t, errors.Is(err, ErrInvalidNodeType), "Expected invalid node type error to scan table B-Tree, got %v", err)
+}
+
+func TestInsertWithIndex(t *testing.T) {
+	btree := openSmallPageBtree(t)
+	index := newIndex(t, btree)
+
+	keys := sequentialKeys(1, 200)
+	for _, key := range keys {
+		err := btree.InsertWithIndex(1, index, key, 1000-key, randomBytes(100))
+		require.Nil(t, err, "Expected nil error to insert key %d", key)
+	}
+
+	assert.Equal(t, keys, cursorKeys(t, btree, 1))
+	assert.Nil(t, btree.CheckIntegrity(index))
+	for _, key := range keys {
+		keyPk, found, err := btree.FindInIndex(index, 1000-key)
+		require.Nil(t, err)
+		require.True(t, found, "Expected to find value %d of key %d", 1000-key, key)
+		assert.Equal(t, uint64(key), keyPk)
+	}
+
+	// The index has an entry for the value of key 1, so the row isn't
+	// inserted either
+	err := btree.InsertWithIndex(1, index, 201, 999, randomBytes(100))
+	assert.True(t, errors.Is(err, ErrDuplicateKey), "Expected duplicate key error, got %v", err)
+	assert.Equal(t, keys, cursorKeys(t, btree, 1), "Expected table unchanged by the failed insert")
+	keyPk, found, err := btree.FindInIndex(index, 999)
+	require.Nil(t, err)
+	require.True(t, found)
+	assert.Equal(t, uint64(1), keyPk)
+
+	// The table has key 1, so the entry isn't inserted either
+	err = btree.InsertWithIndex(1, index, 1, 5000, randomBytes(100))
+	assert.True(t, errors.Is(err, ErrDuplicateKey), "Expected duplicate key error, got %v", err)
+	_, found, err = btree.FindInIndex(index, 5000)
+	require.Nil(t, err)
+	assert.False(t, found, "Expected index unchanged by the failed insert")
+
+	require.Nil(t, btree.BeginTransaction())
+	err = btree.InsertWithIndex(1, index, 201, 799, nil)
+	assert.True(t, errors.Is(err, ErrTransactionActive), "Expected transaction active error, got %v", err)
+	require.Nil(t, btree.Rollback())
+}
+
+func TestDeleteWithIndex(t *testing.T) {
+	btree := openSmallPageBtree(t)
+	index := newIndex(t, btree)
+
+	keys := sequentialKeys(1, 200)
+	for _, key := range keys {
+		require.Nil(t, btree.InsertWithIndex(1, index, key, 1000-key, randomBytes(100)))
+	}
+
+	for _, key := range keys[:150] {
+		require.Nil(t, btree.DeleteWithIndex(1, index, key, 1000-key), "Expected nil error to delete key %d", key)
+	}
+
+	assert.Equal(t, keys[150:], cursorKeys(t, btree, 1))
+	assert.Nil(t, btree.CheckIntegrity(1))
+	assert.Nil(t, btree.CheckIntegrity(index))
+	for _, key := range keys {
+		keyPk, found, err := btree.FindInIndex(index, 1000-key)
+		require.Nil(t, err)
+		if key <= 150 {
+			assert.False(t, found, "Expected no entry for deleted key %d", key)
+			continue
+		}
+		require.True(t, found, "Expected entry for key %d", key)
+		assert.Equal(t, uint64(key), keyPk)
+	}
+
+	// The entry of value 800 maps to key 200, so key 199 isn't deleted
+	err := btree.DeleteWithIndex(1, index, 199, 800)
+	assert.True(t, errors.Is(err, ErrKeyNotFound), "Expected key not found error, got %v", err)
+	assert.Equal(t, keys[150:], cursorKeys(t, btree, 1), "Expected table unchanged by the failed delete")
+
+	// Removing the table row fails, so the entry isn't removed either
+	require.Nil(t, btree.Insert(index, NewLeafIndexCell(5000, 5000)))
+	err = btree.DeleteWithIndex(1, index, 5000, 5000)
+	assert.True(t, errors.Is(err, ErrKeyNotFound), "Expected key not found error, got %v", err)
+	_, found, err := btree.FindInIndex(index, 5000)
+	require.Nil(t, err)
+	assert.True(t, found, "Expected index unchanged by the failed delete")
+}
+
+func TestBuildIndex(t *testing.T) {
+	btree := openSmallPageBtree(t)
+
+	// The indexed value is on the first 8 bytes of the data, which
+	// overflows on some rows
+	keys := sequentialKeys(1, 300)
+	for _, key := range keys {
+		data := randomBytes(100)
+		if key%50 == 0 {
+			data = randomBytes(3000)
+		}
+		binary.BigEndian.PutUint64(data, uint64(10000-key))
+		require.Nil(t, btree.Insert(1, NewLeafTableCell(key, data)))
+	}
+	extract := func(data []byte) ChidbKey {
+		return ChidbKey(binary.BigEndian.Uint64(data))
+	}
+
+	index, err := btree.BuildIndex(1, extract)
+	require.Nil(t, err)
+	assert.Nil(t, btree.CheckIntegrity(index))
+	require.Greater(t, treeHeight(t, btree, index), 1, "Expected index with many levels")
+
+	for _, key := range keys {
+		keyPk, found, err := btree.FindInIndex(index, 10000-key)
+		require.Nil(t, err)
+		require.True(t, found, "Expected entry for key %d", key)
+		assert.Equal(t, uint64(key), keyPk)
+	}
+	_, found, err := btree.FindInIndex(index, 10000)
+	require.Nil(t, err)
+	assert.False(t, found)
+
+	// Rows inserted later are kept on the index with InsertWithIndex
+	require.Nil(t, btree.InsertWithIndex(1, index, 301, 1, nil))
+	keyPk, found, err := btree.FindInIndex(index, 1)
+	require.Nil(t, err)
+	require.True(t, found)
+	assert.Equal(t, uint64(301), keyPk)
+
+	_, err = btree.BuildIndex(1, func(data []byte) ChidbKey { return 7 })
+	assert.True(t, errors.Is(err, ErrDuplicateKey), "Expected duplicate key error, got %v", err)
+}
+
+func TestBuildIndexEmptyTable(t *testing.T) {
+	btree := openBtree(t)
+
+	index, err := btree.BuildIndex(1, func(data []byte) ChidbKey { return 1 })
+	require.Nil(t, err)
+
+	_, found, err := btree.FindInIndex(index, 1)
+	require.Nil(t, err, "Expected empty index leaf")
+	assert.False(t, found)
+
+	require.Nil(t, btree.Insert(index, NewLeafIndexCell(1, 1)))
+	assert.Equal(t, []ChidbKey{1}, cursorKeys(t, btree, index))
+}
+
+func TestIndexDelete(t *testing.T) {
+	btree := openSmallPageBtree(t)
+	root := newIndex(t, btree)
+
+	keys := sequentialKeys(1, 5000)
+	insertIndexKeys(t, btree, root, shuffledKeys(keys))
+	require.Greater(t, treeHeight(t, btree, root), 2, "Expected index with many internal levels")
+
+	remaining := make(map[ChidbKey]bool)
+	for _, key := range keys {
+		remaining[key] = true
+	}
+
+	for i, key := range shuffledKeys(keys) {
+		require.Nil(t, btree.Delete(root, key), "Expected nil error to delete key %d", key)
+		delete(remaining, key)
+
+		_, err := btree.Find(root, key)
+		require.True(t, errors.Is(err, ErrKeyNotFound), "Expected deleted key %d not found, got %v", key, err)
+
+		if i%500 != 0 {
+			continue
+		}
+		require.Nil(t, btree.CheckIntegrity(root), "Expected valid index after deleting %d keys", i+1)
+		for key := range remaining {
+			keyPk, found, err := btree.FindInIndex(root, key)
+			require.Nil(t, err)
+			require.True(t, found, "Expected to find key %d after deleting %d keys", key, i+1)
+			require.Equal(t, uint64(key)*10, keyPk)
+		}
+	}
+
+	assert.Empty(t, cursorKeys(t, btree, root))
+	assert.Equal(t, 1, treeHeight(t, btree, root), "Expected root to collapse into a leaf")
+
+	err := btree.Delete(root, 1)
+	assert.True(t, errors.Is(err, ErrKeyNotFound), "Expected key not found error, got %v", err)
+}
+
+func TestInsertIndexCellOnTable(t *testing.T) {
+	btree := openBtree(t)
+
+	err := btree.Insert(1, NewLeafIndexCell(1, 1))
+	assert.True(t, errors.Is(err, ErrInvalidNodeType), "Expected invalid node type error to insert index cell on table B-Tree, got %v", err)
+}
+
+func TestFindInIndex(t *testing.T) {
+	btree := openSmallPageBtree(t)
+	root := newIndex(t, btree)
+
+	// Only even keys, so odd keys between them are absent
+	keys := make([]ChidbKey, 0)
+	for key := ChidbKey(2); len(keys) < 60; key += 2 {
+		keys = append(keys, key)
+	}
+	insertIndexKeys(t, btree, root, shuffledKeys(keys))
+	require.Equal(t, 2, treeHeight(t, btree, root), "Expected index with two levels")
+
+	for _, key := range keys {
+		keyPk, found, err := btree.FindInIndex(root, key)
+		require.Nil(t, err, "Expected nil error to find key %d", key)
+		assert.True(t, found, "Expected key %d found", key)
+		assert.Equal(t, uint64(key)*10, keyPk, "Expected primary key of key %d", key)
+	}
+
+	// Keys on the root are found without descending to the leaves
+	node, err := btree.GetNodeByPage(root)
+	require.Nil(t, err)
+	require.Equal(t, InternalIndex, node.typ)
+	separators, err := node.cells()
+	require.Nil(t, err)
+	require.NotEmpty(t, separators)
+	for _, separator := range separators {
+		keyPk, found, err := btree.FindInIndex(root, separator.key)
+		require.Nil(t, err)
+		assert.True(t, found, "Expected separator key %d found", separator.key)
+		assert.Equal(t, separator.fields.indexInternal.keyPk, keyPk)
+	}
+
+	for _, key := range []ChidbKey{0, 1, 3, 61, keys[len(keys)-1] + 1, 1000} {
+		keyPk, found, err := btree.FindInIndex(root, key)
+		require.Nil(t, err, "Expected nil error to search absent key %d", key)
+		assert.False(t, found, "Expected key %d not found", key)
+		assert.Equal(t, uint64(0), keyPk)
+	}
+}
+
+func TestFindInIndexOnTable(t *testing.T) {
+	btree := openBtree(t)
+
+	_, _, err := btree.FindInIndex(1, 1)
+	assert.True(t, errors.Is(err, ErrInvalidNodeType), "Expected invalid node type error to search table B-Tree, got %v", err)
+}
+
+// newIndex creates an empty index B-Tree and returns its root page
+func newIndex(tb testing.TB, btree *BTree) uint32 {
+	root, err := btree.NewNode(LeafIndex)
+	require.Nil(tb, err)
+	return root.page.number
+}
+
+// insertIndexKeys inserts an entry for each key mapping it to the primary
+// key ten times greater
+func insertIndexKeys(tb testing.TB, btree *BTree, root uint32, keys []ChidbKey) {
+	for _, key := range keys {
+		require.Nil(tb, btree.Insert(root, NewLeafIndexCell(key, uint64(key)*10)), "Expected nil error to insert key %d", key)
+	}
+}
+
+func shuffledKeys(keys []ChidbKey) []ChidbKey {
+	shuffled := append([]ChidbKey{}, keys...)
+	rand.Shuffle(len(shuffled), func(i, j int) {
+		shuffled[i], shuffled[j] = shuffled[j], shuffled[i]
+	})
+	return shuffled
+}
@@ -0,0 +1,336 @@
+package chidb
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"fmt"
+)
+
+var ErrKeyType = errors.New("key type differs from the keys of the B-Tree")
+
+var ErrKeyTooLarge = errors.New("key too large")
+
+// nodeByteKeys is the bit of the cell format byte of the node header that
+// flags the nodes of byte-keyed index B-Trees, see NewByteIndex
+const nodeByteKeys = 0x40
+
+// NewByteIndex creates an empty byte-keyed index B-Tree and returns its root
+// page
+//
+// The entries of a byte-keyed index map a key of arbitrary bytes, e.g. a
+// text or a composite value, to the primary key of a row, and are ordered
+// by the Comparator of the BTree. Its entries are created with
+// NewLeafIndexCellBytes and found with FindBytes, FindInIndexBytes and
+// BTreeCursor.SeekBytes. Keys can take up to a third of a page.
+func (b *BTree) NewByteIndex() (uint32, error) {
+	root, err := b.NewNode(LeafIndex)
+	if err != nil {
+		return 0, err
+	}
+	root.byteKeys = true
+	if err := b.writeNode(root); err != nil {
+		return 0, err
+	}
+	return root.page.number, nil
+}
+
+// NewLeafIndexCellBytes creates a leaf index cell of a byte-keyed index
+// mapping key to the primary key keyPk of a table row
+func NewLeafIndexCellBytes(key []byte, keyPk uint64) *BTreeCell {
+	cell := &BTreeCell{
+		typ:      LeafIndex,
+		keyBytes: append([]byte{}, key...),
+	}
+	cell.fields.indexLeaf.keyPk = keyPk
+	return cell
+}
+
+// FindBytes searches key on a byte-keyed index B-Tree like Find, comparing
+// keys with the Comparator of the BTree
+//
+// Returns ErrKeyType if the B-Tree on nPage isn't a byte-keyed index, see
+// NewByteIndex.
+func (b *BTree) FindBytes(nPage uint32, key []byte) (*BTreeCell, error) {
+	return b.find(nPage, bytesKey(key))
+}
+
+// FindInIndexBytes searches key on the byte-keyed index B-Tree on rootPage
+// like FindInIndex and returns the primary key of its entry
+func (b *BTree) FindInIndexBytes(rootPage uint32, key []byte) (keyPk uint64, found bool, err error) {
+	return b.findInIndex(rootPage, bytesKey(key))
+}
+
+// DeleteBytes removes the entry with key from a byte-keyed index B-Tree like
+// Delete
+func (b *BTree) DeleteBytes(rootPage uint32, key []byte) error {
+	if err := b.deleteKey(rootPage, bytesKey(key)); err != nil {
+		return err
+	}
+	return b.touch()
+}
+
+// SeekBytes positions the cursor of a byte-keyed index B-Tree at the first
+// entry whose key isn't ordered before key by the Comparator of the BTree,
+// like Seek
+func (c *BTreeCursor) SeekBytes(key []byte) (bool, error) {
+	return c.seek(bytesKey(key))
+}
+
+// treeKey is a key searched on a B-Tree: a ChidbKey, or the bytes of a key
+// of a byte-keyed index B-Tree
+type treeKey struct {
+	key     ChidbKey
+	bytes   []byte
+	isBytes bool
+}
+
+func intKey(key ChidbKey) treeKey {
+	return treeKey{key: key}
+}
+
+func bytesKey(key []byte) treeKey {
+	return treeKey{bytes: key, isBytes: true}
+}
+
+// cellTreeKey returns the key of cell
+func cellTreeKey(cell *BTreeCell) treeKey {
+	if cell.keyBytes != nil {
+		return bytesKey(cell.keyBytes)
+	}
+	return intKey(cell.key)
+}
+
+// cellTreeKey reads only the key of the cell nCell, like cellKey
+func (n *BTreeNode) cellTreeKey(nCell uint16) (treeKey, error) {
+	if !n.byteKeys {
+		key, err := n.cellKey(nCell)
+		return intKey(key), err
+	}
+
+	cell, err := n.getLocalCell(nCell)
+	if err != nil {
+		return treeKey{}, err
+	}
+	return bytesKey(cell.keyBytes), nil
+}
+
+// equal reports whether k and o are the same key, comparing byte keys
+// byte-wise
+func (k treeKey) equal(o treeKey) bool {
+	if k.isBytes != o.isBytes {
+		return false
+	}
+	if k.isBytes {
+		return bytes.Equal(k.bytes, o.bytes)
+	}
+	return k.key == o.key
+}
+
+func (k treeKey) String() string {
+	if k.isBytes {
+		return fmt.Sprintf("%q", k.bytes)
+	}
+	return fmt.Sprint(k.key)
+}
+
+// compareKeys compares the keys a and c of a B-Tree in order, returning a
+// negative number if a goes before c, zero if they're the same key and a
+// positive number if a goes after c. Byte keys are compared with
+// Comparator.
+func (b *BTree) compareKeys(order KeyOrder, a, c treeKey) int {
+	cmp := 0
+	switch {
+	case a.isBytes:
+		cmp = b.compareBytes(a.bytes, c.bytes)
+	case a.key < c.key:
+		cmp = -1
+	case a.key > c.key:
+		cmp = 1
+	}
+	if order == OrderDescending {
+		return -cmp
+	}
+	return cmp
+}
+
+func (b *BTree) compareBytes(x, y []byte) int {
+	if b.Comparator != nil {
+		return b.Comparator(x, y)
+	}
+	return bytes.Compare(x, y)
+}
+
+// search binary searches the cells of node for key like searchKey, except
+// that the keys of byte-keyed index nodes are compared with Comparator
+//
+// Returns ErrKeyType if key is a byte key and the node has ChidbKey keys, or
+// the other way around.
+func (b *BTree) search(node *BTreeNode, key treeKey) (uint16, bool, error) {
+	if key.isBytes != node.byteKeys {
+		return 0, false, fmt.Errorf("%w: can't search key %v on page %d", ErrKeyType, key, node.page.number)
+	}
+	if !node.byteKeys {
+		return node.searchKey(key.key)
+	}
+
+	lo, hi := uint16(1), node.nCells+1
+	for lo < hi {
+		mid := lo + (hi-lo)/2
+
+		cell, err := node.getLocalCell(mid)
+		if err != nil {
+			return 0, false, err
+		}
+
+		if b.compareKeys(node.order, bytesKey(cell.keyBytes), key) < 0 {
+			lo = mid + 1
+		} else {
+			hi = mid
+		}
+	}
+
+	if lo > node.nCells {
+		return lo, false, nil
+	}
+
+	cell, err := node.getLocalCell(lo)
+	if err != nil {
+		return 0, false, err
+	}
+	return lo, b.compareKeys(node.order, bytesKey(cell.keyBytes), key) == 0, nil
+}
+
+// maxKeyBytes returns the size of the biggest key of a byte-keyed index
+// node. Like the data stored on the page by a leaf table cell, see
+// maxLocal, it keeps the cells within a third of the page.
+func (n *BTreeNode) maxKeyBytes() int {
+	return maxLocal(n.page.usableSize()) - MaxVarintLen
+}
+
+// fitsReplacing reports whether cell fits on the node in place of the cell
+// at nCell once the node is defragmented
+func (n *BTreeNode) fitsReplacing(nCell uint16, cell *BTreeCell) (bool, error) {
+	cells, err := n.cells()
+	if err != nil {
+		return false, err
+	}
+	cells[nCell-1] = cell
+
+	size, err := n.sizeOf(cells)
+	if err != nil {
+		return false, err
+	}
+	return size <= n.usableSpace(), nil
+}
+
+// indexLeafCell returns a leaf index cell with the entry of the internal
+// index cell
+func indexLeafCell(cell *BTreeCell) *BTreeCell {
+	leaf := NewLeafIndexCell(cell.key, cell.fields.indexInternal.keyPk)
+	leaf.keyBytes = cell.keyBytes
+	return leaf
+}
+
+// bytesKeyed serializes an index cell of a byte-keyed node with format
+//
+// The key is stored as its length, as a varint, followed by its bytes, in
+// place of the ChidbKey. The child page and the primary key are stored as
+// on cells of the format.
+func (b *BTreeCell) bytesKeyed(format CellFormat) ([]byte, error) {
+	buf := make([]byte, 0, 4+MaxVarintLen+len(b.keyBytes)+MaxVarintLen)
+	varint := make([]byte, MaxVarintLen)
+	put := func(v uint64, size int) {
+		if format == CellFormatV2 {
+			buf = append(buf, varint[:PutVarint(varint, v)]...)
+			return
+		}
+		fixed := make([]byte, 8)
+		binary.LittleEndian.PutUint64(fixed, v)
+		buf = append(buf, fixed[:size]...)
+	}
+	putKey := func() {
+		buf = append(buf, varint[:PutVarint(varint, uint64(len(b.keyBytes)))]...)
+		buf = append(buf, b.keyBytes...)
+	}
+
+	switch b.typ {
+	case InternalIndex:
+		put(uint64(b.fields.indexInternal.childPage), 4)
+		putKey()
+		put(b.fields.indexInternal.keyPk, 8)
+	case LeafIndex:
+		putKey()
+		put(b.fields.indexLeaf.keyPk, 8)
+	default:
+		return nil, fmt.Errorf("%w: %s cell with byte key", ErrInvalidNodeType, b.typ)
+	}
+
+	return buf, nil
+}
+
+// byteKeyCell parses the index cell nCell of a byte-keyed node stored at the
+// start of data
+func (n *BTreeNode) byteKeyCell(nCell uint16, data []byte) (*BTreeCell, error) {
+	cutOff := func() error {
+		return fmt.Errorf("%w: cell %d of page %d is cut off by the end of the page", ErrCorruptCell, nCell, n.page.number)
+	}
+	read := func(size int) (uint64, error) {
+		if n.cellFormat == CellFormatV2 {
+			v, read := Varint(data)
+			if read == 0 {
+				return 0, cutOff()
+			}
+			data = data[read:]
+			return v, nil
+		}
+
+		if len(data) < size {
+			return 0, cutOff()
+		}
+		fixed := make([]byte, 8)
+		copy(fixed, data[:size])
+		data = data[size:]
+		return binary.LittleEndian.Uint64(fixed), nil
+	}
+	readKey := func() ([]byte, error) {
+		size, read := Varint(data)
+		if read == 0 || size > uint64(len(data)-read) {
+			return nil, cutOff()
+		}
+		key := append([]byte{}, data[read:read+int(size)]...)
+		data = data[read+int(size):]
+		return key, nil
+	}
+
+	cell := BTreeCell{typ: n.typ}
+	switch n.typ {
+	case InternalIndex:
+		childPage, err := read(4)
+		if err != nil {
+			return nil, err
+		}
+		if childPage > 1<<32-1 {
+			return nil, fmt.Errorf("%w: cell %d of page %d has child page %d", ErrCorruptCell, nCell, n.page.number, childPage)
+		}
+		if cell.keyBytes, err = readKey(); err != nil {
+			return nil, err
+		}
+		if cell.fields.indexInternal.keyPk, err = read(8); err != nil {
+			return nil, err
+		}
+		cell.fields.indexInternal.childPage = uint32(childPage)
+	case LeafIndex:
+		var err error
+		if cell.keyBytes, err = readKey(); err != nil {
+			return nil, err
+		}
+		if cell.fields.indexLeaf.keyPk, err = read(8); err != nil {
+			return nil, err
+		}
+	default:
+		return nil, fmt.Errorf("%w: %s node with byte keys", ErrInvalidNodeType, n.typ)
+	}
+
+	return &cell, nil
+}
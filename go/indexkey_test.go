@@ -0,0 +1,269 @@
+package chidb
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// numericOrder orders keys of decimal digits by their value, unlike
+// bytes.Compare, which puts "10" before "9"
+func numericOrder(a, b []byte) int {
+	if len(a) != len(b) {
+		return len(a) - len(b)
+	}
+	return bytes.Compare(a, b)
+}
+
+func TestByteIndexComparator(t *testing.T) {
+	btree := openSmallPageBtree(t)
+	btree.Comparator = numericOrder
+
+	root, err := btree.NewByteIndex()
+	require.Nil(t, err)
+
+	keys := insertByteIndexKeys(t, btree, root, shuffledKeys(sequentialKeys(1, 5000)))
+	require.Greater(t, treeHeight(t, btree, root), 2, "Expected internal nodes to be split too")
+
+	expected := append([]string{}, keys...)
+	sort.Slice(expected, func(i, j int) bool {
+		return numericOrder([]byte(expected[i]), []byte(expected[j])) < 0
+	})
+	assert.Equal(t, expected, byteIndexKeys(t, btree, root), "Expected cursor to return keys in the order of the comparator")
+
+	for _, key := range keys {
+		cell, err := btree.FindBytes(root, []byte(key))
+		require.Nil(t, err, "Expected nil error to find key %s", key)
+		assert.Equal(t, key, string(cell.keyBytes))
+
+		keyPk, found, err := btree.FindInIndexBytes(root, []byte(key))
+		require.Nil(t, err)
+		require.True(t, found, "Expected key %s to be found on index", key)
+		n, err := strconv.Atoi(key)
+		require.Nil(t, err)
+		assert.Equal(t, uint64(n*10), keyPk)
+	}
+	_, err = btree.FindBytes(root, []byte("5001"))
+	assert.True(t, errors.Is(err, ErrKeyNotFound), "Expected key not found error, got %v", err)
+	err = btree.Insert(root, NewLeafIndexCellBytes([]byte("250"), 1))
+	assert.True(t, errors.Is(err, ErrDuplicateKey), "Expected duplicate key error, got %v", err)
+
+	assert.Nil(t, btree.CheckIntegrity(root))
+	assert.Nil(t, btree.CheckIntegrityParallel(root, 4))
+}
+
+func TestByteIndexSeek(t *testing.T) {
+	btree := openSmallPageBtree(t)
+	btree.Comparator = numericOrder
+
+	root, err := btree.NewByteIndex()
+	require.Nil(t, err)
+	insertByteIndexKeys(t, btree, root, shuffledKeys(sequentialKeys(1, 500)))
+
+	cursor, err := btree.NewCursor(root)
+	require.Nil(t, err)
+
+	tests := []struct {
+		name  string
+		key   string
+		found bool
+		next  []string
+	}{
+		{name: "existing key", key: "99", found: true, next: []string{"99", "100", "101"}},
+		{name: "before first key", key: "0", found: false, next: []string{"1", "2", "3"}},
+		{name: "between keys", key: "49a", found: false, next: []string{"500"}},
+		{name: "after last key", key: "1000", found: false, next: []string{}},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			found, err := cursor.SeekBytes([]byte(tt.key))
+			require.Nil(t, err)
+			assert.Equal(t, tt.found, found)
+
+			next := make([]string, 0)
+			for len(next) < 3 {
+				cell, ok, err := cursor.Next()
+				require.Nil(t, err)
+				if !ok {
+					break
+				}
+				next = append(next, string(cell.keyBytes))
+			}
+			assert.Equal(t, tt.next, next)
+		})
+	}
+}
+
+func TestByteIndexDefaultComparator(t *testing.T) {
+	btree := openBtree(t)
+
+	root, err := btree.NewByteIndex()
+	require.Nil(t, err)
+	insertByteIndexKeys(t, btree, root, []ChidbKey{9, 10, 100, 2})
+
+	assert.Equal(t, []string{"10", "100", "2", "9"}, byteIndexKeys(t, btree, root), "Expected keys compared byte-wise")
+}
+
+func TestByteIndexDelete(t *testing.T) {
+	btree := openSmallPageBtree(t)
+
+	root, err := btree.NewByteIndex()
+	require.Nil(t, err)
+
+	// Keys of different sizes, in the order of their numbers
+	key := func(n ChidbKey) string {
+		return fmt.Sprintf("%05d%s", n, strings.Repeat("-", int(n)%200))
+	}
+	live := make([]string, 0)
+	numbers := shuffledKeys(sequentialKeys(1, 1500))
+	for _, n := range numbers {
+		require.Nil(t, btree.Insert(root, NewLeafIndexCellBytes([]byte(key(n)), uint64(n))))
+	}
+	require.Nil(t, btree.CheckIntegrity(root))
+
+	for _, n := range numbers {
+		if n%4 == 0 {
+			live = append(live, key(n))
+			continue
+		}
+		require.Nil(t, btree.DeleteBytes(root, []byte(key(n))), "Expected nil error to delete key %d", n)
+	}
+	sort.Strings(live)
+
+	assert.Equal(t, live, byteIndexKeys(t, btree, root))
+	assert.Nil(t, btree.CheckIntegrity(root))
+
+	err = btree.DeleteBytes(root, []byte(key(1)))
+	assert.True(t, errors.Is(err, ErrKeyNotFound), "Expected key not found error, got %v", err)
+}
+
+func TestByteIndexKeyType(t *testing.T) {
+	btree := openBtree(t)
+
+	byteIndex, err := btree.NewByteIndex()
+	require.Nil(t, err)
+	index := newIndex(t, btree)
+
+	err = btree.Insert(byteIndex, NewLeafIndexCell(1, 10))
+	assert.True(t, errors.Is(err, ErrKeyType), "Expected key type error, got %v", err)
+	err = btree.Insert(index, NewLeafIndexCellBytes([]byte("a"), 10))
+	assert.True(t, errors.Is(err, ErrKeyType), "Expected key type error, got %v", err)
+	_, err = btree.Find(byteIndex, 1)
+	assert.True(t, errors.Is(err, ErrKeyType), "Expected key type error, got %v", err)
+	_, err = btree.FindBytes(1, []byte("a"))
+	assert.True(t, errors.Is(err, ErrKeyType), "Expected key type error, got %v", err)
+	_, err = btree.IndexRange(byteIndex, 1, 2)
+	assert.True(t, errors.Is(err, ErrKeyType), "Expected key type error, got %v", err)
+
+	root, err := btree.GetNodeByPage(byteIndex)
+	require.Nil(t, err)
+	require.Nil(t, btree.Insert(byteIndex, NewLeafIndexCellBytes(make([]byte, root.maxKeyBytes()), 10)))
+	err = btree.Insert(byteIndex, NewLeafIndexCellBytes(make([]byte, root.maxKeyBytes()+1), 10))
+	assert.True(t, errors.Is(err, ErrKeyTooLarge), "Expected key too large error, got %v", err)
+}
+
+func TestByteIndexBulkLoad(t *testing.T) {
+	btree := openSmallPageBtree(t)
+	btree.Comparator = numericOrder
+
+	sorted := make([]*BTreeCell, 0)
+	for _, n := range sequentialKeys(1, 1000) {
+		sorted = append(sorted, NewLeafIndexCellBytes([]byte(strconv.Itoa(int(n))), uint64(n)))
+	}
+	root, err := btree.BulkLoad(sorted)
+	require.Nil(t, err)
+
+	keys := byteIndexKeys(t, btree, root)
+	require.Len(t, keys, 1000)
+	assert.Equal(t, "9", keys[8])
+	assert.Equal(t, "10", keys[9])
+	assert.Nil(t, btree.CheckIntegrity(root))
+
+	// Inserted keys follow the comparator too
+	require.Nil(t, btree.Insert(root, NewLeafIndexCellBytes([]byte("1001"), 1001)))
+	keyPk, found, err := btree.FindInIndexBytes(root, []byte("1001"))
+	require.Nil(t, err)
+	assert.True(t, found)
+	assert.Equal(t, uint64(1001), keyPk)
+
+	sorted[0], sorted[1] = sorted[1], sorted[0]
+	_, err = btree.BulkLoad(sorted)
+	assert.True(t, errors.Is(err, ErrNotSorted), "Expected not sorted error, got %v", err)
+	_, err = btree.BulkLoad([]*BTreeCell{NewLeafIndexCellBytes([]byte("1"), 1), NewLeafIndexCell(2, 2)})
+	assert.True(t, errors.Is(err, ErrKeyType), "Expected key type error, got %v", err)
+}
+
+func TestByteIndexPersisted(t *testing.T) {
+	filename := filepath.Join(t.TempDir(), "bytes.db")
+
+	btree, err := Open(filename)
+	require.Nil(t, err)
+	btree.Comparator = numericOrder
+	btree.CellFormat = CellFormatV2
+	root, err := btree.NewByteIndex()
+	require.Nil(t, err)
+	insertByteIndexKeys(t, btree, root, shuffledKeys(sequentialKeys(1, 2000)))
+	require.Nil(t, btree.Close())
+
+	btree, err = Open(filename)
+	require.Nil(t, err)
+	defer btree.Close()
+
+	// The comparator isn't stored, so byte-wise order doesn't match the keys
+	err = btree.CheckIntegrity(root)
+	require.NotNil(t, err)
+	assert.Contains(t, err.Error(), "is not greater than previous key")
+
+	btree.Comparator = numericOrder
+	assert.Nil(t, btree.CheckIntegrity(root))
+	formats := nodeFormats(t, btree, root)
+	assert.Zero(t, formats[CellFormatV1], "Expected every node with v2 cells")
+	assert.NotZero(t, formats[CellFormatV2])
+
+	keyPk, found, err := btree.FindInIndexBytes(root, []byte("1234"))
+	require.Nil(t, err)
+	assert.True(t, found)
+	assert.Equal(t, uint64(12340), keyPk)
+
+	var dump strings.Builder
+	require.Nil(t, btree.Dump(root, &dump))
+	assert.Contains(t, dump.String(), `key "1234"`)
+}
+
+// insertByteIndexKeys inserts the decimal representation of keys on the
+// byte-keyed index on root, mapped to key*10, and returns them
+func insertByteIndexKeys(tb testing.TB, btree *BTree, root uint32, keys []ChidbKey) []string {
+	inserted := make([]string, 0, len(keys))
+	for _, key := range keys {
+		s := strconv.Itoa(int(key))
+		require.Nil(tb, btree.Insert(root, NewLeafIndexCellBytes([]byte(s), uint64(key)*10)), "Expected nil error to insert key %s", s)
+		inserted = append(inserted, s)
+	}
+	return inserted
+}
+
+// byteIndexKeys returns the keys of the byte-keyed index on rootPage in
+// cursor order
+func byteIndexKeys(tb testing.TB, btree *BTree, rootPage uint32) []string {
+	cursor, err := btree.NewCursor(rootPage)
+	require.Nil(tb, err)
+
+	keys := make([]string, 0)
+	for {
+		cell, ok, err := cursor.Next()
+		require.Nil(tb, err)
+		if !ok {
+			return keys
+		}
+		keys = append(keys, string(cell.keyBytes))
+	}
+}
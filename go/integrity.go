@@ -0,0 +1,462 @@
+package chidb
+
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"runtime"
+	"sort"
+	"strings"
+	"sync"
+)
+
+// ErrOverflowChainCorrupt is matched by the *IntegrityError of
+// CheckIntegrity when the overflow pages of a cell are broken
+var ErrOverflowChainCorrupt = errors.New("overflow chain corrupt")
+
+// IntegrityError is returned by CheckIntegrity with all problems found on
+// the B-Tree
+type IntegrityError struct {
+	Problems []string
+
+	// Sentinel errors of the problems, matched by Is
+	causes []error
+}
+
+func (e *IntegrityError) Error() string {
+	return fmt.Sprintf("%d integrity problems found: %s", len(e.Problems), strings.Join(e.Problems, "; "))
+}
+
+// Is reports whether one of the problems found is target, so callers can
+// tell with errors.Is, e.g. ErrOverflowChainCorrupt
+func (e *IntegrityError) Is(target error) bool {
+	for _, cause := range e.causes {
+		if cause == target {
+			return true
+		}
+	}
+	return false
+}
+
+// CheckIntegrity walks the whole B-Tree on rootPage and verifies that:
+//  1. Keys are sorted within each node.
+//  2. Keys of each child subtree are in the range given by the separator
+//     keys of the parent.
+//  3. The number of cells matches the length of the cell offset array.
+//  4. The cell offset array and the cell area are within the page.
+//  5. No two cells overlap in the cell area.
+//  6. The overflow chain of each cell has as many pages as the cell size
+//     needs, without loops, free pages or pages past the end of the file.
+//
+// The check goes on after a problem is found, and an *IntegrityError with
+// all problems is returned. A nil error means the tree is well-formed.
+func (b *BTree) CheckIntegrity(rootPage uint32) error {
+	c := b.newIntegrityCheck()
+	c.checkNode(rootPage, keyRange{})
+	return c.err()
+}
+
+// CheckIntegrityParallel checks the B-Tree on rootPage like CheckIntegrity,
+// but the subtrees of the children of the root are checked concurrently by
+// up to workers goroutines, or by one for each CPU if workers is zero or
+// negative
+//
+// Each subtree is walked on its own, with reads sharing the pager like
+// concurrent Find calls, and the problems found are merged in the order of
+// the children, so they're the ones CheckIntegrity finds. The exception is
+// a page referenced from two subtrees, which is reported after both are
+// walked, along with the problems found walking it from each of them.
+func (b *BTree) CheckIntegrityParallel(rootPage uint32, workers int) error {
+	if workers <= 0 {
+		workers = runtime.NumCPU()
+	}
+
+	c := b.newIntegrityCheck()
+	c.loadFreePages()
+	children := c.checkPage(rootPage, keyRange{})
+
+	checks := make([]*integrityCheck, len(children))
+	sem := make(chan struct{}, workers)
+	var wg sync.WaitGroup
+	for i, child := range children {
+		checks[i] = b.newIntegrityCheck()
+		checks[i].free, checks[i].totalPages = c.free, c.totalPages
+
+		wg.Add(1)
+		go func(sub *integrityCheck, child subtree) {
+			defer wg.Done()
+			sem <- struct{}{}
+			defer func() { <-sem }()
+			sub.checkNode(child.page, child.bounds)
+		}(checks[i], child)
+	}
+	wg.Wait()
+
+	for _, sub := range checks {
+		c.merge(sub)
+	}
+	return c.err()
+}
+
+// integrityCheck holds the state of a CheckIntegrity walk
+type integrityCheck struct {
+	btree *BTree
+
+	// Pages already checked, so a page pointed twice is reported instead
+	// of walked forever
+	visited map[uint32]bool
+
+	// Pages on the free list and the number of pages of the file, loaded
+	// on the first overflow chain checked
+	free       map[uint32]bool
+	totalPages uint32
+
+	problems []string
+	causes   []error
+}
+
+func (b *BTree) newIntegrityCheck() *integrityCheck {
+	return &integrityCheck{
+		btree:   b,
+		visited: make(map[uint32]bool),
+	}
+}
+
+// err returns the *IntegrityError with the problems found, if any
+func (c *integrityCheck) err() error {
+	if len(c.problems) > 0 {
+		return &IntegrityError{Problems: c.problems, causes: c.causes}
+	}
+	return nil
+}
+
+// merge adds the problems found by sub, and reports the pages it visited
+// that were already visited
+func (c *integrityCheck) merge(sub *integrityCheck) {
+	c.problems = append(c.problems, sub.problems...)
+	for _, cause := range sub.causes {
+		c.addCause(cause)
+	}
+
+	pages := make([]uint32, 0, len(sub.visited))
+	for nPage := range sub.visited {
+		pages = append(pages, nPage)
+	}
+	sort.Slice(pages, func(i, j int) bool { return pages[i] < pages[j] })
+	for _, nPage := range pages {
+		if c.visited[nPage] {
+			c.report(nPage, "page is referenced more than once")
+		}
+		c.visited[nPage] = true
+	}
+}
+
+// subtree is a child node to check and the range of the keys under it
+type subtree struct {
+	page   uint32
+	bounds keyRange
+}
+
+// keyRange is the range of keys allowed on a subtree. Keys must be greater
+// than lo and smaller than hi, or equal to hi on table B-Trees, where the
+// separator key is the largest key of the left child. On OrderDescending
+// B-Trees, lo and hi are the bounds in the order of the B-Tree, so keys
+// must be smaller than lo and greater than hi. The keys of byte-keyed
+// indexes are compared with the Comparator of the BTree.
+type keyRange struct {
+	lo, hi       treeKey
+	hasLo, hasHi bool
+
+	// Order of the B-Tree of the parent, which must be the order of the
+	// subtree
+	order KeyOrder
+
+	// Whether the parent is a node of a byte-keyed index, which the
+	// subtree must be too
+	byteKeys bool
+}
+
+func (r keyRange) contains(b *BTree, key treeKey, typ BTreeNodeType) bool {
+	if r.hasLo && b.compareKeys(r.order, key, r.lo) <= 0 {
+		return false
+	}
+	if r.hasHi {
+		if isTable(typ) {
+			return b.compareKeys(r.order, key, r.hi) <= 0
+		}
+		return b.compareKeys(r.order, key, r.hi) < 0
+	}
+	return true
+}
+
+// format returns the range in interval notation for nodes of type typ
+func (r keyRange) format(typ BTreeNodeType) string {
+	lo, hi := "-inf", "+inf"
+	if r.order == OrderDescending {
+		lo, hi = hi, lo
+	}
+	if r.hasLo {
+		lo = fmt.Sprint(r.lo)
+	}
+	if r.hasHi {
+		hi = fmt.Sprint(r.hi)
+	}
+
+	closing := ")"
+	if r.hasHi && isTable(typ) {
+		closing = "]"
+	}
+	return fmt.Sprintf("(%s, %s%s", lo, hi, closing)
+}
+
+// keyKind names the keys of a node with byteKeys
+func keyKind(byteKeys bool) string {
+	if byteKeys {
+		return "byte"
+	}
+	return "integer"
+}
+
+func isTable(typ BTreeNodeType) bool {
+	return typ == LeafTable || typ == InternalTable
+}
+
+func (c *integrityCheck) report(nPage uint32, format string, args ...interface{}) {
+	c.problems = append(c.problems, fmt.Sprintf("page %d: ", nPage)+fmt.Sprintf(format, args...))
+}
+
+func (c *integrityCheck) checkNode(nPage uint32, bounds keyRange) {
+	for _, child := range c.checkPage(nPage, bounds) {
+		c.checkNode(child.page, child.bounds)
+	}
+}
+
+// checkPage checks the node on nPage and returns its children to be
+// checked next
+func (c *integrityCheck) checkPage(nPage uint32, bounds keyRange) []subtree {
+	if c.visited[nPage] {
+		c.report(nPage, "page is referenced more than once")
+		return nil
+	}
+	c.visited[nPage] = true
+
+	node, err := c.btree.GetNodeByPage(nPage)
+	if err != nil {
+		c.report(nPage, "can't read node: %v", err)
+		return nil
+	}
+
+	if (bounds.hasLo || bounds.hasHi) && node.order != bounds.order {
+		c.report(nPage, "node has %s order, its parent has %s order", node.order, bounds.order)
+	}
+	if (bounds.hasLo || bounds.hasHi) && node.byteKeys != bounds.byteKeys {
+		c.report(nPage, "node has %s keys, its parent has %s keys", keyKind(node.byteKeys), keyKind(bounds.byteKeys))
+		return nil
+	}
+
+	c.checkLayout(node)
+	cells := c.checkCells(node, bounds)
+
+	if node.typ == LeafTable || node.typ == LeafIndex {
+		return nil
+	}
+
+	// Each child holds the keys between the previous separator key and its
+	// own, and the right page the keys after the last one.
+	children := make([]subtree, 0, len(cells)+1)
+	child := bounds
+	child.order, child.byteKeys = node.order, node.byteKeys
+	for nCell, cell := range cells {
+		if cell == nil {
+			continue
+		}
+		child.hi, child.hasHi = cellTreeKey(cell), true
+
+		childPage, err := c.btree.ChildPage(node, uint16(nCell+1))
+		if err != nil {
+			c.report(nPage, "%v", err)
+		} else {
+			children = append(children, subtree{page: childPage, bounds: child})
+		}
+
+		child.lo, child.hasLo = cellTreeKey(cell), true
+	}
+	child.hi, child.hasHi = bounds.hi, bounds.hasHi
+
+	rightPage, err := c.btree.childPageForPosition(node, node.nCells+1)
+	if err != nil {
+		c.report(nPage, "%v", err)
+		return children
+	}
+	return append(children, subtree{page: rightPage, bounds: child})
+}
+
+// checkLayout checks the offsets of the node header and of the cells
+func (c *integrityCheck) checkLayout(node *BTreeNode) {
+	nPage := node.page.number
+	pageLen := node.page.Len()
+
+	if node.cellOffsetArray != PageHeaderSize+1 {
+		c.report(nPage, "cell offset array starts at %d instead of %d", node.cellOffsetArray, PageHeaderSize+1)
+	}
+	if want := int(node.cellOffsetArray) + int(node.nCells)*2; int(node.freeOffset) != want {
+		c.report(nPage, "nCells %d doesn't match cell offset array ending at free offset %d", node.nCells, node.freeOffset)
+	}
+	if node.freeOffset > node.cellsOffset {
+		c.report(nPage, "free offset %d is past cells offset %d", node.freeOffset, node.cellsOffset)
+	}
+	if int(node.cellsOffset) > pageLen {
+		c.report(nPage, "cells offset %d is past the end of the page (%d bytes)", node.cellsOffset, pageLen)
+	}
+
+	type extent struct {
+		nCell      uint16
+		start, end int
+	}
+	extents := make([]extent, 0, node.nCells)
+
+	for i, offset := range node.cellOffsets() {
+		nCell := uint16(i + 1)
+		if offset < node.cellsOffset || int(offset) >= pageLen {
+			c.report(nPage, "cell %d offset %d is outside the cell area [%d, %d)", nCell, offset, node.cellsOffset, pageLen)
+			continue
+		}
+
+		cell, err := node.getLocalCell(nCell)
+		if err != nil {
+			// Reported by checkCells
+			continue
+		}
+		bytes, err := node.encodeCell(cell)
+		if err != nil {
+			continue
+		}
+
+		end := int(offset) + len(bytes)
+		if end > pageLen {
+			c.report(nPage, "cell %d ends at %d past the end of the page (%d bytes)", nCell, end, pageLen)
+		}
+		extents = append(extents, extent{nCell: nCell, start: int(offset), end: end})
+	}
+
+	sort.SliceStable(extents, func(i, j int) bool {
+		return extents[i].start < extents[j].start
+	})
+	for i := 1; i < len(extents); i++ {
+		prev, cur := extents[i-1], extents[i]
+		if cur.start < prev.end {
+			c.report(nPage, "cell %d [%d, %d) overlaps cell %d [%d, %d)", cur.nCell, cur.start, cur.end, prev.nCell, prev.start, prev.end)
+		}
+	}
+}
+
+// checkCells checks the keys of the node cells and returns the cells, where
+// cells that can't be read are nil
+func (c *integrityCheck) checkCells(node *BTreeNode, bounds keyRange) []*BTreeCell {
+	nPage := node.page.number
+	cells := make([]*BTreeCell, 0, node.nCells)
+
+	var prev *BTreeCell
+	for nCell := uint16(1); nCell <= node.nCells; nCell++ {
+		cell, err := node.getLocalCell(nCell)
+		if err != nil {
+			c.report(nPage, "can't read cell %d: %v", nCell, err)
+			cells = append(cells, nil)
+			continue
+		}
+		cells = append(cells, cell)
+
+		key := cellTreeKey(cell)
+		if prev != nil && c.btree.compareKeys(node.order, cellTreeKey(prev), key) >= 0 {
+			relation := "greater"
+			if node.order == OrderDescending {
+				relation = "smaller"
+			}
+			c.report(nPage, "cell %d key %v is not %s than previous key %v", nCell, key, relation, cellTreeKey(prev))
+		}
+		if !bounds.contains(c.btree, key, node.typ) {
+			c.report(nPage, "cell %d key %v is outside the range %s of the parent", nCell, key, bounds.format(node.typ))
+		}
+		prev = cell
+
+		if node.typ == LeafTable && cell.fields.tableLeaf.overflowPage != 0 {
+			c.checkOverflow(nPage, nCell, cell)
+		}
+	}
+	return cells
+}
+
+// checkOverflow walks the overflow chain of a leaf table cell
+func (c *integrityCheck) checkOverflow(nPage uint32, nCell uint16, cell *BTreeCell) {
+	pager := c.btree.pager
+	report := func(format string, args ...interface{}) {
+		c.report(nPage, "cell %d key %d: %v: "+format, append([]interface{}{nCell, cell.key, ErrOverflowChainCorrupt}, args...)...)
+		c.addCause(ErrOverflowChainCorrupt)
+	}
+
+	if c.free == nil {
+		c.loadFreePages()
+	}
+
+	size := int(cell.fields.tableLeaf.size) - len(cell.fields.tableLeaf.data)
+	chunk := pager.usableSize() - overflowHeaderSize
+	want := (size + chunk - 1) / chunk
+
+	overflowPage := cell.fields.tableLeaf.overflowPage
+	for i := 0; i < want; i++ {
+		if overflowPage == 0 {
+			report("chain ends after %d of %d pages", i, want)
+			return
+		}
+		if overflowPage > c.totalPages {
+			report("page %d is past the last page %d", overflowPage, c.totalPages)
+			return
+		}
+		if c.free[overflowPage] {
+			report("page %d is on the free list", overflowPage)
+			return
+		}
+		if c.visited[overflowPage] {
+			report("page %d is referenced more than once", overflowPage)
+			return
+		}
+		c.visited[overflowPage] = true
+
+		page, err := pager.ReadPage(overflowPage)
+		if err != nil {
+			report("can't read page %d: %v", overflowPage, err)
+			return
+		}
+		overflowPage = binary.LittleEndian.Uint32(page.Read())
+	}
+	if overflowPage != 0 {
+		report("chain goes on to page %d after the %d pages of %d bytes", overflowPage, want, size)
+	}
+}
+
+// loadFreePages loads the pages on the free list and the number of pages,
+// reporting the free list if it can't be read
+func (c *integrityCheck) loadFreePages() {
+	pager := c.btree.pager
+	pager.mu.RLock()
+	free, err := pager.freePages()
+	c.totalPages = pager.totalPages
+	pager.mu.RUnlock()
+
+	c.free = make(map[uint32]bool)
+	if err != nil {
+		c.problems = append(c.problems, fmt.Sprintf("can't read free pages: %v", err))
+	}
+	for _, nFree := range free {
+		c.free[nFree] = true
+	}
+}
+
+func (c *integrityCheck) addCause(err error) {
+	for _, cause := range c.causes {
+		if cause == err {
+			return
+		}
+	}
+	c.causes = append(c.causes, err)
+}
@@ -0,0 +1,327 @@
+package chidb
+
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"sync"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestCheckIntegrity(t *testing.T) {
+	btree := openBtree(t)
+	root := twoLevelTree(t, btree)
+
+	assert.Nil(t, btree.CheckIntegrity(root), "Expected two level tree to be well-formed")
+	assert.Nil(t, btree.CheckIntegrity(1), "Expected empty tree to be well-formed")
+}
+
+func TestCheckIntegrityAfterSplits(t *testing.T) {
+	btree := openBtree(t)
+	insertSequentialKeys(t, btree, 1, 500, 200)
+
+	assert.Nil(t, btree.CheckIntegrity(1), "Expected tree built by Insert to be well-formed")
+}
+
+func TestCheckIntegrityCorruptNodes(t *testing.T) {
+	tests := []struct {
+		name     string
+		corrupt  func(tb testing.TB, btree *BTree, root uint32)
+		problems []string
+	}{
+		{
+			name: "unsorted keys",
+			corrupt: func(tb testing.TB, btree *BTree, root uint32) {
+				leaf := childNode(tb, btree, root, 2)
+				offsets := leaf.cellOffsets()
+				offsets[0], offsets[1] = offsets[1], offsets[0]
+				require.Nil(tb, leaf.setCellOffsets(offsets))
+				require.Nil(tb, btree.WriteNode(leaf))
+			},
+			problems: []string{"page 4: cell 2 key 15 is not greater than previous key 20"},
+		},
+		{
+			name: "key outside parent range",
+			corrupt: func(tb testing.TB, btree *BTree, root uint32) {
+				leaf := childNode(tb, btree, root, 1)
+				insertLeafTableCells(tb, btree, leaf, 12)
+			},
+			problems: []string{"page 3: cell 3 key 12 is outside the range (-inf, 10] of the parent"},
+		},
+		{
+			name: "nCells mismatch",
+			corrupt: func(tb testing.TB, btree *BTree, root uint32) {
+				leaf := childNode(tb, btree, root, 3)
+				leaf.nCells = 1
+				require.Nil(tb, btree.WriteNode(leaf))
+			},
+			problems: []string{"page 5: nCells 1 doesn't match cell offset array ending at free offset 17"},
+		},
+		{
+			name: "cells offset past page",
+			corrupt: func(tb testing.TB, btree *BTree, root uint32) {
+				leaf := childNode(tb, btree, root, 3)
+				leaf.cellsOffset = PageSize + 1
+				require.Nil(tb, btree.WriteNode(leaf))
+			},
+			problems: []string{"page 5: cells offset 16385 is past the end of the page (16384 bytes)"},
+		},
+		{
+			name: "free offset past cells offset",
+			corrupt: func(tb testing.TB, btree *BTree, root uint32) {
+				leaf := childNode(tb, btree, root, 3)
+				leaf.freeOffset = leaf.cellsOffset + 1
+				require.Nil(tb, btree.WriteNode(leaf))
+			},
+			problems: []string{
+				"page 5: nCells 2 doesn't match cell offset array ending at free offset 16347",
+				"page 5: free offset 16347 is past cells offset 16346",
+			},
+		},
+		{
+			name: "overlapping cells",
+			corrupt: func(tb testing.TB, btree *BTree, root uint32) {
+				leaf := childNode(tb, btree, root, 1)
+				offsets := leaf.cellOffsets()
+				offsets[1] = offsets[0]
+				require.Nil(tb, leaf.setCellOffsets(offsets))
+				require.Nil(tb, btree.WriteNode(leaf))
+			},
+			problems: []string{"page 3: cell 2 [16366, 16384) overlaps cell 1 [16366, 16384)"},
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			btree := openBtree(t)
+			root := twoLevelTree(t, btree)
+			tt.corrupt(t, btree, root)
+
+			err := btree.CheckIntegrity(root)
+
+			var integrityErr *IntegrityError
+			require.True(t, errors.As(err, &integrityErr), "Expected integrity error, got %v", err)
+			for _, problem := range tt.problems {
+				assert.Contains(t, integrityErr.Problems, problem)
+			}
+
+			assert.Equal(t, err, btree.CheckIntegrityParallel(root, 2), "Expected parallel check to find the same problems")
+		})
+	}
+}
+
+func TestCheckIntegrityParallel(t *testing.T) {
+	btree := openSmallPageBtree(t)
+	for _, key := range shuffledKeys(sequentialKeys(1, 3000)) {
+		// Some rows spill to overflow pages
+		data := make([]byte, 20)
+		if key%50 == 0 {
+			data = randomBytes(1500)
+		}
+		require.Nil(t, btree.Insert(1, NewLeafTableCell(key, data)))
+	}
+	require.Greater(t, treeHeight(t, btree, 1), 2)
+	require.Nil(t, btree.CheckIntegrity(1))
+
+	for _, workers := range []int{0, 1, 4} {
+		assert.Nil(t, btree.CheckIntegrityParallel(1, workers), "Expected tree to be well-formed with %d workers", workers)
+	}
+
+	// Break a leaf under each child of the root
+	root, err := btree.GetNodeByPage(1)
+	require.Nil(t, err)
+	for nCell := uint16(1); nCell <= root.nCells+1; nCell++ {
+		nPage, err := btree.childPageForPosition(root, nCell)
+		require.Nil(t, err)
+		for {
+			node, err := btree.GetNodeByPage(nPage)
+			require.Nil(t, err)
+			if node.typ == LeafTable {
+				node.nCells--
+				require.Nil(t, btree.WriteNode(node))
+				break
+			}
+			nPage = node.rightPage
+		}
+	}
+
+	serial := btree.CheckIntegrity(1)
+	var integrityErr *IntegrityError
+	require.True(t, errors.As(serial, &integrityErr), "Expected integrity error, got %v", serial)
+	require.Len(t, integrityErr.Problems, int(root.nCells)+1)
+
+	var wg sync.WaitGroup
+	results := make([]error, 8)
+	for i := range results {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			results[i] = btree.CheckIntegrityParallel(1, 0)
+		}(i)
+	}
+	wg.Wait()
+	for _, err := range results {
+		assert.Equal(t, serial, err, "Expected parallel check to find the same problems")
+	}
+}
+
+func TestCheckIntegrityParallelSharedPage(t *testing.T) {
+	btree := openBtree(t)
+	root := twoLevelTree(t, btree)
+
+	// The first two children of the root point to the same leaf
+	node, err := btree.GetNodeByPage(root)
+	require.Nil(t, err)
+	shared := childNode(t, btree, root, 1).page.number
+	require.Nil(t, node.UpdateCell(2, separatorCell(InternalTable, &BTreeCell{key: 20}, shared)))
+	require.Nil(t, btree.WriteNode(node))
+
+	err = btree.CheckIntegrityParallel(root, 0)
+
+	var integrityErr *IntegrityError
+	require.True(t, errors.As(err, &integrityErr), "Expected integrity error, got %v", err)
+	assert.Contains(t, integrityErr.Problems, fmt.Sprintf("page %d: page is referenced more than once", shared))
+}
+
+func TestCheckIntegrityReportsAllProblems(t *testing.T) {
+	btree := openBtree(t)
+	root := twoLevelTree(t, btree)
+
+	first := childNode(t, btree, root, 1)
+	insertLeafTableCells(t, btree, first, 12)
+
+	last := childNode(t, btree, root, 3)
+	last.nCells = 1
+	require.Nil(t, btree.WriteNode(last))
+
+	err := btree.CheckIntegrity(root)
+
+	var integrityErr *IntegrityError
+	require.True(t, errors.As(err, &integrityErr), "Expected integrity error, got %v", err)
+	assert.Len(t, integrityErr.Problems, 2, "Expected problems of both nodes, got %v", integrityErr.Problems)
+}
+
+// childNode reads the child node of root at position nCell
+func childNode(tb testing.TB, btree *BTree, root uint32, nCell uint16) *BTreeNode {
+	node, err := btree.GetNodeByPage(root)
+	require.Nil(tb, err)
+
+	childPage, err := btree.childPageForPosition(node, nCell)
+	require.Nil(tb, err)
+
+	child, err := btree.GetNodeByPage(childPage)
+	require.Nil(tb, err)
+	return child
+}
+
+func TestCheckIntegrityOverflowChain(t *testing.T) {
+	tests := []struct {
+		name    string
+		corrupt func(tb testing.TB, btree *BTree, chain []uint32) string
+	}{
+		{
+			name: "loop",
+			corrupt: func(tb testing.TB, btree *BTree, chain []uint32) string {
+				setNextOverflowPage(tb, btree, chain[1], chain[0])
+				return fmt.Sprintf("page %d is referenced more than once", chain[0])
+			},
+		},
+		{
+			name: "page past the end",
+			corrupt: func(tb testing.TB, btree *BTree, chain []uint32) string {
+				setNextOverflowPage(tb, btree, chain[0], btree.pager.totalPages+10)
+				return fmt.Sprintf("page %d is past the last page %d", btree.pager.totalPages+10, btree.pager.totalPages)
+			},
+		},
+		{
+			name: "chain too short",
+			corrupt: func(tb testing.TB, btree *BTree, chain []uint32) string {
+				setNextOverflowPage(tb, btree, chain[1], 0)
+				return "chain ends after 2 of 3 pages"
+			},
+		},
+		{
+			name: "chain too long",
+			corrupt: func(tb testing.TB, btree *BTree, chain []uint32) string {
+				nPage, err := btree.pager.AllocatePage()
+				require.Nil(tb, err)
+				setNextOverflowPage(tb, btree, chain[2], nPage)
+				return fmt.Sprintf("chain goes on to page %d after the 3 pages", nPage)
+			},
+		},
+		{
+			name: "free page",
+			corrupt: func(tb testing.TB, btree *BTree, chain []uint32) string {
+				nPage, err := btree.pager.AllocatePage()
+				require.Nil(tb, err)
+				require.Nil(tb, btree.pager.DeallocatePage(nPage))
+				setNextOverflowPage(tb, btree, chain[0], nPage)
+				return fmt.Sprintf("page %d is on the free list", nPage)
+			},
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			btree := openBtree(t)
+			leaf, err := btree.NewNode(LeafTable)
+			require.Nil(t, err)
+			require.Nil(t, leaf.InsertCell(1, NewLeafTableCell(1, randomBytes(3*int(btree.pager.PageSize())))))
+			require.Nil(t, btree.WriteNode(leaf))
+
+			chain := overflowChain(t, btree, leaf)
+			require.Len(t, chain, 3)
+			require.Nil(t, btree.CheckIntegrity(leaf.page.number))
+
+			problem := tt.corrupt(t, btree, chain)
+			err = btree.CheckIntegrity(leaf.page.number)
+
+			assert.True(t, errors.Is(err, ErrOverflowChainCorrupt), "Expected overflow chain error, got %v", err)
+			var integrityErr *IntegrityError
+			require.True(t, errors.As(err, &integrityErr), "Expected integrity error, got %v", err)
+			require.Len(t, integrityErr.Problems, 1)
+			assert.Contains(t, integrityErr.Problems[0], problem)
+		})
+	}
+}
+
+func TestCheckIntegrityWithoutOverflowProblems(t *testing.T) {
+	btree := openBtree(t)
+	root := twoLevelTree(t, btree)
+	leaf := childNode(t, btree, root, 3)
+	leaf.nCells = 1
+	require.Nil(t, btree.WriteNode(leaf))
+
+	err := btree.CheckIntegrity(root)
+	require.NotNil(t, err)
+	assert.False(t, errors.Is(err, ErrOverflowChainCorrupt), "Expected only layout problems, got %v", err)
+}
+
+// overflowChain returns the overflow pages of the first cell of leaf
+func overflowChain(tb testing.TB, btree *BTree, leaf *BTreeNode) []uint32 {
+	cell, err := leaf.getLocalCell(1)
+	require.Nil(tb, err)
+
+	chain := make([]uint32, 0)
+	for nPage := cell.fields.tableLeaf.overflowPage; nPage != 0; {
+		chain = append(chain, nPage)
+		page, err := btree.pager.ReadPage(nPage)
+		require.Nil(tb, err)
+		nPage = binary.LittleEndian.Uint32(page.Read())
+	}
+	return chain
+}
+
+// setNextOverflowPage points the overflow page nPage to next
+func setNextOverflowPage(tb testing.TB, btree *BTree, nPage, next uint32) {
+	page, err := btree.pager.ReadPage(nPage)
+	require.Nil(tb, err)
+
+	content := append([]byte(nil), page.Read()...)
+	binary.LittleEndian.PutUint32(content, next)
+	require.Nil(tb, page.Write(content))
+	require.Nil(tb, btree.pager.WritePage(page))
+}
@@ -0,0 +1,455 @@
+package chidb
+
+import (
+	"bytes"
+	"context"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"sync"
+)
+
+// JournalSuffix is appended to the database filename to name the rollback
+// journal of a transaction.
+const JournalSuffix = "-journal"
+
+var ErrTransactionActive = errors.New("transaction already active")
+
+var ErrNoTransaction = errors.New("no active transaction")
+
+var ErrCorruptJournal = errors.New("corrupt journal")
+
+var journalMagic = []byte("chidbjnl")
+
+// journalHeaderSize is the size of the journal header: the magic bytes, the
+// page size, the size of the file when the transaction began and a copy of
+// the file header.
+const journalHeaderSize = 8 + 4 + 8 + HeaderSize
+
+// journal is the rollback journal of an active transaction
+//
+// The journal file starts with a header followed by an entry for each page
+// changed by the transaction, holding the page number and the contents the
+// page had when the transaction began.
+type journal struct {
+	file Storage
+
+	// Name of the journal file, empty if the journal is kept in memory
+	name string
+
+	// Size of the journal, where the next entry is written
+	size int64
+
+	// Size of the file when the transaction began, pages after it were
+	// allocated by the transaction and are cut off on rollback
+	fileSize int64
+
+	// Pages whose original contents are on the journal
+	saved map[uint32]bool
+
+	// Savepoints of the transaction, from the oldest to the most recent
+	savepoints []*savepoint
+
+	// Whether a transaction uses the journal. With GroupCommit, the journal
+	// of committed transactions is kept until their group is synced, and
+	// the next transactions use it meanwhile.
+	active bool
+
+	// Savepoint created when the transaction began on the journal of
+	// committed transactions waiting for their group sync, Rollback
+	// restores it instead of the journal. It's nil if the transaction
+	// created the journal.
+	begin *savepoint
+
+	// Guards dirty, since readers holding the shared lock of the pager may
+	// evict pages and sync the journal
+	mu sync.Mutex
+
+	// Whether entries were written after the journal was last synced
+	dirty bool
+}
+
+// BeginTransaction starts a transaction on the database
+//
+// Until Commit, the changes done to the database can be undone by Rollback.
+// If the process crashes before Commit, the changes are undone when the
+// database is opened again. BTrees sharing a pager share its transaction.
+//
+// With GroupCommit enabled on the pager, BeginTransaction waits for the
+// active transaction to end instead of returning ErrTransactionActive.
+func (b *BTree) BeginTransaction() error {
+	return b.pager.BeginTransaction()
+}
+
+// Commit makes the changes done since BeginTransaction permanent
+func (b *BTree) Commit() error {
+	return b.pager.Commit()
+}
+
+// Rollback undoes the changes done since BeginTransaction
+func (b *BTree) Rollback() error {
+	return b.pager.Rollback()
+}
+
+// transaction runs fn on its own transaction, which is committed if fn
+// succeeds and rolled back otherwise
+func (b *BTree) transaction(fn func() error) error {
+	if err := b.BeginTransaction(); err != nil {
+		return err
+	}
+	if err := fn(); err != nil {
+		if rollbackErr := b.Rollback(); rollbackErr != nil {
+			return rollbackErr
+		}
+		return err
+	}
+	return b.Commit()
+}
+
+// BeginTransaction starts a transaction, creating the rollback journal
+//
+// Pages changed before the transaction are flushed first, so the journal
+// saves the pages as they are on the file.
+func (p *Pager) BeginTransaction() error {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	if p.closed {
+		return ErrClosed
+	}
+	if p.readOnly {
+		return ErrReadOnly
+	}
+	if p.GroupCommit {
+		p.waitTransaction()
+		if p.closed {
+			return ErrClosed
+		}
+	}
+	if p.inTransaction() {
+		return ErrTransactionActive
+	}
+
+	if err := p.flush(context.Background()); err != nil {
+		return err
+	}
+
+	// Committed transactions waiting for their group sync keep their
+	// journal, which saves the pages as they were before all of them
+	if p.journal != nil {
+		header, err := p.readHeader()
+		if err != nil {
+			return err
+		}
+		p.journal.active = true
+		p.journal.begin = &savepoint{
+			totalPages: p.totalPages,
+			header:     header,
+			pages:      make(map[uint32][]byte),
+		}
+		return nil
+	}
+
+	fileSize, err := p.buffer.Size()
+	if err != nil {
+		return err
+	}
+
+	header := make([]byte, journalHeaderSize)
+	copy(header, journalMagic)
+	binary.LittleEndian.PutUint32(header[8:], p.pageSize)
+	binary.LittleEndian.PutUint64(header[12:], uint64(fileSize))
+	if _, err := p.buffer.ReadAt(header[20:], 0); err != nil && !errors.Is(err, io.EOF) {
+		return err
+	}
+
+	// A database kept in memory has its journal in memory too
+	var f Storage = &memoryStorage{}
+	name := ""
+	if p.filename != "" {
+		name = p.filename + JournalSuffix
+		file, err := os.OpenFile(name, os.O_CREATE|os.O_TRUNC|os.O_RDWR, os.ModePerm)
+		if err != nil {
+			return err
+		}
+		f = &fileStorage{file}
+	}
+
+	// The journal must be on disk before the file is changed
+	if _, err := f.WriteAt(header, 0); err != nil {
+		f.Close()
+		return err
+	}
+	if err := f.Sync(); err != nil {
+		f.Close()
+		return err
+	}
+
+	p.journal = &journal{
+		file:     f,
+		name:     name,
+		size:     int64(len(header)),
+		fileSize: fileSize,
+		saved:    make(map[uint32]bool),
+		active:   true,
+	}
+	return nil
+}
+
+// inTransaction returns whether a transaction is active
+func (p *Pager) inTransaction() bool {
+	return p.journal != nil && p.journal.active
+}
+
+// Commit writes the changes of the transaction to the file and deletes
+// the rollback journal
+//
+// With GroupCommit enabled, the file is synced once for the transactions
+// committed meanwhile, see GroupCommit. The file isn't synced with
+// SyncManual and SyncNever, see SyncMode.
+func (p *Pager) Commit() error {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	if p.closed {
+		return ErrClosed
+	}
+	if !p.inTransaction() {
+		return ErrNoTransaction
+	}
+
+	switch p.SyncMode {
+	case SyncManual:
+		// The journal is kept until the next Sync, see SyncManual
+		if err := p.flush(context.Background()); err != nil {
+			return err
+		}
+		p.endGroupTransaction()
+		return nil
+	case SyncNever:
+		if err := p.flush(context.Background()); err != nil {
+			return err
+		}
+		return p.endTransaction()
+	}
+
+	if p.GroupCommit {
+		return p.groupCommit()
+	}
+	if err := p.sync(); err != nil {
+		return err
+	}
+	return p.endTransaction()
+}
+
+// Rollback discards the changes of the transaction, restoring the pages
+// saved on the rollback journal
+func (p *Pager) Rollback() error {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	if p.closed {
+		return ErrClosed
+	}
+	if !p.inTransaction() {
+		return ErrNoTransaction
+	}
+	return p.rollbackTransaction()
+}
+
+// rollbackTransaction discards the changes of the active transaction
+//
+// The journal of committed transactions waiting for their group sync is
+// kept, only the pages changed since the transaction began are restored.
+func (p *Pager) rollbackTransaction() error {
+	j := p.journal
+	if j.begin == nil {
+		err := p.rollback()
+		p.groupCond.Broadcast()
+		return err
+	}
+
+	// The restored pages are flushed, so the group syncs them instead of
+	// the changes of the transaction already written to the file
+	err := p.rollbackToSavepoint(j.begin)
+	if err == nil {
+		err = p.flush(context.Background())
+	}
+	p.endGroupTransaction()
+	return err
+}
+
+func (p *Pager) rollback() error {
+	// Changed pages not written to the file yet are just dropped
+	p.cache.clear()
+	p.free = nil
+
+	if err := p.restoreJournal(p.journal.file, p.journal.name); err != nil {
+		return err
+	}
+	p.totalPages = uint32(p.journal.fileSize / int64(p.pageSize))
+	p.truncateFilePages()
+
+	return p.endTransaction()
+}
+
+// endTransaction closes and deletes the journal
+func (p *Pager) endTransaction() error {
+	j := p.journal
+	p.journal = nil
+
+	if err := j.file.Close(); err != nil {
+		return err
+	}
+	if j.name == "" {
+		return nil
+	}
+	if err := os.Remove(j.name); err != nil {
+		return err
+	}
+	return syncDir(filepath.Dir(j.name))
+}
+
+// journalPage saves the contents of the page on the file to the journal,
+// if a transaction is active and the page wasn't saved yet
+func (p *Pager) journalPage(nPage uint32) error {
+	j := p.journal
+	if j == nil || j.saved[nPage] {
+		return nil
+	}
+
+	if p.offset(nPage) < j.fileSize {
+		entry := make([]byte, 4+p.pageSize)
+		binary.LittleEndian.PutUint32(entry, nPage)
+		if _, err := p.buffer.ReadAt(entry[4:], p.offset(nPage)); err != nil && !errors.Is(err, io.EOF) {
+			return err
+		}
+		if _, err := j.file.WriteAt(entry, j.size); err != nil {
+			return err
+		}
+		j.size += int64(len(entry))
+
+		j.mu.Lock()
+		j.dirty = true
+		j.mu.Unlock()
+	}
+
+	j.saved[nPage] = true
+	return nil
+}
+
+// syncJournal syncs the journal entries not synced yet, it must be called
+// before the file is changed
+//
+// It's safe to call with the shared lock held.
+func (p *Pager) syncJournal() error {
+	j := p.journal
+	if j == nil {
+		return nil
+	}
+
+	j.mu.Lock()
+	defer j.mu.Unlock()
+
+	if !j.dirty {
+		return nil
+	}
+	if err := j.file.Sync(); err != nil {
+		return err
+	}
+	j.dirty = false
+	return nil
+}
+
+// recoverJournal restores the file from a journal left behind by a
+// transaction that didn't end, e.g. because the process crashed
+//
+// Unlike other unexported methods, it's called while the pager is opened,
+// before mu can be shared.
+func (p *Pager) recoverJournal() error {
+	// A database kept in memory can't outlive its transactions
+	if p.filename == "" {
+		return nil
+	}
+	name := p.filename + JournalSuffix
+
+	f, err := os.Open(name)
+	if errors.Is(err, os.ErrNotExist) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+
+	if p.readOnly {
+		return fmt.Errorf("can't recover journal %s of read-only file", name)
+	}
+
+	if err := p.restoreJournal(&fileStorage{f}, name); err != nil {
+		return err
+	}
+	if err := os.Remove(name); err != nil {
+		return err
+	}
+	return syncDir(filepath.Dir(name))
+}
+
+// restoreJournal writes back the pages and the header saved on the journal
+// and cuts off the pages allocated by the transaction. name is the name of
+// the journal on errors.
+func (p *Pager) restoreJournal(f Storage, name string) error {
+	header := make([]byte, journalHeaderSize)
+	if _, err := f.ReadAt(header, 0); err != nil {
+		// The header is synced before the file is changed, so the
+		// file is unchanged if it's incomplete.
+		if errors.Is(err, io.EOF) {
+			return nil
+		}
+		return err
+	}
+	if !bytes.Equal(header[:len(journalMagic)], journalMagic) {
+		return fmt.Errorf("%w: missing magic bytes on %s", ErrCorruptJournal, name)
+	}
+
+	pageSize := binary.LittleEndian.Uint32(header[8:])
+	fileSize := int64(binary.LittleEndian.Uint64(header[12:]))
+	if !validPageSize(pageSize) {
+		return fmt.Errorf("%w: invalid page size %d on %s", ErrCorruptJournal, pageSize, name)
+	}
+
+	entry := make([]byte, 4+pageSize)
+	for offset := int64(journalHeaderSize); ; offset += int64(len(entry)) {
+		if _, err := f.ReadAt(entry, offset); err != nil {
+			// An incomplete entry wasn't synced, so its page wasn't
+			// changed on the file.
+			if errors.Is(err, io.EOF) {
+				break
+			}
+			return err
+		}
+
+		nPage := binary.LittleEndian.Uint32(entry)
+		if nPage == 0 {
+			return fmt.Errorf("%w: invalid page number 0 on %s", ErrCorruptJournal, name)
+		}
+		if _, err := p.buffer.WriteAt(entry[4:], int64(nPage-1)*int64(pageSize)); err != nil {
+			return err
+		}
+	}
+
+	// The header may have been changed after page one was saved
+	if fileSize >= HeaderSize {
+		if _, err := p.buffer.WriteAt(header[20:], 0); err != nil {
+			return err
+		}
+	}
+
+	if err := p.buffer.Truncate(fileSize); err != nil {
+		return err
+	}
+	return p.buffer.Sync()
+}
@@ -0,0 +1,168 @@
+package chidb
+
+import (
+	"errors"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestTransactionCommit(t *testing.T) {
+	filename := filepath.Join(t.TempDir(), "commit.db")
+
+	btree, err := Open(filename)
+	require.Nil(t, err)
+
+	require.Nil(t, btree.BeginTransaction(), "Expected nil error to begin transaction")
+	assert.FileExists(t, filename+JournalSuffix)
+
+	keys := insertSequentialKeys(t, btree, 1, 200, 200)
+
+	require.Nil(t, btree.Commit(), "Expected nil error to commit transaction")
+	assert.NoFileExists(t, filename+JournalSuffix, "Expected journal to be deleted on commit")
+	require.Nil(t, btree.Close())
+
+	btree, err = Open(filename)
+	require.Nil(t, err)
+	defer btree.Close()
+
+	for _, key := range keys {
+		_, err := btree.Find(1, key)
+		assert.Nil(t, err, "Expected committed key %d to be found", key)
+	}
+}
+
+func TestTransactionRollback(t *testing.T) {
+	filename := filepath.Join(t.TempDir(), "rollback.db")
+
+	btree, err := Open(filename)
+	require.Nil(t, err)
+	defer btree.Close()
+
+	keys := insertSequentialKeys(t, btree, 1, 200, 200)
+	require.Nil(t, btree.pager.Sync())
+	before, err := os.ReadFile(filename)
+	require.Nil(t, err)
+
+	require.Nil(t, btree.BeginTransaction())
+
+	// Split the leaves and grow the file
+	insertSequentialKeys(t, btree, 201, 300, 200)
+	require.Nil(t, btree.pager.Flush())
+
+	require.Nil(t, btree.Rollback(), "Expected nil error to rollback transaction")
+	assert.NoFileExists(t, filename+JournalSuffix, "Expected journal to be deleted on rollback")
+
+	after, err := os.ReadFile(filename)
+	require.Nil(t, err)
+	assert.Equal(t, before, after, "Expected file to be restored")
+
+	assert.Equal(t, keys, cursorKeys(t, btree, 1), "Expected only keys inserted before the transaction")
+	assert.Nil(t, btree.CheckIntegrity(1))
+}
+
+func TestTransactionRecoverOnOpen(t *testing.T) {
+	dir := t.TempDir()
+	filename := filepath.Join(dir, "crash.db")
+
+	btree, err := Open(filename)
+	require.Nil(t, err)
+	defer btree.Close()
+
+	keys := insertSequentialKeys(t, btree, 1, 200, 200)
+	require.Nil(t, btree.pager.Sync())
+
+	require.Nil(t, btree.BeginTransaction())
+	insertSequentialKeys(t, btree, 201, 300, 200)
+	require.Nil(t, btree.Commit(), "Expected nil error to commit first transaction")
+
+	require.Nil(t, btree.BeginTransaction())
+	insertSequentialKeys(t, btree, 501, 300, 200)
+	require.Nil(t, btree.pager.Flush())
+
+	// Crash midway: copy the file and the journal as they are on disk
+	crashed := filepath.Join(dir, "crashed.db")
+	copyFile(t, filename, crashed)
+	copyFile(t, filename+JournalSuffix, crashed+JournalSuffix)
+
+	recovered, err := Open(crashed)
+	require.Nil(t, err, "Expected nil error to open database with journal")
+	defer recovered.Close()
+
+	assert.NoFileExists(t, crashed+JournalSuffix, "Expected journal to be deleted after recovery")
+
+	expected := append(keys, sequentialKeys(201, 300)...)
+	assert.Equal(t, expected, cursorKeys(t, recovered, 1), "Expected keys of committed transactions only")
+	assert.Nil(t, recovered.CheckIntegrity(1))
+}
+
+func TestTransactionIncompleteJournal(t *testing.T) {
+	filename := filepath.Join(t.TempDir(), "incomplete.db")
+
+	btree, err := Open(filename)
+	require.Nil(t, err)
+	keys := insertSequentialKeys(t, btree, 1, 10, 200)
+	require.Nil(t, btree.Close())
+
+	// Crash while the journal header was being written, before the
+	// file was changed
+	require.Nil(t, os.WriteFile(filename+JournalSuffix, journalMagic, os.ModePerm))
+
+	btree, err = Open(filename)
+	require.Nil(t, err, "Expected nil error to open database with incomplete journal")
+	defer btree.Close()
+
+	assert.NoFileExists(t, filename+JournalSuffix)
+	assert.Equal(t, keys, cursorKeys(t, btree, 1))
+}
+
+func TestTransactionErrors(t *testing.T) {
+	btree := openBtree(t)
+
+	err := btree.Commit()
+	assert.True(t, errors.Is(err, ErrNoTransaction), "Expected no transaction error to commit, got %v", err)
+
+	err = btree.Rollback()
+	assert.True(t, errors.Is(err, ErrNoTransaction), "Expected no transaction error to rollback, got %v", err)
+
+	require.Nil(t, btree.BeginTransaction())
+	err = btree.BeginTransaction()
+	assert.True(t, errors.Is(err, ErrTransactionActive), "Expected transaction active error, got %v", err)
+}
+
+func TestTransactionRollbackOnClose(t *testing.T) {
+	filename := filepath.Join(t.TempDir(), "close.db")
+
+	btree, err := Open(filename)
+	require.Nil(t, err)
+
+	require.Nil(t, btree.BeginTransaction())
+	insertSequentialKeys(t, btree, 1, 10, 200)
+	require.Nil(t, btree.Close())
+
+	assert.NoFileExists(t, filename+JournalSuffix)
+
+	btree, err = Open(filename)
+	require.Nil(t, err)
+	defer btree.Close()
+
+	assert.Empty(t, cursorKeys(t, btree, 1), "Expected uncommitted keys to be rolled back on close")
+}
+
+// sequentialKeys returns count keys starting at first
+func sequentialKeys(first ChidbKey, count int) []ChidbKey {
+	keys := make([]ChidbKey, 0, count)
+	for i := 0; i < count; i++ {
+		keys = append(keys, first+ChidbKey(i))
+	}
+	return keys
+}
+
+func copyFile(tb testing.TB, src, dst string) {
+	data, err := os.ReadFile(src)
+	require.Nil(tb, err)
+	require.Nil(tb, os.WriteFile(dst, data, os.ModePerm))
+}
@@ -0,0 +1,51 @@
+package chidb
+
+import "os"
+
+// OpenPagerMmap opens a file for paged access like OpenPager, but reads
+// the pages from a memory mapping of the file
+//
+// Reading a page copies it from the mapping instead of doing a system
+// call, which makes reads faster when they miss the page cache of the
+// pager, e.g. when scanning a large database. Writes are still done on the
+// file, and the mapping grows with the file when pages past its end are
+// read.
+//
+// On platforms without mmap the file is read as with OpenPager.
+func OpenPagerMmap(filename string) (*Pager, error) {
+	f, err := os.OpenFile(filename, os.O_CREATE|os.O_RDWR, os.ModePerm)
+	if err != nil {
+		return nil, err
+	}
+
+	p, err := newPager(newMmapStorage(f), filename, false)
+	if err != nil {
+		f.Close()
+		return nil, err
+	}
+	return p, nil
+}
+
+// OpenPagerMmapHeader opens a file for paged access like OpenPager, but
+// reads and writes the file header on a shared memory mapping of the file
+//
+// Every Insert, Delete and Commit updates the file change counter on the
+// header, so mapping it makes each update a copy to memory instead of a
+// system call, which helps write-heavy workloads. The mapping is written
+// back to the file by Sync and Close like the pages. Pages are read and
+// written on the file, as with OpenPager.
+//
+// On platforms without mmap the header is read and written on the file.
+func OpenPagerMmapHeader(filename string) (*Pager, error) {
+	f, err := os.OpenFile(filename, os.O_CREATE|os.O_RDWR, os.ModePerm)
+	if err != nil {
+		return nil, err
+	}
+
+	p, err := newPager(newMmapHeaderStorage(f), filename, false)
+	if err != nil {
+		f.Close()
+		return nil, err
+	}
+	return p, nil
+}
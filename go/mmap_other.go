@@ -0,0 +1,17 @@
+//go:build !darwin && !dragonfly && !freebsd && !linux && !netbsd
+// +build !darwin,!dragonfly,!freebsd,!linux,!netbsd
+
+package chidb
+
+import "os"
+
+// newMmapStorage falls back to reading the file, since there is no mmap
+func newMmapStorage(f *os.File) Storage {
+	return &fileStorage{f}
+}
+
+// newMmapHeaderStorage falls back to writing the file, since there is no
+// mmap
+func newMmapHeaderStorage(f *os.File) Storage {
+	return &fileStorage{f}
+}
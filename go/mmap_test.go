@@ -0,0 +1,144 @@
+package chidb
+
+import (
+	"path/filepath"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestOpenPagerMmap(t *testing.T) {
+	filename := filepath.Join(t.TempDir(), "mmap.db")
+
+	pager, err := OpenPagerMmap(filename)
+	require.Nil(t, err)
+	btree, err := NewBTree(pager)
+	require.Nil(t, err)
+
+	// The file grows past the mapping while the keys are inserted
+	users, err := btree.CreateTable("users")
+	require.Nil(t, err)
+	keys := insertTableKeys(t, btree, users, sequentialKeys(1, 2000), 100)
+	require.Nil(t, pager.Flush())
+	require.Nil(t, pager.SetCacheSize(0))
+	assert.Equal(t, keys, cursorKeys(t, btree, users))
+
+	// Vacuum shrinks the file under the mapping
+	for _, key := range keys[100:] {
+		require.Nil(t, btree.Delete(users, key))
+	}
+	totalPages := pager.totalPages
+	require.Nil(t, btree.Vacuum())
+	require.Less(t, pager.totalPages, totalPages)
+
+	tables, err := btree.Tables()
+	require.Nil(t, err)
+	assert.Equal(t, keys[:100], cursorKeys(t, btree, tables[0].RootPage))
+	require.Nil(t, pager.Close())
+
+	// The file is a regular database
+	reopened, err := Open(filename)
+	require.Nil(t, err)
+	defer reopened.Close()
+	assert.Equal(t, keys[:100], cursorKeys(t, reopened, tables[0].RootPage))
+	assert.Nil(t, reopened.CheckIntegrity(tables[0].RootPage))
+}
+
+func TestOpenPagerMmapHeader(t *testing.T) {
+	filename := filepath.Join(t.TempDir(), "header.db")
+
+	pager, err := OpenPagerMmapHeader(filename)
+	require.Nil(t, err)
+	btree, err := NewBTree(pager)
+	require.Nil(t, err)
+
+	keys := insertSequentialKeys(t, btree, 1, 500, 100)
+	for i := 0; i < 3; i++ {
+		require.Nil(t, btree.BumpSchemaVersion())
+	}
+	header, err := btree.ReadHeader()
+	require.Nil(t, err)
+	assert.Equal(t, uint32(3), header.schemaVersion)
+	assert.Equal(t, uint32(500), header.fileChangeCounter, "Expected a change for each insert")
+
+	require.Nil(t, pager.Close())
+
+	// The counters written on the mapping are on the file
+	reopened, err := Open(filename)
+	require.Nil(t, err)
+	defer reopened.Close()
+	reopenedHeader, err := reopened.ReadHeader()
+	require.Nil(t, err)
+	assert.Equal(t, header, reopenedHeader)
+	assert.Equal(t, keys, cursorKeys(t, reopened, 1))
+	assert.Nil(t, reopened.CheckIntegrity(1))
+}
+
+func BenchmarkBumpSchemaVersionFile(b *testing.B) {
+	benchmarkBumpSchemaVersion(b, OpenPager)
+}
+
+func BenchmarkBumpSchemaVersionMmapHeader(b *testing.B) {
+	benchmarkBumpSchemaVersion(b, OpenPagerMmapHeader)
+}
+
+// benchmarkBumpSchemaVersion updates the header of a database opened with
+// open
+func benchmarkBumpSchemaVersion(b *testing.B, open func(string) (*Pager, error)) {
+	pager, err := open(filepath.Join(b.TempDir(), "header.db"))
+	require.Nil(b, err)
+	defer pager.Close()
+	btree, err := NewBTree(pager)
+	require.Nil(b, err)
+
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		if err := btree.BumpSchemaVersion(); err != nil {
+			b.Fatal(err)
+		}
+	}
+}
+
+func BenchmarkScanFile(b *testing.B) {
+	benchmarkScan(b, OpenPager)
+}
+
+func BenchmarkScanMmap(b *testing.B) {
+	benchmarkScan(b, OpenPagerMmap)
+}
+
+// benchmarkScan reads every cell of a database opened with open, with a
+// cache too small to keep its pages
+func benchmarkScan(b *testing.B, open func(string) (*Pager, error)) {
+	filename := filepath.Join(b.TempDir(), "scan.db")
+	btree, err := Open(filename)
+	require.Nil(b, err)
+	insertSequentialKeys(b, btree, 1, 20000, 100)
+	require.Nil(b, btree.Close())
+
+	pager, err := open(filename)
+	require.Nil(b, err)
+	defer pager.Close()
+	require.Nil(b, pager.SetCacheSize(0))
+	btree, err = NewBTree(pager)
+	require.Nil(b, err)
+
+	b.SetBytes(int64(pager.totalPages) * int64(pager.pageSize))
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		cursor, err := btree.NewCursor(1)
+		if err != nil {
+			b.Fatal(err)
+		}
+		for {
+			_, ok, err := cursor.Next()
+			if err != nil {
+				b.Fatal(err)
+			}
+			if !ok {
+				break
+			}
+		}
+	}
+}
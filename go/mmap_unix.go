@@ -0,0 +1,254 @@
+//go:build darwin || dragonfly || freebsd || linux || netbsd
+// +build darwin dragonfly freebsd linux netbsd
+
+package chidb
+
+import (
+	"io"
+	"os"
+	"sync"
+	"syscall"
+)
+
+// mmapStorage is a storage on a file whose reads are served from a shared
+// memory mapping of the file
+//
+// Writes are done on the file, which on these platforms updates the
+// mapping too. The mapping covers the file as it was when it was mapped,
+// so reads past its end map the file again.
+type mmapStorage struct {
+	fileStorage
+
+	// Guards data. Reads share it, mapping and unmapping the file takes
+	// it exclusively.
+	mu sync.RWMutex
+
+	// Mapping of the file, nil if it's not mapped
+	data []byte
+}
+
+func newMmapStorage(f *os.File) Storage {
+	return &mmapStorage{fileStorage: fileStorage{f}}
+}
+
+func (s *mmapStorage) ReadAt(b []byte, off int64) (int, error) {
+	s.mu.RLock()
+	if off >= 0 && off+int64(len(b)) <= int64(len(s.data)) {
+		n := copy(b, s.data[off:])
+		s.mu.RUnlock()
+		return n, nil
+	}
+	s.mu.RUnlock()
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if err := s.remap(); err != nil {
+		return 0, err
+	}
+	if off < 0 || off >= int64(len(s.data)) {
+		return 0, io.EOF
+	}
+	n := copy(b, s.data[off:])
+	if n < len(b) {
+		return n, io.EOF
+	}
+	return n, nil
+}
+
+// Truncate unmaps the file before changing its size, since accessing the
+// mapping past the end of the file faults
+func (s *mmapStorage) Truncate(size int64) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if err := s.unmap(); err != nil {
+		return err
+	}
+	return s.File.Truncate(size)
+}
+
+func (s *mmapStorage) Close() error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if err := s.unmap(); err != nil {
+		s.File.Close()
+		return err
+	}
+	return s.File.Close()
+}
+
+// remap maps the file again if its size changed, mu must be held
+// exclusively
+func (s *mmapStorage) remap() error {
+	size, err := s.Size()
+	if err != nil {
+		return err
+	}
+	if size == int64(len(s.data)) {
+		return nil
+	}
+
+	if err := s.unmap(); err != nil {
+		return err
+	}
+	// An empty file can't be mapped
+	if size == 0 {
+		return nil
+	}
+
+	data, err := syscall.Mmap(int(s.Fd()), 0, int(size), syscall.PROT_READ, syscall.MAP_SHARED)
+	if err != nil {
+		return err
+	}
+	s.data = data
+	return nil
+}
+
+// unmap removes the mapping of the file, mu must be held exclusively
+func (s *mmapStorage) unmap() error {
+	if s.data == nil {
+		return nil
+	}
+	if err := syscall.Munmap(s.data); err != nil {
+		return err
+	}
+	s.data = nil
+	return nil
+}
+
+// mmapHeaderStorage is a storage on a file whose header is read and written
+// on a shared writable mapping of the start of the file
+//
+// The rest of the file is read and written with system calls, which on
+// these platforms see the changes done on the mapping and the other way
+// around. The header is only mapped once the file holds one, and unmapped
+// before the file is cut below it, since accessing the mapping past the end
+// of the file faults.
+type mmapHeaderStorage struct {
+	fileStorage
+
+	// Guards header. Reads share it, writes and mapping and unmapping the
+	// file take it exclusively.
+	mu sync.RWMutex
+
+	// Mapping of the header, nil if it's not mapped
+	header []byte
+}
+
+func newMmapHeaderStorage(f *os.File) Storage {
+	return &mmapHeaderStorage{fileStorage: fileStorage{f}}
+}
+
+func (s *mmapHeaderStorage) ReadAt(b []byte, off int64) (int, error) {
+	if !inHeader(b, off) {
+		return s.File.ReadAt(b, off)
+	}
+
+	s.mu.RLock()
+	if s.header != nil {
+		n := copy(b, s.header[off:])
+		s.mu.RUnlock()
+		return n, nil
+	}
+	s.mu.RUnlock()
+
+	return s.File.ReadAt(b, off)
+}
+
+func (s *mmapHeaderStorage) WriteAt(b []byte, off int64) (int, error) {
+	if !inHeader(b, off) {
+		return s.File.WriteAt(b, off)
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if err := s.mapHeader(); err != nil {
+		return 0, err
+	}
+	if s.header == nil {
+		return s.File.WriteAt(b, off)
+	}
+	return copy(s.header[off:], b), nil
+}
+
+// Truncate unmaps the header before cutting the file below it
+func (s *mmapHeaderStorage) Truncate(size int64) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if size < HeaderSize {
+		if err := s.unmapHeader(); err != nil {
+			return err
+		}
+	}
+	return s.File.Truncate(size)
+}
+
+// Sync writes the header back to the file before syncing it, since not all
+// of these platforms sync the changes done on a mapping with the file
+func (s *mmapHeaderStorage) Sync() error {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	if s.header != nil {
+		if _, err := s.File.WriteAt(s.header, 0); err != nil {
+			return err
+		}
+	}
+	return s.File.Sync()
+}
+
+func (s *mmapHeaderStorage) Close() error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if err := s.unmapHeader(); err != nil {
+		s.File.Close()
+		return err
+	}
+	return s.File.Close()
+}
+
+// mapHeader maps the header if it isn't mapped and the file holds one, mu
+// must be held exclusively
+func (s *mmapHeaderStorage) mapHeader() error {
+	if s.header != nil {
+		return nil
+	}
+
+	size, err := s.Size()
+	if err != nil {
+		return err
+	}
+	if size < HeaderSize {
+		return nil
+	}
+
+	header, err := syscall.Mmap(int(s.Fd()), 0, HeaderSize, syscall.PROT_READ|syscall.PROT_WRITE, syscall.MAP_SHARED)
+	if err != nil {
+		return err
+	}
+	s.header = header
+	return nil
+}
+
+// unmapHeader removes the mapping of the header, mu must be held
+// exclusively
+func (s *mmapHeaderStorage) unmapHeader() error {
+	if s.header == nil {
+		return nil
+	}
+	if err := syscall.Munmap(s.header); err != nil {
+		return err
+	}
+	s.header = nil
+	return nil
+}
+
+// inHeader reports whether the bytes of b at off are within the header
+func inHeader(b []byte, off int64) bool {
+	return off >= 0 && off+int64(len(b)) <= HeaderSize
+}
@@ -0,0 +1,51 @@
+package chidb
+
+// KeyOrder is the order of the cells of a table B-Tree, chosen when the
+// table is created with CreateTableOrdered
+//
+// Every node of the B-Tree stores the order on its header, so search,
+// insert and the cursor follow it without looking up the table. Index
+// B-Trees are always in ascending order.
+type KeyOrder int
+
+const (
+	// OrderAscending stores the cells from the smallest key to the largest
+	// one
+	OrderAscending KeyOrder = iota
+
+	// OrderDescending stores the cells from the largest key to the smallest
+	// one, so a forward cursor returns the largest keys first, e.g. the
+	// newest rows of a table with increasing keys
+	OrderDescending
+)
+
+// nodeDescending is the bit of the cell format byte of the node header that
+// flags the nodes of OrderDescending B-Trees
+const nodeDescending = 0x80
+
+func (o KeyOrder) String() string {
+	switch o {
+	case OrderAscending:
+		return "ascending"
+	case OrderDescending:
+		return "descending"
+	}
+	return "<invalid order>"
+}
+
+// before reports whether a cell with key a goes before a cell with key b
+func (o KeyOrder) before(a, b ChidbKey) bool {
+	if o == OrderDescending {
+		return a > b
+	}
+	return a < b
+}
+
+// Order returns the order of the cells of the B-Tree on rootPage
+func (b *BTree) Order(rootPage uint32) (KeyOrder, error) {
+	root, err := b.GetNodeByPage(rootPage)
+	if err != nil {
+		return 0, err
+	}
+	return root.order, nil
+}
@@ -0,0 +1,205 @@
+package chidb
+
+import (
+	"errors"
+	"path/filepath"
+	"sort"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestCreateTableOrderedDescending(t *testing.T) {
+	btree := openSmallPageBtree(t)
+
+	root, err := btree.CreateTableOrdered("events", OrderDescending)
+	require.Nil(t, err)
+
+	keys := sequentialKeys(1, 2000)
+	insertTableKeys(t, btree, root, shuffledKeys(keys), 50)
+	require.Greater(t, treeHeight(t, btree, root), 2, "Expected internal nodes to be split too")
+
+	order, err := btree.Order(root)
+	require.Nil(t, err)
+	assert.Equal(t, OrderDescending, order)
+	assert.Equal(t, OrderDescending, nodeOrders(t, btree, root), "Expected every node to be descending")
+
+	descending := append([]ChidbKey{}, keys...)
+	sort.Slice(descending, func(i, j int) bool { return descending[i] > descending[j] })
+	assert.Equal(t, descending, cursorKeys(t, btree, root), "Expected forward cursor to return descending keys")
+
+	for _, key := range keys {
+		cell, err := btree.Find(root, key)
+		require.Nil(t, err, "Expected nil error to find key %d", key)
+		assert.Equal(t, key, cell.key)
+	}
+	_, err = btree.Find(root, 2001)
+	assert.True(t, errors.Is(err, ErrKeyNotFound), "Expected key not found error, got %v", err)
+	err = btree.Insert(root, NewLeafTableCell(250, nil))
+	assert.True(t, errors.Is(err, ErrDuplicateKey), "Expected duplicate key error, got %v", err)
+
+	assert.Nil(t, btree.CheckIntegrity(root))
+	assert.Nil(t, btree.CheckIntegrityParallel(root, 4))
+}
+
+func TestDescendingTableCursor(t *testing.T) {
+	btree := openSmallPageBtree(t)
+
+	root, err := btree.CreateTableOrdered("events", OrderDescending)
+	require.Nil(t, err)
+	insertTableKeys(t, btree, root, shuffledKeys(sequentialKeys(1, 300)), 50)
+
+	cursor, err := btree.NewCursor(root)
+	require.Nil(t, err)
+
+	found, err := cursor.Seek(150)
+	require.Nil(t, err)
+	assert.True(t, found)
+	assert.Equal(t, []ChidbKey{150, 149, 148}, nextKeys(t, cursor)[:3])
+
+	// Keys smaller than key are after it on a descending table
+	found, err = cursor.Seek(1000)
+	require.Nil(t, err)
+	assert.False(t, found)
+	cell, ok, err := cursor.Next()
+	require.Nil(t, err)
+	require.True(t, ok)
+	assert.Equal(t, ChidbKey(300), cell.key)
+
+	require.Nil(t, cursor.SeekLast())
+	cell, ok, err = cursor.Prev()
+	require.Nil(t, err)
+	require.True(t, ok)
+	assert.Equal(t, ChidbKey(1), cell.key, "Expected Prev to start from the smallest key")
+}
+
+func TestDescendingTableRange(t *testing.T) {
+	btree := openSmallPageBtree(t)
+
+	root, err := btree.CreateTableOrdered("events", OrderDescending)
+	require.Nil(t, err)
+	insertTableKeys(t, btree, root, sequentialKeys(1, 300), 50)
+
+	cells, err := btree.Range(root, 100, 105)
+	require.Nil(t, err)
+	keys := make([]ChidbKey, 0, len(cells))
+	for _, cell := range cells {
+		keys = append(keys, cell.key)
+	}
+	assert.Equal(t, []ChidbKey{105, 104, 103, 102, 101, 100}, keys)
+
+	deleted, err := btree.DeleteRange(root, 11, 290)
+	require.Nil(t, err)
+	assert.Equal(t, 280, deleted)
+
+	expected := append(sequentialKeys(291, 10), sequentialKeys(1, 10)...)
+	sort.Slice(expected, func(i, j int) bool { return expected[i] > expected[j] })
+	assert.Equal(t, expected, cursorKeys(t, btree, root))
+	assert.Nil(t, btree.CheckIntegrity(root))
+}
+
+func TestDescendingTableDelete(t *testing.T) {
+	btree := openSmallPageBtree(t)
+
+	root, err := btree.CreateTableOrdered("events", OrderDescending)
+	require.Nil(t, err)
+	keys := insertTableKeys(t, btree, root, shuffledKeys(sequentialKeys(1, 400)), 50)
+
+	live := make([]ChidbKey, 0)
+	for _, key := range keys {
+		if key%4 == 0 {
+			live = append(live, key)
+			continue
+		}
+		require.Nil(t, btree.Delete(root, key), "Expected nil error to delete key %d", key)
+	}
+	sort.Slice(live, func(i, j int) bool { return live[i] > live[j] })
+
+	assert.Equal(t, live, cursorKeys(t, btree, root))
+	assert.Equal(t, OrderDescending, nodeOrders(t, btree, root))
+	assert.Nil(t, btree.CheckIntegrity(root))
+}
+
+func TestDescendingTableVacuum(t *testing.T) {
+	btree := openSmallPageBtree(t)
+
+	root, err := btree.CreateTableOrdered("events", OrderDescending)
+	require.Nil(t, err)
+	insertTableKeys(t, btree, root, sequentialKeys(1, 300), 50)
+	before := cursorKeys(t, btree, root)
+
+	require.Nil(t, btree.Vacuum())
+
+	tables, err := btree.Tables()
+	require.Nil(t, err)
+	require.Len(t, tables, 1)
+	root = tables[0].RootPage
+
+	assert.Equal(t, before, cursorKeys(t, btree, root))
+	assert.Equal(t, OrderDescending, nodeOrders(t, btree, root))
+	assert.Nil(t, btree.CheckIntegrity(root))
+}
+
+func TestDescendingTablePersisted(t *testing.T) {
+	filename := filepath.Join(t.TempDir(), "descending.db")
+
+	btree, err := Open(filename)
+	require.Nil(t, err)
+	root, err := btree.CreateTableOrdered("events", OrderDescending)
+	require.Nil(t, err)
+	insertTableKeys(t, btree, root, sequentialKeys(1, 100), 50)
+	require.Nil(t, btree.Close())
+
+	btree, err = Open(filename)
+	require.Nil(t, err)
+	defer btree.Close()
+
+	order, err := btree.Order(root)
+	require.Nil(t, err)
+	assert.Equal(t, OrderDescending, order)
+
+	// Keys inserted after reopening keep the order
+	insertTableKeys(t, btree, root, sequentialKeys(101, 100), 50)
+	keys := cursorKeys(t, btree, root)
+	require.Len(t, keys, 200)
+	assert.Equal(t, ChidbKey(200), keys[0])
+	assert.Equal(t, ChidbKey(1), keys[199])
+}
+
+func TestCheckIntegrityMixedOrder(t *testing.T) {
+	btree := openBtree(t)
+
+	root := twoLevelTree(t, btree)
+	node, err := btree.GetNodeByPage(root)
+	require.Nil(t, err)
+	childPage, err := btree.childPageForPosition(node, 1)
+	require.Nil(t, err)
+
+	child, err := btree.GetNodeByPage(childPage)
+	require.Nil(t, err)
+	child.order = OrderDescending
+	require.Nil(t, btree.WriteNode(child))
+
+	err = btree.CheckIntegrity(root)
+	require.NotNil(t, err)
+	assert.Contains(t, err.Error(), "node has descending order, its parent has ascending order")
+	assert.Contains(t, err.Error(), "is not smaller than previous key")
+}
+
+// nodeOrders returns the order of the nodes of the B-Tree on nPage, failing
+// if they don't have the same order
+func nodeOrders(tb testing.TB, btree *BTree, nPage uint32) KeyOrder {
+	node, err := btree.GetNodeByPage(nPage)
+	require.Nil(tb, err)
+	if node.typ == LeafTable || node.typ == LeafIndex {
+		return node.order
+	}
+
+	for nCell := uint16(1); nCell <= node.nCells+1; nCell++ {
+		childPage, err := btree.childPageForPosition(node, nCell)
+		require.Nil(tb, err)
+		require.Equal(tb, node.order, nodeOrders(tb, btree, childPage), "Expected children of page %d with its order", nPage)
+	}
+	return node.order
+}
@@ -0,0 +1,119 @@
+package chidb
+
+import (
+	"encoding/binary"
+	"fmt"
+)
+
+// overflowHeaderSize is the size of the next page number stored at the
+// start of each overflow page.
+const overflowHeaderSize = 4
+
+// maxLocal returns how many bytes of data a leaf table cell stores on a page
+// of pageSize bytes, the rest is stored on overflow pages.
+//
+// A cell storing this much data, plus its size, key, overflow page and cell
+// offset array entry, takes a third of the space of page one, so at least
+// three cells always fit on a node and splitting a node never leaves one of
+// the halves empty.
+func maxLocal(pageSize int) int {
+	usable := pageSize - HeaderSize - (PageHeaderSize + 1)
+	return usable/3 - leafTableCellHeaderSize - overflowHeaderSize - 2
+}
+
+// writeOverflow stores data on a chain of newly allocated overflow pages and
+// returns the first page of the chain.
+//
+// Each overflow page starts with the number of the next page of the chain,
+// or 0 on the last page, followed by as much data as fits on the page.
+func (p *Pager) writeOverflow(data []byte) (uint32, error) {
+	if len(data) == 0 {
+		return 0, nil
+	}
+
+	chunk := p.usableSize() - overflowHeaderSize
+	pages := make([]uint32, 0, (len(data)+chunk-1)/chunk)
+	for i := 0; i < len(data); i += chunk {
+		nPage, err := p.AllocatePage()
+		if err != nil {
+			return 0, err
+		}
+		pages = append(pages, nPage)
+	}
+
+	for i, nPage := range pages {
+		page, err := p.ReadPage(nPage)
+		if err != nil {
+			return 0, err
+		}
+
+		content := make([]byte, page.Len())
+		if i+1 < len(pages) {
+			binary.LittleEndian.PutUint32(content, pages[i+1])
+		}
+
+		end := (i + 1) * chunk
+		if end > len(data) {
+			end = len(data)
+		}
+		copy(content[overflowHeaderSize:], data[i*chunk:end])
+
+		if err := page.Write(content); err != nil {
+			return 0, err
+		}
+		if err := p.WritePage(page); err != nil {
+			return 0, err
+		}
+	}
+
+	return pages[0], nil
+}
+
+// readOverflow reads size bytes of data from the chain of overflow pages
+// starting at nPage.
+func (p *Pager) readOverflow(nPage uint32, size int) ([]byte, error) {
+	data := make([]byte, 0, size)
+	for len(data) < size {
+		if nPage == 0 {
+			return nil, fmt.Errorf("overflow pages end after %d of %d bytes", len(data), size)
+		}
+
+		page, err := p.ReadPage(nPage)
+		if err != nil {
+			return nil, fmt.Errorf("overflow page %d: %w", nPage, err)
+		}
+
+		content := page.Read()
+		chunk := content[overflowHeaderSize:]
+		if remaining := size - len(data); len(chunk) > remaining {
+			chunk = chunk[:remaining]
+		}
+		data = append(data, chunk...)
+
+		nPage = binary.LittleEndian.Uint32(content)
+	}
+	return data, nil
+}
+
+// freeOverflow releases the chain of overflow pages starting at nPage that
+// stores size bytes of data.
+func (p *Pager) freeOverflow(nPage uint32, size int) error {
+	chunk := p.usableSize() - overflowHeaderSize
+	for ; size > 0; size -= chunk {
+		if nPage == 0 {
+			return fmt.Errorf("overflow pages end with %d bytes left", size)
+		}
+
+		page, err := p.ReadPage(nPage)
+		if err != nil {
+			return fmt.Errorf("overflow page %d: %w", nPage, err)
+		}
+		next := binary.LittleEndian.Uint32(page.Read())
+
+		if err := p.DeallocatePage(nPage); err != nil {
+			return err
+		}
+		nPage = next
+	}
+	return nil
+}
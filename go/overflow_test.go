@@ -0,0 +1,84 @@
+package chidb
+
+import (
+	"errors"
+	"math/rand"
+	"path/filepath"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestInsertCellOverflow(t *testing.T) {
+	btree := openBtree(t)
+
+	node, err := btree.NewNode(LeafTable)
+	require.Nil(t, err, "Expected nil error to create new node")
+
+	data := randomBytes(30 * 1024)
+	require.Nil(t, node.InsertCell(1, NewLeafTableCell(1, data)), "Expected nil error to insert cell bigger than a page")
+
+	local, err := node.getLocalCell(1)
+	require.Nil(t, err)
+	assert.Equal(t, maxLocal(PageSize), len(local.fields.tableLeaf.data), "Expected only a prefix of data on the page")
+	assert.NotZero(t, local.fields.tableLeaf.overflowPage, "Expected cell to have an overflow page")
+
+	cell, err := node.GetCell(1)
+	require.Nil(t, err, "Expected nil error to get cell with overflow pages")
+	assert.Equal(t, uint32(len(data)), cell.fields.tableLeaf.size)
+	assert.Equal(t, data, cell.fields.tableLeaf.data, "Expected data to be read back byte for byte")
+}
+
+func TestInsertOverflowPersisted(t *testing.T) {
+	filename := filepath.Join(t.TempDir(), "overflow.db")
+
+	btree, err := Open(filename)
+	require.Nil(t, err)
+
+	blobs := make(map[ChidbKey][]byte)
+	for key := ChidbKey(1); key <= 20; key++ {
+		blobs[key] = randomBytes(30 * 1024)
+		require.Nil(t, btree.Insert(1, NewLeafTableCell(key, blobs[key])), "Expected nil error to insert key %d", key)
+	}
+	require.Nil(t, btree.Close())
+
+	btree, err = Open(filename)
+	require.Nil(t, err)
+	defer btree.Close()
+
+	// The leaves were split, so cells were moved keeping their overflow pages
+	for key, data := range blobs {
+		cell, err := btree.Find(1, key)
+		require.Nil(t, err, "Expected nil error to find key %d", key)
+		assert.Equal(t, data, cell.fields.tableLeaf.data, "Expected data of key %d to be read back byte for byte", key)
+	}
+}
+
+func TestGetCellBrokenOverflowChain(t *testing.T) {
+	btree := openBtree(t)
+
+	node, err := btree.NewNode(LeafTable)
+	require.Nil(t, err)
+	require.Nil(t, node.InsertCell(1, NewLeafTableCell(1, randomBytes(30*1024))))
+
+	local, err := node.getLocalCell(1)
+	require.Nil(t, err)
+
+	// Cut the chain after the first overflow page
+	page, err := btree.pager.ReadPage(local.fields.tableLeaf.overflowPage)
+	require.Nil(t, err)
+	content := page.Read()
+	copy(content, []byte{0, 0, 0, 0})
+	require.Nil(t, page.Write(content))
+	require.Nil(t, btree.pager.WritePage(page))
+
+	_, err = node.GetCell(1)
+	assert.True(t, errors.Is(err, ErrCorruptCell), "Expected corrupt cell error, got %v", err)
+}
+
+func randomBytes(n int) []byte {
+	data := make([]byte, n)
+	rand.Read(data)
+	return data
+}
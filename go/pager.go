@@ -2,20 +2,52 @@ package chidb
 
 import (
 	"bytes"
+	"context"
+	"encoding/binary"
 	"errors"
 	"fmt"
+	"hash/crc32"
 	"io"
-	"log"
 	"os"
+	"sync"
+	"sync/atomic"
 )
 
 const (
-	PageSize   = 4096 * 4 // 8 Kb
+	// PageSize is the page size of new files, existing files use the page
+	// size stored on their header.
+	PageSize   = 4096 * 4 // 16 Kb
 	HeaderSize = 100
+
+	// MinPageSize and MaxPageSize are the limits of the page size. The
+	// page size is stored on 2 bytes of the header and so are the offsets
+	// inside a page, so bigger pages can't be addressed.
+	MinPageSize = 512
+	MaxPageSize = 32768
+
+	// ChecksumSize is the number of bytes reserved at the end of each page
+	// for its checksum on files with checksums, see EnableChecksums.
+	ChecksumSize = 4
 )
 
+// DefaultCacheSize is the number of bytes used to cache pages by a new
+// pager, see SetCacheSize. It holds 128 pages of PageSize bytes.
+const DefaultCacheSize = 2 << 20
+
 var ErrIncorrectPageNumber = errors.New("incorrect page number")
 
+var ErrClosed = errors.New("pager is closed")
+
+var ErrWriteVerifyFailed = errors.New("page read back differs from written page")
+
+var ErrReadOnly = errors.New("pager is read-only")
+
+var ErrPageBounds = errors.New("write past the end of the page")
+
+var ErrPageChecksum = errors.New("page checksum mismatch")
+
+var ErrShortPage = errors.New("page cut off by the end of the file")
+
 // MemPage Represents a in-memory copy of page
 type MemPage struct {
 
@@ -25,105 +57,422 @@ type MemPage struct {
 	// Offset where to start to read or write on data
 	offset uint16
 
-	// Page bytes data
-	data [PageSize]byte
+	// Page bytes data, sized to the page size of the pager
+	data []byte
+
+	// Bytes at the end of data reserved for the page checksum
+	reserved uint16
+}
+
+// Number returns the number of the page on the file, starting at 1
+func (m *MemPage) Number() uint32 {
+	return m.number
 }
 
 // Read returns the bytes of the page
 // The returned data is only data avaliable to write and read in page
 func (m *MemPage) Read() []byte {
-	return m.data[m.offset:]
+	return m.data[m.offset:m.usableSize()]
+}
+
+// usableSize returns the size of the page without the bytes reserved for
+// its checksum, including the file header on page one
+func (m *MemPage) usableSize() int {
+	return len(m.data) - int(m.reserved)
 }
 
 // WriteAt write data on page after at value
+// The at value is relative to the data returned by Read, so on page one
+// it starts after the file header. Data that would run past the end of the
+// page is rejected with ErrPageBounds and the page is left unchanged.
 func (m *MemPage) WriteAt(data []byte, at uint16) error {
-	buffer := bytes.NewBuffer([]byte(""))
-	buffer.Grow(PageSize)
+	if end := int(at) + len(data); end > m.Len() {
+		return fmt.Errorf(
+			"%w: writing %d bytes at %d of page %d ends at %d, past its %d bytes",
+			ErrPageBounds, len(data), at, m.number, end, m.Len(),
+		)
+	}
 
-	dataSize := uint16(len(m.data))
+	copy(m.data[int(m.offset)+int(at):], data)
 
-	if l := dataSize; l < at {
-		return fmt.Errorf("page data %d is less than %d", l, at)
+	return nil
+}
+
+// Write write data on current page
+// NOTE: the data param should has the same size of Len
+func (m *MemPage) Write(data []byte) error {
+	if l := len(data); l != m.Len() {
+		return fmt.Errorf("invalid page size to write: expected %d got %d", m.Len(), l)
 	}
 
-	// Write data that is before of `at` value
-	if _, err := buffer.Write(m.data[:at]); err != nil {
-		return err
+	copy(m.Read(), data)
+
+	return nil
+}
+
+// Len returns the lenght of page data available to read and write
+func (m *MemPage) Len() int {
+	return len(m.Read())
+}
+
+// clone returns a copy of the page
+func (m *MemPage) clone() *MemPage {
+	page := *m
+	page.data = make([]byte, len(m.data))
+	copy(page.data, m.data)
+	return &page
+}
+
+// copyTo copies the page into dst, reusing the data of dst if it's big
+// enough
+func (m *MemPage) copyTo(dst *MemPage) {
+	data := dst.data
+	if cap(data) < len(m.data) {
+		data = make([]byte, len(m.data))
 	}
+	*dst = *m
+	dst.data = data[:len(m.data)]
+	copy(dst.data, m.data)
+}
+
+// Pager reads and writes the pages of a file
+//
+// A Pager is safe for concurrent use. Reads take a shared lock, so many
+// goroutines can read pages at once, while writes, page allocation and
+// header writes take an exclusive lock. Unexported methods expect the
+// caller to hold mu, unless stated otherwise.
+type Pager struct {
+	// Guards the fields and the file, see Pager
+	mu sync.RWMutex
+
+	buffer     Storage
+	totalPages uint32
+
+	// Number of pages known to be on the file: the pages found on open and
+	// the ones written since. Pages after it were allocated but not written
+	// yet, so they're read as zeros, while a page up to it cut off by the
+	// end of the file is corrupt. It's raised atomically by writeBack,
+	// since concurrent readers may write back pages.
+	filePages uint32
+
+	// Name of the database file, the name of buffer may differ if the
+	// file was renamed after being opened (see create). It's empty for
+	// databases kept in memory.
+	filename string
+
+	// Size in bytes of each page, including the header on page one
+	pageSize uint32
+
+	// Set after Close, every operation on a closed pager returns ErrClosed
+	closed bool
+
+	// Set by OpenPagerReadOnly, every write returns ErrReadOnly
+	readOnly bool
+
+	// Recently used pages, see SetCacheSize
+	cache *pageCache
+
+	// Pages on the free list and the first of them, so DeallocatePage
+	// finds pages already free without walking the list. It's built by
+	// the first DeallocatePage, kept up to date by the changes to the
+	// list, and reset to nil when the header or the pages are restored.
+	free     map[uint32]bool
+	freeHead uint32
 
-	// Write new data
-	writen, err := buffer.Write(data)
+	// Rollback journal of the active transaction, or of the committed
+	// transactions waiting for their group sync. It's nil if there is none.
+	journal *journal
+
+	// Commits waiting for the file to be synced, nil if there are none,
+	// see GroupCommit
+	group *commitGroup
+
+	// Signaled on p.mu when a transaction or a commit group ends
+	groupCond *sync.Cond
+
+	// Page I/O counters, see Metrics. They're updated atomically since
+	// concurrent readers share the lock.
+	metrics Metrics
+
+	// Whether pages end with a checksum, see EnableChecksums
+	checksums bool
+
+	// VerifyWrites makes WritePage read every written page back and compare
+	// it with the written data, returning ErrWriteVerifyFailed on mismatch.
+	// This detects failing storage at the cost of an extra read per write,
+	// so it's disabled by default.
+	VerifyWrites bool
+
+	// SyncWrites makes WritePage write the page and sync the file before
+	// returning, so a written page survives a crash. Syncing waits for the
+	// storage device, which makes writes orders of magnitude slower, so
+	// it's disabled by default and callers should use Sync at the points
+	// where durability matters (e.g. when a transaction commits).
+	SyncWrites bool
+
+	// GroupCommit makes concurrent commits share the syncs of the file.
+	// A commit writes its pages and waits for the next sync, which is done
+	// by the first waiting commit without holding the pager, so the
+	// transactions committed meanwhile are synced together. Commit returns
+	// once the changes of the transaction are on stable storage, as it
+	// does without GroupCommit. Sync outside of a transaction shares the
+	// syncs too.
+	//
+	// Goroutines may run transactions on the pager concurrently, since
+	// BeginTransaction waits for the active transaction to end instead of
+	// returning ErrTransactionActive. A goroutine beginning a transaction
+	// while its own is active waits forever.
+	GroupCommit bool
+
+	// SyncMode chooses whether Commit syncs the file, trading the durability
+	// of committed transactions for fewer syncs. The zero value is
+	// SyncAlways. With SyncManual or SyncNever, GroupCommit only shares the
+	// syncs of Sync.
+	SyncMode SyncMode
+
+	// Logger receives a message for every page read from and written to
+	// the file, and for every cell skipped by a CellScanner on its pages.
+	// It's nil by default, which discards the messages. Set it to
+	// log.Default() to log them with the standard logger.
+	Logger Logger
+}
+
+// Logger receives the messages of a Pager, see Pager.Logger. It's
+// implemented by *log.Logger.
+type Logger interface {
+	Printf(format string, v ...interface{})
+}
+
+// OpenPager opens a file for paged access
+//
+// The page size is read from the file header, new files use PageSize.
+//
+// The number of pages of an existing file is derived from its size, so the
+// pages already on disk are reachable. Only complete pages are counted: a
+// file holding just the header has no pages, and a trailing partial page
+// (e.g. from an interrupted write) is ignored and reused by AllocatePage.
+func OpenPager(filename string) (*Pager, error) {
+	return openPagerFile(filename, false)
+}
+
+// OpenPagerReadOnly opens an existing file for paged access like OpenPager,
+// but without write permission
+//
+// Writing a page or the header and allocating pages return ErrReadOnly, so
+// the file is never modified.
+func OpenPagerReadOnly(filename string) (*Pager, error) {
+	return openPagerFile(filename, true)
+}
+
+func openPagerFile(filename string, readOnly bool) (*Pager, error) {
+	flag := os.O_CREATE | os.O_RDWR
+	if readOnly {
+		flag = os.O_RDONLY
+	}
+
+	f, err := os.OpenFile(filename, flag, os.ModePerm)
 	if err != nil {
-		return err
+		return nil, err
 	}
 
-	remaning := at + uint16(writen)
+	p, err := newPager(&fileStorage{f}, filename, readOnly)
+	if err != nil {
+		f.Close()
+		return nil, err
+	}
+	return p, nil
+}
 
-	if remaning < dataSize {
-		// Write the remaning bytes
-		if _, err := buffer.Write(m.data[remaning:]); err != nil {
-			return err
-		}
+// OpenPagerStorage opens a pager on the database kept on s, like OpenPager
+// does with a file
+//
+// The pager takes ownership of s, which is closed with the pager. There is
+// no file to put the rollback journal of transactions beside, so it's kept
+// in memory: Rollback works, but a transaction interrupted by a crash isn't
+// rolled back.
+func OpenPagerStorage(s Storage) (*Pager, error) {
+	return newPager(s, "", false)
+}
+
+// openPagerMemory opens a pager on an empty database kept in memory
+func openPagerMemory() (*Pager, error) {
+	return newPager(&memoryStorage{}, "", false)
+}
+
+// newPager opens a pager on the database kept on buffer. filename is the
+// name of its file, or empty if it's not on a file.
+func newPager(buffer Storage, filename string, readOnly bool) (*Pager, error) {
+	p := &Pager{
+		buffer:   buffer,
+		filename: filename,
+		pageSize: PageSize,
+		readOnly: readOnly,
+	}
+	p.groupCond = sync.NewCond(&p.mu)
+
+	if err := p.recoverJournal(); err != nil {
+		return nil, err
 	}
 
-	if uint16(buffer.Len()) != dataSize {
-		panic(fmt.Sprintf(
-			"Something goes really wrong here\n\n\nBuffer len: %d\nPage len: %d\n\n\n",
-			buffer.Len(), dataSize,
-		))
+	size, err := buffer.Size()
+	if err != nil {
+		return nil, err
 	}
 
-	newData := buffer.Bytes()
-	copy(m.data[:], newData[:PageSize])
+	if size >= HeaderSize {
+		b, err := p.readHeader()
+		if err != nil {
+			return nil, err
+		}
+		header, err := NewBtreeHeader(b)
+		if err != nil {
+			return nil, err
+		}
+		if header.pageSize != 0 {
+			p.pageSize = uint32(header.pageSize)
+		}
+		p.checksums = header.flags&HeaderFlagChecksums != 0
+	}
 
-	return nil
+	p.totalPages = uint32(size / int64(p.pageSize))
+	p.filePages = p.totalPages
+	p.cache = newPageCache(p.cachePages(DefaultCacheSize), p.writeBack)
+	return p, nil
 }
 
-// Write write data on current page
-// NOTE: the data param should has the same size of PageSize
-func (m *MemPage) Write(data []byte) error {
-	buffer := bytes.NewBuffer([]byte(""))
-	buffer.Grow(PageSize)
+// PageSize returns the size in bytes of the pages of the file
+func (p *Pager) PageSize() uint32 {
+	p.mu.RLock()
+	defer p.mu.RUnlock()
+
+	return p.pageSize
+}
 
-	if _, err := buffer.Write(m.data[:m.offset]); err != nil {
+// setPageSize changes the page size of a pager without pages
+//
+// Only an empty file, which has no header with the page size yet, can have
+// its page size changed. Unlike other unexported methods, it takes mu.
+func (p *Pager) setPageSize(size uint32) error {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	isEmpty, err := p.isEmpty()
+	if err != nil {
 		return err
 	}
+	if !isEmpty || p.totalPages > 0 {
+		return fmt.Errorf("can't change page size of a non empty file")
+	}
+	if !validPageSize(size) {
+		return fmt.Errorf("page size %d is not a power of two between %d and %d", size, MinPageSize, MaxPageSize)
+	}
+
+	p.pageSize = size
+	return p.cache.resize(p.cachePages(DefaultCacheSize))
+}
+
+// EnableChecksums makes the pager store a checksum on every page
+//
+// The last ChecksumSize bytes of each page are reserved for a CRC32 of the
+// rest of the page, which WritePage sets and ReadPage verifies, returning
+// ErrPageChecksum if the page read from the file doesn't match it. On page
+// one the file header isn't covered, since it's written apart from the page.
+//
+// Like the page size, checksums can only be enabled on an empty file. The
+// BTree created over the pager records them on the file header with
+// HeaderFlagChecksums, so they are enabled again when the file is opened.
+// Files without the flag have no checksums and are read as before.
+func (p *Pager) EnableChecksums() error {
+	p.mu.Lock()
+	defer p.mu.Unlock()
 
-	if _, err := buffer.Write(data); err != nil {
+	isEmpty, err := p.isEmpty()
+	if err != nil {
 		return err
 	}
-
-	if l := buffer.Len(); l != PageSize {
-		return fmt.Errorf("invalid page size to write: expected %d got %d", PageSize, l)
+	if !isEmpty || p.totalPages > 0 {
+		return fmt.Errorf("can't enable checksums on a non empty file")
 	}
 
-	newData := buffer.Bytes()
-	copy(m.data[:], newData[:PageSize])
-
+	p.checksums = true
 	return nil
 }
 
-// Len returns the lenght of page data available to read and write
-func (m *MemPage) Len() int {
-	return len(m.Read())
+// Checksums reports whether the pages of the file have checksums
+func (p *Pager) Checksums() bool {
+	p.mu.RLock()
+	defer p.mu.RUnlock()
+
+	return p.checksums
 }
 
-type Pager struct {
-	buffer     *os.File
-	totalPages uint32
+// reservedBytes returns the bytes reserved at the end of each page
+func (p *Pager) reservedBytes() uint16 {
+	if p.checksums {
+		return ChecksumSize
+	}
+	return 0
 }
 
-// OpenPager opens a file for paged access
-func OpenPager(filename string) (*Pager, error) {
-	f, err := os.OpenFile(filename, os.O_CREATE|os.O_RDWR, os.ModePerm)
-	if err != nil {
-		return nil, err
+// usableSize returns the size of each page without the reserved bytes
+func (p *Pager) usableSize() int {
+	return int(p.pageSize) - int(p.reservedBytes())
+}
+
+// SetCacheSize sets the number of bytes used to cache pages in memory
+//
+// The cache holds size / page size pages, but at least one. When the cache
+// is full, the least recently used page is evicted, being written to the
+// file first if it's dirty.
+func (p *Pager) SetCacheSize(size uint32) error {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	return p.cache.resize(p.cachePages(size))
+}
+
+// Metrics counts the page I/O of a Pager since it was opened
+type Metrics struct {
+	// Pages read from the file
+	Reads uint64
+
+	// Pages written to the file, when they're flushed or evicted from the
+	// cache
+	Writes uint64
+
+	// Pages read from the cache without reading the file
+	CacheHits uint64
+
+	// Pages not found on the cache, which are read from the file
+	CacheMisses uint64
+
+	// Pages evicted from the cache to make room for other pages
+	Evictions uint64
+}
+
+// Metrics returns the page I/O counters of the pager
+func (p *Pager) Metrics() Metrics {
+	return Metrics{
+		Reads:       atomic.LoadUint64(&p.metrics.Reads),
+		Writes:      atomic.LoadUint64(&p.metrics.Writes),
+		CacheHits:   atomic.LoadUint64(&p.metrics.CacheHits),
+		CacheMisses: atomic.LoadUint64(&p.metrics.CacheMisses),
+		Evictions:   p.cache.evicted(),
 	}
+}
+
+// validPageSize reports whether size is a power of two between MinPageSize
+// and MaxPageSize
+func validPageSize(size uint32) bool {
+	return size >= MinPageSize && size <= MaxPageSize && size&(size-1) == 0
+}
 
-	return &Pager{
-		buffer:     f,
-		totalPages: 0,
-	}, nil
+// cachePages returns how many pages fit on a cache of size bytes
+func (p *Pager) cachePages(size uint32) int {
+	if pages := int(size / p.pageSize); pages > 1 {
+		return pages
+	}
+	return 1
 }
 
 // ReadHeader reads in the header of a chidb file and returns it
@@ -131,28 +480,57 @@ func OpenPager(filename string) (*Pager, error) {
 // the page size is unknown, since the chidb header always occupies
 // the first 100 bytes of the file.
 func (p *Pager) ReadHeader() ([]byte, error) {
-	if _, err := p.buffer.Seek(0, io.SeekStart); err != nil {
-		return nil, err
+	p.mu.RLock()
+	defer p.mu.RUnlock()
+
+	return p.readHeader()
+}
+
+func (p *Pager) readHeader() ([]byte, error) {
+	if p.closed {
+		return nil, ErrClosed
 	}
 
+	// A partial header is returned as is, so NewBtreeHeader fails to
+	// parse it, an empty file returns io.EOF.
 	header := make([]byte, HeaderSize)
-	if _, err := p.buffer.Read(header); err != nil {
+	n, err := p.buffer.ReadAt(header, 0)
+	if err != nil && !(errors.Is(err, io.EOF) && n > 0) {
 		return nil, err
 	}
 
-	return header, nil
+	return header[:n], nil
 }
 
+// WriteHeader writes the header on the first 100 bytes of the file
 func (p *Pager) WriteHeader(header []byte) error {
-	if _, err := p.buffer.Seek(0, io.SeekStart); err != nil {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	if err := p.writeHeader(header); err != nil {
 		return err
 	}
 
+	// The header may point to another free list
+	if h, err := NewBtreeHeader(header); err != nil || h.firstFreePage != p.freeHead {
+		p.free = nil
+	}
+	return nil
+}
+
+func (p *Pager) writeHeader(header []byte) error {
+	if p.closed {
+		return ErrClosed
+	}
+	if p.readOnly {
+		return ErrReadOnly
+	}
+
 	if l := len(header); l != HeaderSize {
 		return fmt.Errorf("invalid header size %d", l)
 	}
 
-	if _, err := p.buffer.Write(header); err != nil {
+	if _, err := p.buffer.WriteAt(header, 0); err != nil {
 		return err
 	}
 	return nil
@@ -163,75 +541,842 @@ func (p *Pager) WriteHeader(header []byte) error {
 // in a MemPage struct (see header file for more details on this struct).
 // Any changes done to a MemPage will not be effective until you call
 // chidb_Pager_writePage with that MemPage.
+//
+// Pages are cached, so reading a recently used page returns a copy of the
+// cached page without reading the file.
 func (p *Pager) ReadPage(page uint32) (*MemPage, error) {
+	p.mu.RLock()
+	defer p.mu.RUnlock()
+
+	return p.readPage(page)
+}
+
+func (p *Pager) readPage(page uint32) (*MemPage, error) {
+	if p.closed {
+		return nil, ErrClosed
+	}
+
 	if err := p.pageIsValid(page); err != nil {
 		return nil, err
 	}
 
-	var data [PageSize]byte
-	count, err := p.buffer.ReadAt(data[:], p.offset(page))
+	if cached, ok := p.cache.get(page); ok {
+		atomic.AddUint64(&p.metrics.CacheHits, 1)
+		return cached, nil
+	}
+	atomic.AddUint64(&p.metrics.CacheMisses, 1)
+
+	memPage := &MemPage{}
+	if err := p.readFile(page, memPage); err != nil {
+		return nil, err
+	}
+	if err := p.cache.put(memPage, false); err != nil {
+		return nil, err
+	}
+
+	return memPage, nil
+}
+
+// ReadPageInto reads a page like ReadPage, but into dst, reusing its data
+// instead of allocating a new page on every read
+//
+// dst can be a zero MemPage, its data is allocated on the first read. A
+// page read from the file isn't added to the cache, so scanning many pages
+// doesn't evict the pages cached by other reads.
+func (p *Pager) ReadPageInto(page uint32, dst *MemPage) error {
+	p.mu.RLock()
+	defer p.mu.RUnlock()
+
+	if p.closed {
+		return ErrClosed
+	}
+
+	if err := p.pageIsValid(page); err != nil {
+		return err
+	}
+
+	if p.cache.getInto(page, dst) {
+		atomic.AddUint64(&p.metrics.CacheHits, 1)
+		return nil
+	}
+	atomic.AddUint64(&p.metrics.CacheMisses, 1)
+	return p.readFile(page, dst)
+}
+
+// EachPage calls fn with each page of the file, from page one to the last
+// one, stopping on the first error
+//
+// Like the pages of ReadPageInto, the pages aren't added to the cache, and
+// the data of page one starts after the file header. The pager isn't
+// locked while fn runs, so fn may use the pager, and pages allocated
+// meanwhile are visited too.
+func (p *Pager) EachPage(fn func(n uint32, page *MemPage) error) error {
+	for n := uint32(1); ; n++ {
+		p.mu.RLock()
+		closed, last := p.closed, p.totalPages
+		p.mu.RUnlock()
+		if closed {
+			return ErrClosed
+		}
+		if n > last {
+			return nil
+		}
+
+		page := &MemPage{}
+		if err := p.ReadPageInto(n, page); err != nil {
+			return err
+		}
+		if err := fn(n, page); err != nil {
+			return err
+		}
+	}
+}
+
+// readFile reads the page from the file into dst, reusing its data
+func (p *Pager) readFile(page uint32, dst *MemPage) error {
+	data := dst.data
+	if cap(data) < int(p.pageSize) {
+		data = make([]byte, p.pageSize)
+	}
+	data = data[:p.pageSize]
+
+	count, err := p.buffer.ReadAt(data, p.offset(page))
 	if err != nil {
 		if !errors.Is(err, io.EOF) {
-			return nil, fmt.Errorf("read buffer: %w", err)
+			return fmt.Errorf("read buffer: %w", err)
 		}
 	}
-	log.Printf("Read %d bytes from page %d\n", count, page)
+	p.logf("Read %d bytes from page %d\n", count, page)
+	atomic.AddUint64(&p.metrics.Reads, 1)
 
-	// Page one is special, the first `HeaderSize` are used by the header
-	// so we start to read after the header.
-	// http://chi.cs.uchicago.edu/chidb/fileformat.html#physical-organization
-	offset := uint16(0)
-	if page == 1 {
-		offset = HeaderSize
+	if count < len(data) {
+		if err := p.checkShortPage(page); err != nil {
+			return err
+		}
+	}
+
+	// Bytes past the end of the file are zeros, not the previous page
+	for i := count; i < len(data); i++ {
+		data[i] = 0
 	}
 
-	return &MemPage{
-		number: page,
-		data:   data,
-		offset: offset,
-	}, nil
+	*dst = MemPage{
+		number:   page,
+		data:     data,
+		offset:   dataOffset(page),
+		reserved: p.reservedBytes(),
+	}
+	if p.checksums && count == len(data) {
+		return verifyChecksum(dst)
+	}
+	return nil
+}
+
+// readPagePrefix reads the first len(b) bytes of the page data into b
+//
+// Like MemPage.Read, the data of page one starts after the file header.
+// This avoids reading a whole page when only its first bytes are needed,
+// but the page checksum isn't verified. Unlike other unexported methods, it
+// takes mu.
+func (p *Pager) readPagePrefix(page uint32, b []byte) error {
+	p.mu.RLock()
+	defer p.mu.RUnlock()
+
+	if p.closed {
+		return ErrClosed
+	}
+
+	if err := p.pageIsValid(page); err != nil {
+		return err
+	}
+
+	// The cached page may have changes not flushed to the file yet
+	if cached, ok := p.cache.get(page); ok {
+		copy(b, cached.Read())
+		return nil
+	}
+
+	count, err := p.buffer.ReadAt(b, p.offset(page)+int64(dataOffset(page)))
+	if err != nil {
+		if !errors.Is(err, io.EOF) {
+			return fmt.Errorf("read buffer: %w", err)
+		}
+	}
+	if count < len(b) {
+		if err := p.checkShortPage(page); err != nil {
+			return err
+		}
+		for i := count; i < len(b); i++ {
+			b[i] = 0
+		}
+	}
+	return nil
+}
+
+// checkShortPage is called when the file ends before the end of the page,
+// it returns ErrShortPage if the page should be on the file
+//
+// Only pages allocated and not written yet are missing from the file, they
+// read as zeros.
+func (p *Pager) checkShortPage(page uint32) error {
+	if page <= atomic.LoadUint32(&p.filePages) {
+		return fmt.Errorf("%w: page %d of %d", ErrShortPage, page, p.totalPages)
+	}
+	return nil
+}
+
+// setFilePages marks the first n pages as written to the file
+func (p *Pager) setFilePages(n uint32) {
+	for {
+		filePages := atomic.LoadUint32(&p.filePages)
+		if n <= filePages || atomic.CompareAndSwapUint32(&p.filePages, filePages, n) {
+			return
+		}
+	}
+}
+
+// truncateFilePages drops the pages after totalPages from the pages known
+// to be on the file, after the file was cut off
+func (p *Pager) truncateFilePages() {
+	if p.filePages > p.totalPages {
+		p.filePages = p.totalPages
+	}
 }
 
 // WritePage write a page to file
 // This page writes the in-memory copy of a page (stored in a MemPage
 // struct) back to disk.
+//
+// The page is stored on the cache and marked as dirty, it's only written to
+// the file when it's evicted from the cache or on Flush. So a page changed
+// many times is written only once.
 func (p *Pager) WritePage(page *MemPage) error {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	return p.writePage(page)
+}
+
+func (p *Pager) writePage(page *MemPage) error {
+	if p.closed {
+		return ErrClosed
+	}
+	if p.readOnly {
+		return ErrReadOnly
+	}
+
 	if err := p.pageIsValid(page.number); err != nil {
 		return err
 	}
 
-	if l := len(page.data); l != PageSize {
-		return fmt.Errorf("invalid page data size: expected %d got %d", PageSize, l)
+	if l := len(page.data); l != int(p.pageSize) {
+		return fmt.Errorf("invalid page data size: expected %d got %d", p.pageSize, l)
+	}
+
+	if err := p.savePage(page.number); err != nil {
+		return err
+	}
+	if err := p.journalPage(page.number); err != nil {
+		return err
+	}
+
+	if p.checksums {
+		setChecksum(page)
+	}
+	if err := p.cache.put(page, true); err != nil {
+		return err
+	}
+
+	if p.SyncWrites {
+		return p.sync()
 	}
+	return nil
+}
+
+// Flush writes all dirty pages to the file
+func (p *Pager) Flush() error {
+	return p.FlushContext(context.Background())
+}
+
+// FlushContext writes all dirty pages to the file like Flush, but stops
+// with the context error if ctx is done before all pages are written
+//
+// Pages written before ctx is done stay written, the others are kept dirty
+// and are written by the next flush.
+func (p *Pager) FlushContext(ctx context.Context) error {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	return p.flush(ctx)
+}
 
-	offset := p.offset(page.number)
-	count, err := p.buffer.WriteAt(page.data[:], offset)
+func (p *Pager) flush(ctx context.Context) error {
+	if p.closed {
+		return ErrClosed
+	}
+	return p.cache.flush(ctx)
+}
+
+// writeBack writes the page to the file, it's called by the cache to write
+// dirty pages
+//
+// Readers holding the shared lock may evict dirty pages from the cache, so
+// writeBack only does positioned writes that are safe to run concurrently
+// with reads of other pages.
+func (p *Pager) writeBack(page *MemPage) error {
+	if err := p.syncJournal(); err != nil {
+		return err
+	}
+
+	// The header on page one is only written by WriteHeader, a cached
+	// page may have an outdated copy of it.
+	offset := p.offset(page.number) + int64(page.offset)
+	count, err := p.buffer.WriteAt(page.data[page.offset:], offset)
 	if err != nil {
 		return err
 	}
-	log.Printf("Wrote %d bytes to page %d\n", count, page.number)
+	p.logf("Wrote %d bytes to page %d\n", count, page.number)
+	atomic.AddUint64(&p.metrics.Writes, 1)
+
+	// Writing past the end of the file fills the pages before it with
+	// zeros, so all of them are on the file now
+	p.setFilePages(page.number)
+
+	if p.VerifyWrites {
+		return p.verifyPage(page)
+	}
+
+	return nil
+}
+
+// verifyPage reads the page back from the file and compares it with the
+// in-memory page.
+func (p *Pager) verifyPage(page *MemPage) error {
+	data := make([]byte, len(page.data)-int(page.offset))
+	if _, err := p.buffer.ReadAt(data, p.offset(page.number)+int64(page.offset)); err != nil {
+		if !errors.Is(err, io.EOF) {
+			return fmt.Errorf("read buffer: %w", err)
+		}
+	}
+
+	if !bytes.Equal(data, page.data[page.offset:]) {
+		return fmt.Errorf("%w: page %d", ErrWriteVerifyFailed, page.number)
+	}
+	return nil
+}
+
+// setChecksum stores the checksum of the page on its reserved bytes
+func setChecksum(page *MemPage) {
+	binary.LittleEndian.PutUint32(page.data[page.usableSize():], crc32.ChecksumIEEE(page.Read()))
+}
 
+// verifyChecksum returns ErrPageChecksum if the page doesn't match its
+// checksum. A page of zeros was allocated but never written, so it has no
+// checksum yet.
+func verifyChecksum(page *MemPage) error {
+	stored := binary.LittleEndian.Uint32(page.data[page.usableSize():])
+	if stored == 0 && isZero(page.Read()) {
+		return nil
+	}
+	if sum := crc32.ChecksumIEEE(page.Read()); sum != stored {
+		return fmt.Errorf("%w: page %d has checksum %#08x, expected %#08x", ErrPageChecksum, page.number, sum, stored)
+	}
 	return nil
 }
 
+func isZero(b []byte) bool {
+	for _, c := range b {
+		if c != 0 {
+			return false
+		}
+	}
+	return true
+}
+
 // AllocatePage Allocate an extra page on the file and returns the page number
-func (p *Pager) AllocatePage() uint32 {
-	// We simply increment the page number counter.
-	// ReadPage and WritePage take care of the rest.
-	p.totalPages += 1
-	return p.totalPages
+//
+// Pages released by DeallocatePage are reused before the file grows. The
+// contents of a reused page are undefined, so it must be initialized.
+func (p *Pager) AllocatePage() (uint32, error) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	if p.closed {
+		return 0, ErrClosed
+	}
+	if p.readOnly {
+		return 0, ErrReadOnly
+	}
+
+	free, err := p.firstFreePage()
+	if err != nil {
+		return 0, err
+	}
+
+	if free == 0 {
+		// We simply increment the page number counter.
+		// ReadPage and WritePage take care of the rest.
+		p.totalPages += 1
+		return p.totalPages, nil
+	}
+
+	next, count, err := p.readFreeRun(free)
+	if err != nil {
+		return 0, err
+	}
+
+	// The first page of the run is taken, so the rest of a longer run
+	// starts on the next page
+	head := next
+	if count > 1 {
+		head = free + 1
+		if err := p.writeFreeRun(head, next, count-1); err != nil {
+			return 0, err
+		}
+	}
+
+	if err := p.setFirstFreePage(head); err != nil {
+		return 0, err
+	}
+	if p.free != nil {
+		delete(p.free, free)
+		p.freeHead = head
+	}
+	return free, nil
+}
+
+// DeallocatePage releases a page to be reused by AllocatePage
+//
+// Free pages are kept on a list of runs of contiguous pages persisted in the
+// file: the header stores the first page of the first run, and the first
+// page of each run stores the first page of the next run and the number of
+// pages of its own, see freeRunHeaderSize. A page next to the first run
+// joins it, so a block of pages freed in order takes a single run. Page one
+// holds the file header and can't be released.
+func (p *Pager) DeallocatePage(nPage uint32) error {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	if p.closed {
+		return ErrClosed
+	}
+	if p.readOnly {
+		return ErrReadOnly
+	}
+
+	if err := p.pageIsValid(nPage); err != nil {
+		return err
+	}
+	if nPage == 1 {
+		return fmt.Errorf("can't deallocate page 1")
+	}
+
+	if err := p.loadFreePages(); err != nil {
+		return err
+	}
+	if p.free[nPage] {
+		return fmt.Errorf("page %d is already free", nPage)
+	}
+
+	next, count := p.freeHead, uint32(1)
+	if p.freeHead != 0 {
+		headNext, headCount, err := p.readFreeRun(p.freeHead)
+		if err != nil {
+			return err
+		}
+
+		switch nPage {
+		case p.freeHead + headCount:
+			if err := p.writeFreeRun(p.freeHead, headNext, headCount+1); err != nil {
+				return err
+			}
+			p.free[nPage] = true
+			return nil
+		case p.freeHead - 1:
+			// The page becomes the first page of the run
+			next, count = headNext, headCount+1
+		}
+	}
+
+	if err := p.writeFreeRun(nPage, next, count); err != nil {
+		return err
+	}
+	if err := p.setFirstFreePage(nPage); err != nil {
+		return err
+	}
+	p.free[nPage] = true
+	p.freeHead = nPage
+	return nil
+}
+
+// loadFreePages builds the set of free pages if it isn't built yet
+func (p *Pager) loadFreePages() error {
+	if p.free != nil {
+		return nil
+	}
+
+	pages, err := p.freePages()
+	if err != nil {
+		return err
+	}
+	p.setFreePageSet(pages)
+	return nil
+}
+
+// setFreePageSet replaces the set of free pages with the free list pages
+func (p *Pager) setFreePageSet(pages []uint32) {
+	p.free = make(map[uint32]bool, len(pages))
+	for _, nPage := range pages {
+		p.free[nPage] = true
+	}
+	p.freeHead = 0
+	if len(pages) > 0 {
+		p.freeHead = pages[0]
+	}
+}
+
+// Truncate shrinks the file to its first nPages pages
+//
+// Only free pages can be cut off, so every page after nPages must have been
+// released with DeallocatePage. These pages are removed from the free list.
+func (p *Pager) Truncate(nPages uint32) error {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	if p.closed {
+		return ErrClosed
+	}
+	if p.readOnly {
+		return ErrReadOnly
+	}
+
+	if nPages > p.totalPages {
+		return fmt.Errorf("can't truncate file with %d pages to %d pages", p.totalPages, nPages)
+	}
+
+	free, err := p.freePages()
+	if err != nil {
+		return err
+	}
+
+	isFree := make(map[uint32]bool, len(free))
+	for _, nPage := range free {
+		isFree[nPage] = true
+	}
+	for nPage := nPages + 1; nPage <= p.totalPages; nPage++ {
+		if !isFree[nPage] {
+			return fmt.Errorf("can't truncate file to %d pages: page %d is in use", nPages, nPage)
+		}
+	}
+
+	kept := make([]uint32, 0, len(free))
+	for _, nPage := range free {
+		if nPage <= nPages {
+			kept = append(kept, nPage)
+		}
+	}
+	if err := p.setFreePages(kept); err != nil {
+		return err
+	}
+
+	// Cut off pages must not be written back by the cache
+	for nPage := nPages + 1; nPage <= p.totalPages; nPage++ {
+		if err := p.journalPage(nPage); err != nil {
+			return err
+		}
+		p.cache.remove(nPage)
+	}
+
+	if err := p.syncJournal(); err != nil {
+		return err
+	}
+	if err := p.buffer.Truncate(int64(nPages) * int64(p.pageSize)); err != nil {
+		return err
+	}
+	p.totalPages = nPages
+	p.truncateFilePages()
+	return nil
+}
+
+// setFreePages rewrites the free list with pages, in the given order, where
+// consecutive pages are stored as a single run
+func (p *Pager) setFreePages(pages []uint32) error {
+	p.free = nil
+
+	runs := make([]freeRun, 0)
+	for _, nPage := range pages {
+		if n := len(runs); n > 0 && runs[n-1].start+runs[n-1].count == nPage {
+			runs[n-1].count++
+			continue
+		}
+		runs = append(runs, freeRun{start: nPage, count: 1})
+	}
+
+	for i, run := range runs {
+		next := uint32(0)
+		if i+1 < len(runs) {
+			next = runs[i+1].start
+		}
+		if err := p.writeFreeRun(run.start, next, run.count); err != nil {
+			return err
+		}
+	}
+
+	first := uint32(0)
+	if len(runs) > 0 {
+		first = runs[0].start
+	}
+	if err := p.setFirstFreePage(first); err != nil {
+		return err
+	}
+	p.setFreePageSet(pages)
+	return nil
+}
+
+// freePages returns the pages on the free list, from the first to the last
+func (p *Pager) freePages() ([]uint32, error) {
+	runs, err := p.freeRuns()
+	if err != nil {
+		return nil, err
+	}
+
+	pages := make([]uint32, 0)
+	for _, run := range runs {
+		for nPage := run.start; nPage < run.start+run.count; nPage++ {
+			pages = append(pages, nPage)
+		}
+	}
+	return pages, nil
+}
+
+// freeRunHeaderSize is the size of the header on the first page of a run of
+// free pages: the first page of the next run, or 0 on the last run, and the
+// number of pages of the run
+const freeRunHeaderSize = 8
+
+// freeRun is a run of contiguous pages on the free list
+type freeRun struct {
+	start, count uint32
 }
 
+// freeRuns returns the runs of the free list, from the first to the last
+func (p *Pager) freeRuns() ([]freeRun, error) {
+	runs := make([]freeRun, 0)
+
+	nPage, err := p.firstFreePage()
+	if err != nil {
+		return nil, err
+	}
+
+	pages := uint32(0)
+	for nPage != 0 {
+		next, count, err := p.readFreeRun(nPage)
+		if err != nil {
+			return nil, err
+		}
+
+		// A corrupt list could point back to one of its pages
+		pages += count
+		if pages > p.totalPages || nPage+count-1 > p.totalPages {
+			return nil, fmt.Errorf("free page list has a cycle or pages past the end of the file")
+		}
+		runs = append(runs, freeRun{start: nPage, count: count})
+
+		nPage = next
+	}
+	return runs, nil
+}
+
+// logf writes a message to Logger, if there is one
+func (p *Pager) logf(format string, args ...interface{}) {
+	if p.Logger != nil {
+		p.Logger.Printf(format, args...)
+	}
+}
+
+// readFreeRun returns the first page of the run after the run starting at
+// nPage on the free list, and the number of pages of the run
+func (p *Pager) readFreeRun(nPage uint32) (next, count uint32, err error) {
+	page, err := p.readPage(nPage)
+	if err != nil {
+		return 0, 0, fmt.Errorf("free page %d: %w", nPage, err)
+	}
+
+	data := page.Read()
+	next = binary.LittleEndian.Uint32(data)
+	count = binary.LittleEndian.Uint32(data[4:])
+	if count == 0 {
+		return 0, 0, fmt.Errorf("run of free pages on page %d has no pages", nPage)
+	}
+	return next, count, nil
+}
+
+// writeFreeRun writes the header of the run of count free pages starting
+// at nPage, followed by the run starting at next
+func (p *Pager) writeFreeRun(nPage, next, count uint32) error {
+	page, err := p.readPage(nPage)
+	if err != nil {
+		return err
+	}
+
+	data := make([]byte, page.Len())
+	binary.LittleEndian.PutUint32(data, next)
+	binary.LittleEndian.PutUint32(data[4:], count)
+	if err := page.Write(data); err != nil {
+		return err
+	}
+	return p.writePage(page)
+}
+
+// firstFreePage returns the first page of the free list stored on the
+// header, or zero if there are no free pages
+func (p *Pager) firstFreePage() (uint32, error) {
+	header, err := p.readBTreeHeader()
+	if err != nil {
+		return 0, err
+	}
+	if header == nil {
+		return 0, nil
+	}
+	return header.firstFreePage, nil
+}
+
+// setFirstFreePage stores the first page of the free list on the header
+func (p *Pager) setFirstFreePage(nPage uint32) error {
+	header, err := p.readBTreeHeader()
+	if err != nil {
+		return err
+	}
+	if header == nil {
+		return fmt.Errorf("can't store free pages on file without header")
+	}
+
+	header.firstFreePage = nPage
+
+	b, err := header.Bytes()
+	if err != nil {
+		return err
+	}
+	return p.writeHeader(b)
+}
+
+// readBTreeHeader returns the parsed file header, or nil if the file has
+// no header yet
+func (p *Pager) readBTreeHeader() (*BTreeHeader, error) {
+	b, err := p.readHeader()
+	if err != nil {
+		if errors.Is(err, io.EOF) {
+			return nil, nil
+		}
+		return nil, err
+	}
+	return NewBtreeHeader(b)
+}
+
+// IsEmpty reports whether the file has no data at all, not even a header
 func (p *Pager) IsEmpty() (bool, error) {
-	info, err := p.buffer.Stat()
+	p.mu.RLock()
+	defer p.mu.RUnlock()
+
+	return p.isEmpty()
+}
+
+func (p *Pager) isEmpty() (bool, error) {
+	if p.closed {
+		return false, ErrClosed
+	}
+
+	size, err := p.buffer.Size()
 	if err != nil {
 		return false, err
 	}
-	return info.Size() == 0, nil
+	return size == 0, nil
 }
 
+// Sync flushes the dirty pages and commits the current contents of the
+// file to stable storage
+//
+// Until Sync returns, written pages may be lost on a crash even if the
+// file was written, since the operating system may keep the data on its
+// own buffers. With SyncManual, the transactions committed since the last
+// Sync become durable when it returns. With SyncNever the dirty pages are
+// written without syncing the file.
+func (p *Pager) Sync() error {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	if p.SyncMode == SyncNever {
+		return p.flush(context.Background())
+	}
+
+	// The group sync waits for the active transaction to end
+	if p.GroupCommit && !p.inTransaction() {
+		if err := p.flush(context.Background()); err != nil {
+			return err
+		}
+		return p.groupSync()
+	}
+	if err := p.sync(); err != nil {
+		return err
+	}
+	return p.endSyncedJournal()
+}
+
+func (p *Pager) sync() error {
+	if err := p.flush(context.Background()); err != nil {
+		return err
+	}
+	return p.buffer.Sync()
+}
+
+// Close syncs the dirty pages and closes the pager file
+//
+// An active transaction is rolled back. With SyncNever the dirty pages are
+// written without syncing the file.
+//
+// The file is closed even if the sync fails. Closing an already closed
+// pager is a no-op.
 func (p *Pager) Close() error {
-	return p.buffer.Close()
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	if p.closed {
+		return nil
+	}
+
+	var err error
+	if p.inTransaction() {
+		err = p.rollbackTransaction()
+	}
+	for p.group != nil {
+		p.groupCond.Wait()
+	}
+
+	switch {
+	case p.journal != nil && p.SyncMode == SyncManual:
+		// Transactions committed since the last Sync are synced now
+		if syncErr := p.sync(); syncErr != nil {
+			err = syncErr
+		} else if endErr := p.endTransaction(); err == nil {
+			err = endErr
+		}
+	case p.journal != nil:
+		// A journal is left by a failed group sync, its commits returned
+		// the error
+		if rollbackErr := p.rollback(); err == nil {
+			err = rollbackErr
+		}
+	case err == nil && !p.readOnly && p.SyncMode == SyncNever:
+		err = p.flush(context.Background())
+	case err == nil && !p.readOnly:
+		err = p.sync()
+	}
+	p.closed = true
+	p.groupCond.Broadcast()
+	if closeErr := p.buffer.Close(); err == nil {
+		err = closeErr
+	}
+	return err
 }
 
 func (p *Pager) pageIsValid(page uint32) error {
@@ -241,6 +1386,18 @@ func (p *Pager) pageIsValid(page uint32) error {
 	return nil
 }
 
+// dataOffset returns where the data of the page starts
+//
+// Page one is special, the first `HeaderSize` are used by the header
+// so we start to read after the header.
+// http://chi.cs.uchicago.edu/chidb/fileformat.html#physical-organization
+func dataOffset(page uint32) uint16 {
+	if page == 1 {
+		return HeaderSize
+	}
+	return 0
+}
+
 func (p *Pager) offset(page uint32) int64 {
-	return int64((page - 1) * PageSize)
+	return int64(page-1) * int64(p.pageSize)
 }
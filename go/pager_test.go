@@ -1,7 +1,15 @@
 package chidb
 
 import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"log"
 	"os"
+	"path/filepath"
+	"sync"
 	"testing"
 
 	"github.com/stretchr/testify/assert"
@@ -28,7 +36,8 @@ func TestPageWriteReadHeader(t *testing.T) {
 func TestPageWriteReadPage(t *testing.T) {
 	pager := openPager(t)
 
-	nPage := pager.AllocatePage()
+	nPage, err := pager.AllocatePage()
+	require.Nil(t, err)
 
 	page, err := pager.ReadPage(nPage)
 	require.Nil(t, err)
@@ -45,6 +54,748 @@ func TestPageWriteReadPage(t *testing.T) {
 	require.Nil(t, err)
 }
 
+func TestMemPageNumber(t *testing.T) {
+	pager := openPagerWithHeader(t)
+
+	for i := 0; i < 3; i++ {
+		nPage, err := pager.AllocatePage()
+		require.Nil(t, err)
+
+		page, err := pager.ReadPage(nPage)
+		require.Nil(t, err)
+		assert.Equal(t, nPage, page.Number())
+
+		var dst MemPage
+		require.Nil(t, pager.ReadPageInto(nPage, &dst))
+		assert.Equal(t, nPage, dst.Number())
+	}
+}
+
+func TestPagerReopenReadPage(t *testing.T) {
+	pager := openPager(t)
+	filename := pager.filename
+
+	for i := 1; i <= 2; i++ {
+		nPage, err := pager.AllocatePage()
+		require.Nil(t, err)
+
+		page, err := pager.ReadPage(nPage)
+		require.Nil(t, err)
+
+		err = page.WriteAt([]byte(fmt.Sprintf("page %d", nPage)), 0)
+		require.Nil(t, err)
+
+		err = pager.WritePage(page)
+		require.Nil(t, err)
+	}
+	require.Nil(t, pager.Close())
+
+	pager, err := OpenPager(filename)
+	require.Nil(t, err, "Expected nil error to reopen pager")
+
+	page, err := pager.ReadPage(2)
+	require.Nil(t, err, "Expected nil error to read page 2 after reopen")
+	assert.Equal(t, []byte("page 2"), page.Read()[:len("page 2")], "Expected equal page data after reopen")
+
+	nPage, err := pager.AllocatePage()
+	require.Nil(t, err)
+	assert.Equal(t, uint32(3), nPage, "Expected new page after the existing ones")
+}
+
+func TestPagerTotalPagesFromFileSize(t *testing.T) {
+	testcases := []struct {
+		name       string
+		size       int
+		totalPages uint32
+	}{
+		{
+			name:       "TestEmptyFile",
+			size:       0,
+			totalPages: 0,
+		},
+		{
+			name:       "TestHeaderOnlyFile",
+			size:       HeaderSize,
+			totalPages: 0,
+		},
+		{
+			name:       "TestExactPagesFile",
+			size:       2 * PageSize,
+			totalPages: 2,
+		},
+		{
+			name:       "TestPartialPageFile",
+			size:       2*PageSize + 10,
+			totalPages: 2,
+		},
+	}
+
+	for _, tt := range testcases {
+		t.Run(tt.name, func(t *testing.T) {
+			filename := filepath.Join(t.TempDir(), "test.db")
+			err := os.WriteFile(filename, make([]byte, tt.size), os.ModePerm)
+			require.Nil(t, err)
+
+			pager, err := OpenPager(filename)
+			require.Nil(t, err)
+			assert.Equal(t, tt.totalPages, pager.totalPages)
+		})
+	}
+}
+
+func TestPagerUseAfterClose(t *testing.T) {
+	pager := openPager(t)
+
+	nPage, err := pager.AllocatePage()
+	require.Nil(t, err)
+
+	page, err := pager.ReadPage(nPage)
+	require.Nil(t, err)
+
+	require.Nil(t, pager.Close(), "Expected nil error to close pager")
+	assert.Nil(t, pager.Close(), "Expected nil error to close pager twice")
+
+	_, err = pager.ReadPage(nPage)
+	assert.Equal(t, ErrClosed, err, "Expected closed error to read page")
+
+	err = pager.WritePage(page)
+	assert.Equal(t, ErrClosed, err, "Expected closed error to write page")
+
+	_, err = pager.ReadHeader()
+	assert.Equal(t, ErrClosed, err, "Expected closed error to read header")
+
+	err = pager.WriteHeader(make([]byte, HeaderSize))
+	assert.Equal(t, ErrClosed, err, "Expected closed error to write header")
+
+	_, err = pager.AllocatePage()
+	assert.Equal(t, ErrClosed, err, "Expected closed error to allocate page")
+
+	_, err = pager.IsEmpty()
+	assert.Equal(t, ErrClosed, err, "Expected closed error to check if is empty")
+}
+
+func TestPagerVerifyWrites(t *testing.T) {
+	pager := openPager(t)
+	pager.VerifyWrites = true
+
+	nPage, err := pager.AllocatePage()
+	require.Nil(t, err)
+
+	page, err := pager.ReadPage(nPage)
+	require.Nil(t, err)
+
+	err = page.WriteAt([]byte("Hello World"), 0)
+	require.Nil(t, err)
+
+	// Pages are written and verified when flushed
+	require.Nil(t, pager.WritePage(page))
+	err = pager.Flush()
+	require.Nil(t, err, "Expected nil error to write and verify page")
+
+	// The null device accepts every write but reads back nothing, like
+	// a failing storage would.
+	devNull, err := os.OpenFile(os.DevNull, os.O_RDWR, os.ModePerm)
+	require.Nil(t, err)
+	pager.buffer = &fileStorage{devNull}
+
+	require.Nil(t, pager.WritePage(page))
+	err = pager.Flush()
+	assert.True(t, errors.Is(err, ErrWriteVerifyFailed), "Expected write verify error, got %v", err)
+}
+
+func TestPagerReadPageCached(t *testing.T) {
+	pager := openPager(t)
+
+	nPage, err := pager.AllocatePage()
+	require.Nil(t, err)
+
+	first, err := pager.ReadPage(nPage)
+	require.Nil(t, err)
+	assert.Equal(t, uint64(1), pager.metrics.Reads, "Expected first read to hit the file")
+
+	// Changes on a read page are not seen by other readers until written
+	first.data[0] = 1
+
+	second, err := pager.ReadPage(nPage)
+	require.Nil(t, err)
+	assert.Equal(t, uint64(1), pager.metrics.Reads, "Expected second read to hit the cache")
+	assert.Equal(t, byte(0), second.data[0], "Expected cached page to not have unwritten changes")
+
+	require.Nil(t, pager.WritePage(first))
+
+	third, err := pager.ReadPage(nPage)
+	require.Nil(t, err)
+	assert.Equal(t, uint64(1), pager.metrics.Reads, "Expected read after write to hit the cache")
+	assert.Equal(t, byte(1), third.data[0], "Expected cached page to have written changes")
+}
+
+func TestPagerReadPageInto(t *testing.T) {
+	pager := openPagerWithHeader(t)
+
+	pages := make([]uint32, 0)
+	for i := 0; i < 3; i++ {
+		nPage, err := pager.AllocatePage()
+		require.Nil(t, err)
+
+		page, err := pager.ReadPage(nPage)
+		require.Nil(t, err)
+		require.Nil(t, page.WriteAt([]byte(fmt.Sprintf("page %d", nPage)), 0))
+		require.Nil(t, pager.WritePage(page))
+		pages = append(pages, nPage)
+	}
+	require.Nil(t, pager.Flush())
+	pager.cache.clear()
+
+	var dst MemPage
+	for _, nPage := range append([]uint32{1}, pages...) {
+		require.Nil(t, pager.ReadPageInto(nPage, &dst), "Expected nil error to read page %d", nPage)
+
+		page, err := pager.ReadPage(nPage)
+		require.Nil(t, err)
+		assert.Equal(t, page, &dst, "Expected same page from ReadPage and ReadPageInto")
+	}
+
+	// The data of dst is reused, and pages read from the file aren't cached
+	pager.cache.clear()
+	data := &dst.data[0]
+	reads := pager.metrics.Reads
+	require.Nil(t, pager.ReadPageInto(pages[0], &dst))
+	require.Nil(t, pager.ReadPageInto(pages[0], &dst))
+	assert.Equal(t, reads+2, pager.metrics.Reads, "Expected both reads to hit the file")
+	assert.Equal(t, data, &dst.data[0], "Expected data of dst to be reused")
+
+	// Written pages are read from the cache
+	page, err := pager.ReadPage(pages[1])
+	require.Nil(t, err)
+	require.Nil(t, page.WriteAt([]byte("changed"), 0))
+	require.Nil(t, pager.WritePage(page))
+	require.Nil(t, pager.ReadPageInto(pages[1], &dst))
+	assert.Equal(t, []byte("changed"), dst.Read()[:7])
+
+	assert.Equal(t, ErrIncorrectPageNumber, pager.ReadPageInto(100, &dst))
+}
+
+func TestPagerCacheEviction(t *testing.T) {
+	pager := openPager(t)
+	require.Nil(t, pager.SetCacheSize(2*PageSize))
+
+	for i := 0; i < 3; i++ {
+		_, err := pager.AllocatePage()
+		require.Nil(t, err)
+	}
+
+	read := func(nPage uint32) {
+		_, err := pager.ReadPage(nPage)
+		require.Nil(t, err, "Expected nil error to read page %d", nPage)
+	}
+
+	read(1)
+	read(2)
+	read(1) // page 2 is now the least recently used
+	read(3) // evicts page 2
+	assert.Equal(t, uint64(3), pager.metrics.Reads)
+
+	read(1)
+	assert.Equal(t, uint64(3), pager.metrics.Reads, "Expected page 1 to be cached")
+
+	read(2)
+	assert.Equal(t, uint64(4), pager.metrics.Reads, "Expected page 2 to be evicted")
+}
+
+func TestPagerMetrics(t *testing.T) {
+	pager := openPager(t)
+	require.Nil(t, pager.SetCacheSize(2*PageSize))
+
+	pages := make([]*MemPage, 0)
+	for i := 0; i < 3; i++ {
+		nPage, err := pager.AllocatePage()
+		require.Nil(t, err)
+		pages = append(pages, &MemPage{number: nPage, data: make([]byte, PageSize), offset: dataOffset(nPage)})
+	}
+
+	// Writing page 3 evicts page 1, which is written to the file
+	for _, page := range pages {
+		require.Nil(t, pager.WritePage(page))
+	}
+	assert.Equal(t, Metrics{Writes: 1, Evictions: 1}, pager.Metrics())
+
+	read := func(nPage uint32) {
+		_, err := pager.ReadPage(nPage)
+		require.Nil(t, err, "Expected nil error to read page %d", nPage)
+	}
+
+	read(2) // hit
+	read(3) // hit
+	read(1) // miss, evicts page 2, which is written
+	read(3) // hit
+	read(2) // miss, evicts page 1, which is clean
+
+	var dst MemPage
+	require.Nil(t, pager.ReadPageInto(3, &dst)) // hit
+	require.Nil(t, pager.ReadPageInto(1, &dst)) // miss, not cached
+
+	assert.Equal(t, Metrics{
+		Reads:       3,
+		Writes:      2,
+		CacheHits:   4,
+		CacheMisses: 3,
+		Evictions:   3,
+	}, pager.Metrics())
+}
+
+func TestPagerDefaultCacheSize(t *testing.T) {
+	btree := openBtree(t)
+	pager := btree.pager
+	opened := pager.Metrics()
+	keys := insertSequentialKeys(t, btree, 1, 5000, 100)
+	require.Less(t, int(pager.totalPages), DefaultCacheSize/PageSize, "Expected tree fitting on the cache")
+
+	// Changed pages stay on the cache until they're flushed
+	inserted := pager.Metrics()
+	assert.Equal(t, opened.Evictions, inserted.Evictions, "Expected no page evicted while inserting")
+	assert.Equal(t, opened.Writes, inserted.Writes, "Expected no page written while inserting")
+	require.Nil(t, pager.Flush())
+
+	// The whole tree is read from the cache
+	before := pager.Metrics()
+	assert.Equal(t, keys, cursorKeys(t, btree, 1))
+	after := pager.Metrics()
+	assert.Equal(t, before.CacheMisses, after.CacheMisses, "Expected no cache miss scanning a cached tree")
+	assert.Greater(t, after.CacheHits, before.CacheHits)
+}
+
+func TestPagerFlush(t *testing.T) {
+	pager := openPager(t)
+	require.Nil(t, pager.SetCacheSize(10*PageSize))
+
+	nPage, err := pager.AllocatePage()
+	require.Nil(t, err)
+
+	for i := byte(1); i <= 5; i++ {
+		page, err := pager.ReadPage(nPage)
+		require.Nil(t, err)
+
+		require.Nil(t, page.WriteAt([]byte{i, i, i}, 10))
+		require.Nil(t, pager.WritePage(page))
+	}
+
+	onDisk := func() []byte {
+		return readFromFile(t, pager, nPage, 13)[10:]
+	}
+	assert.Equal(t, []byte{0, 0, 0}, onDisk(), "Expected dirty page to not be written before flush")
+
+	require.Nil(t, pager.Flush(), "Expected nil error to flush pages")
+	assert.Equal(t, []byte{5, 5, 5}, onDisk(), "Expected last write of page on disk after flush")
+}
+
+func TestPagerFlushContextCanceled(t *testing.T) {
+	pager := openPager(t)
+
+	nPage, err := pager.AllocatePage()
+	require.Nil(t, err)
+
+	page, err := pager.ReadPage(nPage)
+	require.Nil(t, err)
+	require.Nil(t, page.WriteAt([]byte{1, 2, 3}, 10))
+	require.Nil(t, pager.WritePage(page))
+
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+
+	err = pager.FlushContext(ctx)
+	assert.True(t, errors.Is(err, context.Canceled), "Expected context canceled error, got %v", err)
+	assert.Equal(t, []byte{0, 0, 0}, readFromFile(t, pager, nPage, 13)[10:], "Expected page to not be written")
+
+	require.Nil(t, pager.Flush(), "Expected page to be kept dirty after canceled flush")
+	assert.Equal(t, []byte{1, 2, 3}, readFromFile(t, pager, nPage, 13)[10:])
+}
+
+func TestPagerCloseFlushes(t *testing.T) {
+	pager := openPager(t)
+	filename := pager.filename
+
+	nPage, err := pager.AllocatePage()
+	require.Nil(t, err)
+
+	page, err := pager.ReadPage(nPage)
+	require.Nil(t, err)
+	require.Nil(t, page.WriteAt([]byte("Hello World"), 0))
+	require.Nil(t, pager.WritePage(page))
+
+	require.Nil(t, pager.Close(), "Expected nil error to close pager")
+
+	pager, err = OpenPager(filename)
+	require.Nil(t, err)
+	defer pager.Close()
+
+	page, err = pager.ReadPage(nPage)
+	require.Nil(t, err)
+	assert.Equal(t, []byte("Hello World"), page.Read()[:11], "Expected page to be flushed on close")
+}
+
+func TestPagerSync(t *testing.T) {
+	pager := openPager(t)
+
+	nPage, err := pager.AllocatePage()
+	require.Nil(t, err)
+
+	page, err := pager.ReadPage(nPage)
+	require.Nil(t, err)
+	require.Nil(t, page.WriteAt([]byte("Hello World"), 0))
+	require.Nil(t, pager.WritePage(page))
+
+	require.Nil(t, pager.Sync(), "Expected nil error to sync pager")
+	assert.Equal(t, []byte("Hello World"), readFromFile(t, pager, nPage, 11), "Expected dirty page to be written on sync")
+
+	require.Nil(t, pager.Close())
+	assert.Equal(t, ErrClosed, pager.Sync(), "Expected closed error to sync closed pager")
+}
+
+func TestPagerSyncWrites(t *testing.T) {
+	pager := openPager(t)
+	pager.SyncWrites = true
+
+	nPage, err := pager.AllocatePage()
+	require.Nil(t, err)
+
+	page, err := pager.ReadPage(nPage)
+	require.Nil(t, err)
+	require.Nil(t, page.WriteAt([]byte("Hello World"), 0))
+	require.Nil(t, pager.WritePage(page), "Expected nil error to write and sync page")
+
+	assert.Equal(t, []byte("Hello World"), readFromFile(t, pager, nPage, 11), "Expected page to be on file after write")
+}
+
+func TestPagerDeallocatePage(t *testing.T) {
+	pager := openPagerWithHeader(t)
+
+	for i := 0; i < 3; i++ {
+		_, err := pager.AllocatePage()
+		require.Nil(t, err)
+	}
+
+	require.Nil(t, pager.DeallocatePage(2), "Expected nil error to deallocate page")
+
+	nPage, err := pager.AllocatePage()
+	require.Nil(t, err)
+	assert.Equal(t, uint32(2), nPage, "Expected deallocated page to be reused")
+
+	// The last deallocated page is the first to be reused
+	require.Nil(t, pager.DeallocatePage(3))
+	require.Nil(t, pager.DeallocatePage(2))
+
+	for _, expected := range []uint32{2, 3, 4} {
+		nPage, err := pager.AllocatePage()
+		require.Nil(t, err)
+		assert.Equal(t, expected, nPage)
+	}
+
+	assert.NotNil(t, pager.DeallocatePage(1), "Expected error to deallocate page with header")
+	assert.Equal(t, ErrIncorrectPageNumber, pager.DeallocatePage(5))
+
+	require.Nil(t, pager.DeallocatePage(4))
+	assert.NotNil(t, pager.DeallocatePage(4), "Expected error to deallocate free page")
+}
+
+func TestPagerDeallocateManyPages(t *testing.T) {
+	pager := openPagerWithHeader(t)
+	allocatePages(t, pager, 2001)
+
+	// Freeing a page doesn't walk the free list
+	before := pager.Metrics()
+	for nPage := uint32(2); nPage <= 2001; nPage++ {
+		require.Nil(t, pager.DeallocatePage(nPage))
+	}
+	after := pager.Metrics()
+	reads := (after.CacheHits + after.CacheMisses) - (before.CacheHits + before.CacheMisses)
+	assert.Less(t, reads, uint64(3*2000), "Expected a few page reads per freed page")
+
+	free, err := pager.freePages()
+	require.Nil(t, err)
+	assert.Len(t, free, 2000)
+	assert.NotNil(t, pager.DeallocatePage(1000), "Expected error to deallocate free page")
+}
+
+func TestPagerFreePageRuns(t *testing.T) {
+	pager := openPagerWithHeader(t)
+	allocatePages(t, pager, 40)
+
+	// A block freed in either order takes a single run
+	for nPage := uint32(10); nPage <= 20; nPage++ {
+		require.Nil(t, pager.DeallocatePage(nPage))
+	}
+	for nPage := uint32(9); nPage >= 5; nPage-- {
+		require.Nil(t, pager.DeallocatePage(nPage))
+	}
+	require.Nil(t, pager.DeallocatePage(30))
+
+	runs, err := pager.freeRuns()
+	require.Nil(t, err)
+	assert.Equal(t, []freeRun{{start: 30, count: 1}, {start: 5, count: 16}}, runs)
+
+	free, err := pager.freePages()
+	require.Nil(t, err)
+	assert.Equal(t, append([]uint32{30}, sequentialPages(5, 16)...), free)
+
+	// Each allocation splits the first page off the run, until every page
+	// is reused before the file grows
+	totalPages := pager.totalPages
+	allocated := make([]uint32, 0)
+	for i := 0; i < 17; i++ {
+		nPage, err := pager.AllocatePage()
+		require.Nil(t, err)
+		allocated = append(allocated, nPage)
+
+		if i == 1 {
+			runs, err := pager.freeRuns()
+			require.Nil(t, err)
+			assert.Equal(t, []freeRun{{start: 6, count: 15}}, runs)
+		}
+	}
+	assert.Equal(t, append([]uint32{30}, sequentialPages(5, 16)...), allocated)
+	assert.Equal(t, totalPages, pager.totalPages, "Expected free pages reused")
+
+	free, err = pager.freePages()
+	require.Nil(t, err)
+	assert.Empty(t, free)
+}
+
+func TestPagerFreePageRunsPersisted(t *testing.T) {
+	pager := openPagerWithHeader(t)
+	filename := pager.filename
+	allocatePages(t, pager, 20)
+
+	require.Nil(t, pager.BeginTransaction())
+	require.Nil(t, pager.setFreePages([]uint32{3, 4, 5, 6, 12, 8, 9}))
+	require.Nil(t, pager.Commit())
+	require.Nil(t, pager.Close())
+
+	pager, err := OpenPager(filename)
+	require.Nil(t, err)
+	defer pager.Close()
+
+	runs, err := pager.freeRuns()
+	require.Nil(t, err)
+	assert.Equal(t, []freeRun{{start: 3, count: 4}, {start: 12, count: 1}, {start: 8, count: 2}}, runs)
+}
+
+// sequentialPages returns count page numbers from first
+func sequentialPages(first uint32, count int) []uint32 {
+	pages := make([]uint32, 0, count)
+	for i := 0; i < count; i++ {
+		pages = append(pages, first+uint32(i))
+	}
+	return pages
+}
+
+func TestPagerDeallocateAfterRollback(t *testing.T) {
+	pager := openPagerWithHeader(t)
+	allocatePages(t, pager, 8)
+	require.Nil(t, pager.DeallocatePage(3))
+	require.Nil(t, pager.DeallocatePage(5))
+
+	// The free list restored by the rollback has the same first page, but
+	// not the same pages
+	require.Nil(t, pager.BeginTransaction())
+	require.Nil(t, pager.Savepoint("free"))
+	nPage, err := pager.AllocatePage()
+	require.Nil(t, err)
+	require.Equal(t, uint32(5), nPage)
+	require.Nil(t, pager.DeallocatePage(7))
+	require.Nil(t, pager.DeallocatePage(5))
+	require.Nil(t, pager.RollbackTo("free"))
+
+	require.Nil(t, pager.DeallocatePage(7), "Expected page freed after the savepoint to be in use")
+	assert.NotNil(t, pager.DeallocatePage(3), "Expected error to deallocate free page")
+	require.Nil(t, pager.Rollback())
+
+	require.Nil(t, pager.DeallocatePage(7), "Expected page freed in the transaction to be in use")
+	free, err := pager.freePages()
+	require.Nil(t, err)
+	assert.Equal(t, []uint32{7, 5, 3}, free)
+}
+
+func TestPagerFreePagesPersisted(t *testing.T) {
+	pager := openPagerWithHeader(t)
+	filename := pager.filename
+
+	for i := 0; i < 4; i++ {
+		_, err := pager.AllocatePage()
+		require.Nil(t, err)
+	}
+	require.Nil(t, pager.DeallocatePage(2))
+	require.Nil(t, pager.DeallocatePage(4))
+	require.Nil(t, pager.Close())
+
+	pager, err := OpenPager(filename)
+	require.Nil(t, err)
+	defer pager.Close()
+
+	for _, expected := range []uint32{4, 2, 5} {
+		nPage, err := pager.AllocatePage()
+		require.Nil(t, err)
+		assert.Equal(t, expected, nPage, "Expected free pages to be reused after reopen")
+	}
+}
+
+func TestPagerTruncate(t *testing.T) {
+	pager := openPagerWithHeader(t)
+	filename := pager.filename
+
+	for i := 0; i < 5; i++ {
+		_, err := pager.AllocatePage()
+		require.Nil(t, err)
+	}
+
+	require.Nil(t, pager.DeallocatePage(4))
+	assert.NotNil(t, pager.Truncate(3), "Expected error to truncate page 5 in use")
+
+	require.Nil(t, pager.DeallocatePage(2))
+	require.Nil(t, pager.DeallocatePage(5))
+	require.Nil(t, pager.Truncate(3), "Expected nil error to truncate free pages")
+
+	_, err := pager.ReadPage(4)
+	assert.Equal(t, ErrIncorrectPageNumber, err, "Expected truncated page to be invalid")
+
+	require.Nil(t, pager.Sync())
+	info, err := os.Stat(filename)
+	require.Nil(t, err)
+	assert.Equal(t, int64(3*PageSize), info.Size(), "Expected file with three pages")
+
+	// The free page before the truncated ones is kept on the free list
+	for _, expected := range []uint32{2, 4} {
+		nPage, err := pager.AllocatePage()
+		require.Nil(t, err)
+		assert.Equal(t, expected, nPage)
+	}
+
+	assert.NotNil(t, pager.Truncate(10), "Expected error to truncate to more pages than the file has")
+}
+
+func TestPagerReadAllocatedPage(t *testing.T) {
+	pager := openPagerWithHeader(t)
+	require.Nil(t, pager.SetCacheSize(0))
+
+	// Pages allocated and not written yet aren't on the file
+	allocatePages(t, pager, 3)
+	page, err := pager.ReadPage(2)
+	require.Nil(t, err, "Expected nil error to read allocated page")
+	assert.True(t, isZero(page.data), "Expected allocated page to be zeros")
+
+	// Writing the last page fills the ones before it with zeros
+	page, err = pager.ReadPage(3)
+	require.Nil(t, err)
+	require.Nil(t, page.WriteAt([]byte("data"), 0))
+	require.Nil(t, pager.WritePage(page))
+	require.Nil(t, pager.Flush())
+
+	page, err = pager.ReadPage(2)
+	require.Nil(t, err)
+	assert.True(t, isZero(page.data))
+	page, err = pager.ReadPage(3)
+	require.Nil(t, err)
+	assert.Equal(t, []byte("data"), page.Read()[:4])
+}
+
+func TestPagerReadTruncatedFile(t *testing.T) {
+	pager := openPagerWithHeader(t)
+	allocatePages(t, pager, 3)
+	for nPage := uint32(1); nPage <= 3; nPage++ {
+		page, err := pager.ReadPage(nPage)
+		require.Nil(t, err)
+		require.Nil(t, page.WriteAt([]byte("data"), 0))
+		require.Nil(t, pager.WritePage(page))
+	}
+	require.Nil(t, pager.Flush())
+	require.Nil(t, pager.SetCacheSize(0))
+
+	// The file is cut off in the middle of page 2 behind the pager
+	require.Nil(t, os.Truncate(pager.filename, PageSize+10))
+
+	page, err := pager.ReadPage(1)
+	require.Nil(t, err)
+	assert.Equal(t, []byte("data"), page.Read()[:4])
+
+	for _, nPage := range []uint32{2, 3} {
+		_, err = pager.ReadPage(nPage)
+		assert.True(t, errors.Is(err, ErrShortPage), "Expected short page error to read page %d, got %v", nPage, err)
+		err = pager.ReadPageInto(nPage, &MemPage{})
+		assert.True(t, errors.Is(err, ErrShortPage), "Expected short page error to read page %d into, got %v", nPage, err)
+	}
+}
+
+func TestPagerEachPage(t *testing.T) {
+	pager := openPagerWithHeader(t)
+	allocatePages(t, pager, 4)
+	for nPage := uint32(1); nPage <= 4; nPage++ {
+		page, err := pager.ReadPage(nPage)
+		require.Nil(t, err)
+		require.Nil(t, page.WriteAt([]byte(fmt.Sprintf("page %d", nPage)), 0))
+		require.Nil(t, pager.WritePage(page))
+	}
+
+	visited := make([]uint32, 0)
+	err := pager.EachPage(func(n uint32, page *MemPage) error {
+		visited = append(visited, n)
+		assert.Equal(t, n, page.Number())
+		expected := fmt.Sprintf("page %d", n)
+		assert.Equal(t, expected, string(page.Read()[:len(expected)]))
+		return nil
+	})
+	require.Nil(t, err)
+	assert.Equal(t, []uint32{1, 2, 3, 4}, visited)
+
+	// The data of page one starts after the file header
+	err = pager.EachPage(func(n uint32, page *MemPage) error {
+		if n == 1 {
+			assert.Equal(t, PageSize-HeaderSize, page.Len())
+		} else {
+			assert.Equal(t, PageSize, page.Len())
+		}
+		return nil
+	})
+	require.Nil(t, err)
+
+	stop := errors.New("stop")
+	visited = visited[:0]
+	err = pager.EachPage(func(n uint32, page *MemPage) error {
+		visited = append(visited, n)
+		if n == 2 {
+			return stop
+		}
+		return nil
+	})
+	assert.Equal(t, stop, err, "Expected error of the callback")
+	assert.Equal(t, []uint32{1, 2}, visited)
+
+	require.Nil(t, pager.Close())
+	err = pager.EachPage(func(n uint32, page *MemPage) error { return nil })
+	assert.Equal(t, ErrClosed, err)
+}
+
+// openPagerWithHeader opens a pager on a new file with the default header
+func openPagerWithHeader(tb testing.TB) *Pager {
+	pager := openPager(tb)
+
+	header := DefaultBTreeHeader()
+	b, err := header.Bytes()
+	require.Nil(tb, err)
+	require.Nil(tb, pager.WriteHeader(b))
+
+	return pager
+}
+
+// readFromFile reads the first n bytes of the page data directly from the
+// pager file, bypassing the cache.
+func readFromFile(tb testing.TB, pager *Pager, nPage uint32, n int) []byte {
+	data := make([]byte, n)
+	_, err := pager.buffer.ReadAt(data, pager.offset(nPage)+int64(dataOffset(nPage)))
+	if !errors.Is(err, io.EOF) {
+		require.Nil(tb, err)
+	}
+	return data
+}
+
 func openPager(tb testing.TB) *Pager {
 	db, err := os.CreateTemp(os.TempDir(), tb.Name())
 	require.Nil(tb, err)
@@ -53,3 +804,283 @@ func openPager(tb testing.TB) *Pager {
 	require.Nil(tb, err)
 	return pager
 }
+
+func TestMemPageWriteAtEndOfPage(t *testing.T) {
+	pager := openPagerWithHeader(t)
+
+	nPage, err := pager.AllocatePage()
+	require.Nil(t, err)
+
+	for _, n := range []uint32{1, nPage} {
+		page, err := pager.ReadPage(n)
+		require.Nil(t, err)
+
+		data := []byte("Hello World")
+		at := uint16(page.Len() - len(data))
+		require.Nil(t, page.WriteAt(data, at), "Expected nil error to write up to the end of page %d", n)
+		assert.Equal(t, data, page.Read()[at:])
+	}
+}
+
+func TestMemPageWriteAtPastEnd(t *testing.T) {
+	pager := openPagerWithHeader(t)
+
+	nPage, err := pager.AllocatePage()
+	require.Nil(t, err)
+
+	for _, n := range []uint32{1, nPage} {
+		page, err := pager.ReadPage(n)
+		require.Nil(t, err)
+		before := page.clone()
+
+		data := []byte("Hello World")
+		for _, at := range []uint16{uint16(page.Len() - len(data) + 1), uint16(page.Len() + 1)} {
+			err := page.WriteAt(data, at)
+			assert.True(t, errors.Is(err, ErrPageBounds), "Expected page bounds error writing at %d of page %d, got %v", at, n, err)
+		}
+		assert.Equal(t, before.data, page.data, "Expected rejected writes to leave page %d unchanged", n)
+	}
+}
+
+func TestPagerConcurrentReads(t *testing.T) {
+	pager := openPagerWithHeader(t)
+
+	// A small cache makes readers evict pages while others read them
+	require.Nil(t, pager.SetCacheSize(4*PageSize))
+
+	pages := make([]uint32, 0)
+	for i := 0; i < 16; i++ {
+		nPage, err := pager.AllocatePage()
+		require.Nil(t, err)
+
+		page, err := pager.ReadPage(nPage)
+		require.Nil(t, err)
+		require.Nil(t, page.WriteAt([]byte(fmt.Sprintf("page %d", nPage)), 0))
+		require.Nil(t, pager.WritePage(page))
+		pages = append(pages, nPage)
+	}
+
+	var wg sync.WaitGroup
+	errs := make(chan error, 32)
+	for g := 0; g < 32; g++ {
+		wg.Add(1)
+		go func(g int) {
+			defer wg.Done()
+			for i := 0; i < 50; i++ {
+				nPage := pages[(g+i)%len(pages)]
+				page, err := pager.ReadPage(nPage)
+				if err != nil {
+					errs <- err
+					return
+				}
+				if expected := fmt.Sprintf("page %d", nPage); string(page.Read()[:len(expected)]) != expected {
+					errs <- fmt.Errorf("page %d has unexpected data %q", nPage, page.Read()[:len(expected)])
+					return
+				}
+				if _, err := pager.ReadHeader(); err != nil {
+					errs <- err
+					return
+				}
+			}
+		}(g)
+	}
+	wg.Wait()
+	close(errs)
+
+	for err := range errs {
+		assert.Nil(t, err, "Expected nil error on concurrent reads")
+	}
+}
+
+func TestPagerChecksums(t *testing.T) {
+	filename := filepath.Join(t.TempDir(), "checksums.db")
+	keys := writeChecksummedBtree(t, filename)
+
+	btree, err := Open(filename)
+	require.Nil(t, err)
+	defer btree.Close()
+
+	assert.True(t, btree.pager.Checksums(), "Expected checksums enabled from the header")
+	assert.Equal(t, keys, cursorKeys(t, btree, 1))
+	assert.Nil(t, btree.CheckIntegrity(1))
+
+	// Cells with overflow pages fit on pages with reserved bytes
+	data := randomBytes(3 * PageSize)
+	require.Nil(t, btree.Insert(1, NewLeafTableCell(10000, data)))
+	cell, err := btree.Find(1, 10000)
+	require.Nil(t, err)
+	assert.Equal(t, data, cell.fields.tableLeaf.data)
+}
+
+func TestPagerChecksumMismatch(t *testing.T) {
+	filename := filepath.Join(t.TempDir(), "checksums.db")
+	writeChecksummedBtree(t, filename)
+
+	for _, nPage := range []uint32{1, 2} {
+		corrupt := filepath.Join(t.TempDir(), fmt.Sprintf("corrupt%d.db", nPage))
+		copyFile(t, filename, corrupt)
+		flipByte(t, corrupt, int64(nPage-1)*PageSize+HeaderSize+PageHeaderSize+1)
+
+		pager, err := OpenPager(corrupt)
+		require.Nil(t, err)
+
+		_, err = pager.ReadPage(nPage)
+		assert.True(t, errors.Is(err, ErrPageChecksum), "Expected checksum error to read page %d, got %v", nPage, err)
+		require.Nil(t, pager.Close())
+	}
+}
+
+func TestPagerWithoutChecksums(t *testing.T) {
+	btree := openBtree(t)
+	assert.False(t, btree.pager.Checksums())
+
+	header, err := btree.ReadHeader()
+	require.Nil(t, err)
+	assert.Zero(t, header.flags&HeaderFlagChecksums, "Expected no checksums flag on header")
+
+	page, err := btree.pager.ReadPage(1)
+	require.Nil(t, err)
+	assert.Equal(t, PageSize-HeaderSize, page.Len(), "Expected no reserved bytes")
+}
+
+func TestPagerEnableChecksumsNonEmpty(t *testing.T) {
+	pager := openPagerWithHeader(t)
+	assert.NotNil(t, pager.EnableChecksums(), "Expected error to enable checksums on non empty file")
+	assert.False(t, pager.Checksums())
+}
+
+// writeChecksummedBtree creates a database with checksums on filename and
+// returns the keys inserted on it
+func writeChecksummedBtree(tb testing.TB, filename string) []ChidbKey {
+	pager, err := OpenPager(filename)
+	require.Nil(tb, err)
+	require.Nil(tb, pager.EnableChecksums())
+
+	btree, err := NewBTree(pager)
+	require.Nil(tb, err)
+	keys := insertSequentialKeys(tb, btree, 1, 500, 100)
+	require.Nil(tb, pager.Close())
+	return keys
+}
+
+// flipByte inverts the bits of the byte at offset of filename
+func flipByte(tb testing.TB, filename string, offset int64) {
+	f, err := os.OpenFile(filename, os.O_RDWR, os.ModePerm)
+	require.Nil(tb, err)
+	defer f.Close()
+
+	b := make([]byte, 1)
+	_, err = f.ReadAt(b, offset)
+	require.Nil(tb, err)
+	b[0] ^= 0xff
+	_, err = f.WriteAt(b, offset)
+	require.Nil(tb, err)
+}
+
+func BenchmarkReadPage(b *testing.B) {
+	pager := openPagerWithHeader(b)
+	nPages := allocatePages(b, pager, 16)
+
+	b.ReportAllocs()
+	b.SetBytes(PageSize)
+	for i := 0; i < b.N; i++ {
+		if _, err := pager.ReadPage(uint32(i%nPages) + 1); err != nil {
+			b.Fatal(err)
+		}
+	}
+}
+
+func BenchmarkReadPageInto(b *testing.B) {
+	pager := openPagerWithHeader(b)
+	nPages := allocatePages(b, pager, 16)
+
+	var page MemPage
+	b.ReportAllocs()
+	b.SetBytes(PageSize)
+	for i := 0; i < b.N; i++ {
+		if err := pager.ReadPageInto(uint32(i%nPages)+1, &page); err != nil {
+			b.Fatal(err)
+		}
+	}
+}
+
+// allocatePages allocates and flushes count pages, returning the total
+// number of pages of the pager
+func allocatePages(tb testing.TB, pager *Pager, count int) int {
+	for i := 0; i < count; i++ {
+		nPage, err := pager.AllocatePage()
+		require.Nil(tb, err)
+
+		page, err := pager.ReadPage(nPage)
+		require.Nil(tb, err)
+		require.Nil(tb, pager.WritePage(page))
+	}
+	require.Nil(tb, pager.Flush())
+	return int(pager.totalPages)
+}
+
+func TestPagerNoOutput(t *testing.T) {
+	stdout := os.Stdout
+	r, w, err := os.Pipe()
+	require.Nil(t, err)
+	os.Stdout = w
+	defer func() { os.Stdout = stdout }()
+
+	var logged bytes.Buffer
+	log.SetOutput(&logged)
+	defer log.SetOutput(os.Stderr)
+
+	btree := openBtree(t)
+	keys := insertSequentialKeys(t, btree, 1, 200, 100)
+	require.Nil(t, btree.pager.Flush())
+	require.Nil(t, btree.pager.SetCacheSize(0))
+	for _, key := range keys {
+		_, err := btree.Find(1, key)
+		require.Nil(t, err)
+	}
+
+	require.Nil(t, w.Close())
+	printed, err := io.ReadAll(r)
+	require.Nil(t, err)
+
+	assert.Empty(t, string(printed), "Expected nothing printed to stdout")
+	assert.Empty(t, logged.String(), "Expected nothing logged to the standard logger")
+}
+
+func TestPagerLogger(t *testing.T) {
+	pager := openPager(t)
+	logger := &messageLogger{}
+	pager.Logger = logger
+
+	// Writes to page 1 leave the file header out
+	allocatePages(t, pager, 3)
+	pages := []uint32{2, 3}
+
+	// The cache keeps only the last read page
+	require.Nil(t, pager.SetCacheSize(0))
+	for _, nPage := range pages {
+		_, err := pager.ReadPage(nPage)
+		require.Nil(t, err)
+	}
+
+	for _, nPage := range pages {
+		assert.Contains(t, logger.messages, fmt.Sprintf("Wrote %d bytes to page %d\n", pager.PageSize(), nPage))
+		assert.Contains(t, logger.messages, fmt.Sprintf("Read %d bytes from page %d\n", pager.PageSize(), nPage))
+	}
+
+	// The standard logger can be used as is
+	var logged bytes.Buffer
+	pager.Logger = log.New(&logged, "", 0)
+	_, err := pager.ReadPage(pages[0])
+	require.Nil(t, err)
+	assert.Equal(t, fmt.Sprintf("Read %d bytes from page %d\n", pager.PageSize(), pages[0]), logged.String())
+}
+
+// messageLogger keeps the messages logged to it
+type messageLogger struct {
+	messages []string
+}
+
+func (l *messageLogger) Printf(format string, v ...interface{}) {
+	l.messages = append(l.messages, fmt.Sprintf(format, v...))
+}
@@ -0,0 +1,202 @@
+package chidb
+
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"math"
+)
+
+var ErrCorruptRecord = errors.New("corrupt record")
+
+// Serial types of the record columns, text and blob columns have a serial
+// type derived from their length, see textSerialType and blobSerialType.
+// http://chi.cs.uchicago.edu/chidb/fileformat.html#database-records
+const (
+	serialTypeNull     = 0
+	serialTypeByte     = 1
+	serialTypeSmallInt = 2
+	serialTypeInteger  = 4
+	serialTypeBigInt   = 6
+)
+
+// Record is a row stored on the data of a leaf table cell
+//
+// Each value is a column of the row, which can be nil (NULL), an int64,
+// a string (text) or a []byte (blob). Encode also accepts int and int32
+// values, but decoded integers are always int64.
+type Record struct {
+	Values []interface{}
+}
+
+// NewRecord creates a record with values as its columns
+func NewRecord(values ...interface{}) *Record {
+	return &Record{Values: values}
+}
+
+// Encode serializes the record on the chidb record format
+//
+// The record starts with a header: its length, followed by the serial type
+// of each column, all stored as varints. The header is followed by the value
+// of each column, with integers stored in big-endian using as few bytes as
+// possible.
+func (r *Record) Encode() ([]byte, error) {
+	types := make([]uint64, 0, len(r.Values))
+	body := make([]byte, 0)
+
+	for i, value := range r.Values {
+		serialType, b, err := encodeValue(value)
+		if err != nil {
+			return nil, fmt.Errorf("column %d: %w", i, err)
+		}
+		types = append(types, serialType)
+		body = append(body, b...)
+	}
+
+	typesSize := 0
+	for _, serialType := range types {
+		typesSize += varintLen(serialType)
+	}
+
+	// The header size counts the bytes of its own varint
+	headerSize := typesSize + 1
+	for typesSize+varintLen(uint64(headerSize)) > headerSize {
+		headerSize = typesSize + varintLen(uint64(headerSize))
+	}
+
+	record := make([]byte, headerSize, headerSize+len(body))
+	offset := PutVarint(record, uint64(headerSize))
+	for _, serialType := range types {
+		offset += PutVarint(record[offset:], serialType)
+	}
+	return append(record, body...), nil
+}
+
+// DecodeRecord parses a record serialized by Record.Encode
+func DecodeRecord(b []byte) (*Record, error) {
+	if len(b) == 0 {
+		return nil, fmt.Errorf("%w: empty record", ErrCorruptRecord)
+	}
+
+	size, offset := Varint(b)
+	if offset == 0 || size < uint64(offset) || size > uint64(len(b)) {
+		return nil, fmt.Errorf("%w: invalid header size %d", ErrCorruptRecord, size)
+	}
+	headerSize := int(size)
+
+	record := &Record{Values: make([]interface{}, 0)}
+	body := b[headerSize:]
+	for offset < headerSize {
+		serialType, n := Varint(b[offset:headerSize])
+		if n == 0 {
+			return nil, fmt.Errorf("%w: column %d: truncated serial type", ErrCorruptRecord, len(record.Values))
+		}
+		offset += n
+
+		value, n, err := decodeValue(serialType, body)
+		if err != nil {
+			return nil, fmt.Errorf("%w: column %d: %v", ErrCorruptRecord, len(record.Values), err)
+		}
+		record.Values = append(record.Values, value)
+		body = body[n:]
+	}
+
+	if len(body) > 0 {
+		return nil, fmt.Errorf("%w: %d bytes after the last column", ErrCorruptRecord, len(body))
+	}
+	return record, nil
+}
+
+func textSerialType(n int) uint64 {
+	return uint64(2*n + 13)
+}
+
+func blobSerialType(n int) uint64 {
+	return uint64(2*n + 12)
+}
+
+// encodeValue returns the serial type and the serialized value
+func encodeValue(value interface{}) (uint64, []byte, error) {
+	switch v := value.(type) {
+	case nil:
+		return serialTypeNull, nil, nil
+	case int:
+		return encodeInt(int64(v))
+	case int32:
+		return encodeInt(int64(v))
+	case int64:
+		return encodeInt(v)
+	case string:
+		return textSerialType(len(v)), []byte(v), nil
+	case []byte:
+		return blobSerialType(len(v)), v, nil
+	}
+	return 0, nil, fmt.Errorf("unsupported value type %T", value)
+}
+
+func encodeInt(v int64) (uint64, []byte, error) {
+	switch {
+	case v >= math.MinInt8 && v <= math.MaxInt8:
+		return serialTypeByte, []byte{byte(v)}, nil
+	case v >= math.MinInt16 && v <= math.MaxInt16:
+		b := make([]byte, 2)
+		binary.BigEndian.PutUint16(b, uint16(v))
+		return serialTypeSmallInt, b, nil
+	case v >= math.MinInt32 && v <= math.MaxInt32:
+		b := make([]byte, 4)
+		binary.BigEndian.PutUint32(b, uint32(v))
+		return serialTypeInteger, b, nil
+	}
+	b := make([]byte, 8)
+	binary.BigEndian.PutUint64(b, uint64(v))
+	return serialTypeBigInt, b, nil
+}
+
+// decodeValue parses the value of serialType on the start of body and
+// returns it with the number of bytes read
+func decodeValue(serialType uint64, body []byte) (interface{}, int, error) {
+	size, err := serialTypeSize(serialType)
+	if err != nil {
+		return nil, 0, err
+	}
+	if size > len(body) {
+		return nil, 0, fmt.Errorf("value of %d bytes exceeds the %d bytes left", size, len(body))
+	}
+	b := body[:size]
+
+	switch {
+	case serialType == serialTypeNull:
+		return nil, 0, nil
+	case serialType == serialTypeByte:
+		return int64(int8(b[0])), size, nil
+	case serialType == serialTypeSmallInt:
+		return int64(int16(binary.BigEndian.Uint16(b))), size, nil
+	case serialType == serialTypeInteger:
+		return int64(int32(binary.BigEndian.Uint32(b))), size, nil
+	case serialType == serialTypeBigInt:
+		return int64(binary.BigEndian.Uint64(b)), size, nil
+	case serialType%2 == 1:
+		return string(b), size, nil
+	}
+	return append([]byte{}, b...), size, nil
+}
+
+// serialTypeSize returns the number of bytes of a value of serialType
+func serialTypeSize(serialType uint64) (int, error) {
+	switch serialType {
+	case serialTypeNull:
+		return 0, nil
+	case serialTypeByte:
+		return 1, nil
+	case serialTypeSmallInt:
+		return 2, nil
+	case serialTypeInteger:
+		return 4, nil
+	case serialTypeBigInt:
+		return 8, nil
+	}
+	if serialType >= 12 && (serialType-12)/2 <= math.MaxInt32 {
+		return int(serialType-12) / 2, nil
+	}
+	return 0, fmt.Errorf("invalid serial type %d", serialType)
+}
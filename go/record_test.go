@@ -0,0 +1,107 @@
+package chidb
+
+import (
+	"errors"
+	"math"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestRecordRoundTrip(t *testing.T) {
+	tests := []struct {
+		name   string
+		values []interface{}
+	}{
+		{name: "empty", values: []interface{}{}},
+		{name: "null", values: []interface{}{nil}},
+		{name: "integers", values: []interface{}{
+			int64(0), int64(-1), int64(math.MaxInt8), int64(math.MinInt16),
+			int64(math.MaxInt32), int64(math.MinInt32), int64(math.MaxInt64),
+		}},
+		{name: "text and blob", values: []interface{}{"", "chidb", []byte{}, []byte{0, 1, 2}}},
+		{name: "mixed", values: []interface{}{int64(42), nil, "Hello World", []byte("blob"), nil, int64(-300)}},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			b, err := NewRecord(tt.values...).Encode()
+			require.Nil(t, err, "Expected nil error to encode record")
+
+			record, err := DecodeRecord(b)
+			require.Nil(t, err, "Expected nil error to decode record")
+			assert.Equal(t, tt.values, record.Values)
+		})
+	}
+}
+
+func TestRecordEncodeFormat(t *testing.T) {
+	b, err := NewRecord(nil, 7, "ab").Encode()
+	require.Nil(t, err)
+
+	expected := []byte{
+		// Header size and serial types of NULL, BYTE and TEXT(2)
+		4, 0, 1, 17,
+		// Column bodies
+		7, 'a', 'b',
+	}
+	assert.Equal(t, expected, b)
+}
+
+func TestRecordEncodeIntTypes(t *testing.T) {
+	record, err := DecodeRecord(mustEncode(t, NewRecord(1, int32(2), int64(3))))
+	require.Nil(t, err)
+	assert.Equal(t, []interface{}{int64(1), int64(2), int64(3)}, record.Values, "Expected integers to be decoded as int64")
+
+	_, err = NewRecord(1.5).Encode()
+	assert.NotNil(t, err, "Expected error to encode unsupported value")
+}
+
+func TestDecodeCorruptRecord(t *testing.T) {
+	valid := mustEncode(t, NewRecord(int64(1000), "text"))
+
+	tests := []struct {
+		name string
+		b    []byte
+	}{
+		{name: "empty", b: []byte{}},
+		{name: "header past record", b: []byte{9, 0, 0}},
+		{name: "header smaller than its size", b: []byte{0}},
+		{name: "truncated header size", b: []byte{0x81}},
+		{name: "truncated serial type", b: []byte{2, 0x81, 0}},
+		{name: "truncated body", b: valid[:len(valid)-1]},
+		{name: "trailing bytes", b: append(append([]byte{}, valid...), 0)},
+		{name: "invalid serial type", b: []byte{2, 3, 0, 0, 0}},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			_, err := DecodeRecord(tt.b)
+			assert.True(t, errors.Is(err, ErrCorruptRecord), "Expected corrupt record error, got %v", err)
+		})
+	}
+}
+
+func TestRecordLargeHeader(t *testing.T) {
+	// 200 columns with 1 byte serial types need a 2 byte header size
+	values := make([]interface{}, 200)
+	values[0] = string(make([]byte, 100))
+
+	b, err := NewRecord(values...).Encode()
+	require.Nil(t, err)
+
+	headerSize, n := Varint(b)
+	assert.Equal(t, 2, n)
+	assert.Equal(t, uint64(2+2+199), headerSize)
+
+	record, err := DecodeRecord(b)
+	require.Nil(t, err)
+	assert.Equal(t, values, record.Values)
+}
+
+func mustEncode(tb testing.TB, record *Record) []byte {
+	b, err := record.Encode()
+	require.Nil(tb, err)
+	return b
+}
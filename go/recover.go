@@ -0,0 +1,94 @@
+package chidb
+
+import (
+	"errors"
+	"sort"
+)
+
+// RecoverInto salvages the rows of a damaged database into dst
+//
+// Instead of walking the B-Trees, where a corrupt internal node cuts off
+// the leaves under it, every page of the file is read on its own. The pages
+// that parse as table leaves are read with a CellScanner skipping corrupt
+// cells, and the salvaged cells are inserted with InsertMany, in order of
+// key, on the table B-Tree on the root page of dst. A key found on more than
+// one page is inserted once, with the first cell found, and keys already on
+// dst are skipped. Pages on the free list are skipped, and so are the pages
+// and cells that can't be read, which are logged to the Logger of the pager.
+//
+// The rows of all tables of the file are merged into a single table, so it's
+// meant for databases with one table or to salvage rows for inspection.
+func (b *BTree) RecoverInto(dst *BTree) error {
+	p := b.pager
+	p.mu.RLock()
+	free, err := p.freePages()
+	totalPages := p.totalPages
+	p.mu.RUnlock()
+	if err != nil {
+		// A damaged free list only means free pages are scanned too
+		p.logf("Can't read free pages: %v\n", err)
+	}
+
+	isFree := make(map[uint32]bool, len(free))
+	for _, nPage := range free {
+		isFree[nPage] = true
+	}
+
+	salvaged := make(map[ChidbKey]*BTreeCell)
+	for nPage := uint32(1); nPage <= totalPages; nPage++ {
+		if isFree[nPage] {
+			continue
+		}
+
+		node, err := b.GetNodeByPage(nPage)
+		if err != nil || node.typ != LeafTable || !node.plausible() {
+			continue
+		}
+
+		scanner := NewCellScanner(node)
+		scanner.SkipCorrupt = true
+		for {
+			cell, ok, err := scanner.Next()
+			if err != nil {
+				// Overflow pages of the cell can't be read, the next cells
+				// may still be fine
+				p.logf("Skipping a cell of page %d: %v\n", nPage, err)
+				continue
+			}
+			if !ok {
+				break
+			}
+			if _, found := salvaged[cell.key]; !found {
+				salvaged[cell.key] = cell
+			}
+		}
+	}
+
+	rootPage := dst.RootPage()
+	cells := make([]*BTreeCell, 0, len(salvaged))
+	for key, cell := range salvaged {
+		_, err := dst.Find(rootPage, key)
+		if err == nil {
+			continue
+		}
+		if !errors.Is(err, ErrKeyNotFound) {
+			return err
+		}
+		cells = append(cells, NewLeafTableCell(key, cell.fields.tableLeaf.data))
+	}
+	sort.Slice(cells, func(i, j int) bool {
+		return cells[i].key < cells[j].key
+	})
+
+	return dst.InsertMany(rootPage, cells)
+}
+
+// plausible reports whether the offsets of the node header agree with each
+// other, so a page that isn't a node but starts with the byte of a node type
+// (e.g. an overflow page) is unlikely to be taken for one
+func (n *BTreeNode) plausible() bool {
+	return n.cellOffsetArray == PageHeaderSize+1 &&
+		int(n.freeOffset) == int(n.cellOffsetArray)+2*int(n.nCells) &&
+		n.freeOffset <= n.cellsOffset &&
+		int(n.cellsOffset) <= n.page.Len()
+}
@@ -0,0 +1,86 @@
+package chidb
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestRecoverInto(t *testing.T) {
+	btree := openSmallPageBtree(t)
+	rows := make(map[ChidbKey][]byte)
+	for _, key := range shuffledKeys(sequentialKeys(1, 2000)) {
+		// Some rows are stored on overflow pages
+		data := randomBytes(30)
+		if key%100 == 0 {
+			data = randomBytes(3000)
+		}
+		require.Nil(t, btree.Insert(1, NewLeafTableCell(key, data)))
+		rows[key] = data
+	}
+
+	// Deleted rows are on freed leaves, which must not come back
+	for key := ChidbKey(1501); key <= 2000; key++ {
+		require.Nil(t, btree.Delete(1, key))
+		delete(rows, key)
+	}
+	require.Greater(t, treeHeight(t, btree, 1), 2, "Expected tree with internal nodes below the root")
+
+	// Every internal node is overwritten, cutting the leaves off the tree
+	internal := internalPages(t, btree, 1)
+	require.Greater(t, len(internal), 1)
+	for _, nPage := range internal {
+		page, err := btree.pager.ReadPage(nPage)
+		require.Nil(t, err)
+		require.Nil(t, page.Write(randomBytes(page.Len())))
+		require.Nil(t, btree.pager.WritePage(page))
+	}
+	require.NotNil(t, btree.CheckIntegrity(1), "Expected corrupt tree")
+
+	dst := openBtree(t)
+	require.Nil(t, btree.RecoverInto(dst))
+
+	assert.Equal(t, sequentialKeys(1, 1500), cursorKeys(t, dst, 1))
+	for key, data := range rows {
+		cell, err := dst.Find(1, key)
+		require.Nil(t, err, "Expected key %d recovered", key)
+		require.Equal(t, data, cell.fields.tableLeaf.data, "Expected data of key %d recovered", key)
+	}
+	assert.Nil(t, dst.CheckIntegrity(1))
+}
+
+func TestRecoverIntoSkipsDuplicates(t *testing.T) {
+	btree := openBtree(t)
+	insertSequentialKeys(t, btree, 1, 100, 10)
+
+	dst := openBtree(t)
+	kept := NewLeafTableCell(50, []byte("kept"))
+	require.Nil(t, dst.Insert(1, kept))
+
+	require.Nil(t, btree.RecoverInto(dst))
+	require.Nil(t, btree.RecoverInto(dst), "Expected recovering the same rows twice to skip them")
+
+	assert.Equal(t, sequentialKeys(1, 100), cursorKeys(t, dst, 1))
+	cell, err := dst.Find(1, 50)
+	require.Nil(t, err)
+	assert.Equal(t, []byte("kept"), cell.fields.tableLeaf.data, "Expected row already on dst kept")
+}
+
+// internalPages returns the pages of the internal nodes of the B-Tree on
+// nPage
+func internalPages(tb testing.TB, btree *BTree, nPage uint32) []uint32 {
+	node, err := btree.GetNodeByPage(nPage)
+	require.Nil(tb, err)
+	if node.typ == LeafTable || node.typ == LeafIndex {
+		return nil
+	}
+
+	pages := []uint32{nPage}
+	for nCell := uint16(1); nCell <= node.nCells+1; nCell++ {
+		childPage, err := btree.childPageForPosition(node, nCell)
+		require.Nil(tb, err)
+		pages = append(pages, internalPages(tb, btree, childPage)...)
+	}
+	return pages
+}
@@ -0,0 +1,49 @@
+package chidb
+
+import "fmt"
+
+// RowCursor iterates over the rows of a table B-Tree in ascending key
+// order, decoding the record stored on each leaf cell.
+//
+// Rows are read from the leaves as the cursor moves, so only the path to
+// the current leaf is kept in memory.
+type RowCursor struct {
+	cursor *BTreeCursor
+}
+
+// Rows returns a RowCursor positioned before the first row of the table
+// B-Tree on rootPage
+func (b *BTree) Rows(rootPage uint32) (*RowCursor, error) {
+	cursor, err := b.NewCursor(rootPage)
+	if err != nil {
+		return nil, err
+	}
+	return &RowCursor{cursor: cursor}, nil
+}
+
+// Next returns the key and the decoded record of the next row
+//
+// The boolean return value is false when there are no more rows to read.
+// Returns ErrCorruptRecord if the data of the row isn't a valid record.
+func (r *RowCursor) Next() (ChidbKey, *Record, bool, error) {
+	cell, ok, err := r.cursor.Next()
+	if err != nil || !ok {
+		return 0, nil, false, err
+	}
+	if cell.typ != LeafTable {
+		return 0, nil, false, fmt.Errorf("rows can't be read from %s cells", cell.typ)
+	}
+
+	record, err := DecodeRecord(cell.fields.tableLeaf.data)
+	if err != nil {
+		return 0, nil, false, fmt.Errorf("row %d: %w", cell.key, err)
+	}
+	return cell.key, record, true, nil
+}
+
+// Seek positions the cursor at the first row whose key is greater than or
+// equal to key, so that it's the row returned by the following Next.
+// Returns whether a row with exactly key was found.
+func (r *RowCursor) Seek(key ChidbKey) (bool, error) {
+	return r.cursor.Seek(key)
+}
@@ -0,0 +1,75 @@
+package chidb
+
+import (
+	"errors"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestRows(t *testing.T) {
+	btree := openBtree(t)
+
+	records := make(map[ChidbKey]*Record)
+	for _, key := range sequentialKeys(1, 300) {
+		record := NewRecord(int64(key)*100, "name", []byte{byte(key)}, nil)
+		if key%2 == 0 {
+			record = NewRecord(int64(-1), nil)
+		}
+		data, err := record.Encode()
+		require.Nil(t, err)
+		require.Nil(t, btree.Insert(1, NewLeafTableCell(key, data)))
+		records[key] = record
+	}
+
+	rows, err := btree.Rows(1)
+	require.Nil(t, err)
+
+	expected := ChidbKey(1)
+	for {
+		key, record, ok, err := rows.Next()
+		require.Nil(t, err)
+		if !ok {
+			break
+		}
+
+		require.Equal(t, expected, key, "Expected rows in key order")
+		assert.Equal(t, records[key].Values, record.Values, "Expected columns of row %d", key)
+		expected++
+	}
+	assert.Equal(t, ChidbKey(301), expected, "Expected all rows")
+
+	found, err := rows.Seek(151)
+	require.Nil(t, err)
+	assert.True(t, found)
+	key, record, ok, err := rows.Next()
+	require.Nil(t, err)
+	require.True(t, ok)
+	assert.Equal(t, ChidbKey(151), key)
+	assert.Equal(t, []interface{}{int64(15100), "name", []byte{151}, nil}, record.Values)
+}
+
+func TestRowsCorruptRecord(t *testing.T) {
+	btree := openBtree(t)
+	require.Nil(t, btree.Insert(1, NewLeafTableCell(1, []byte{5, 1})))
+
+	rows, err := btree.Rows(1)
+	require.Nil(t, err)
+
+	_, _, ok, err := rows.Next()
+	assert.False(t, ok)
+	assert.True(t, errors.Is(err, ErrCorruptRecord), "Expected corrupt record error, got %v", err)
+}
+
+func TestRowsIndex(t *testing.T) {
+	btree := openBtree(t)
+	root := newIndex(t, btree)
+	insertIndexKeys(t, btree, root, sequentialKeys(1, 3))
+
+	rows, err := btree.Rows(root)
+	require.Nil(t, err)
+
+	_, _, _, err = rows.Next()
+	assert.NotNil(t, err, "Expected error to read rows of an index")
+}
@@ -0,0 +1,166 @@
+package chidb
+
+import (
+	"errors"
+	"fmt"
+)
+
+var ErrSavepointNotFound = errors.New("savepoint not found")
+
+// savepoint is a point of a transaction that can be rolled back to
+//
+// It keeps the contents the changed pages had when the savepoint was
+// created, so rolling back to it only restores these pages.
+type savepoint struct {
+	name string
+
+	// Number of pages and file header when the savepoint was created
+	totalPages uint32
+	header     []byte
+
+	// Contents of the pages changed after the savepoint was created
+	pages map[uint32][]byte
+}
+
+// Savepoint creates a savepoint with name on the active transaction
+//
+// RollbackTo undoes the changes done after the savepoint, without ending
+// the transaction. Savepoints are released when the transaction ends.
+func (b *BTree) Savepoint(name string) error {
+	return b.pager.Savepoint(name)
+}
+
+// RollbackTo undoes the changes done after the savepoint with name
+//
+// Savepoints created after it are released, while the savepoint itself is
+// kept, so it can be rolled back to again.
+func (b *BTree) RollbackTo(name string) error {
+	return b.pager.RollbackTo(name)
+}
+
+// Savepoint creates a savepoint with name on the active transaction
+func (p *Pager) Savepoint(name string) error {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	if p.closed {
+		return ErrClosed
+	}
+	if !p.inTransaction() {
+		return ErrNoTransaction
+	}
+
+	header, err := p.readHeader()
+	if err != nil {
+		return err
+	}
+
+	p.journal.savepoints = append(p.journal.savepoints, &savepoint{
+		name:       name,
+		totalPages: p.totalPages,
+		header:     header,
+		pages:      make(map[uint32][]byte),
+	})
+	return nil
+}
+
+// RollbackTo restores the pages and the file header as they were when the
+// savepoint with name was created
+//
+// If many savepoints have the same name, the most recent one is used.
+func (p *Pager) RollbackTo(name string) error {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	if p.closed {
+		return ErrClosed
+	}
+	if !p.inTransaction() {
+		return ErrNoTransaction
+	}
+
+	savepoints := p.journal.savepoints
+	i := len(savepoints) - 1
+	for ; i >= 0; i-- {
+		if savepoints[i].name == name {
+			break
+		}
+	}
+	if i < 0 {
+		return fmt.Errorf("%w: %s", ErrSavepointNotFound, name)
+	}
+	p.journal.savepoints = savepoints[:i+1]
+	return p.rollbackToSavepoint(savepoints[i])
+}
+
+// rollbackToSavepoint restores the pages and the file header saved on s
+func (p *Pager) rollbackToSavepoint(s *savepoint) error {
+	p.free = nil
+
+	// Pages allocated after the savepoint are dropped
+	for nPage := s.totalPages + 1; nPage <= p.totalPages; nPage++ {
+		p.cache.remove(nPage)
+	}
+	p.totalPages = s.totalPages
+	p.truncateFilePages()
+
+	fileSize, err := p.buffer.Size()
+	if err != nil {
+		return err
+	}
+	if size := int64(s.totalPages) * int64(p.pageSize); fileSize > size {
+		if err := p.syncJournal(); err != nil {
+			return err
+		}
+		if err := p.buffer.Truncate(size); err != nil {
+			return err
+		}
+	}
+
+	for nPage, data := range s.pages {
+		if nPage > s.totalPages {
+			continue
+		}
+		page := &MemPage{
+			number:   nPage,
+			offset:   dataOffset(nPage),
+			data:     append([]byte(nil), data...),
+			reserved: p.reservedBytes(),
+		}
+		if err := p.writePage(page); err != nil {
+			return err
+		}
+	}
+
+	return p.writeHeader(s.header)
+}
+
+// savePage keeps the current contents of the page on the savepoints that
+// don't have it yet, it must be called before the page is changed
+func (p *Pager) savePage(nPage uint32) error {
+	if p.journal == nil {
+		return nil
+	}
+
+	savepoints := p.journal.savepoints
+	if begin := p.journal.begin; begin != nil {
+		savepoints = append([]*savepoint{begin}, savepoints...)
+	}
+
+	var data []byte
+	for _, s := range savepoints {
+		if _, ok := s.pages[nPage]; ok || nPage > s.totalPages {
+			continue
+		}
+
+		if data == nil {
+			page, err := p.readPage(nPage)
+			if err != nil {
+				return err
+			}
+			data = page.data
+		}
+		s.pages[nPage] = data
+	}
+	return nil
+}
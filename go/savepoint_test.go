@@ -0,0 +1,73 @@
+package chidb
+
+import (
+	"errors"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestSavepointRollbackTo(t *testing.T) {
+	btree := openBtree(t)
+	root := twoLevelTree(t, btree)
+
+	require.Nil(t, btree.BeginTransaction())
+
+	// Changes before the savepoints are kept
+	insertLeafTableCells(t, btree, childNode(t, btree, root, 3), 35)
+
+	require.Nil(t, btree.Savepoint("first"), "Expected nil error to create savepoint")
+	insertLeafTableCells(t, btree, childNode(t, btree, root, 1), 11)
+	totalPages := btree.pager.totalPages
+
+	require.Nil(t, btree.Savepoint("second"), "Expected nil error to create savepoint")
+	insertLeafTableCells(t, btree, childNode(t, btree, root, 2), 21)
+	_, err := btree.NewNode(LeafTable)
+	require.Nil(t, err)
+
+	require.Nil(t, btree.RollbackTo("second"), "Expected nil error to rollback to second savepoint")
+	assert.Equal(t, []ChidbKey{5, 10, 11, 15, 20, 25, 30, 35}, cursorKeys(t, btree, root))
+	assert.Equal(t, totalPages, btree.pager.totalPages, "Expected page allocated after savepoint to be dropped")
+
+	require.Nil(t, btree.RollbackTo("first"), "Expected nil error to rollback to first savepoint")
+	assert.Equal(t, []ChidbKey{5, 10, 15, 20, 25, 30, 35}, cursorKeys(t, btree, root))
+
+	err = btree.RollbackTo("second")
+	assert.True(t, errors.Is(err, ErrSavepointNotFound), "Expected later savepoint to be released, got %v", err)
+
+	// The savepoint is kept after rolling back to it
+	insertLeafTableCells(t, btree, childNode(t, btree, root, 1), 12)
+	require.Nil(t, btree.RollbackTo("first"))
+	assert.Equal(t, []ChidbKey{5, 10, 15, 20, 25, 30, 35}, cursorKeys(t, btree, root))
+
+	require.Nil(t, btree.Commit())
+	assert.Equal(t, []ChidbKey{5, 10, 15, 20, 25, 30, 35}, cursorKeys(t, btree, root))
+	assert.Nil(t, btree.CheckIntegrity(root))
+}
+
+func TestSavepointRollbackTransaction(t *testing.T) {
+	btree := openBtree(t)
+	root := twoLevelTree(t, btree)
+
+	require.Nil(t, btree.BeginTransaction())
+	require.Nil(t, btree.Savepoint("first"))
+	insertLeafTableCells(t, btree, childNode(t, btree, root, 1), 11)
+
+	require.Nil(t, btree.Rollback(), "Expected nil error to rollback transaction with savepoints")
+	assert.Equal(t, []ChidbKey{5, 10, 15, 20, 25, 30}, cursorKeys(t, btree, root))
+}
+
+func TestSavepointErrors(t *testing.T) {
+	btree := openBtree(t)
+
+	err := btree.Savepoint("first")
+	assert.True(t, errors.Is(err, ErrNoTransaction), "Expected no transaction error to create savepoint, got %v", err)
+
+	err = btree.RollbackTo("first")
+	assert.True(t, errors.Is(err, ErrNoTransaction), "Expected no transaction error to rollback to savepoint, got %v", err)
+
+	require.Nil(t, btree.BeginTransaction())
+	err = btree.RollbackTo("unknown")
+	assert.True(t, errors.Is(err, ErrSavepointNotFound), "Expected savepoint not found error, got %v", err)
+}
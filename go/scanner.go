@@ -0,0 +1,58 @@
+package chidb
+
+import "errors"
+
+// CellScanner iterates over the cells of a B-Tree node in the order of the
+// cell offset array.
+//
+// By default the scanner stops on the first cell that can't be parsed. When
+// SkipCorrupt is set, corrupt cells (bad size, out-of-range offset) are
+// logged to the Logger of the pager and skipped, so as many cells as
+// possible are salvaged from a damaged page.
+type CellScanner struct {
+	// Node being scanned
+	node *BTreeNode
+
+	// Next cell number to be returned
+	nCell uint16
+
+	// SkipCorrupt makes the scanner skip cells that fail to parse
+	// instead of returning an error.
+	SkipCorrupt bool
+}
+
+// NewCellScanner create a new CellScanner positioned at the first cell of node
+func NewCellScanner(node *BTreeNode) *CellScanner {
+	return &CellScanner{
+		node:  node,
+		nCell: 1,
+	}
+}
+
+// Next returns the next cell of the node
+//
+// The boolean return value is false when there are no more cells to read.
+func (s *CellScanner) Next() (*BTreeCell, bool, error) {
+	// The cell offset array is the only source of cell boundaries, so
+	// nCells is not trusted beyond the entries that fit on the page.
+	total := uint16(len(s.node.cellOffsets()))
+
+	for s.nCell <= total {
+		nCell := s.nCell
+		s.nCell++
+
+		cell, err := s.node.GetCell(nCell)
+		if err == nil {
+			return cell, true, nil
+		}
+
+		if !s.SkipCorrupt || !errors.Is(err, ErrCorruptCell) {
+			return nil, false, err
+		}
+		if s.node.pager != nil {
+			s.node.pager.logf("Skipping cell %d of page %d: %v\n", nCell, s.node.page.number, err)
+		}
+	}
+
+	return nil, false, nil
+}
@@ -0,0 +1,102 @@
+package chidb
+
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestCellScannerSkipCorrupt(t *testing.T) {
+	node := corruptLeafTableNode(t)
+
+	scanner := NewCellScanner(node)
+	scanner.SkipCorrupt = true
+
+	keys := make([]ChidbKey, 0)
+	for {
+		cell, ok, err := scanner.Next()
+		require.Nil(t, err, "Expected nil error to scan cells skipping corrupt ones")
+		if !ok {
+			break
+		}
+		keys = append(keys, cell.key)
+	}
+
+	assert.Equal(t, []ChidbKey{1, 3, 4}, keys, "Expected good cells to be recovered")
+}
+
+func TestCellScannerSkipCorruptLogger(t *testing.T) {
+	node := corruptLeafTableNode(t)
+	logger := &messageLogger{}
+	node.pager.Logger = logger
+
+	scanner := NewCellScanner(node)
+	scanner.SkipCorrupt = true
+	for {
+		_, ok, err := scanner.Next()
+		require.Nil(t, err)
+		if !ok {
+			break
+		}
+	}
+
+	require.Len(t, logger.messages, 1, "Expected a message for the skipped cell")
+	assert.Contains(t, logger.messages[0], fmt.Sprintf("Skipping cell 2 of page %d", node.page.number))
+}
+
+func TestCellScannerStopOnCorrupt(t *testing.T) {
+	node := corruptLeafTableNode(t)
+
+	scanner := NewCellScanner(node)
+
+	cell, ok, err := scanner.Next()
+	require.Nil(t, err, "Expected nil error to scan first cell")
+	require.True(t, ok)
+	assert.Equal(t, ChidbKey(1), cell.key)
+
+	_, ok, err = scanner.Next()
+	assert.False(t, ok)
+	assert.True(t, errors.Is(err, ErrCorruptCell), "Expected corrupt cell error, got %v", err)
+}
+
+// corruptLeafTableNode returns a leaf table node with four cells where
+// the second one has a size larger than the page.
+func corruptLeafTableNode(tb testing.TB) *BTreeNode {
+	btree := openBtree(tb)
+
+	node, err := btree.NewNode(LeafTable)
+	require.Nil(tb, err, "Expected nil error to create new node")
+
+	offsets := make([]byte, 0)
+	for key := ChidbKey(1); key <= 4; key++ {
+		cell := BTreeCell{
+			typ: node.typ,
+			key: key,
+		}
+		cell.fields.tableLeaf.data = []byte("Hello World")
+		cell.fields.tableLeaf.size = uint32(len(cell.fields.tableLeaf.data))
+		if key == 2 {
+			cell.fields.tableLeaf.size = PageSize * 2
+		}
+
+		b, err := cell.Bytes()
+		require.Nil(tb, err)
+
+		node.cellsOffset -= uint16(len(b))
+		require.Nil(tb, node.page.WriteAt(b, node.cellsOffset))
+
+		offset := make([]byte, 2)
+		binary.LittleEndian.PutUint16(offset, node.cellsOffset)
+		offsets = append(offsets, offset...)
+	}
+
+	require.Nil(tb, node.page.WriteAt(offsets, uint16(node.cellOffsetArray)))
+	node.nCells = 4
+	node.freeOffset = uint16(node.cellOffsetArray) + uint16(len(offsets))
+
+	return node
+}
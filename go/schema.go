@@ -0,0 +1,244 @@
+package chidb
+
+import (
+	"errors"
+	"fmt"
+	"math"
+)
+
+var ErrCorruptSchema = errors.New("corrupt schema entry")
+
+var ErrTableExists = errors.New("table already exists")
+
+var ErrTableNotFound = errors.New("table not found")
+
+// SchemaTypeTable is the type of the schema entries of tables
+const SchemaTypeTable = "table"
+
+// SchemaEntry is a row of the schema table, which describes a table or an
+// index of the database
+//
+// Each entry is stored on the schema table (see RootPage) as a record with
+// the columns type, name, table name, root page and SQL, like the
+// sqlite_master table.
+// http://chi.cs.uchicago.edu/chidb/fileformat.html#the-schema-table
+type SchemaEntry struct {
+	// Type of the entry, SchemaTypeTable for tables
+	Type string
+
+	// Name of the table or index
+	Name string
+
+	// Table of an index, or the name of the table itself for tables
+	TableName string
+
+	// Root page of the B-Tree of the table or index
+	RootPage uint32
+
+	// Statement used to create the table or index, empty if unknown
+	SQL string
+}
+
+// CreateTable creates an empty table called name and returns its root page
+//
+// The root is a new table leaf node, which gets a schema entry so the table
+// is found by its name, and the schema version is bumped. Returns
+// ErrTableExists if the schema already has a table called name.
+func (b *BTree) CreateTable(name string) (uint32, error) {
+	return b.CreateTableOrdered(name, OrderAscending)
+}
+
+// CreateTableOrdered creates an empty table called name like CreateTable,
+// with its cells stored in order
+//
+// The order is kept on every node of the table, so Find, Insert and the
+// cursor follow it, and Vacuum keeps it when the table is rebuilt.
+func (b *BTree) CreateTableOrdered(name string, order KeyOrder) (uint32, error) {
+	_, _, found, err := b.findTable(name)
+	if err != nil {
+		return 0, err
+	}
+	if found {
+		return 0, fmt.Errorf("%w: %s", ErrTableExists, name)
+	}
+
+	root, err := b.NewNode(LeafTable)
+	if err != nil {
+		return 0, err
+	}
+	rootPage := root.page.number
+	if order != OrderAscending {
+		root.order = order
+		if err := b.writeNode(root); err != nil {
+			return 0, err
+		}
+	}
+
+	if err := b.CreateTableEntry(name, rootPage); err != nil {
+		// Without its entry the table can't be found
+		if freeErr := b.pager.DeallocatePage(rootPage); freeErr != nil {
+			return 0, freeErr
+		}
+		return 0, err
+	}
+	if err := b.BumpSchemaVersion(); err != nil {
+		return 0, err
+	}
+	return rootPage, nil
+}
+
+// DropTable removes the table called name and releases its pages
+//
+// The schema entry of the table is removed first, and then every page of
+// its B-Tree, including overflow pages, is released to the free list to be
+// reused by AllocatePage. The root page is released last, so it's the
+// first page to be reused. The schema version is bumped. Returns
+// ErrTableNotFound if the schema has no table called name.
+func (b *BTree) DropTable(name string) error {
+	key, entry, found, err := b.findTable(name)
+	if err != nil {
+		return err
+	}
+	if !found {
+		return fmt.Errorf("%w: %s", ErrTableNotFound, name)
+	}
+
+	// A failure while releasing the pages leaves them unused rather than
+	// the schema pointing to released pages
+	if err := b.Delete(b.RootPage(), key); err != nil {
+		return err
+	}
+	if err := b.freeTree(entry.RootPage); err != nil {
+		return err
+	}
+	return b.BumpSchemaVersion()
+}
+
+// CreateTableEntry adds a schema entry for the table name whose B-Tree is
+// on rootPage
+//
+// The entry gets the key after the last key of the schema table. Only the
+// entry is written, the B-Tree on rootPage must be created by the caller.
+func (b *BTree) CreateTableEntry(name string, rootPage uint32) error {
+	entry := SchemaEntry{
+		Type:      SchemaTypeTable,
+		Name:      name,
+		TableName: name,
+		RootPage:  rootPage,
+	}
+
+	keys, _, err := b.schemaEntries()
+	if err != nil {
+		return err
+	}
+	key := ChidbKey(1)
+	if len(keys) > 0 {
+		key = keys[len(keys)-1] + 1
+	}
+
+	data, err := entry.record().Encode()
+	if err != nil {
+		return err
+	}
+	return b.Insert(b.RootPage(), NewLeafTableCell(key, data))
+}
+
+// Tables returns the schema entries of the tables of the database, ordered
+// by their key on the schema table
+func (b *BTree) Tables() ([]SchemaEntry, error) {
+	_, entries, err := b.schemaEntries()
+	if err != nil {
+		return nil, err
+	}
+
+	tables := make([]SchemaEntry, 0, len(entries))
+	for _, entry := range entries {
+		if entry.Type == SchemaTypeTable {
+			tables = append(tables, entry)
+		}
+	}
+	return tables, nil
+}
+
+// findTable returns the schema entry of the table called name and its key
+// on the schema table, if there is one
+func (b *BTree) findTable(name string) (ChidbKey, SchemaEntry, bool, error) {
+	keys, entries, err := b.schemaEntries()
+	if err != nil {
+		return 0, SchemaEntry{}, false, err
+	}
+	for i, entry := range entries {
+		if entry.Type == SchemaTypeTable && entry.Name == name {
+			return keys[i], entry, true, nil
+		}
+	}
+	return 0, SchemaEntry{}, false, nil
+}
+
+// schemaEntries returns all entries of the schema table and their keys
+func (b *BTree) schemaEntries() ([]ChidbKey, []SchemaEntry, error) {
+	rows, err := b.Rows(b.RootPage())
+	if err != nil {
+		return nil, nil, err
+	}
+
+	keys := make([]ChidbKey, 0)
+	entries := make([]SchemaEntry, 0)
+	for {
+		key, record, ok, err := rows.Next()
+		if err != nil {
+			return nil, nil, err
+		}
+		if !ok {
+			return keys, entries, nil
+		}
+
+		entry, err := schemaEntryFromRecord(record)
+		if err != nil {
+			return nil, nil, fmt.Errorf("schema row %d: %w", key, err)
+		}
+		keys = append(keys, key)
+		entries = append(entries, entry)
+	}
+}
+
+// record returns the schema row of the entry, with a NULL SQL column when
+// the statement is unknown
+func (e *SchemaEntry) record() *Record {
+	var sql interface{}
+	if e.SQL != "" {
+		sql = e.SQL
+	}
+	return NewRecord(e.Type, e.Name, e.TableName, int64(e.RootPage), sql)
+}
+
+func schemaEntryFromRecord(record *Record) (SchemaEntry, error) {
+	var entry SchemaEntry
+	if len(record.Values) != 5 {
+		return entry, fmt.Errorf("%w: %d columns, expected 5", ErrCorruptSchema, len(record.Values))
+	}
+
+	texts := []*string{&entry.Type, &entry.Name, &entry.TableName}
+	for i, text := range texts {
+		value, ok := record.Values[i].(string)
+		if !ok {
+			return entry, fmt.Errorf("%w: column %d isn't text", ErrCorruptSchema, i)
+		}
+		*text = value
+	}
+
+	rootPage, ok := record.Values[3].(int64)
+	if !ok || rootPage < 1 || rootPage > math.MaxUint32 {
+		return entry, fmt.Errorf("%w: invalid root page %v", ErrCorruptSchema, record.Values[3])
+	}
+	entry.RootPage = uint32(rootPage)
+
+	switch sql := record.Values[4].(type) {
+	case nil:
+	case string:
+		entry.SQL = sql
+	default:
+		return entry, fmt.Errorf("%w: column 4 isn't text", ErrCorruptSchema)
+	}
+	return entry, nil
+}
@@ -0,0 +1,161 @@
+package chidb
+
+import (
+	"errors"
+	"path/filepath"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestSchemaTables(t *testing.T) {
+	filename := filepath.Join(t.TempDir(), "schema.db")
+	btree, err := Open(filename)
+	require.Nil(t, err)
+
+	tables, err := btree.Tables()
+	require.Nil(t, err)
+	assert.Empty(t, tables, "Expected no tables on new database")
+
+	expected := make([]SchemaEntry, 0)
+	for _, name := range []string{"users", "orders"} {
+		root, err := btree.NewNode(LeafTable)
+		require.Nil(t, err)
+		require.Nil(t, btree.CreateTableEntry(name, root.page.number))
+
+		expected = append(expected, SchemaEntry{
+			Type:      SchemaTypeTable,
+			Name:      name,
+			TableName: name,
+			RootPage:  root.page.number,
+		})
+	}
+	require.Nil(t, btree.Close())
+
+	btree, err = Open(filename)
+	require.Nil(t, err)
+	defer btree.Close()
+
+	tables, err = btree.Tables()
+	require.Nil(t, err)
+	assert.Equal(t, expected, tables)
+
+	// Schema entries are records on leaf cells of the schema table
+	keys := cursorKeys(t, btree, btree.RootPage())
+	assert.Equal(t, []ChidbKey{1, 2}, keys)
+}
+
+func TestCreateTable(t *testing.T) {
+	filename := filepath.Join(t.TempDir(), "schema.db")
+	btree, err := Open(filename)
+	require.Nil(t, err)
+
+	version, err := btree.SchemaVersion()
+	require.Nil(t, err)
+
+	root, err := btree.CreateTable("users")
+	require.Nil(t, err)
+	assert.NotEqual(t, btree.RootPage(), root)
+
+	bumped, err := btree.SchemaVersion()
+	require.Nil(t, err)
+	assert.Equal(t, version+1, bumped, "Expected schema version bumped")
+
+	_, err = btree.CreateTable("users")
+	assert.True(t, errors.Is(err, ErrTableExists), "Expected table exists error, got %v", err)
+
+	for _, key := range sequentialKeys(1, 300) {
+		data, err := NewRecord(int64(key), "user").Encode()
+		require.Nil(t, err)
+		require.Nil(t, btree.Insert(root, NewLeafTableCell(key, data)))
+	}
+	require.Nil(t, btree.Close())
+
+	btree, err = Open(filename)
+	require.Nil(t, err)
+	defer btree.Close()
+
+	tables, err := btree.Tables()
+	require.Nil(t, err)
+	require.Len(t, tables, 1)
+	assert.Equal(t, "users", tables[0].Name)
+	assert.Equal(t, root, tables[0].RootPage)
+
+	rows, err := btree.Rows(tables[0].RootPage)
+	require.Nil(t, err)
+	for _, expected := range sequentialKeys(1, 300) {
+		key, record, ok, err := rows.Next()
+		require.Nil(t, err)
+		require.True(t, ok, "Expected row %d", expected)
+		assert.Equal(t, expected, key)
+		assert.Equal(t, []interface{}{int64(key), "user"}, record.Values)
+	}
+	_, _, ok, err := rows.Next()
+	require.Nil(t, err)
+	assert.False(t, ok)
+}
+
+func TestDropTable(t *testing.T) {
+	btree := openSmallPageBtree(t)
+
+	users, err := btree.CreateTable("users")
+	require.Nil(t, err)
+	orders, err := btree.CreateTable("orders")
+	require.Nil(t, err)
+
+	for _, key := range sequentialKeys(1, 200) {
+		require.Nil(t, btree.Insert(users, NewLeafTableCell(key, make([]byte, 200))))
+		require.Nil(t, btree.Insert(orders, NewLeafTableCell(key, make([]byte, 200))))
+	}
+	// A cell with overflow pages, which are released too
+	require.Nil(t, btree.Insert(users, NewLeafTableCell(1000, randomBytes(4*1024))))
+	require.Greater(t, treeHeight(t, btree, users), 1)
+
+	stats, err := btree.Stats(users)
+	require.Nil(t, err)
+	totalPages := btree.pager.totalPages
+	version, err := btree.SchemaVersion()
+	require.Nil(t, err)
+
+	require.Nil(t, btree.DropTable("users"))
+
+	tables, err := btree.Tables()
+	require.Nil(t, err)
+	require.Len(t, tables, 1)
+	assert.Equal(t, "orders", tables[0].Name)
+
+	bumped, err := btree.SchemaVersion()
+	require.Nil(t, err)
+	assert.Equal(t, version+1, bumped, "Expected schema version bumped")
+
+	free, err := btree.pager.freePages()
+	require.Nil(t, err)
+	// The overflow pages hold the data not stored on the leaf
+	overflowPages := (4*1024 - maxLocal(1024) + 1024 - overflowHeaderSize - 1) / (1024 - overflowHeaderSize)
+	assert.Equal(t, stats.Nodes+overflowPages, len(free), "Expected pages of the table released")
+
+	// The root page is the first page reused
+	nPage, err := btree.pager.AllocatePage()
+	require.Nil(t, err)
+	assert.Equal(t, users, nPage)
+	assert.Equal(t, totalPages, btree.pager.totalPages)
+
+	// Other tables are left untouched
+	assert.Equal(t, sequentialKeys(1, 200), cursorKeys(t, btree, orders))
+	assert.Nil(t, btree.CheckIntegrity(orders))
+
+	err = btree.DropTable("users")
+	assert.True(t, errors.Is(err, ErrTableNotFound), "Expected table not found error, got %v", err)
+}
+
+func TestSchemaCorruptEntry(t *testing.T) {
+	btree := openBtree(t)
+
+	data, err := NewRecord("table", "users", "users", int64(0), nil).Encode()
+	require.Nil(t, err)
+	require.Nil(t, btree.Insert(btree.RootPage(), NewLeafTableCell(1, data)))
+
+	_, err = btree.Tables()
+	assert.True(t, errors.Is(err, ErrCorruptSchema), "Expected corrupt schema error, got %v", err)
+}
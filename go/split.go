@@ -0,0 +1,45 @@
+package chidb
+
+// SplitPolicy chooses how the cells of a full node are divided between the
+// two nodes of a split
+type SplitPolicy int
+
+const (
+	// SplitHalf splits nodes in two halves with the same number of cells,
+	// leaving room on both for keys inserted in any order
+	SplitHalf SplitPolicy = iota
+
+	// SplitRightBiased leaves a single cell on the node with the higher
+	// keys when the key being inserted is greater than every key of the
+	// node, so keys inserted in ascending order leave full nodes behind
+	// them. Other splits are done like SplitHalf. On OrderDescending
+	// B-Trees it's done for keys smaller than every key of the node.
+	SplitRightBiased
+)
+
+// splitMedian returns the position on cells of the median cell of a split
+// of child, before inserting key. The cells up to the median go to the new
+// node, the median itself too on table leaves.
+func (b *BTree) splitMedian(child *BTreeNode, cells []*BTreeCell, key treeKey) int {
+	typ := child.typ
+
+	// Lower keys get the extra cell of an even split on table leaves, so
+	// a leaf with two cells is split in one cell each.
+	m := len(cells) / 2
+	if typ == LeafTable {
+		m = (len(cells) - 1) / 2
+	}
+
+	if b.SplitPolicy != SplitRightBiased {
+		return m
+	}
+	if b.compareKeys(child.order, cellTreeKey(cells[len(cells)-1]), key) >= 0 {
+		return m
+	}
+
+	// The last cell stays on the node, which then gets key
+	if len(cells)-2 > m {
+		return len(cells) - 2
+	}
+	return m
+}
@@ -0,0 +1,81 @@
+package chidb
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestSplitPolicyAscendingKeys(t *testing.T) {
+	keys := sequentialKeys(1, 2000)
+
+	half := openSmallPageBtree(t)
+	insertTableKeys(t, half, 1, keys, 50)
+	halfStats, err := half.Stats(1)
+	require.Nil(t, err)
+
+	biased := openSmallPageBtree(t)
+	biased.SplitPolicy = SplitRightBiased
+	insertTableKeys(t, biased, 1, keys, 50)
+	biasedStats, err := biased.Stats(1)
+	require.Nil(t, err)
+
+	assert.Equal(t, keys, cursorKeys(t, biased, 1))
+	assert.Nil(t, biased.CheckIntegrity(1))
+
+	assert.Less(t, halfStats.AvgLeafFillPercent, 75.0, "Expected half empty nodes splitting in halves")
+	assert.Greater(t, biasedStats.AvgLeafFillPercent, 85.0, "Expected full nodes with right biased splits")
+	assert.Less(t, biasedStats.Nodes, halfStats.Nodes)
+}
+
+func TestSplitPolicyRightBiasedIndex(t *testing.T) {
+	btree := openSmallPageBtree(t)
+	btree.SplitPolicy = SplitRightBiased
+
+	root := newIndex(t, btree)
+	keys := sequentialKeys(1, 3000)
+	insertIndexKeys(t, btree, root, keys)
+
+	assert.Equal(t, keys, cursorKeys(t, btree, root))
+	assert.Nil(t, btree.CheckIntegrity(root))
+
+	stats, err := btree.Stats(root)
+	require.Nil(t, err)
+	assert.Greater(t, stats.AvgLeafFillPercent, 85.0)
+}
+
+func TestSplitPolicyRightBiasedRandomKeys(t *testing.T) {
+	btree := openSmallPageBtree(t)
+	btree.SplitPolicy = SplitRightBiased
+
+	// Keys not inserted at the end are split in halves
+	keys := sequentialKeys(1, 1000)
+	insertTableKeys(t, btree, 1, shuffledKeys(keys), 50)
+
+	assert.Equal(t, keys, cursorKeys(t, btree, 1))
+	assert.Nil(t, btree.CheckIntegrity(1))
+	treeHeight(t, btree, 1)
+}
+
+func TestSplitPolicyRightBiasedDescendingTable(t *testing.T) {
+	btree := openSmallPageBtree(t)
+	btree.SplitPolicy = SplitRightBiased
+
+	root, err := btree.CreateTableOrdered("events", OrderDescending)
+	require.Nil(t, err)
+
+	// Descending keys are inserted at the end of a descending table
+	keys := make([]ChidbKey, 0, 2000)
+	for key := ChidbKey(2000); key >= 1; key-- {
+		keys = append(keys, key)
+	}
+	insertTableKeys(t, btree, root, keys, 50)
+
+	assert.Equal(t, keys, cursorKeys(t, btree, root))
+	assert.Nil(t, btree.CheckIntegrity(root))
+
+	stats, err := btree.Stats(root)
+	require.Nil(t, err)
+	assert.Greater(t, stats.AvgLeafFillPercent, 85.0, "Expected full nodes with right biased splits")
+}
@@ -0,0 +1,114 @@
+package chidb
+
+// TreeStats holds statistics about the shape of a B-Tree
+type TreeStats struct {
+	// Number of levels of the tree, 1 for a tree with a single leaf
+	Height int
+
+	// Number of nodes of the tree, split in leaves and internal nodes
+	Nodes         int
+	Leaves        int
+	InternalNodes int
+
+	// Minimum, average and maximum percentage of the usable space of the
+	// leaves taken by their cells, including their entries on the cell
+	// offset array. The dead space left by removed cells isn't counted.
+	MinLeafFillPercent float64
+	AvgLeafFillPercent float64
+	MaxLeafFillPercent float64
+}
+
+// Stats walks the B-Tree on rootPage once and returns statistics about
+// its shape
+func (b *BTree) Stats(rootPage uint32) (TreeStats, error) {
+	var stats TreeStats
+	fill := 0.0
+	if err := b.statsNode(rootPage, 1, &stats, &fill); err != nil {
+		return TreeStats{}, err
+	}
+	stats.AvgLeafFillPercent = fill / float64(stats.Leaves)
+	return stats, nil
+}
+
+// statsNode adds the node on nPage, which is at level depth of the tree, and
+// its subtree to stats, summing the fill percentage of each leaf to fill
+func (b *BTree) statsNode(nPage uint32, depth int, stats *TreeStats, fill *float64) error {
+	node, err := b.GetNodeByPage(nPage)
+	if err != nil {
+		return err
+	}
+
+	stats.Nodes++
+	if depth > stats.Height {
+		stats.Height = depth
+	}
+
+	if node.typ == LeafTable || node.typ == LeafIndex {
+		ratio, err := node.FillRatio()
+		if err != nil {
+			return err
+		}
+		percent := 100 * ratio
+		*fill += percent
+
+		stats.Leaves++
+		if stats.Leaves == 1 || percent < stats.MinLeafFillPercent {
+			stats.MinLeafFillPercent = percent
+		}
+		if percent > stats.MaxLeafFillPercent {
+			stats.MaxLeafFillPercent = percent
+		}
+		return nil
+	}
+	stats.InternalNodes++
+
+	for nCell := uint16(1); nCell <= node.nCells+1; nCell++ {
+		childPage, err := b.childPageForPosition(node, nCell)
+		if err != nil {
+			return err
+		}
+		if err := b.statsNode(childPage, depth+1, stats, fill); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// Count returns the number of entries of the B-Tree on rootPage
+//
+// On table B-Trees the entries are the cells of the leaves, which are
+// counted from the header of each leaf without reading its cells. Index
+// B-Trees also store entries on internal nodes, so their cells are counted
+// too.
+func (b *BTree) Count(rootPage uint32) (uint64, error) {
+	typ, nCells, _, err := b.ReadNodeHeader(rootPage)
+	if err != nil {
+		return 0, err
+	}
+	if typ == LeafTable || typ == LeafIndex {
+		return uint64(nCells), nil
+	}
+
+	node, err := b.GetNodeByPage(rootPage)
+	if err != nil {
+		return 0, err
+	}
+
+	count := uint64(0)
+	if typ == InternalIndex {
+		count += uint64(nCells)
+	}
+	for nCell := uint16(1); nCell <= node.nCells+1; nCell++ {
+		childPage, err := b.childPageForPosition(node, nCell)
+		if err != nil {
+			return 0, err
+		}
+
+		n, err := b.Count(childPage)
+		if err != nil {
+			return 0, err
+		}
+		count += n
+	}
+	return count, nil
+}
@@ -0,0 +1,116 @@
+package chidb
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestCount(t *testing.T) {
+	btree := openSmallPageBtree(t)
+
+	count, err := btree.Count(1)
+	require.Nil(t, err, "Expected nil error to count empty tree")
+	assert.Equal(t, uint64(0), count)
+
+	insertSequentialKeys(t, btree, 1, 3, 200)
+	count, err = btree.Count(1)
+	require.Nil(t, err)
+	assert.Equal(t, uint64(3), count, "Expected count of single leaf tree")
+
+	keys := insertSequentialKeys(t, btree, 4, 497, 200)
+	require.Equal(t, 3, treeHeight(t, btree, 1))
+	count, err = btree.Count(1)
+	require.Nil(t, err)
+	assert.Equal(t, uint64(500), count, "Expected count of multi-level tree")
+
+	for _, key := range keys[:100] {
+		require.Nil(t, btree.Delete(1, key))
+	}
+	count, err = btree.Count(1)
+	require.Nil(t, err)
+	assert.Equal(t, uint64(400), count, "Expected count after deletes")
+}
+
+func TestCountIndex(t *testing.T) {
+	btree := openBtree(t)
+	root := twoLevelIndexTree(t, btree)
+
+	count, err := btree.Count(root)
+	require.Nil(t, err)
+	assert.Equal(t, uint64(6), count, "Expected cells of internal index nodes to be counted")
+}
+
+// twoLevelIndexTree creates an index B-Tree whose root has the key 10 and
+// two leaves with the keys 5, 7 and 12, 15, 20
+func twoLevelIndexTree(tb testing.TB, btree *BTree) uint32 {
+	leaves := make([]*BTreeNode, 0)
+	for _, keys := range [][]ChidbKey{{5, 7}, {12, 15, 20}} {
+		leaf, err := btree.NewNode(LeafIndex)
+		require.Nil(tb, err)
+		for _, key := range keys {
+			cell := BTreeCell{typ: LeafIndex, key: key}
+			cell.fields.indexLeaf.keyPk = uint64(key)
+			require.Nil(tb, leaf.InsertCell(leaf.nCells+1, &cell))
+		}
+		require.Nil(tb, btree.WriteNode(leaf))
+		leaves = append(leaves, leaf)
+	}
+
+	root, err := btree.NewNode(InternalIndex)
+	require.Nil(tb, err)
+	cell := BTreeCell{typ: InternalIndex, key: 10}
+	cell.fields.indexInternal.keyPk = 10
+	cell.fields.indexInternal.childPage = leaves[0].page.number
+	require.Nil(tb, root.InsertCell(1, &cell))
+	root.rightPage = leaves[1].page.number
+	require.Nil(tb, btree.WriteNode(root))
+
+	return root.page.number
+}
+
+func TestStats(t *testing.T) {
+	btree := openBtree(t)
+
+	stats, err := btree.Stats(1)
+	require.Nil(t, err, "Expected nil error to get stats of empty tree")
+	assert.Equal(t, TreeStats{Height: 1, Nodes: 1, Leaves: 1}, stats)
+
+	root := twoLevelTree(t, btree)
+	stats, err = btree.Stats(root)
+	require.Nil(t, err)
+	assert.Equal(t, 2, stats.Height)
+	assert.Equal(t, 4, stats.Nodes)
+	assert.Equal(t, 3, stats.Leaves)
+	assert.Equal(t, 1, stats.InternalNodes)
+
+	// The root has two internal cells of 12 bytes and each leaf has two
+	// cells of 12 bytes plus their data, all with a 2 bytes offset array
+	// entry. The data of the first leaf is "data 5" and "data 10", and the
+	// data of the others has 7 bytes per cell.
+	// Only the leaves are aggregated.
+	node, err := btree.GetNodeByPage(root)
+	require.Nil(t, err)
+	usable := float64(node.usableSpace())
+	assert.InDelta(t, 100*float64(2*14+6+7)/usable, stats.MinLeafFillPercent, 1e-9)
+	assert.InDelta(t, 100*float64((2*14+6+7)+2*(2*14+14))/usable/3, stats.AvgLeafFillPercent, 1e-9)
+	assert.InDelta(t, 100*float64(2*14+14)/usable, stats.MaxLeafFillPercent, 1e-9)
+}
+
+func TestStatsMultiLevel(t *testing.T) {
+	btree := openSmallPageBtree(t)
+	insertSequentialKeys(t, btree, 1, 500, 200)
+
+	stats, err := btree.Stats(1)
+	require.Nil(t, err)
+	assert.Equal(t, treeHeight(t, btree, 1), stats.Height)
+	assert.Equal(t, stats.Leaves+stats.InternalNodes, stats.Nodes)
+
+	// Four cells of 210 bytes fit on a leaf of 1024 bytes pages
+	assert.GreaterOrEqual(t, stats.Leaves, 500/4)
+	assert.Greater(t, stats.AvgLeafFillPercent, 100*minFillRatio, "Expected leaves to be filled over the minimum")
+	assert.LessOrEqual(t, stats.MinLeafFillPercent, stats.AvgLeafFillPercent)
+	assert.LessOrEqual(t, stats.AvgLeafFillPercent, stats.MaxLeafFillPercent)
+	assert.LessOrEqual(t, stats.MaxLeafFillPercent, 100.0)
+}
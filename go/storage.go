@@ -0,0 +1,131 @@
+package chidb
+
+import (
+	"fmt"
+	"io"
+	"os"
+	"sync"
+)
+
+// Storage holds the bytes of a database for a Pager
+//
+// OpenPager keeps the database on a file, and OpenPagerStorage on any
+// Storage, e.g. to keep it in memory or on a remote service. Reads past the
+// end return io.EOF with the bytes read before it, like a file, and writes
+// past the end grow the storage. Readers of a Pager may read and write
+// pages concurrently, so a Storage must be safe for concurrent use.
+type Storage interface {
+	io.ReaderAt
+	io.WriterAt
+
+	// Truncate changes the size of the storage, new bytes are zeros
+	Truncate(size int64) error
+
+	// Sync commits the written bytes to stable storage
+	Sync() error
+
+	// Size returns the size of the storage in bytes
+	Size() (int64, error)
+
+	Close() error
+}
+
+// fileStorage is the storage of a file on disk
+type fileStorage struct {
+	*os.File
+}
+
+func (s *fileStorage) Size() (int64, error) {
+	info, err := s.Stat()
+	if err != nil {
+		return 0, err
+	}
+	return info.Size(), nil
+}
+
+// memoryStorage is a storage kept on a byte slice, which is lost on Close
+type memoryStorage struct {
+	// Guards data, since readers sharing the lock of the pager may read
+	// and write back pages concurrently
+	mu sync.RWMutex
+
+	data []byte
+}
+
+func (s *memoryStorage) ReadAt(b []byte, off int64) (int, error) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	if off < 0 {
+		return 0, fmt.Errorf("read at negative offset %d", off)
+	}
+	if off >= int64(len(s.data)) {
+		return 0, io.EOF
+	}
+
+	n := copy(b, s.data[off:])
+	if n < len(b) {
+		return n, io.EOF
+	}
+	return n, nil
+}
+
+func (s *memoryStorage) WriteAt(b []byte, off int64) (int, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if off < 0 {
+		return 0, fmt.Errorf("write at negative offset %d", off)
+	}
+	if end := off + int64(len(b)); end > int64(len(s.data)) {
+		s.resize(end)
+	}
+	return copy(s.data[off:], b), nil
+}
+
+func (s *memoryStorage) Truncate(size int64) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if size < 0 {
+		return fmt.Errorf("truncate to negative size %d", size)
+	}
+	s.resize(size)
+	return nil
+}
+
+// resize changes the length of data, zeroing the bytes after the old end
+func (s *memoryStorage) resize(size int64) {
+	if size <= int64(cap(s.data)) {
+		old := len(s.data)
+		s.data = s.data[:size]
+		for i := old; i < len(s.data); i++ {
+			s.data[i] = 0
+		}
+		return
+	}
+
+	// Doubling the capacity keeps appending pages cheap
+	data := make([]byte, size, 2*size)
+	copy(data, s.data)
+	s.data = data
+}
+
+func (s *memoryStorage) Sync() error {
+	return nil
+}
+
+func (s *memoryStorage) Size() (int64, error) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	return int64(len(s.data)), nil
+}
+
+func (s *memoryStorage) Close() error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	s.data = nil
+	return nil
+}
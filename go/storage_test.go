@@ -0,0 +1,174 @@
+package chidb
+
+import (
+	"errors"
+	"io"
+	"os"
+	"sync"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// memoryBackend makes openBtree open databases with OpenMemory, see
+// TestOpenMemory
+var memoryBackend bool
+
+func TestOpenMemory(t *testing.T) {
+	memoryBackend = true
+	defer func() { memoryBackend = false }()
+
+	// Tests opening their database with openBtree run on memory too
+	tests := map[string]func(*testing.T){
+		"Insert":                       TestInsert,
+		"InsertSplitsInternalNodes":    TestInsertSplitsInternalNodes,
+		"Find":                         TestFind,
+		"InsertCellOverflow":           TestInsertCellOverflow,
+		"CursorNextMultiLevel":         TestCursorNextMultiLevel,
+		"CursorSeek":                   TestCursorSeek,
+		"DeleteOverflow":               TestDeleteOverflow,
+		"DeleteKeyNotFound":            TestDeleteKeyNotFound,
+		"SavepointRollbackTo":          TestSavepointRollbackTo,
+		"SavepointRollbackTransaction": TestSavepointRollbackTransaction,
+		"BackupTo":                     TestBackupTo,
+		"Range":                        TestRange,
+	}
+	for name, test := range tests {
+		t.Run(name, test)
+	}
+}
+
+func TestOpenMemoryTransaction(t *testing.T) {
+	btree, err := OpenMemory()
+	require.Nil(t, err)
+	defer btree.Close()
+
+	keys := insertSequentialKeys(t, btree, 1, 200, 200)
+
+	require.Nil(t, btree.BeginTransaction())
+	insertSequentialKeys(t, btree, 201, 300, 200)
+	require.Nil(t, btree.pager.Flush())
+	require.Nil(t, btree.Rollback())
+
+	assert.Equal(t, keys, cursorKeys(t, btree, 1), "Expected only keys inserted before the transaction")
+	assert.Nil(t, btree.CheckIntegrity(1))
+
+	_, err = os.Stat(JournalSuffix)
+	assert.True(t, errors.Is(err, os.ErrNotExist), "Expected no journal file")
+}
+
+func TestOpenPagerStorage(t *testing.T) {
+	s := &bytesStorage{}
+
+	pager, err := OpenPagerStorage(s)
+	require.Nil(t, err)
+	btree, err := NewBTree(pager)
+	require.Nil(t, err)
+
+	keys := insertSequentialKeys(t, btree, 1, 300, 200)
+	require.Nil(t, btree.Delete(1, 10))
+	require.Nil(t, pager.Close())
+	assert.True(t, s.synced, "Expected storage synced on close")
+	assert.True(t, s.closed, "Expected storage closed with the pager")
+
+	// The database is read back from the bytes of the storage
+	pager, err = OpenPagerStorage(&bytesStorage{data: s.data})
+	require.Nil(t, err)
+	defer pager.Close()
+	btree, err = NewBTree(pager)
+	require.Nil(t, err)
+
+	assert.Equal(t, append(keys[:9:9], keys[10:]...), cursorKeys(t, btree, 1))
+	assert.Nil(t, btree.CheckIntegrity(1))
+}
+
+func TestMemoryStorage(t *testing.T) {
+	s := &memoryStorage{}
+
+	b := make([]byte, 4)
+	n, err := s.ReadAt(b, 0)
+	assert.Equal(t, 0, n)
+	assert.Equal(t, io.EOF, err, "Expected EOF reading empty storage")
+
+	// Writing past the end grows the storage with zeros
+	n, err = s.WriteAt([]byte("data"), 4)
+	require.Nil(t, err)
+	assert.Equal(t, 4, n)
+	size, err := s.Size()
+	require.Nil(t, err)
+	assert.Equal(t, int64(8), size)
+
+	b = make([]byte, 10)
+	n, err = s.ReadAt(b, 0)
+	assert.Equal(t, io.EOF, err, "Expected EOF reading past the end")
+	assert.Equal(t, 8, n)
+	assert.Equal(t, []byte("\x00\x00\x00\x00data"), b[:n])
+
+	require.Nil(t, s.Truncate(6))
+	require.Nil(t, s.Truncate(8))
+	b = make([]byte, 8)
+	_, err = s.ReadAt(b, 0)
+	require.Nil(t, err)
+	assert.Equal(t, []byte("\x00\x00\x00\x00da\x00\x00"), b, "Expected bytes cut off to be zeros after growing")
+}
+
+// bytesStorage is a minimal Storage on a byte slice
+type bytesStorage struct {
+	mu     sync.Mutex
+	data   []byte
+	synced bool
+	closed bool
+}
+
+func (s *bytesStorage) ReadAt(b []byte, off int64) (int, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if off >= int64(len(s.data)) {
+		return 0, io.EOF
+	}
+	n := copy(b, s.data[off:])
+	if n < len(b) {
+		return n, io.EOF
+	}
+	return n, nil
+}
+
+func (s *bytesStorage) WriteAt(b []byte, off int64) (int, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	for int64(len(s.data)) < off+int64(len(b)) {
+		s.data = append(s.data, 0)
+	}
+	return copy(s.data[off:], b), nil
+}
+
+func (s *bytesStorage) Truncate(size int64) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	for int64(len(s.data)) < size {
+		s.data = append(s.data, 0)
+	}
+	s.data = s.data[:size]
+	return nil
+}
+
+func (s *bytesStorage) Sync() error {
+	s.synced = true
+	return nil
+}
+
+func (s *bytesStorage) Size() (int64, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	return int64(len(s.data)), nil
+}
+
+func (s *bytesStorage) Close() error {
+	s.closed = true
+	return nil
+}
@@ -0,0 +1,36 @@
+package chidb
+
+// SyncMode chooses when the changes of committed transactions are synced to
+// stable storage, see Pager.SyncMode
+type SyncMode int
+
+const (
+	// SyncAlways syncs the file on every Commit, so a committed transaction
+	// survives a crash of the process or of the machine
+	SyncAlways SyncMode = iota
+
+	// SyncManual writes the pages of a transaction to the file on Commit
+	// without syncing it. The transactions committed since the last Sync
+	// become durable together on the next Sync or Close, saving a sync per
+	// commit. Their rollback journal is kept until then, so a crash before
+	// Sync undoes all of them, leaving the database as it was on the last
+	// Sync instead of half-written.
+	SyncManual
+
+	// SyncNever doesn't sync the file on Commit, Sync or Close, leaving it
+	// to the operating system to write the pages to stable storage. The
+	// journal is deleted on Commit, so a crash of the machine may lose
+	// committed transactions and leave a corrupt database. It's meant for
+	// databases that can be rebuilt, e.g. caches and tests.
+	SyncNever
+)
+
+// endSyncedJournal deletes the journal kept for the transactions committed
+// with SyncManual, once the file was synced. It's kept if a transaction or
+// a commit group is using it.
+func (p *Pager) endSyncedJournal() error {
+	if p.journal == nil || p.journal.active || p.group != nil {
+		return nil
+	}
+	return p.endTransaction()
+}
@@ -0,0 +1,142 @@
+package chidb
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestSyncModeAlways(t *testing.T) {
+	s, btree := openCrashBtree(t)
+
+	commitSequentialKeys(t, btree, 1, 50)
+	commitSequentialKeys(t, btree, 51, 50)
+
+	assert.Equal(t, 2, s.syncs, "Expected a sync for each commit")
+	assert.Equal(t, sequentialKeys(1, 100), crashKeys(t, s, btree), "Expected committed keys durable")
+}
+
+func TestSyncModeManual(t *testing.T) {
+	s, btree := openCrashBtree(t)
+	commitSequentialKeys(t, btree, 1, 50)
+	btree.pager.SyncMode = SyncManual
+	syncs := s.syncs
+
+	commitSequentialKeys(t, btree, 51, 50)
+
+	assert.Equal(t, syncs, s.syncs, "Expected commits not to sync")
+	assert.FileExists(t, btree.pager.filename+JournalSuffix, "Expected journal kept until Sync")
+	assert.Equal(t, sequentialKeys(1, 50), crashKeys(t, s, btree), "Expected keys committed after the last Sync undone by a crash")
+
+	require.Nil(t, btree.pager.Sync())
+
+	assert.NoFileExists(t, btree.pager.filename+JournalSuffix, "Expected journal deleted by Sync")
+	assert.Equal(t, sequentialKeys(1, 100), crashKeys(t, s, btree), "Expected keys durable after Sync")
+
+	// A rolled back transaction on the kept journal only undoes its own
+	// changes
+	commitSequentialKeys(t, btree, 101, 50)
+	require.Nil(t, btree.BeginTransaction())
+	insertSequentialKeys(t, btree, 151, 50, 100)
+	require.Nil(t, btree.Rollback())
+	assert.Equal(t, sequentialKeys(1, 150), cursorKeys(t, btree, 1))
+	assert.Equal(t, sequentialKeys(1, 100), crashKeys(t, s, btree))
+}
+
+func TestSyncModeManualClose(t *testing.T) {
+	s, btree := openCrashBtree(t)
+	btree.pager.SyncMode = SyncManual
+
+	commitSequentialKeys(t, btree, 1, 50)
+	require.Nil(t, btree.BeginTransaction())
+	insertSequentialKeys(t, btree, 51, 50, 100)
+	require.Nil(t, btree.pager.Close())
+
+	assert.NoFileExists(t, btree.pager.filename+JournalSuffix, "Expected journal deleted by Close")
+	assert.Equal(t, sequentialKeys(1, 50), crashKeys(t, s, btree), "Expected Close to sync committed keys and undo the active transaction")
+}
+
+func TestSyncModeNever(t *testing.T) {
+	s, btree := openCrashBtree(t)
+	btree.pager.SyncMode = SyncNever
+	syncs := s.syncs
+
+	commitSequentialKeys(t, btree, 1, 50)
+	assert.NoFileExists(t, btree.pager.filename+JournalSuffix, "Expected journal deleted on Commit")
+	require.Nil(t, btree.pager.Sync())
+	require.Nil(t, btree.pager.Close())
+
+	assert.Equal(t, syncs, s.syncs, "Expected file never synced")
+	assert.Empty(t, crashKeys(t, s, btree), "Expected keys lost by a crash")
+
+	// The pages were written, just not synced
+	s.durable = append([]byte(nil), s.data...)
+	assert.Equal(t, sequentialKeys(1, 50), crashKeys(t, s, btree))
+}
+
+// crashStorage is a storage kept in memory that only keeps the data written
+// before its last sync on a crash, see crashKeys
+type crashStorage struct {
+	bytesStorage
+
+	// Data as of the last sync
+	durable []byte
+	syncs   int
+}
+
+func (s *crashStorage) Sync() error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	s.durable = append([]byte(nil), s.data...)
+	s.syncs++
+	return nil
+}
+
+// openCrashBtree opens an empty database on a crashStorage, with its
+// rollback journal on a file
+func openCrashBtree(tb testing.TB) (*crashStorage, *BTree) {
+	s := &crashStorage{}
+	pager, err := newPager(s, filepath.Join(tb.TempDir(), "crash.db"), false)
+	require.Nil(tb, err)
+	tb.Cleanup(func() { pager.Close() })
+
+	btree, err := NewBTree(pager)
+	require.Nil(tb, err)
+	require.Nil(tb, pager.Sync())
+	s.syncs = 0
+	return s, btree
+}
+
+// commitSequentialKeys inserts count keys from first on a transaction of
+// their own
+func commitSequentialKeys(tb testing.TB, btree *BTree, first ChidbKey, count int) {
+	require.Nil(tb, btree.BeginTransaction())
+	insertSequentialKeys(tb, btree, first, count, 100)
+	require.Nil(tb, btree.Commit())
+}
+
+// crashKeys returns the keys of the database of btree as it would be opened
+// after a crash: with the data synced to s and the rollback journal on file
+func crashKeys(tb testing.TB, s *crashStorage, btree *BTree) []ChidbKey {
+	s.mu.Lock()
+	durable := append([]byte(nil), s.durable...)
+	s.mu.Unlock()
+
+	filename := filepath.Join(tb.TempDir(), "crashed.db")
+	journal := btree.pager.filename + JournalSuffix
+	if _, err := os.Stat(journal); err == nil {
+		copyFile(tb, journal, filename+JournalSuffix)
+	}
+
+	pager, err := newPager(&crashStorage{bytesStorage: bytesStorage{data: durable}}, filename, false)
+	require.Nil(tb, err)
+	defer pager.Close()
+	crashed, err := NewBTree(pager)
+	require.Nil(tb, err)
+	require.Nil(tb, crashed.CheckIntegrity(1))
+	return cursorKeys(tb, crashed, 1)
+}
@@ -0,0 +1,177 @@
+package chidb
+
+import (
+	"sort"
+)
+
+// Vacuum rebuilds the database to take as few pages as possible
+//
+// Deleting cells leaves half-empty nodes and free pages which are reused by
+// later inserts, but never given back to the file system. Vacuum reads the
+// cells of every B-Tree of the schema, releases all of their pages and bulk
+// loads them again from the lowest free pages, like BulkLoad. The schema is
+// rebuilt last with the new root pages, on page 1, and the free pages left
+// at the end of the file are cut off with Truncate.
+//
+// The cells of the database are kept in memory while the trees are rebuilt.
+// Pages not referenced by the schema are left as they are, so they may keep
+// the file from shrinking. Vacuum runs on its own transaction, so it fails
+// with ErrTransactionActive during a transaction, and a failure leaves the
+// database untouched.
+func (b *BTree) Vacuum() error {
+	return b.transaction(b.vacuum)
+}
+
+func (b *BTree) vacuum() error {
+	keys, entries, err := b.schemaEntries()
+	if err != nil {
+		return err
+	}
+
+	trees := make([][]*BTreeCell, len(entries))
+	orders := make([]KeyOrder, len(entries))
+	for i, entry := range entries {
+		if entry.RootPage == 0 {
+			continue
+		}
+		if trees[i], err = b.allCells(entry.RootPage); err != nil {
+			return err
+		}
+		if orders[i], err = b.Order(entry.RootPage); err != nil {
+			return err
+		}
+	}
+
+	for _, entry := range entries {
+		if entry.RootPage == 0 {
+			continue
+		}
+		if err := b.freeTree(entry.RootPage); err != nil {
+			return err
+		}
+	}
+	if err := b.freeChildren(b.RootPage()); err != nil {
+		return err
+	}
+	if err := b.pager.sortFreePages(); err != nil {
+		return err
+	}
+
+	schema := make([]*BTreeCell, 0, len(entries))
+	for i, entry := range entries {
+		if entry.RootPage != 0 {
+			if entry.RootPage, err = b.bulkLoad(trees[i], orders[i]); err != nil {
+				return err
+			}
+		}
+
+		data, err := entry.record().Encode()
+		if err != nil {
+			return err
+		}
+		schema = append(schema, NewLeafTableCell(keys[i], data))
+	}
+	if err := b.loadRoot(b.RootPage(), schema); err != nil {
+		return err
+	}
+
+	nPages, err := b.pager.usedPages()
+	if err != nil {
+		return err
+	}
+	if err := b.pager.Truncate(nPages); err != nil {
+		return err
+	}
+	if err := b.touch(); err != nil {
+		return err
+	}
+	return b.BumpSchemaVersion()
+}
+
+// allCells returns every cell of the leaves of the B-Tree on rootPage, in
+// order, with all of their data
+func (b *BTree) allCells(rootPage uint32) ([]*BTreeCell, error) {
+	cursor, err := b.NewCursor(rootPage)
+	if err != nil {
+		return nil, err
+	}
+
+	cells := make([]*BTreeCell, 0)
+	for {
+		cell, ok, err := cursor.Next()
+		if err != nil {
+			return nil, err
+		}
+		if !ok {
+			return cells, nil
+		}
+
+		// Entries on internal index nodes are loaded on leaves
+		if cell.typ == InternalIndex {
+			cell = indexLeafCell(cell)
+		}
+		cells = append(cells, cell)
+	}
+}
+
+// loadRoot bulk loads sorted on the empty table B-Tree on rootPage
+//
+// The root of the loaded tree is moved to rootPage, unless its cells don't
+// fit on it, in which case rootPage is left as an internal node with no
+// cells pointing to it.
+func (b *BTree) loadRoot(rootPage uint32, sorted []*BTreeCell) error {
+	loaded, err := b.bulkLoad(sorted, OrderAscending)
+	if err != nil {
+		return err
+	}
+
+	root, err := b.getNode(rootPage)
+	if err != nil {
+		return err
+	}
+	if err := root.reset(InternalTable); err != nil {
+		return err
+	}
+	root.rightPage = loaded
+	if err := b.putNode(root); err != nil {
+		return err
+	}
+	return b.collapseRoot(root)
+}
+
+// sortFreePages rewrites the free list in ascending order, so AllocatePage
+// reuses the lowest free pages first
+func (p *Pager) sortFreePages() error {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	free, err := p.freePages()
+	if err != nil {
+		return err
+	}
+	sort.Slice(free, func(i, j int) bool { return free[i] < free[j] })
+	return p.setFreePages(free)
+}
+
+// usedPages returns the number of pages of the file without the free pages
+// at its end
+func (p *Pager) usedPages() (uint32, error) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	free, err := p.freePages()
+	if err != nil {
+		return 0, err
+	}
+
+	isFree := make(map[uint32]bool, len(free))
+	for _, nPage := range free {
+		isFree[nPage] = true
+	}
+
+	nPages := p.totalPages
+	for nPages > 1 && isFree[nPages] {
+		nPages--
+	}
+	return nPages, nil
+}
@@ -0,0 +1,135 @@
+package chidb
+
+import (
+	"errors"
+	"math"
+	"os"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestVacuum(t *testing.T) {
+	btree := openSmallPageBtree(t)
+
+	live := make(map[string][]ChidbKey)
+	for _, name := range []string{"users", "orders", "items"} {
+		root, err := btree.CreateTable(name)
+		require.Nil(t, err)
+
+		keys := insertTableKeys(t, btree, root, sequentialKeys(1, 400), 100)
+
+		// Overflow cells are moved too
+		require.Nil(t, btree.Insert(root, NewLeafTableCell(1000, randomBytes(3000))))
+
+		for i, key := range keys {
+			if i%5 != 0 {
+				require.Nil(t, btree.Delete(root, key))
+			} else {
+				live[name] = append(live[name], key)
+			}
+		}
+		live[name] = append(live[name], 1000)
+	}
+
+	// A dropped table only leaves free pages
+	_, err := btree.CreateTable("dropped")
+	require.Nil(t, err)
+	require.Nil(t, btree.DropTable("dropped"))
+
+	require.Nil(t, btree.pager.Flush())
+	before := fileSize(t, btree)
+	header, err := btree.ReadHeader()
+	require.Nil(t, err)
+
+	require.Nil(t, btree.Vacuum())
+
+	assert.Less(t, fileSize(t, btree), before, "Expected smaller file after vacuum")
+	free, err := btree.pager.freePages()
+	require.Nil(t, err)
+	assert.Empty(t, free, "Expected no free pages after vacuum")
+
+	tables, err := btree.Tables()
+	require.Nil(t, err)
+	require.Len(t, tables, 3)
+	for _, table := range tables {
+		assert.Equal(t, live[table.Name], cursorKeys(t, btree, table.RootPage), "Expected live keys of table %s", table.Name)
+		assert.Nil(t, btree.CheckIntegrity(table.RootPage))
+	}
+	assert.Nil(t, btree.CheckIntegrity(btree.RootPage()))
+
+	vacuumed, err := btree.ReadHeader()
+	require.Nil(t, err)
+	assert.Equal(t, header.schemaVersion+1, vacuumed.schemaVersion)
+}
+
+func TestVacuumIndex(t *testing.T) {
+	btree := openSmallPageBtree(t)
+
+	root := newIndex(t, btree)
+	keys := sequentialKeys(1, 1000)
+	insertIndexKeys(t, btree, root, shuffledKeys(keys))
+	require.Nil(t, btree.CreateTableEntry("index", root))
+
+	require.Nil(t, btree.Vacuum())
+
+	tables, err := btree.Tables()
+	require.Nil(t, err)
+	require.Len(t, tables, 1)
+	assert.Equal(t, keys, cursorKeys(t, btree, tables[0].RootPage))
+	assert.Nil(t, btree.CheckIntegrity(tables[0].RootPage))
+}
+
+func TestVacuumPastPage65535(t *testing.T) {
+	if testing.Short() {
+		t.Skip("vacuums more than 65535 pages")
+	}
+	btree := openTinyPageBtree(t)
+
+	keys := sequentialKeys(1, 140000)
+	root, err := btree.BulkLoad(leafTableCells(keys, 200))
+	require.Nil(t, err)
+	require.Nil(t, btree.CreateTableEntry("users", root))
+	for _, key := range keys[:1000] {
+		require.Nil(t, btree.Delete(root, key))
+	}
+
+	// The schema is loaded after the table, past page 65535, and then
+	// moved to page 1 through its right page
+	require.Nil(t, btree.Vacuum())
+	require.Greater(t, btree.pager.totalPages, uint32(math.MaxUint16))
+
+	tables, err := btree.Tables()
+	require.Nil(t, err)
+	require.Len(t, tables, 1)
+	assert.Equal(t, keys[1000:], cursorKeys(t, btree, tables[0].RootPage))
+	assert.Nil(t, btree.CheckIntegrity(tables[0].RootPage))
+	assert.Nil(t, btree.CheckIntegrity(btree.RootPage()))
+}
+
+func TestVacuumTransactionActive(t *testing.T) {
+	btree := openBtree(t)
+	_, err := btree.CreateTable("users")
+	require.Nil(t, err)
+
+	require.Nil(t, btree.BeginTransaction())
+	err = btree.Vacuum()
+	assert.True(t, errors.Is(err, ErrTransactionActive), "Expected transaction error, got %v", err)
+	require.Nil(t, btree.Rollback())
+}
+
+// insertTableKeys inserts a cell with dataSize bytes of data for each key
+// on the table B-Tree on root
+func insertTableKeys(tb testing.TB, btree *BTree, root uint32, keys []ChidbKey, dataSize int) []ChidbKey {
+	for _, cell := range leafTableCells(keys, dataSize) {
+		require.Nil(tb, btree.Insert(root, cell), "Expected nil error to insert key %d", cell.key)
+	}
+	return keys
+}
+
+func fileSize(tb testing.TB, btree *BTree) int64 {
+	info, err := os.Stat(btree.pager.filename)
+	require.Nil(tb, err)
+	return info.Size()
+}
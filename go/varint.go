@@ -0,0 +1,64 @@
+package chidb
+
+// MaxVarintLen is the maximum number of bytes of a varint
+const MaxVarintLen = 9
+
+// PutVarint encodes v on buf as a varint and returns the number of bytes
+// written, buf must have room for the encoded value, up to MaxVarintLen
+// bytes
+//
+// Varints are big-endian and store 7 bits per byte, using the high bit of
+// each byte to flag that another byte follows. A ninth byte, if needed,
+// stores 8 bits, so any uint64 fits on MaxVarintLen bytes. Values under 128
+// are stored on a single byte.
+func PutVarint(buf []byte, v uint64) int {
+	if v>>56 != 0 {
+		buf[8] = byte(v)
+		v >>= 8
+		for i := 7; i >= 0; i-- {
+			buf[i] = byte(v&0x7f) | 0x80
+			v >>= 7
+		}
+		return MaxVarintLen
+	}
+
+	n := varintLen(v)
+	for i := n - 1; i >= 0; i-- {
+		buf[i] = byte(v&0x7f) | 0x80
+		v >>= 7
+	}
+	buf[n-1] &= 0x7f
+	return n
+}
+
+// Varint decodes a varint from the start of buf and returns it with the
+// number of bytes read
+//
+// If buf ends before the varint does, Varint returns n == 0.
+func Varint(buf []byte) (v uint64, n int) {
+	for i := 0; i < MaxVarintLen-1; i++ {
+		if i >= len(buf) {
+			return 0, 0
+		}
+		v = v<<7 | uint64(buf[i]&0x7f)
+		if buf[i]&0x80 == 0 {
+			return v, i + 1
+		}
+	}
+	if len(buf) < MaxVarintLen {
+		return 0, 0
+	}
+	return v<<8 | uint64(buf[8]), MaxVarintLen
+}
+
+// varintLen returns the number of bytes of v encoded as a varint
+func varintLen(v uint64) int {
+	if v>>56 != 0 {
+		return MaxVarintLen
+	}
+	n := 1
+	for v >>= 7; v != 0; v >>= 7 {
+		n++
+	}
+	return n
+}
@@ -0,0 +1,56 @@
+package chidb
+
+import (
+	"math"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestVarint(t *testing.T) {
+	tests := []struct {
+		v       uint64
+		encoded []byte
+	}{
+		{v: 0, encoded: []byte{0x00}},
+		{v: 1, encoded: []byte{0x01}},
+		{v: 127, encoded: []byte{0x7f}},
+		{v: 128, encoded: []byte{0x81, 0x00}},
+		{v: 300, encoded: []byte{0x82, 0x2c}},
+		{v: 1<<14 - 1, encoded: []byte{0xff, 0x7f}},
+		{v: 1 << 14, encoded: []byte{0x81, 0x80, 0x00}},
+		{v: 1<<56 - 1, encoded: []byte{0xff, 0xff, 0xff, 0xff, 0xff, 0xff, 0xff, 0x7f}},
+		{v: 1 << 56, encoded: []byte{0x80, 0xc0, 0x80, 0x80, 0x80, 0x80, 0x80, 0x80, 0x00}},
+		{v: math.MaxUint64, encoded: []byte{0xff, 0xff, 0xff, 0xff, 0xff, 0xff, 0xff, 0xff, 0xff}},
+	}
+
+	for _, tt := range tests {
+		buf := make([]byte, MaxVarintLen)
+		n := PutVarint(buf, tt.v)
+		assert.Equal(t, tt.encoded, buf[:n], "Expected encoding of %d", tt.v)
+		assert.Equal(t, len(tt.encoded), varintLen(tt.v), "Expected length of %d", tt.v)
+
+		v, n := Varint(append(tt.encoded, 0xff))
+		assert.Equal(t, tt.v, v, "Expected to decode %d", tt.v)
+		assert.Equal(t, len(tt.encoded), n, "Expected to read the whole varint of %d", tt.v)
+	}
+}
+
+func TestVarintTruncated(t *testing.T) {
+	tests := []struct {
+		name string
+		buf  []byte
+	}{
+		{name: "empty", buf: []byte{}},
+		{name: "missing last byte", buf: []byte{0x81}},
+		{name: "missing ninth byte", buf: []byte{0xff, 0xff, 0xff, 0xff, 0xff, 0xff, 0xff, 0xff}},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			v, n := Varint(tt.buf)
+			assert.Equal(t, 0, n, "Expected no bytes read of truncated varint")
+			assert.Equal(t, uint64(0), v)
+		})
+	}
+}